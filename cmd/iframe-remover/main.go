@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/mattetti/moshing-vfx/datamosh"
 )
@@ -15,6 +22,22 @@ var (
 	inputFlag       = flag.String("input", "", "Input file")
 	debugFlag       = flag.Bool("debug", false, "Enable debug mode")
 	interactiveFlag = flag.Bool("interactive", false, "Enable interactive mode")
+	repeatFlag      = flag.Int("repeat", 0, "Number of times to repeat inter frames (when not writing MP4 from MP4)")
+	formatFlag      = flag.String("format", "", "Output container: mp4, fmp4, mkv, webm, ivf or obu (defaults to the input container)")
+	previewFlag     = flag.Float64("preview", -1, "Time in seconds of a frame of the moshed H.264 video to render to a PNG file")
+	exportFlag      = flag.String("export", "", "Decode the moshed H.264 video to a .y4m file or to PNG files named after a pattern such as frames/%05d.png")
+	fromFlag        = flag.Float64("from", 0, "Start time in seconds of the exported frames, of the -qp shift and of the -aac effects")
+	toFlag          = flag.Float64("to", 0, "End time in seconds of the exported frames, of the -qp shift and of the -aac effects, 0 for the end of the video")
+	mvFlag          = flag.String("mv", "", "Motion vector transforms of the H.264 P slices: scale=<factor>, rotate=<degrees>, invert, freeze or noise=<quarter samples>, comma separated")
+	mvAbsoluteFlag  = flag.Bool("mv-absolute", false, "Apply the -mv transforms to the motion vectors instead of their differences")
+	residualFlag    = flag.String("residual", "", "Coefficient transforms of the residual blocks of the H.264 I and P slices: zero=<levels kept>, quantize=<step>, noise=<amount> or swap, comma separated")
+	qpFlag          = flag.Int("qp", 0, "Shift of the QP of the H.264 I and P slices between -from and -to")
+	qpInitFlag      = flag.Int("qp-init", 0, "Shift of the initial QP of the H.264 picture parameter sets, for all the slices")
+	aacFlag         = flag.String("aac", "", "Effects on the AAC frames between -from and -to: repeat=<n>, drop or corrupt=<rate>, comma separated")
+	audioFlag       = flag.String("audio", "wallclock", "Sync of the audio tracks with the edited video: wallclock, stretch, follow or none")
+	transplantFlag  = flag.String("transplant", "", "Second video file whose H.264 P frames are appended to the key frame of the input")
+	faststartFlag   = flag.Bool("faststart", false, "Place the moov box of MP4 output before the media data, for progressive playback on the web")
+	jobsFlag        = flag.Int("jobs", 1, "Number of GOPs moshed concurrently when moshing in place, 0 for one per CPU; 1 streams the file in a single pass, other values keep all its frames in memory")
 )
 
 func main() {
@@ -26,9 +49,6 @@ func main() {
 	}
 
 	inputFileName := *inputFlag
-	ext := filepath.Ext(inputFileName)
-	outputFileName := filepath.Join(filepath.Dir(inputFileName), fmt.Sprintf("%s-iframoshed%s", filepath.Base(inputFileName)[:len(ext)], ext))
-
 	inputFile, err := os.Open(inputFileName)
 	if err != nil {
 		fmt.Println("Error opening input file:", err)
@@ -36,6 +56,27 @@ func main() {
 	}
 	defer inputFile.Close()
 
+	inputFormat, err := datamosh.DetectContainer(inputFile)
+	if err != nil {
+		fmt.Println("Error reading input file:", err)
+		return
+	}
+	outputFormat := inputFormat
+	if *formatFlag != "" {
+		if outputFormat, err = datamosh.ParseContainerFormat(*formatFlag); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	ext := filepath.Ext(inputFileName)
+	outputExt := ext
+	if outputFormat != inputFormat {
+		outputExt = outputFormat.Extension()
+	}
+	base := filepath.Base(inputFileName)
+	outputFileName := filepath.Join(filepath.Dir(inputFileName), fmt.Sprintf("%s-iframoshed%s", base[:len(base)-len(ext)], outputExt))
+
 	outputFile, err := os.Create(outputFileName)
 	if err != nil {
 		fmt.Println("Error creating output file:", err)
@@ -43,6 +84,39 @@ func main() {
 	}
 	defer outputFile.Close()
 
+	if *transplantFlag != "" {
+		if err := transplant(inputFile, *transplantFlag, outputFile, outputFormat); err != nil {
+			fmt.Println("Error processing file:", err)
+			return
+		}
+		fmt.Println("File processed and available as", outputFileName)
+		preview(outputFileName)
+		export(outputFileName)
+		return
+	}
+
+	if *mvFlag != "" || *residualFlag != "" || *qpFlag != 0 || *qpInitFlag != 0 {
+		if err := h264Mosh(inputFile, outputFile, outputFormat); err != nil {
+			fmt.Println("Error processing file:", err)
+			return
+		}
+		fmt.Println("File processed and available as", outputFileName)
+		preview(outputFileName)
+		export(outputFileName)
+		return
+	}
+
+	if inputFormat != datamosh.ContainerMP4 || outputFormat != datamosh.ContainerMP4 || *aacFlag != "" {
+		if err := remux(inputFile, outputFile, outputFormat); err != nil {
+			fmt.Println("Error processing file:", err)
+			return
+		}
+		fmt.Println("File processed and available as", outputFileName)
+		preview(outputFileName)
+		export(outputFileName)
+		return
+	}
+
 	// copy the input file to the output file
 	if _, err := io.Copy(outputFile, inputFile); err != nil {
 		fmt.Println("Error copying input file to output file:", err)
@@ -57,8 +131,14 @@ func main() {
 		ctx = context.WithValue(ctx, datamosh.InteractiveKey, *interactiveFlag)
 	}
 
-	ctx, err = datamosh.ProcessFrames(ctx, outputFile, datamosh.NullifyIFrames)
-	if err != nil {
+	if *jobsFlag == 1 {
+		ctx, err = datamosh.StreamFrames(ctx, outputFile, datamosh.NullifyIFrames)
+	} else {
+		ctx, err = datamosh.ProcessFramesParallel(ctx, outputFile, datamosh.NullifyIFrames, *jobsFlag)
+	}
+	// the tracks without stss box list the key frames left once remuxed
+	mustRemux := errors.Is(err, datamosh.ErrNoSyncSampleBox)
+	if err != nil && !mustRemux {
 		fmt.Println("Error processing frames:", err)
 		return
 	}
@@ -71,5 +151,381 @@ func main() {
 		fmt.Printf("Total I-frames removed: %d\n", iFrameCount)
 	}
 
+	if *faststartFlag || mustRemux {
+		if err := rewriteMP4(outputFileName, *faststartFlag); err != nil {
+			fmt.Println("Error remuxing the output file:", err)
+			return
+		}
+	}
+
 	fmt.Println("File processed and available as", outputFileName)
+	preview(outputFileName)
+	export(outputFileName)
+}
+
+// newMuxer returns the muxer of the output container, writing faststart MP4
+// files as set by the faststart flag.
+func newMuxer(format datamosh.ContainerFormat) (datamosh.Muxer, error) {
+	muxer, err := datamosh.NewMuxer(format)
+	if mp4Muxer, ok := muxer.(*datamosh.MP4Muxer); ok {
+		mp4Muxer.Faststart = *faststartFlag
+	}
+	return muxer, err
+}
+
+// muxAll writes all the tracks of r the muxer supports to w.
+func muxAll(w io.Writer, r io.ReadSeeker, tracks []*datamosh.Track, muxer datamosh.Muxer) error {
+	muxTracks := []datamosh.MuxTrack{}
+	for _, track := range tracks {
+		if muxer.Supports(track) {
+			muxTracks = append(muxTracks, datamosh.MuxTrack{Track: track})
+		}
+	}
+	if len(muxTracks) == 0 {
+		return errors.New("no track can be written to the output file")
+	}
+	return muxer.Mux(w, r, muxTracks)
+}
+
+// rewriteMP4 remuxes an MP4 file processed in place, with its moov box before
+// the media data if faststart is set.
+func rewriteMP4(fileName string, faststart bool) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tracks, _, err := datamosh.Demux(f)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	if err := muxAll(w, f, tracks, &datamosh.MP4Muxer{Faststart: faststart}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// preview renders the frame of the moshed video at the time given by the
+// preview flag, if any.
+func preview(fileName string) {
+	if *previewFlag < 0 {
+		return
+	}
+	ext := filepath.Ext(fileName)
+	previewFileName := fileName[:len(fileName)-len(ext)] + "-preview.png"
+	if err := writePreview(fileName, previewFileName, *previewFlag); err != nil {
+		fmt.Println("Error rendering the preview:", err)
+		return
+	}
+	fmt.Println("Preview available as", previewFileName)
+}
+
+// writePreview decodes the H.264 track of a file up to the given time and
+// writes the frame shown at that time to a PNG file.
+func writePreview(fileName, previewFileName string, seconds float64) error {
+	f, track, err := openH264Track(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	last := &lastFrame{}
+	if err := track.ExportFrames(f, datamosh.TimeRange{End: math.Nextafter(seconds, math.Inf(1))}, last); err != nil {
+		return err
+	}
+	if last.img == nil {
+		return errors.New("no frame decoded")
+	}
+
+	out, err := os.Create(previewFileName)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return png.Encode(out, last.img)
+}
+
+// lastFrame keeps the last frame written to it.
+type lastFrame struct {
+	img *image.YCbCr
+}
+
+func (l *lastFrame) WriteFrame(img *image.YCbCr, pts float64) error {
+	l.img = img
+	return nil
+}
+
+// export decodes the frames of the moshed video within the time range given
+// by the flags to the Y4M file or PNG files given by the export flag.
+func export(fileName string) {
+	if *exportFlag == "" {
+		return
+	}
+	if err := exportFrames(fileName, *exportFlag, datamosh.TimeRange{Start: *fromFlag, End: *toFlag}); err != nil {
+		fmt.Println("Error exporting the frames:", err)
+		return
+	}
+	fmt.Println("Frames exported to", *exportFlag)
+}
+
+func exportFrames(fileName, exportName string, tr datamosh.TimeRange) error {
+	f, track, err := openH264Track(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(exportName), ".y4m") {
+		out, err := os.Create(exportName)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w := bufio.NewWriter(out)
+		fpsNum, fpsDen := track.FrameRate()
+		if err := track.ExportFrames(f, tr, datamosh.NewY4MWriter(w, fpsNum, fpsDen)); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	w, err := datamosh.NewPNGSequenceWriter(exportName)
+	if err != nil {
+		return err
+	}
+	return track.ExportFrames(f, tr, w)
+}
+
+// openH264Track opens a video file and returns its first H.264 track.
+func openH264Track(fileName string) (*os.File, *datamosh.Track, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	tracks, _, err := datamosh.Demux(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	for _, track := range tracks {
+		if track.AVC != nil {
+			return f, track, nil
+		}
+	}
+	f.Close()
+	return nil, nil, errors.New("no H.264 track found")
+}
+
+// remux drops the key frames of the video tracks, repeats their inter frames
+// and writes the result in the output container, the audio tracks synced with
+// the first video track as set by the audio flag.
+func remux(inputFile, outputFile *os.File, format datamosh.ContainerFormat) error {
+	tracks, _, err := datamosh.Demux(inputFile)
+	if err != nil {
+		return err
+	}
+	muxer, err := newMuxer(format)
+	if err != nil {
+		return err
+	}
+	muxTracks := []datamosh.MuxTrack{}
+	var video *datamosh.MuxTrack
+	for _, track := range tracks {
+		if !muxer.Supports(track) || track.IsAudio() {
+			continue
+		}
+		muxTrack := datamosh.MuxTrack{Track: track}
+		if len(track.Frames()) > 0 {
+			muxTrack.Samples = datamosh.DropKeyFrames(track)
+			fmt.Printf("Track %d: %d key frames removed\n", track.TrackID, len(track.Samples)-len(muxTrack.Samples))
+			if *repeatFlag > 0 {
+				muxTrack.Samples = datamosh.RepeatInterFrames(track, muxTrack.Samples, *repeatFlag)
+			}
+		}
+		muxTracks = append(muxTracks, muxTrack)
+		if video == nil && track.IsVideo() {
+			video = &muxTracks[len(muxTracks)-1]
+		}
+	}
+	if video == nil {
+		return muxAll(outputFile, inputFile, tracks, muxer)
+	}
+	audioTracks, err := syncAudio(*video, inputFile, tracks, muxer)
+	if err != nil {
+		return err
+	}
+	return muxer.Mux(outputFile, inputFile, append(muxTracks, audioTracks...))
+}
+
+// syncAudio returns the audio tracks of r the muxer supports, their AAC
+// frames processed as set by the aac flag and synced with the edited video
+// track as set by the audio flag.
+func syncAudio(video datamosh.MuxTrack, r io.ReadSeeker, tracks []*datamosh.Track, muxer datamosh.Muxer) ([]datamosh.MuxTrack, error) {
+	if *audioFlag == "none" {
+		return nil, nil
+	}
+	sync, err := datamosh.ParseAudioSync(*audioFlag)
+	if err != nil {
+		return nil, err
+	}
+	var fx datamosh.AACFrameProcessor
+	if *aacFlag != "" {
+		if fx, err = datamosh.ParseAACProcessor(*aacFlag); err != nil {
+			return nil, err
+		}
+		fx = datamosh.AACFramesInRange(datamosh.TimeRange{Start: *fromFlag, End: *toFlag}, fx)
+	}
+	muxTracks := []datamosh.MuxTrack{}
+	for _, track := range tracks {
+		if !track.IsAudio() || !muxer.Supports(track) {
+			continue
+		}
+		var data []byte
+		if fx != nil && track.MP4A != nil {
+			if track, data, err = track.ProcessAACFrames(r, fx); err != nil {
+				return nil, err
+			}
+		}
+		muxTrack, err := datamosh.SyncAudio(video, track, sync)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			muxTrack.Data = bytes.NewReader(data)
+		}
+		muxTracks = append(muxTracks, muxTrack)
+	}
+	return muxTracks, nil
+}
+
+// h264Mosh drops the key frames of the first H.264 track but the first one,
+// transforms the motion vectors of its P slices and the residual blocks of
+// its slices, shifts their QP as set by the mv, residual and qp flags and
+// writes it in the output container. The slices using coding tools the
+// moshers don't support are written as is. The audio tracks are copied from
+// the input file, the rewritten slices from memory.
+func h264Mosh(inputFile, outputFile *os.File, format datamosh.ContainerFormat) error {
+	var motion datamosh.MotionTransform
+	var residual datamosh.ResidualTransform
+	var err error
+	if *mvFlag != "" {
+		if motion, err = datamosh.ParseMotionTransform(*mvFlag); err != nil {
+			return err
+		}
+	}
+	if *residualFlag != "" {
+		if residual, err = datamosh.ParseResidualTransform(*residualFlag); err != nil {
+			return err
+		}
+	}
+	tracks, _, err := datamosh.Demux(inputFile)
+	if err != nil {
+		return err
+	}
+	muxer, err := newMuxer(format)
+	if err != nil {
+		return err
+	}
+	for _, track := range tracks {
+		if track.AVC == nil {
+			continue
+		}
+		m, err := datamosh.NewMotionMosher(track.AVC, motion)
+		if err != nil {
+			return err
+		}
+		m.Absolute = *mvAbsoluteFlag
+		r, err := datamosh.NewResidualMosher(track.AVC, residual)
+		if err != nil {
+			return err
+		}
+		warned := false
+		moshed, data, err := track.RewriteNALs(inputFile, func(nal []byte) ([]byte, error) {
+			rewritten, err := m.RewriteNAL(nal)
+			if err == nil {
+				rewritten, err = r.RewriteNAL(rewritten)
+			}
+			if errors.Is(err, datamosh.ErrH264Unsupported) {
+				// the slices the moshers can't parse are kept as is
+				if !warned {
+					fmt.Printf("Track %d: some slices left as is: %v\n", track.TrackID, err)
+					warned = true
+				}
+				return nal, nil
+			}
+			return rewritten, err
+		})
+		if err != nil {
+			return err
+		}
+		if *qpFlag != 0 || *qpInitFlag != 0 {
+			// last, the other moshers parse the slices with the PPS as coded
+			q, err := datamosh.NewQPMosher(moshed.AVC, *qpFlag)
+			if err != nil {
+				return err
+			}
+			q.PicInitDelta = *qpInitFlag
+			q.Range = datamosh.TimeRange{Start: *fromFlag, End: *toFlag}
+			if moshed, data, err = q.RewriteTrack(bytes.NewReader(data), moshed); err != nil {
+				return err
+			}
+		}
+		samples := datamosh.DropKeyFrames(moshed)
+		fmt.Printf("Track %d: %d key frames removed, slices rewritten\n", track.TrackID, len(track.Samples)-len(samples))
+		if *repeatFlag > 0 {
+			samples = datamosh.RepeatInterFrames(moshed, samples, *repeatFlag)
+		}
+		video := datamosh.MuxTrack{Track: moshed, Samples: samples, Data: bytes.NewReader(data)}
+		audioTracks, err := syncAudio(video, inputFile, tracks, muxer)
+		if err != nil {
+			return err
+		}
+		return muxer.Mux(outputFile, inputFile, append([]datamosh.MuxTrack{video}, audioTracks...))
+	}
+	return errors.New("no H.264 track found")
+}
+
+// transplant appends the P frames of the first H.264 track of a second file
+// to the key frame of the first H.264 track of the input and writes the result
+// in the output container.
+func transplant(inputFile *os.File, motionFileName string, outputFile *os.File, format datamosh.ContainerFormat) error {
+	motionFile, motionTrack, err := openH264Track(motionFileName)
+	if err != nil {
+		return err
+	}
+	defer motionFile.Close()
+	tracks, _, err := datamosh.Demux(inputFile)
+	if err != nil {
+		return err
+	}
+	muxer, err := newMuxer(format)
+	if err != nil {
+		return err
+	}
+	for _, track := range tracks {
+		if track.AVC == nil {
+			continue
+		}
+		moshed, data, err := datamosh.Transplant(track, inputFile, motionTrack, motionFile)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Track %d: %d P frames of %s transplanted\n", track.TrackID, len(moshed.Samples)-1, motionFileName)
+		return muxer.Mux(outputFile, bytes.NewReader(data), []datamosh.MuxTrack{{Track: moshed}})
+	}
+	return errors.New("no H.264 track found")
 }
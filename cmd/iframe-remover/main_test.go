@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattetti/moshing-vfx/datamosh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestH264MoshUnsupportedSlices(t *testing.T) {
+	*mvFlag, *residualFlag = "invert", "zero=1"
+	defer func() { *mvFlag, *residualFlag = "", "" }()
+
+	// the moshers can't parse the slices of interlaced streams
+	inputFile, err := os.Open(filepath.Join("testdata", "interlaced.mp4"))
+	require.NoError(t, err)
+	defer inputFile.Close()
+	outputFile, err := os.Create(filepath.Join(t.TempDir(), "moshed.mp4"))
+	require.NoError(t, err)
+	defer outputFile.Close()
+	require.NoError(t, h264Mosh(inputFile, outputFile, datamosh.ContainerMP4))
+
+	// the key frames are dropped, the slices kept as is
+	input, _, err := datamosh.Demux(inputFile)
+	require.NoError(t, err)
+	output, _, err := datamosh.Demux(outputFile)
+	require.NoError(t, err)
+	require.Len(t, output, 2)
+	samples := datamosh.DropKeyFrames(input[0])
+	require.Len(t, output[0].Samples, len(samples))
+	var want, got [][]byte
+	for _, nal := range input[0].NALs {
+		for _, id := range samples {
+			if nal.SampleID == id {
+				payload, err := nal.Payload(inputFile)
+				require.NoError(t, err)
+				want = append(want, payload)
+			}
+		}
+	}
+	for _, nal := range output[0].NALs {
+		payload, err := nal.Payload(outputFile)
+		require.NoError(t, err)
+		got = append(got, payload)
+	}
+	require.Len(t, got, len(want))
+	for i := range want {
+		assert.True(t, bytes.Equal(want[i], got[i]), "NAL unit %d", i)
+	}
+}
@@ -0,0 +1,400 @@
+package datamosh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/abema/go-mp4"
+)
+
+// ErrAACUnsupported is returned when an AAC frame uses a coding tool the
+// frame parser doesn't implement.
+var ErrAACUnsupported = errors.New("unsupported AAC feature")
+
+// AACElementType is the type of a syntactic element of an AAC raw data block.
+// See ISO/IEC 14496-3 4.5.2.1.1 Table 4.85.
+type AACElementType int
+
+const (
+	AACSingleChannel AACElementType = iota
+	AACChannelPair
+	AACCoupling
+	AACLowFrequency
+	AACData
+	AACProgramConfig
+	AACFill
+	AACEnd
+)
+
+func (e AACElementType) String() string {
+	switch e {
+	case AACSingleChannel:
+		return "SCE"
+	case AACChannelPair:
+		return "CPE"
+	case AACCoupling:
+		return "CCE"
+	case AACLowFrequency:
+		return "LFE"
+	case AACData:
+		return "DSE"
+	case AACProgramConfig:
+		return "PCE"
+	case AACFill:
+		return "FIL"
+	case AACEnd:
+		return "END"
+	}
+	return "unknown"
+}
+
+// window_sequence values. See ISO/IEC 14496-3 4.5.2.3.2.
+const (
+	aacOnlyLongSequence = iota
+	aacLongStartSequence
+	aacEightShortSequence
+	aacLongStopSequence
+)
+
+// AACFrameHeader is the start of the first channel element of an AAC raw data
+// block, up to the scale factors of its first channel: the spectral data
+// coded next is Huffman coded. See ISO/IEC 14496-3 4.4.2.
+type AACFrameHeader struct {
+	Element        AACElementType
+	Tag            uint8 // element_instance_tag
+	CommonWindow   bool  // the channels of a pair share their ics_info
+	WindowSequence uint8
+	MaxSFB         uint8
+	WindowGroups   int
+	// MSMaskPresent is 0 for the channel pairs coded as left and right, 1
+	// when the bands flagged in MSUsed are coded as mid and side and 2 when
+	// all the bands are.
+	MSMaskPresent uint8
+	MSUsed        []bool // by window group then scale factor band
+	GlobalGain    uint8  // of the first channel
+
+	pos aacFrameHeaderPos
+}
+
+// aacFrameHeaderPos are the bit positions of header fields, for rewriting.
+type aacFrameHeaderPos struct {
+	globalGain, scaleFactors int
+}
+
+// AACFrame is the raw data block of a sample of an AAC track.
+type AACFrame struct {
+	Data []byte
+	PTS  float64 // in seconds
+
+	config *MP4AConfig
+}
+
+// withData returns a copy of the frame holding other data.
+func (f *AACFrame) withData(data []byte) *AACFrame {
+	copied := *f
+	copied.Data = data
+	return &copied
+}
+
+// ParseHeader parses the frame up to the scale factors of the first channel
+// of its first channel element, the data and fill elements before it being
+// skipped.
+func (f *AACFrame) ParseHeader() (*AACFrameHeader, error) {
+	var aot uint8
+	if f.config != nil {
+		aot = f.config.AudOTI
+	}
+	return parseAACFrameHeader(f.Data, aot)
+}
+
+func parseAACFrameHeader(data []byte, aot uint8) (*AACFrameHeader, error) {
+	r := newRBSPReader(data)
+	h := &AACFrameHeader{}
+	for h.pos.globalGain == 0 && r.err == nil {
+		h.Element = AACElementType(r.u(3))
+		switch h.Element {
+		case AACSingleChannel, AACLowFrequency:
+			h.Tag = uint8(r.u(4))
+			h.pos.globalGain = r.pos
+			h.GlobalGain = uint8(r.u(8))
+			if err := h.parseICSInfo(r, aot); err != nil {
+				return nil, err
+			}
+		case AACChannelPair:
+			h.Tag = uint8(r.u(4))
+			h.CommonWindow = r.flag()
+			if h.CommonWindow {
+				if err := h.parseICSInfo(r, aot); err != nil {
+					return nil, err
+				}
+				h.MSMaskPresent = uint8(r.u(2))
+				if h.MSMaskPresent == 1 {
+					h.MSUsed = make([]bool, h.WindowGroups*int(h.MaxSFB))
+					for i := range h.MSUsed {
+						h.MSUsed[i] = r.flag()
+					}
+				}
+			}
+			h.pos.globalGain = r.pos
+			h.GlobalGain = uint8(r.u(8))
+			if !h.CommonWindow {
+				if err := h.parseICSInfo(r, aot); err != nil {
+					return nil, err
+				}
+			}
+		case AACData:
+			r.u(4) // element_instance_tag
+			align := r.flag()
+			count := int(r.u(8))
+			if count == 255 {
+				count += int(r.u(8))
+			}
+			if align && r.pos%8 != 0 {
+				r.u(8 - r.pos%8)
+			}
+			skipBits(r, count*8)
+		case AACFill:
+			count := int(r.u(4))
+			if count == 15 {
+				count += int(r.u(8)) - 1
+			}
+			skipBits(r, count*8)
+		case AACEnd:
+			return nil, errors.New("no channel element")
+		default:
+			return nil, fmt.Errorf("%w: %s element", ErrAACUnsupported, h.Element)
+		}
+	}
+	h.parseSectionData(r)
+	h.pos.scaleFactors = r.pos
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to parse AAC frame: %v", r.err)
+	}
+	return h, nil
+}
+
+// skipBits skips n bits.
+func skipBits(r *rbspReader, n int) {
+	for ; n > 0; n -= 32 {
+		r.u(min(n, 32))
+	}
+}
+
+// parseICSInfo parses the ics_info of the element. See ISO/IEC 14496-3
+// 4.4.2.7 Table 4.6.
+func (h *AACFrameHeader) parseICSInfo(r *rbspReader, aot uint8) error {
+	r.u(1) // ics_reserved_bit
+	h.WindowSequence = uint8(r.u(2))
+	r.u(1) // window_shape
+	h.WindowGroups = 1
+	if h.WindowSequence == aacEightShortSequence {
+		h.MaxSFB = uint8(r.u(4))
+		grouping := r.u(7)
+		for bit := 6; bit >= 0; bit-- {
+			if grouping&(1<<bit) == 0 {
+				h.WindowGroups++
+			}
+		}
+		return nil
+	}
+	h.MaxSFB = uint8(r.u(6))
+	if r.flag() {
+		// the prediction of the AAC Main and LTP profiles
+		return fmt.Errorf("%w: predictor data of audio object type %d", ErrAACUnsupported, aot)
+	}
+	return nil
+}
+
+// parseSectionData skips the section_data of the first channel. See ISO/IEC
+// 14496-3 4.4.2.7 Table 4.52.
+func (h *AACFrameHeader) parseSectionData(r *rbspReader) {
+	bits := 5
+	if h.WindowSequence == aacEightShortSequence {
+		bits = 3
+	}
+	esc := uint32(1)<<bits - 1
+	for g := 0; g < h.WindowGroups && r.err == nil; g++ {
+		for k := 0; k < int(h.MaxSFB) && r.err == nil; {
+			r.u(4) // sect_cb
+			length := 0
+			for {
+				incr := r.u(bits)
+				length += int(incr)
+				if incr != esc || r.err != nil {
+					break
+				}
+			}
+			if length == 0 {
+				r.fail(errors.New("empty section"))
+			}
+			k += length
+			if k > int(h.MaxSFB) {
+				r.fail(fmt.Errorf("section ends at band %d past max_sfb %d", k, h.MaxSFB))
+			}
+		}
+	}
+}
+
+// flipBit inverts the bit at pos.
+func flipBit(data []byte, pos int) {
+	data[pos/8] ^= 0x80 >> (pos % 8)
+}
+
+// AACFrameProcessor returns the frames to write in place of an AAC frame:
+// none drops it, several repeat it.
+type AACFrameProcessor func(frame *AACFrame) ([]*AACFrame, error)
+
+// ChainAAC applies the processors in order, each one to the frames returned
+// by the previous one.
+func ChainAAC(processors ...AACFrameProcessor) AACFrameProcessor {
+	return func(frame *AACFrame) ([]*AACFrame, error) {
+		frames := []*AACFrame{frame}
+		for _, p := range processors {
+			var out []*AACFrame
+			for _, f := range frames {
+				processed, err := p(f)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, processed...)
+			}
+			frames = out
+		}
+		return frames, nil
+	}
+}
+
+// AACFramesInRange applies the processor to the frames presented within the
+// time range, the other frames being kept as is.
+func AACFramesInRange(tr TimeRange, p AACFrameProcessor) AACFrameProcessor {
+	return func(frame *AACFrame) ([]*AACFrame, error) {
+		if !tr.Contains(frame.PTS) {
+			return []*AACFrame{frame}, nil
+		}
+		return p(frame)
+	}
+}
+
+// RepeatAACFrames repeats every frame n extra times, stuttering the sound
+// like the video bloom.
+func RepeatAACFrames(n int) AACFrameProcessor {
+	return func(frame *AACFrame) ([]*AACFrame, error) {
+		frames := []*AACFrame{frame}
+		for i := 0; i < n; i++ {
+			frames = append(frames, frame)
+		}
+		return frames, nil
+	}
+}
+
+// DropAACFrames drops the frames, skipping the sound ahead.
+func DropAACFrames() AACFrameProcessor {
+	return func(frame *AACFrame) ([]*AACFrame, error) {
+		return nil, nil
+	}
+}
+
+// CorruptAACSpectra flips a random share rate of the bits of the frames from
+// the scale factors of their first channel, seed making the corruption
+// reproducible. Decoders choke on the broken Huffman codes and conceal the
+// frames they can't decode, others play the corrupted spectra.
+func CorruptAACSpectra(rate float64, seed int64) AACFrameProcessor {
+	rng := rand.New(rand.NewSource(seed))
+	return func(frame *AACFrame) ([]*AACFrame, error) {
+		h, err := frame.ParseHeader()
+		if err != nil {
+			return nil, err
+		}
+		bits := len(frame.Data)*8 - h.pos.scaleFactors
+		if bits <= 0 || rate <= 0 {
+			return []*AACFrame{frame}, nil
+		}
+		data := append([]byte{}, frame.Data...)
+		for i := 0; i < int(rate*float64(bits)+0.5); i++ {
+			flipBit(data, h.pos.scaleFactors+rng.Intn(bits))
+		}
+		return []*AACFrame{frame.withData(data)}, nil
+	}
+}
+
+// ParseAACProcessor parses a comma separated list of processors, applied in
+// order: repeat=<n>, drop and corrupt=<rate>. For instance
+// "repeat=2,corrupt=0.001".
+func ParseAACProcessor(spec string) (AACFrameProcessor, error) {
+	var processors []AACFrameProcessor
+	for i, item := range strings.Split(spec, ",") {
+		name, arg, hasArg := strings.Cut(strings.TrimSpace(item), "=")
+		if (name == "drop") == hasArg {
+			return nil, fmt.Errorf("invalid AAC effect %q", item)
+		}
+		var value float64
+		if hasArg {
+			var err error
+			if value, err = strconv.ParseFloat(arg, 64); err != nil {
+				return nil, fmt.Errorf("invalid AAC effect %q: %v", item, err)
+			}
+		}
+		switch name {
+		case "repeat":
+			processors = append(processors, RepeatAACFrames(int(value)))
+		case "drop":
+			processors = append(processors, DropAACFrames())
+		case "corrupt":
+			processors = append(processors, CorruptAACSpectra(value, int64(i)))
+		default:
+			return nil, fmt.Errorf("unknown AAC effect %q", name)
+		}
+	}
+	return ChainAAC(processors...), nil
+}
+
+// ProcessAACFrames returns a copy of the AAC track whose frames are replaced
+// by the ones returned by fn, and the sample data the track points to. The
+// frames keep the duration and composition offset of the sample they come
+// from.
+func (t *Track) ProcessAACFrames(r io.ReadSeeker, fn AACFrameProcessor) (*Track, []byte, error) {
+	if t.MP4A == nil || t.MP4A.OTI != objectTypeAAC {
+		return nil, nil, errors.New("AAC configuration not found")
+	}
+	if t.Timescale == 0 {
+		return nil, nil, errors.New("track timescale is not set")
+	}
+	out := *t
+	out.Samples = make(mp4.Samples, 0, len(t.Samples))
+	out.SampleFlags = nil
+	out.stss = nil
+	out.Duration = 0
+	var data []byte
+	var dts uint64
+	for id, offset := range t.sampleOffsets() {
+		sample := t.Samples[id]
+		payload, err := readPayload(r, int64(offset), int(sample.Size))
+		if err != nil {
+			return nil, nil, err
+		}
+		pts, _ := t.PresentationTime(int64(dts) + sample.CompositionTimeOffset)
+		dts += uint64(sample.TimeDelta)
+		frames, err := fn(&AACFrame{Data: payload, PTS: pts.Seconds(), config: t.MP4A})
+		if err != nil {
+			return nil, nil, fmt.Errorf("sample %d: %w", id, err)
+		}
+		for _, frame := range frames {
+			copied := *sample
+			copied.Size = uint32(len(frame.Data))
+			out.Samples = append(out.Samples, &copied)
+			if id < len(t.SampleFlags) {
+				out.SampleFlags = append(out.SampleFlags, t.SampleFlags[id])
+			}
+			out.Duration += uint64(copied.TimeDelta)
+			data = append(data, frame.Data...)
+		}
+	}
+	out.Chunks = mp4.Chunks{{DataOffset: 0, SamplesPerChunk: uint32(len(out.Samples))}}
+	// the encoder delay trimmed at the start is kept
+	out.EditList = t.rebuildEditList(t.mediaStart(), out.Duration)
+	return &out, data, nil
+}
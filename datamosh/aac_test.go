@@ -0,0 +1,172 @@
+package datamosh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAACFrame returns a raw data block starting with a fill element and a
+// channel pair sharing a long window of 4 bands, the data after the section
+// data of the first channel being 0xa5 bytes. msMask is the ms_mask_present,
+// with the bands 0 and 2 coded as mid and side when 1.
+func testAACFrame(msMask uint32) []byte {
+	w := newRBSPWriter()
+	w.u(3, uint32(AACFill))
+	w.u(4, 2) // count
+	w.u(16, 0xa5a5)
+	w.u(3, uint32(AACChannelPair))
+	w.u(4, 0) // element_instance_tag
+	w.u(1, 1) // common_window
+	w.u(1, 0) // ics_reserved_bit
+	w.u(2, aacOnlyLongSequence)
+	w.u(1, 0) // window_shape
+	w.u(6, 4) // max_sfb
+	w.u(1, 0) // predictor_data_present
+	w.u(2, msMask)
+	if msMask == 1 {
+		w.u(4, 0b1010)
+	}
+	w.u(8, 100) // global_gain
+	// two sections of 3 and 1 bands
+	w.u(4, 1)
+	w.u(5, 3)
+	w.u(4, 11)
+	w.u(5, 1)
+	for i := 0; i < 6; i++ {
+		w.u(8, 0xa5)
+	}
+	data, err := w.alignedBytes()
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestParseAACFrameHeader(t *testing.T) {
+	h, err := parseAACFrameHeader(testAACFrame(1), 2)
+	require.NoError(t, err)
+	assert.Equal(t, AACChannelPair, h.Element)
+	assert.True(t, h.CommonWindow)
+	assert.Equal(t, uint8(aacOnlyLongSequence), h.WindowSequence)
+	assert.Equal(t, uint8(4), h.MaxSFB)
+	assert.Equal(t, 1, h.WindowGroups)
+	assert.Equal(t, uint8(1), h.MSMaskPresent)
+	assert.Equal(t, []bool{true, false, true, false}, h.MSUsed)
+	assert.Equal(t, uint8(100), h.GlobalGain)
+	assert.Equal(t, 23+3+4+1+1+2+1+6+1+2+4+8+9+9, h.pos.scaleFactors)
+
+	// short windows: 3 groups, sections of 3 bit lengths
+	w := newRBSPWriter()
+	w.u(3, uint32(AACSingleChannel))
+	w.u(4, 1)
+	w.u(8, 90)
+	w.u(1, 0)
+	w.u(2, aacEightShortSequence)
+	w.u(1, 0)
+	w.u(4, 2)         // max_sfb
+	w.u(7, 0b1101101) // scale_factor_grouping
+	for g := 0; g < 3; g++ {
+		w.u(4, 5)
+		w.u(3, 2)
+	}
+	data, err := w.alignedBytes()
+	require.NoError(t, err)
+	h, err = parseAACFrameHeader(data, 2)
+	require.NoError(t, err)
+	assert.Equal(t, AACSingleChannel, h.Element)
+	assert.Equal(t, uint8(1), h.Tag)
+	assert.Equal(t, uint8(90), h.GlobalGain)
+	assert.Equal(t, 3, h.WindowGroups)
+	assert.Equal(t, 3+4+8+1+2+1+4+7+3*7, h.pos.scaleFactors)
+
+	_, err = parseAACFrameHeader([]byte{0xa0, 0, 0, 0}, 2)
+	assert.True(t, errors.Is(err, ErrAACUnsupported), "unexpected error %v", err)
+	_, err = parseAACFrameHeader([]byte{0xe0}, 2)
+	assert.EqualError(t, err, "no channel element")
+	_, err = parseAACFrameHeader(testAACFrame(1)[:6], 2)
+	assert.EqualError(t, err, "failed to parse AAC frame: EOF")
+}
+
+func TestAACFrameProcessors(t *testing.T) {
+	frame := &AACFrame{Data: testAACFrame(1), PTS: 1}
+	frames, err := CorruptAACSpectra(0.1, 1)(frame)
+	require.NoError(t, err)
+	corrupted := frames[0].Data
+	assert.NotEqual(t, frame.Data, corrupted)
+	assert.Equal(t, testAACFrame(1), frame.Data, "the frame is left as is")
+	// the header is intact
+	h, err := parseAACFrameHeader(corrupted, 2)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(100), h.GlobalGain)
+	assert.Equal(t, frame.Data[:h.pos.scaleFactors/8], corrupted[:h.pos.scaleFactors/8])
+
+	p := ChainAAC(AACFramesInRange(TimeRange{Start: 1, End: 2}, RepeatAACFrames(2)), RepeatAACFrames(1))
+	frames, err = p(frame)
+	require.NoError(t, err)
+	assert.Len(t, frames, 6)
+	frames, err = p(&AACFrame{Data: frame.Data, PTS: 2})
+	require.NoError(t, err)
+	assert.Len(t, frames, 2)
+	frames, err = DropAACFrames()(frame)
+	require.NoError(t, err)
+	assert.Empty(t, frames)
+
+	p, err = ParseAACProcessor("repeat=1, corrupt=0.01")
+	require.NoError(t, err)
+	frames, err = p(frame)
+	require.NoError(t, err)
+	assert.Len(t, frames, 2)
+	for _, spec := range []string{"drop=1", "repeat", "midside", "bounce=1", "corrupt=x"} {
+		_, err = ParseAACProcessor(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestProcessAACFrames(t *testing.T) {
+	asc := []byte{0x11, 0x90}
+	config, err := newAACConfig(asc, 0, 0)
+	require.NoError(t, err)
+	track := &Track{TrackID: 1, Timescale: fixtureSampleRate, Codec: mp4.CodecMP4A, Handler: handlerAudio, MP4A: config}
+	var data []byte
+	for i := 0; i < 4; i++ {
+		frame := testAACFrame(uint32(i%2) * 2)
+		track.Samples = append(track.Samples, &mp4.Sample{Size: uint32(len(frame)), TimeDelta: fixtureAudioFrame})
+		data = append(data, frame...)
+	}
+	track.Chunks = mp4.Chunks{{SamplesPerChunk: 4}}
+
+	// the second frame repeated, the third one dropped
+	frameDuration := float64(fixtureAudioFrame) / fixtureSampleRate
+	p := ChainAAC(
+		AACFramesInRange(TimeRange{Start: frameDuration, End: 2 * frameDuration}, RepeatAACFrames(1)),
+		AACFramesInRange(TimeRange{Start: 2 * frameDuration, End: 3 * frameDuration}, DropAACFrames()),
+	)
+	processed, out, err := track.ProcessAACFrames(bytes.NewReader(data), p)
+	require.NoError(t, err)
+	require.Len(t, processed.Samples, 4)
+	assert.Equal(t, uint64(4*fixtureAudioFrame), processed.Duration)
+	assert.Len(t, track.Samples, 4, "the original track is left as is")
+
+	var muxed bytes.Buffer
+	require.NoError(t, (&MP4Muxer{}).Mux(&muxed, bytes.NewReader(out), []MuxTrack{{Track: processed}}))
+	r := bytes.NewReader(muxed.Bytes())
+	tracks, err := ParseTracks(r)
+	require.NoError(t, err)
+	require.Len(t, tracks, 1)
+	assert.Equal(t, config, tracks[0].MP4A)
+	for i, want := range []uint32{0, 2, 2, 2} {
+		got := make([]byte, tracks[0].Samples[i].Size)
+		_, err := r.ReadAt(got, int64(tracks[0].sampleOffsets()[i]))
+		require.NoError(t, err)
+		assert.Equal(t, testAACFrame(want), got, "sample %d", i)
+	}
+
+	_, _, err = track.ProcessAACFrames(bytes.NewReader(binary.BigEndian.AppendUint32(nil, 0)), p)
+	assert.Error(t, err)
+}
@@ -0,0 +1,281 @@
+package datamosh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/abema/go-mp4"
+	"github.com/mattetti/moshing-vfx/internal/bitio"
+)
+
+// objectTypeAAC is the object type indication of MPEG-4 audio in the
+// DecoderConfigDescriptor. See ISO/IEC 14496-1 7.2.6.6.2.
+const objectTypeAAC = 0x40
+
+// MP4AConfig is the configuration of an MPEG-4 audio track, AAC mostly.
+type MP4AConfig struct {
+	mp4.MP4AInfo
+
+	SampleRate uint32
+	SampleSize uint16
+	// DecoderSpecificInfo is the AudioSpecificConfig of AAC tracks. See
+	// ISO/IEC 14496-3 1.6.2.1.
+	DecoderSpecificInfo []byte
+}
+
+// aacSampleRates are the sampling frequencies by samplingFrequencyIndex. See
+// ISO/IEC 14496-3 1.6.3.4.
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// newMP4AConfig returns the configuration of an mp4a sample entry.
+func newMP4AConfig(entry *mp4.AudioSampleEntry, esds *mp4.Esds) (*MP4AConfig, error) {
+	var oti uint8
+	var asc []byte
+	for _, d := range esds.Descriptors {
+		switch {
+		case d.Tag == mp4.DecoderConfigDescrTag && d.DecoderConfigDescriptor != nil:
+			oti = d.DecoderConfigDescriptor.ObjectTypeIndication
+		case d.Tag == mp4.DecSpecificInfoTag:
+			asc = d.Data
+		}
+	}
+	// the sample rate is 16.16 fixed point
+	sampleRate, channels := entry.SampleRate>>16, entry.ChannelCount
+	if oti != objectTypeAAC {
+		return &MP4AConfig{
+			MP4AInfo:   mp4.MP4AInfo{OTI: oti, ChannelCount: channels},
+			SampleRate: sampleRate,
+			SampleSize: entry.SampleSize,
+		}, nil
+	}
+	config, err := newAACConfig(asc, sampleRate, channels)
+	if err != nil {
+		return nil, err
+	}
+	config.SampleSize = entry.SampleSize
+	return config, nil
+}
+
+// newAACConfig returns the configuration of an AAC track from its
+// AudioSpecificConfig. The sample rate and channel count of the container
+// are used when set, the AudioSpecificConfig doesn't hold the output ones of
+// implicitly signalled SBR and PS.
+func newAACConfig(asc []byte, sampleRate uint32, channels uint16) (*MP4AConfig, error) {
+	if len(asc) == 0 {
+		return nil, errors.New("AudioSpecificConfig not found")
+	}
+	aot, ascRate, ascChannels, err := parseAudioSpecificConfig(asc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse AudioSpecificConfig: %v", err)
+	}
+	if sampleRate == 0 {
+		sampleRate = ascRate
+	}
+	if channels == 0 {
+		channels = ascChannels
+	}
+	return &MP4AConfig{
+		MP4AInfo:            mp4.MP4AInfo{OTI: objectTypeAAC, AudOTI: aot, ChannelCount: channels},
+		SampleRate:          sampleRate,
+		SampleSize:          16,
+		DecoderSpecificInfo: asc,
+	}, nil
+}
+
+// parseAudioSpecificConfig returns the audio object type, sample rate and
+// channel count of an AudioSpecificConfig. See ISO/IEC 14496-3 1.6.2.1.
+func parseAudioSpecificConfig(asc []byte) (aot uint8, sampleRate uint32, channels uint16, err error) {
+	r := bitio.NewReader(bytes.NewReader(asc))
+	v, err := r.ReadUInt(5)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if v == 31 {
+		if v, err = r.ReadUInt(6); err != nil {
+			return 0, 0, 0, err
+		}
+		v += 32
+	}
+	aot = uint8(v)
+	index, err := r.ReadUInt(4)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	switch {
+	case index == 15:
+		if sampleRate, err = r.ReadUInt(24); err != nil {
+			return 0, 0, 0, err
+		}
+	case int(index) < len(aacSampleRates):
+		sampleRate = aacSampleRates[index]
+	default:
+		return 0, 0, 0, fmt.Errorf("invalid sampling frequency index %d", index)
+	}
+	config, err := r.ReadUInt(4)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	// channel configuration 7 is 7.1, 0 is defined by a program config
+	// element
+	channels = uint16(config)
+	if config == 7 {
+		channels = 8
+	}
+	return aot, sampleRate, channels, nil
+}
+
+// newMP4AStsd builds the sample description of an MPEG-4 audio track read
+// from another container.
+func newMP4AStsd(track *Track) ([]byte, error) {
+	config := track.MP4A
+	asc := config.DecoderSpecificInfo
+	// the descriptor sizes must fit in a byte of the varint
+	if len(asc) > 127-(3+2+13+2+2+1) {
+		return nil, fmt.Errorf("decoder specific info of track %d is too long", track.TrackID)
+	}
+	// the ES_ID is 0 in MP4 files, see ISO/IEC 14496-14 3.1.2
+	esds := &mp4.Esds{Descriptors: []mp4.Descriptor{
+		{Tag: mp4.ESDescrTag, Size: 3 + 2 + 13 + 2 + uint32(len(asc)) + 2 + 1, ESDescriptor: &mp4.ESDescriptor{}},
+		{Tag: mp4.DecoderConfigDescrTag, Size: 13 + 2 + uint32(len(asc)), DecoderConfigDescriptor: &mp4.DecoderConfigDescriptor{
+			ObjectTypeIndication: config.OTI,
+			StreamType:           5, // audio
+			Reserved:             true,
+		}},
+		{Tag: mp4.DecSpecificInfoTag, Size: uint32(len(asc)), Data: asc},
+		{Tag: mp4.SLConfigDescrTag, Size: 1, Data: []byte{2}}, // predefined for MP4 files
+	}}
+	esdsData, err := marshalMP4Box(esds)
+	if err != nil {
+		return nil, err
+	}
+	sampleSize := config.SampleSize
+	if sampleSize == 0 {
+		sampleSize = 16
+	}
+	entry := &mp4.AudioSampleEntry{
+		SampleEntry:  mp4.SampleEntry{AnyTypeBox: mp4.AnyTypeBox{Type: mp4.BoxTypeMp4a()}, DataReferenceIndex: 1},
+		ChannelCount: config.ChannelCount,
+		SampleSize:   sampleSize,
+	}
+	if config.SampleRate <= math.MaxUint16 {
+		entry.SampleRate = config.SampleRate << 16
+	}
+	entryData, err := marshalMP4Box(entry, esdsData)
+	if err != nil {
+		return nil, err
+	}
+	return marshalMP4Box(&mp4.Stsd{EntryCount: 1}, entryData)
+}
+
+// AudioSync is how the audio tracks follow the edits of the video samples.
+type AudioSync int
+
+const (
+	// AudioWallClock keeps the audio samples at their time, up to the end of
+	// the edited video.
+	AudioWallClock AudioSync = iota
+	// AudioStretch scales the durations of the audio samples to the duration
+	// of the edited video.
+	AudioStretch
+	// AudioFollow drops and repeats the audio samples with the video samples
+	// they play along.
+	AudioFollow
+)
+
+func (s AudioSync) String() string {
+	switch s {
+	case AudioWallClock:
+		return "wallclock"
+	case AudioStretch:
+		return "stretch"
+	case AudioFollow:
+		return "follow"
+	}
+	return "unknown"
+}
+
+// ParseAudioSync returns the sync mode matching a name: wallclock, stretch or
+// follow.
+func ParseAudioSync(name string) (AudioSync, error) {
+	for _, s := range []AudioSync{AudioWallClock, AudioStretch, AudioFollow} {
+		if strings.EqualFold(name, s.String()) {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown audio sync %q", name)
+}
+
+// SyncAudio returns the audio track to write along with the edited video
+// track. The durations of the video samples are the ones of the video track,
+// the samples being played one after the other. With AudioStretch, the track
+// is a copy with other sample durations.
+func SyncAudio(video MuxTrack, audio *Track, sync AudioSync) (MuxTrack, error) {
+	if video.Track.Timescale == 0 || audio.Timescale == 0 {
+		return MuxTrack{}, errors.New("track timescale is not set")
+	}
+	videoTimes := video.Track.decodeTimes()
+	var duration uint64 // of the edited video
+	for _, id := range video.sampleIDs() {
+		if int(id) >= len(video.Track.Samples) {
+			return MuxTrack{}, fmt.Errorf("sample %d out of range", id)
+		}
+		duration += uint64(video.Track.Samples[id].TimeDelta)
+	}
+	videoEnd := videoTimes[len(videoTimes)-1]
+	audioTimes := audio.decodeTimes()
+	// the times of the audio in the video timescale
+	for i, t := range audioTimes {
+		audioTimes[i] = t * uint64(video.Track.Timescale) / uint64(audio.Timescale)
+	}
+
+	switch sync {
+	case AudioWallClock:
+		samples := []uint32{}
+		for i := range audio.Samples {
+			if audioTimes[i] < duration {
+				samples = append(samples, uint32(i))
+			}
+		}
+		return MuxTrack{Track: audio, Samples: samples}, nil
+	case AudioStretch:
+		if videoEnd == 0 {
+			return MuxTrack{Track: audio}, nil
+		}
+		ratio := float64(duration) / float64(videoEnd)
+		stretched := *audio
+		stretched.Samples = make(mp4.Samples, len(audio.Samples))
+		var end, prev uint64
+		for i, s := range audio.Samples {
+			sample := *s
+			// rounded from the start so the error doesn't add up
+			end += uint64(s.TimeDelta)
+			scaled := uint64(math.Round(float64(end) * ratio))
+			sample.TimeDelta = uint32(scaled - prev)
+			prev = scaled
+			stretched.Samples[i] = &sample
+		}
+		stretched.Duration = prev
+		stretched.EditList = audio.rebuildEditList(int64(math.Round(float64(audio.mediaStart())*ratio)), prev)
+		return MuxTrack{Track: &stretched}, nil
+	case AudioFollow:
+		// the audio samples starting during each video sample
+		starting := make([][]uint32, len(video.Track.Samples))
+		for i, t := range audioTimes[:len(audio.Samples)] {
+			if t >= videoEnd {
+				break
+			}
+			j := sort.Search(len(video.Track.Samples), func(j int) bool { return videoTimes[j+1] > t })
+			starting[j] = append(starting[j], uint32(i))
+		}
+		samples := []uint32{}
+		for _, id := range video.sampleIDs() {
+			samples = append(samples, starting[id]...)
+		}
+		return MuxTrack{Track: audio, Samples: samples}, nil
+	}
+	return MuxTrack{}, fmt.Errorf("unknown audio sync %d", sync)
+}
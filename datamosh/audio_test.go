@@ -0,0 +1,104 @@
+package datamosh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMP4AConfig(t *testing.T) {
+	fixture := mp4Fixture{gop: "IPPP", audio: true}.withDefaults()
+	tracks, err := ParseTracks(bytes.NewReader(fixture.build(t)))
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+	want := tracks[1].MP4A
+	require.NotNil(t, want)
+	assert.Equal(t, uint8(objectTypeAAC), want.OTI)
+	assert.Equal(t, uint8(2), want.AudOTI) // AAC LC
+	assert.Equal(t, uint16(2), want.ChannelCount)
+	assert.Equal(t, uint32(fixtureSampleRate), want.SampleRate)
+	assert.Equal(t, []byte{0x11, 0x90}, want.DecoderSpecificInfo)
+
+	// through Matroska and back to MP4, the sample description being built
+	// from the configuration
+	mkv := &bytes.Buffer{}
+	require.NoError(t, Remux(mkv, bytes.NewReader(fixture.build(t)), ContainerMatroska, nil))
+	tracks, _, err = Demux(bytes.NewReader(mkv.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+	assert.Equal(t, want, tracks[1].MP4A)
+	out := &bytes.Buffer{}
+	require.NoError(t, Remux(out, bytes.NewReader(mkv.Bytes()), ContainerMP4, nil))
+	tracks, err = ParseTracks(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+	assert.Equal(t, want, tracks[1].MP4A)
+	assert.Len(t, tracks[1].Samples, len(fixture.audioFrames()))
+
+	_, _, _, err = parseAudioSpecificConfig([]byte{0x16, 0x90})
+	assert.EqualError(t, err, "invalid sampling frequency index 13")
+}
+
+func TestSyncAudio(t *testing.T) {
+	fixture := mp4Fixture{gop: "IPPPIPPP", audio: true}.withDefaults()
+	data := fixture.build(t)
+	tracks, err := ParseTracks(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+	video, audio := tracks[0], tracks[1]
+	// the second key frame dropped: 7 frames of 40 ms, the audio frames
+	// lasting 1024/48000 s
+	dropped := MuxTrack{Track: video, Samples: DropKeyFrames(video)}
+	require.Len(t, dropped.Samples, 7)
+	require.Len(t, audio.Samples, 15)
+
+	synced, err := SyncAudio(dropped, audio, AudioWallClock)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}, synced.Samples)
+
+	// the audio frames starting during the dropped frame are dropped as well
+	synced, err = SyncAudio(dropped, audio, AudioFollow)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{0, 1, 2, 3, 4, 5, 6, 7, 10, 11, 12, 13, 14}, synced.Samples)
+	repeated := MuxTrack{Track: video, Samples: []uint32{0, 1, 1, 7}}
+	synced, err = SyncAudio(repeated, audio, AudioFollow)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{0, 1, 2, 3, 2, 3, 14}, synced.Samples)
+
+	synced, err = SyncAudio(dropped, audio, AudioStretch)
+	require.NoError(t, err)
+	assert.Nil(t, synced.Samples)
+	require.Len(t, synced.Track.Samples, 15)
+	assert.Equal(t, uint64(15*fixtureAudioFrame*7/8), synced.Track.Duration)
+	assert.Equal(t, uint32(fixtureAudioFrame), audio.Samples[0].TimeDelta, "the original track is left as is")
+
+	// the video samples rewritten in memory, the audio ones in the file
+	moshed, moshedData, err := video.RewriteNALs(bytes.NewReader(data), func(nal []byte) ([]byte, error) {
+		return nal, nil
+	})
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	dropped = MuxTrack{Track: moshed, Samples: dropped.Samples, Data: bytes.NewReader(moshedData)}
+	require.NoError(t, (&MP4Muxer{}).Mux(out, bytes.NewReader(data), []MuxTrack{dropped, synced}))
+	r := bytes.NewReader(out.Bytes())
+	tracks, err = ParseTracks(r)
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+	payload, err := tracks[0].NALs[0].Payload(r)
+	require.NoError(t, err)
+	assert.Equal(t, fixture.frames()[0].nals[0], payload)
+	got := make([]byte, tracks[1].Samples[0].Size)
+	_, err = r.ReadAt(got, int64(tracks[1].sampleOffsets()[0]))
+	require.NoError(t, err)
+	assert.Equal(t, fixture.audioFrames()[0], got)
+	assert.Equal(t, uint64(7*fixtureFrameDuration), tracks[0].Duration)
+	assert.Equal(t, uint64(15*fixtureAudioFrame*7/8), tracks[1].Duration)
+
+	_, err = ParseAudioSync("bounce")
+	assert.EqualError(t, err, `unknown audio sync "bounce"`)
+	sync, err := ParseAudioSync("Follow")
+	require.NoError(t, err)
+	assert.Equal(t, AudioFollow, sync)
+}
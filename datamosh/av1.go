@@ -0,0 +1,836 @@
+package datamosh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abema/go-mp4"
+	"github.com/mattetti/moshing-vfx/internal/bitio"
+)
+
+// AV1 OBU types, see 6.2.2 OBU header semantics
+const (
+	OBU_SEQUENCE_HEADER        = 1
+	OBU_TEMPORAL_DELIMITER     = 2
+	OBU_FRAME_HEADER           = 3
+	OBU_TILE_GROUP             = 4
+	OBU_METADATA               = 5
+	OBU_FRAME                  = 6
+	OBU_REDUNDANT_FRAME_HEADER = 7
+	OBU_TILE_LIST              = 8
+	OBU_PADDING                = 15
+)
+
+// AV1 frame types, see 6.8.2 Uncompressed header semantics
+const (
+	AV1_KEY_FRAME        = 0
+	AV1_INTER_FRAME      = 1
+	AV1_INTRA_ONLY_FRAME = 2
+	AV1_SWITCH_FRAME     = 3
+)
+
+const (
+	av1SelectScreenContentTools = 2
+	av1SelectIntegerMV          = 2
+	av1PrimaryRefNone           = 7
+	av1AllFrames                = 0xff
+)
+
+// OBU represents an AV1 Open Bitstream Unit in a video file.
+type OBU struct {
+	Type       byte
+	Offset     int64  // first byte of the OBU header
+	HeaderSize uint32 // header, optional extension and size field
+	Length     uint32 // of the OBU payload, excluding the header
+	TemporalID byte
+	SpatialID  byte
+	TrackID    uint32
+	Chunk      uint32
+	SampleID   uint32
+	Timestamp  uint64 // presentation time in the timescale of the track
+	DecodeTime uint64 // in the timescale of the track
+
+	// Frame is set for OBU_FRAME, OBU_FRAME_HEADER and OBU_TILE_GROUP units,
+	// tile groups share the header of the frame they belong to.
+	Frame *AV1FrameHeader
+}
+
+// AV1Config holds the decoder configuration of an av01 track.
+type AV1Config struct {
+	mp4.Av1C
+
+	Width          uint16
+	Height         uint16
+	SequenceHeader *AV1SequenceHeader
+}
+
+// AV1SequenceHeader represents the parsed sequence header OBU.
+// See 5.5 Sequence header OBU syntax
+type AV1SequenceHeader struct {
+	SeqProfile                 uint32
+	StillPicture               bool
+	ReducedStillPictureHeader  bool
+	TimingInfoPresent          bool
+	NumUnitsInDisplayTick      uint32
+	TimeScale                  uint32
+	EqualPictureInterval       bool
+	NumTicksPerPictureMinus1   uint32
+	DecoderModelInfoPresent    bool
+	BufferDelayLengthMinus1    uint32
+	BufferRemovalTimeLenMinus1 uint32
+	FramePresentationLenMinus1 uint32
+	OperatingPointIdc          []uint32
+	SeqLevelIdx                []uint32
+	SeqTier                    []uint32
+	DecoderModelPresentForOp   []bool
+	MaxFrameWidthMinus1        uint32
+	MaxFrameHeightMinus1       uint32
+	FrameIDNumbersPresent      bool
+	DeltaFrameIDLengthMinus2   uint32
+	AdditionalFrameIDLenMinus1 uint32
+	Use128x128Superblock       bool
+	EnableOrderHint            bool
+	SeqForceScreenContentTools uint32
+	SeqForceIntegerMV          uint32
+	OrderHintBits              uint32
+	EnableSuperres             bool
+	EnableCdef                 bool
+	EnableRestoration          bool
+	BitDepth                   uint32
+	MonoChrome                 bool
+	SubsamplingX               uint32
+	SubsamplingY               uint32
+	FilmGrainParamsPresent     bool
+}
+
+// AV1FrameHeader represents the leading part of the uncompressed frame header,
+// up to the reference refresh flags.
+// See 5.9.2 Uncompressed header syntax
+type AV1FrameHeader struct {
+	ShowExistingFrame  bool
+	FrameToShowMapIdx  uint32
+	FrameType          uint32
+	ShowFrame          bool
+	ShowableFrame      bool
+	ErrorResilientMode bool
+	OrderHint          uint32
+	PrimaryRefFrame    uint32
+	RefreshFrameFlags  uint32
+}
+
+// IsKeyFrame returns true if the frame is a shown key frame, the AV1
+// equivalent of an IDR.
+func (h *AV1FrameHeader) IsKeyFrame() bool {
+	return !h.ShowExistingFrame && h.FrameType == AV1_KEY_FRAME && h.ShowFrame
+}
+
+// IsIntra returns true for key and intra only frames.
+func (h *AV1FrameHeader) IsIntra() bool {
+	return h.FrameType == AV1_KEY_FRAME || h.FrameType == AV1_INTRA_ONLY_FRAME
+}
+
+// readLEB128 decodes a little endian base 128 value from the start of data.
+// It returns the value and the number of bytes consumed.
+// See 4.10.5 leb128()
+func readLEB128(data []byte) (uint64, int, error) {
+	var value uint64
+	for i := 0; i < 8; i++ {
+		if i >= len(data) {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		value |= uint64(data[i]&0x7f) << (i * 7)
+		if data[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("leb128 value is too long")
+}
+
+// readUVLC reads a variable length unsigned value.
+// See 4.10.3 uvlc()
+func readUVLC(r bitio.Reader) (uint32, error) {
+	var leadingZeros int
+	for {
+		bit, err := r.ReadBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit {
+			break
+		}
+		leadingZeros++
+	}
+	if leadingZeros >= 32 {
+		return 1<<32 - 1, nil
+	}
+	value, err := r.ReadUInt(leadingZeros)
+	if err != nil {
+		return 0, err
+	}
+	return value + (1 << leadingZeros) - 1, nil
+}
+
+func readFlag(r bitio.Reader) (bool, error) {
+	return r.ReadBit()
+}
+
+// parseOBUHeader parses the OBU header at the start of data.
+// When the OBU has no size field, the OBU spans the rest of data.
+func parseOBUHeader(data []byte) (*OBU, error) {
+	if len(data) < 1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	header := data[0]
+	if header&0x80 != 0 {
+		return nil, errors.New("obu_forbidden_bit is not 0")
+	}
+	obu := &OBU{Type: (header >> 3) & 0x0f}
+	hasExtension := header&0x04 != 0
+	hasSize := header&0x02 != 0
+
+	pos := 1
+	if hasExtension {
+		if len(data) < 2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		obu.TemporalID = data[1] >> 5
+		obu.SpatialID = (data[1] >> 3) & 0x03
+		pos++
+	}
+
+	if hasSize {
+		size, n, err := readLEB128(data[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read obu_size: %v", err)
+		}
+		pos += n
+		if uint64(len(data)-pos) < size {
+			return nil, fmt.Errorf("obu_size %d exceeds the available %d bytes", size, len(data)-pos)
+		}
+		obu.Length = uint32(size)
+	} else {
+		obu.Length = uint32(len(data) - pos)
+	}
+	obu.HeaderSize = uint32(pos)
+
+	return obu, nil
+}
+
+// ParseAV1SequenceHeader parses the payload of a sequence header OBU.
+func ParseAV1SequenceHeader(payload []byte) (*AV1SequenceHeader, error) {
+	r := bitio.NewReader(bytes.NewReader(payload))
+	sh := &AV1SequenceHeader{}
+	var err error
+	var flag bool
+
+	if sh.SeqProfile, err = r.ReadUInt(3); err != nil {
+		return nil, fmt.Errorf("failed to read seq_profile: %v", err)
+	}
+	if sh.StillPicture, err = readFlag(r); err != nil {
+		return nil, fmt.Errorf("failed to read still_picture: %v", err)
+	}
+	if sh.ReducedStillPictureHeader, err = readFlag(r); err != nil {
+		return nil, fmt.Errorf("failed to read reduced_still_picture_header: %v", err)
+	}
+
+	if sh.ReducedStillPictureHeader {
+		levelIdx, err := r.ReadUInt(5)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read seq_level_idx: %v", err)
+		}
+		sh.OperatingPointIdc = []uint32{0}
+		sh.SeqLevelIdx = []uint32{levelIdx}
+		sh.SeqTier = []uint32{0}
+		sh.DecoderModelPresentForOp = []bool{false}
+	} else {
+		if sh.TimingInfoPresent, err = readFlag(r); err != nil {
+			return nil, fmt.Errorf("failed to read timing_info_present_flag: %v", err)
+		}
+		if sh.TimingInfoPresent {
+			if sh.NumUnitsInDisplayTick, err = r.ReadUInt(32); err != nil {
+				return nil, fmt.Errorf("failed to read num_units_in_display_tick: %v", err)
+			}
+			if sh.TimeScale, err = r.ReadUInt(32); err != nil {
+				return nil, fmt.Errorf("failed to read time_scale: %v", err)
+			}
+			if sh.EqualPictureInterval, err = readFlag(r); err != nil {
+				return nil, fmt.Errorf("failed to read equal_picture_interval: %v", err)
+			}
+			if sh.EqualPictureInterval {
+				if sh.NumTicksPerPictureMinus1, err = readUVLC(r); err != nil {
+					return nil, fmt.Errorf("failed to read num_ticks_per_picture_minus_1: %v", err)
+				}
+			}
+
+			if sh.DecoderModelInfoPresent, err = readFlag(r); err != nil {
+				return nil, fmt.Errorf("failed to read decoder_model_info_present_flag: %v", err)
+			}
+			if sh.DecoderModelInfoPresent {
+				if sh.BufferDelayLengthMinus1, err = r.ReadUInt(5); err != nil {
+					return nil, fmt.Errorf("failed to read buffer_delay_length_minus_1: %v", err)
+				}
+				// num_units_in_decoding_tick
+				if _, err = r.ReadUInt(32); err != nil {
+					return nil, fmt.Errorf("failed to read num_units_in_decoding_tick: %v", err)
+				}
+				if sh.BufferRemovalTimeLenMinus1, err = r.ReadUInt(5); err != nil {
+					return nil, fmt.Errorf("failed to read buffer_removal_time_length_minus_1: %v", err)
+				}
+				if sh.FramePresentationLenMinus1, err = r.ReadUInt(5); err != nil {
+					return nil, fmt.Errorf("failed to read frame_presentation_time_length_minus_1: %v", err)
+				}
+			}
+		}
+
+		initialDisplayDelayPresent, err := readFlag(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read initial_display_delay_present_flag: %v", err)
+		}
+		opCountMinus1, err := r.ReadUInt(5)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read operating_points_cnt_minus_1: %v", err)
+		}
+		for i := uint32(0); i <= opCountMinus1; i++ {
+			idc, err := r.ReadUInt(12)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read operating_point_idc: %v", err)
+			}
+			levelIdx, err := r.ReadUInt(5)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read seq_level_idx: %v", err)
+			}
+			var tier uint32
+			if levelIdx > 7 {
+				if tier, err = r.ReadUInt(1); err != nil {
+					return nil, fmt.Errorf("failed to read seq_tier: %v", err)
+				}
+			}
+			var modelPresent bool
+			if sh.DecoderModelInfoPresent {
+				if modelPresent, err = readFlag(r); err != nil {
+					return nil, fmt.Errorf("failed to read decoder_model_present_for_this_op: %v", err)
+				}
+				if modelPresent {
+					// operating_parameters_info
+					n := int(sh.BufferDelayLengthMinus1) + 1
+					if _, err = r.ReadUInt(n); err != nil {
+						return nil, fmt.Errorf("failed to read decoder_buffer_delay: %v", err)
+					}
+					if _, err = r.ReadUInt(n); err != nil {
+						return nil, fmt.Errorf("failed to read encoder_buffer_delay: %v", err)
+					}
+					if _, err = r.ReadUInt(1); err != nil {
+						return nil, fmt.Errorf("failed to read low_delay_mode_flag: %v", err)
+					}
+				}
+			}
+			if initialDisplayDelayPresent {
+				if flag, err = readFlag(r); err != nil {
+					return nil, fmt.Errorf("failed to read initial_display_delay_present_for_this_op: %v", err)
+				}
+				if flag {
+					if _, err = r.ReadUInt(4); err != nil {
+						return nil, fmt.Errorf("failed to read initial_display_delay_minus_1: %v", err)
+					}
+				}
+			}
+			sh.OperatingPointIdc = append(sh.OperatingPointIdc, idc)
+			sh.SeqLevelIdx = append(sh.SeqLevelIdx, levelIdx)
+			sh.SeqTier = append(sh.SeqTier, tier)
+			sh.DecoderModelPresentForOp = append(sh.DecoderModelPresentForOp, modelPresent)
+		}
+	}
+
+	widthBitsMinus1, err := r.ReadUInt(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame_width_bits_minus_1: %v", err)
+	}
+	heightBitsMinus1, err := r.ReadUInt(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame_height_bits_minus_1: %v", err)
+	}
+	if sh.MaxFrameWidthMinus1, err = r.ReadUInt(int(widthBitsMinus1) + 1); err != nil {
+		return nil, fmt.Errorf("failed to read max_frame_width_minus_1: %v", err)
+	}
+	if sh.MaxFrameHeightMinus1, err = r.ReadUInt(int(heightBitsMinus1) + 1); err != nil {
+		return nil, fmt.Errorf("failed to read max_frame_height_minus_1: %v", err)
+	}
+
+	if !sh.ReducedStillPictureHeader {
+		if sh.FrameIDNumbersPresent, err = readFlag(r); err != nil {
+			return nil, fmt.Errorf("failed to read frame_id_numbers_present_flag: %v", err)
+		}
+	}
+	if sh.FrameIDNumbersPresent {
+		if sh.DeltaFrameIDLengthMinus2, err = r.ReadUInt(4); err != nil {
+			return nil, fmt.Errorf("failed to read delta_frame_id_length_minus_2: %v", err)
+		}
+		if sh.AdditionalFrameIDLenMinus1, err = r.ReadUInt(3); err != nil {
+			return nil, fmt.Errorf("failed to read additional_frame_id_length_minus_1: %v", err)
+		}
+	}
+
+	if sh.Use128x128Superblock, err = readFlag(r); err != nil {
+		return nil, fmt.Errorf("failed to read use_128x128_superblock: %v", err)
+	}
+	// enable_filter_intra and enable_intra_edge_filter
+	if _, err = r.ReadUInt(2); err != nil {
+		return nil, fmt.Errorf("failed to read intra filter flags: %v", err)
+	}
+
+	sh.SeqForceScreenContentTools = av1SelectScreenContentTools
+	sh.SeqForceIntegerMV = av1SelectIntegerMV
+	if !sh.ReducedStillPictureHeader {
+		// enable_interintra_compound, enable_masked_compound,
+		// enable_warped_motion and enable_dual_filter
+		if _, err = r.ReadUInt(4); err != nil {
+			return nil, fmt.Errorf("failed to read compound tool flags: %v", err)
+		}
+		if sh.EnableOrderHint, err = readFlag(r); err != nil {
+			return nil, fmt.Errorf("failed to read enable_order_hint: %v", err)
+		}
+		if sh.EnableOrderHint {
+			// enable_jnt_comp and enable_ref_frame_mvs
+			if _, err = r.ReadUInt(2); err != nil {
+				return nil, fmt.Errorf("failed to read order hint tool flags: %v", err)
+			}
+		}
+		if flag, err = readFlag(r); err != nil {
+			return nil, fmt.Errorf("failed to read seq_choose_screen_content_tools: %v", err)
+		}
+		if !flag {
+			if sh.SeqForceScreenContentTools, err = r.ReadUInt(1); err != nil {
+				return nil, fmt.Errorf("failed to read seq_force_screen_content_tools: %v", err)
+			}
+		}
+		if sh.SeqForceScreenContentTools > 0 {
+			if flag, err = readFlag(r); err != nil {
+				return nil, fmt.Errorf("failed to read seq_choose_integer_mv: %v", err)
+			}
+			if !flag {
+				if sh.SeqForceIntegerMV, err = r.ReadUInt(1); err != nil {
+					return nil, fmt.Errorf("failed to read seq_force_integer_mv: %v", err)
+				}
+			}
+		}
+		if sh.EnableOrderHint {
+			bitsMinus1, err := r.ReadUInt(3)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read order_hint_bits_minus_1: %v", err)
+			}
+			sh.OrderHintBits = bitsMinus1 + 1
+		}
+	}
+
+	if sh.EnableSuperres, err = readFlag(r); err != nil {
+		return nil, fmt.Errorf("failed to read enable_superres: %v", err)
+	}
+	if sh.EnableCdef, err = readFlag(r); err != nil {
+		return nil, fmt.Errorf("failed to read enable_cdef: %v", err)
+	}
+	if sh.EnableRestoration, err = readFlag(r); err != nil {
+		return nil, fmt.Errorf("failed to read enable_restoration: %v", err)
+	}
+	if err = sh.parseColorConfig(r); err != nil {
+		return nil, err
+	}
+	if sh.FilmGrainParamsPresent, err = readFlag(r); err != nil {
+		return nil, fmt.Errorf("failed to read film_grain_params_present: %v", err)
+	}
+
+	return sh, nil
+}
+
+// parseColorConfig parses the color config of a sequence header.
+// See 5.5.2 Color config syntax
+func (sh *AV1SequenceHeader) parseColorConfig(r bitio.Reader) error {
+	highBitdepth, err := readFlag(r)
+	if err != nil {
+		return fmt.Errorf("failed to read high_bitdepth: %v", err)
+	}
+	sh.BitDepth = 8
+	if sh.SeqProfile == 2 && highBitdepth {
+		twelveBit, err := readFlag(r)
+		if err != nil {
+			return fmt.Errorf("failed to read twelve_bit: %v", err)
+		}
+		sh.BitDepth = 10
+		if twelveBit {
+			sh.BitDepth = 12
+		}
+	} else if highBitdepth {
+		sh.BitDepth = 10
+	}
+
+	if sh.SeqProfile != 1 {
+		if sh.MonoChrome, err = readFlag(r); err != nil {
+			return fmt.Errorf("failed to read mono_chrome: %v", err)
+		}
+	}
+
+	colorDescriptionPresent, err := readFlag(r)
+	if err != nil {
+		return fmt.Errorf("failed to read color_description_present_flag: %v", err)
+	}
+	// CP_UNSPECIFIED, TC_UNSPECIFIED, MC_UNSPECIFIED
+	colorPrimaries, transfer, matrix := uint32(2), uint32(2), uint32(2)
+	if colorDescriptionPresent {
+		if colorPrimaries, err = r.ReadUInt(8); err != nil {
+			return fmt.Errorf("failed to read color_primaries: %v", err)
+		}
+		if transfer, err = r.ReadUInt(8); err != nil {
+			return fmt.Errorf("failed to read transfer_characteristics: %v", err)
+		}
+		if matrix, err = r.ReadUInt(8); err != nil {
+			return fmt.Errorf("failed to read matrix_coefficients: %v", err)
+		}
+	}
+
+	if sh.MonoChrome {
+		// color_range
+		if _, err = r.ReadUInt(1); err != nil {
+			return fmt.Errorf("failed to read color_range: %v", err)
+		}
+		sh.SubsamplingX, sh.SubsamplingY = 1, 1
+		return nil
+	}
+
+	// CP_BT_709, TC_SRGB and MC_IDENTITY imply 4:4:4 full range
+	if colorPrimaries == 1 && transfer == 13 && matrix == 0 {
+		sh.SubsamplingX, sh.SubsamplingY = 0, 0
+	} else {
+		if _, err = r.ReadUInt(1); err != nil {
+			return fmt.Errorf("failed to read color_range: %v", err)
+		}
+		switch sh.SeqProfile {
+		case 0:
+			sh.SubsamplingX, sh.SubsamplingY = 1, 1
+		case 1:
+			sh.SubsamplingX, sh.SubsamplingY = 0, 0
+		default:
+			sh.SubsamplingX, sh.SubsamplingY = 1, 0
+			if sh.BitDepth == 12 {
+				if sh.SubsamplingX, err = r.ReadUInt(1); err != nil {
+					return fmt.Errorf("failed to read subsampling_x: %v", err)
+				}
+				sh.SubsamplingY = 0
+				if sh.SubsamplingX == 1 {
+					if sh.SubsamplingY, err = r.ReadUInt(1); err != nil {
+						return fmt.Errorf("failed to read subsampling_y: %v", err)
+					}
+				}
+			}
+		}
+		if sh.SubsamplingX == 1 && sh.SubsamplingY == 1 {
+			// chroma_sample_position
+			if _, err = r.ReadUInt(2); err != nil {
+				return fmt.Errorf("failed to read chroma_sample_position: %v", err)
+			}
+		}
+	}
+
+	// separate_uv_delta_q
+	if _, err = r.ReadUInt(1); err != nil {
+		return fmt.Errorf("failed to read separate_uv_delta_q: %v", err)
+	}
+	return nil
+}
+
+// ParseAV1FrameHeader parses the start of a frame header OBU payload (or
+// OBU_FRAME payload) using the active sequence header.
+func ParseAV1FrameHeader(payload []byte, sh *AV1SequenceHeader, temporalID, spatialID byte) (*AV1FrameHeader, error) {
+	if sh == nil {
+		return nil, errors.New("no sequence header before the frame header")
+	}
+	r := bitio.NewReader(bytes.NewReader(payload))
+	fh := &AV1FrameHeader{PrimaryRefFrame: av1PrimaryRefNone}
+	var err error
+
+	idLen := 0
+	if sh.FrameIDNumbersPresent {
+		idLen = int(sh.AdditionalFrameIDLenMinus1 + sh.DeltaFrameIDLengthMinus2 + 3)
+	}
+
+	if sh.ReducedStillPictureHeader {
+		fh.FrameType = AV1_KEY_FRAME
+		fh.ShowFrame = true
+	} else {
+		if fh.ShowExistingFrame, err = readFlag(r); err != nil {
+			return nil, fmt.Errorf("failed to read show_existing_frame: %v", err)
+		}
+		if fh.ShowExistingFrame {
+			if fh.FrameToShowMapIdx, err = r.ReadUInt(3); err != nil {
+				return nil, fmt.Errorf("failed to read frame_to_show_map_idx: %v", err)
+			}
+			// The frame type of the shown frame depends on the decoder state,
+			// it is reported as an inter frame.
+			fh.FrameType = AV1_INTER_FRAME
+			fh.ShowFrame = true
+			return fh, nil
+		}
+
+		if fh.FrameType, err = r.ReadUInt(2); err != nil {
+			return nil, fmt.Errorf("failed to read frame_type: %v", err)
+		}
+		if fh.ShowFrame, err = readFlag(r); err != nil {
+			return nil, fmt.Errorf("failed to read show_frame: %v", err)
+		}
+		if fh.ShowFrame && sh.DecoderModelInfoPresent && !sh.EqualPictureInterval {
+			// temporal_point_info
+			if _, err = r.ReadUInt(int(sh.FramePresentationLenMinus1) + 1); err != nil {
+				return nil, fmt.Errorf("failed to read frame_presentation_time: %v", err)
+			}
+		}
+		if fh.ShowFrame {
+			fh.ShowableFrame = fh.FrameType != AV1_KEY_FRAME
+		} else if fh.ShowableFrame, err = readFlag(r); err != nil {
+			return nil, fmt.Errorf("failed to read showable_frame: %v", err)
+		}
+		if fh.FrameType == AV1_SWITCH_FRAME || (fh.FrameType == AV1_KEY_FRAME && fh.ShowFrame) {
+			fh.ErrorResilientMode = true
+		} else if fh.ErrorResilientMode, err = readFlag(r); err != nil {
+			return nil, fmt.Errorf("failed to read error_resilient_mode: %v", err)
+		}
+	}
+
+	// disable_cdf_update
+	if _, err = r.ReadUInt(1); err != nil {
+		return nil, fmt.Errorf("failed to read disable_cdf_update: %v", err)
+	}
+	allowScreenContentTools := sh.SeqForceScreenContentTools
+	if sh.SeqForceScreenContentTools == av1SelectScreenContentTools {
+		if allowScreenContentTools, err = r.ReadUInt(1); err != nil {
+			return nil, fmt.Errorf("failed to read allow_screen_content_tools: %v", err)
+		}
+	}
+	if allowScreenContentTools > 0 && sh.SeqForceIntegerMV == av1SelectIntegerMV {
+		// force_integer_mv
+		if _, err = r.ReadUInt(1); err != nil {
+			return nil, fmt.Errorf("failed to read force_integer_mv: %v", err)
+		}
+	}
+	if sh.FrameIDNumbersPresent {
+		// current_frame_id
+		if _, err = r.ReadUInt(idLen); err != nil {
+			return nil, fmt.Errorf("failed to read current_frame_id: %v", err)
+		}
+	}
+	if fh.FrameType != AV1_SWITCH_FRAME && !sh.ReducedStillPictureHeader {
+		// frame_size_override_flag
+		if _, err = r.ReadUInt(1); err != nil {
+			return nil, fmt.Errorf("failed to read frame_size_override_flag: %v", err)
+		}
+	}
+	if fh.OrderHint, err = r.ReadUInt(int(sh.OrderHintBits)); err != nil {
+		return nil, fmt.Errorf("failed to read order_hint: %v", err)
+	}
+	if !fh.IsIntra() && !fh.ErrorResilientMode {
+		if fh.PrimaryRefFrame, err = r.ReadUInt(3); err != nil {
+			return nil, fmt.Errorf("failed to read primary_ref_frame: %v", err)
+		}
+	}
+
+	if sh.DecoderModelInfoPresent {
+		bufferRemovalTimePresent, err := readFlag(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read buffer_removal_time_present_flag: %v", err)
+		}
+		if bufferRemovalTimePresent {
+			for op, idc := range sh.OperatingPointIdc {
+				if !sh.DecoderModelPresentForOp[op] {
+					continue
+				}
+				inTemporalLayer := (idc>>temporalID)&1 != 0
+				inSpatialLayer := (idc>>(spatialID+8))&1 != 0
+				if idc == 0 || (inTemporalLayer && inSpatialLayer) {
+					if _, err = r.ReadUInt(int(sh.BufferRemovalTimeLenMinus1) + 1); err != nil {
+						return nil, fmt.Errorf("failed to read buffer_removal_time: %v", err)
+					}
+				}
+			}
+		}
+	}
+
+	if fh.FrameType == AV1_SWITCH_FRAME || (fh.FrameType == AV1_KEY_FRAME && fh.ShowFrame) {
+		fh.RefreshFrameFlags = av1AllFrames
+	} else if fh.RefreshFrameFlags, err = r.ReadUInt(8); err != nil {
+		return nil, fmt.Errorf("failed to read refresh_frame_flags: %v", err)
+	}
+
+	return fh, nil
+}
+
+// parseOBUs splits a temporal unit into OBUs, parsing sequence and frame headers
+// along the way. offset is the position of data in the source file.
+// The active sequence header is returned, updated if the temporal unit carried one.
+func parseOBUs(data []byte, offset int64, sh *AV1SequenceHeader) ([]*OBU, *AV1SequenceHeader, error) {
+	obus := []*OBU{}
+	var frame *AV1FrameHeader
+	for pos := 0; pos < len(data); {
+		obu, err := parseOBUHeader(data[pos:])
+		if err != nil {
+			return obus, sh, err
+		}
+		obu.Offset = offset + int64(pos)
+		payload := data[pos+int(obu.HeaderSize) : pos+int(obu.HeaderSize)+int(obu.Length)]
+
+		switch obu.Type {
+		case OBU_SEQUENCE_HEADER:
+			sh, err = ParseAV1SequenceHeader(payload)
+			if err != nil {
+				return obus, sh, fmt.Errorf("failed to parse sequence header: %v", err)
+			}
+		case OBU_FRAME, OBU_FRAME_HEADER:
+			obu.Frame, err = ParseAV1FrameHeader(payload, sh, obu.TemporalID, obu.SpatialID)
+			if err != nil {
+				return obus, sh, fmt.Errorf("failed to parse frame header: %v", err)
+			}
+			frame = obu.Frame
+		case OBU_TILE_GROUP:
+			obu.Frame = frame
+		}
+
+		if Debug {
+			fmt.Printf("  OBU type: %d, offset: %d, length: %d\n", obu.Type, obu.Offset, obu.Length)
+		}
+
+		obus = append(obus, obu)
+		pos += int(obu.HeaderSize + obu.Length)
+	}
+	return obus, sh, nil
+}
+
+// newAV1Config builds the track configuration from an av1C box.
+func newAV1Config(av01 *mp4.VisualSampleEntry, av1C *mp4.Av1C) (*AV1Config, error) {
+	config := &AV1Config{
+		Av1C:   *av1C,
+		Width:  av01.Width,
+		Height: av01.Height,
+	}
+	_, sh, err := parseOBUs(av1C.ConfigOBUs, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse av1C config OBUs: %v", err)
+	}
+	config.SequenceHeader = sh
+	return config, nil
+}
+
+// newAV1ConfigFromSequenceHeader synthesizes the av1C box content for streams
+// that don't carry one (IVF and raw OBU streams).
+func newAV1ConfigFromSequenceHeader(sh *AV1SequenceHeader, sequenceHeaderOBU []byte) *AV1Config {
+	config := &AV1Config{
+		Av1C: mp4.Av1C{
+			Marker:     1,
+			Version:    1,
+			SeqProfile: uint8(sh.SeqProfile),
+			ConfigOBUs: sequenceHeaderOBU,
+		},
+		Width:          uint16(sh.MaxFrameWidthMinus1 + 1),
+		Height:         uint16(sh.MaxFrameHeightMinus1 + 1),
+		SequenceHeader: sh,
+	}
+	if len(sh.SeqLevelIdx) > 0 {
+		config.SeqLevelIdx0 = uint8(sh.SeqLevelIdx[0])
+		config.SeqTier0 = uint8(sh.SeqTier[0])
+	}
+	if sh.BitDepth > 8 {
+		config.HighBitdepth = 1
+	}
+	if sh.BitDepth == 12 {
+		config.TwelveBit = 1
+	}
+	if sh.MonoChrome {
+		config.Monochrome = 1
+	}
+	config.ChromaSubsamplingX = uint8(sh.SubsamplingX)
+	config.ChromaSubsamplingY = uint8(sh.SubsamplingY)
+	return config
+}
+
+// processAV1Track reads every sample of an AV1 track and splits it into OBUs.
+func processAV1Track(r io.ReadSeeker, track *Track) ([]*OBU, error) {
+	if track.AV1 == nil {
+		return nil, errors.New("AV1 configuration not found")
+	}
+	sh := track.AV1.SequenceHeader
+	obus := []*OBU{}
+
+	var si int
+	currentTime := uint64(0)
+	for nChunk, chunk := range track.Chunks {
+		end := si + int(chunk.SamplesPerChunk)
+		dataOffset := chunk.DataOffset
+		for ; si < end && si < len(track.Samples); si++ {
+			sample := track.Samples[si]
+			decodeTime := currentTime
+			presentationTime := currentTime + uint64(sample.CompositionTimeOffset)
+			currentTime += uint64(sample.TimeDelta)
+			if sample.Size == 0 {
+				continue
+			}
+
+			if _, err := r.Seek(int64(dataOffset), io.SeekStart); err != nil {
+				return obus, err
+			}
+			data := make([]byte, sample.Size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return obus, err
+			}
+
+			sampleOBUs, newSH, err := parseOBUs(data, int64(dataOffset), sh)
+			if err != nil {
+				return obus, fmt.Errorf("sample %d: %v", si, err)
+			}
+			sh = newSH
+			for _, obu := range sampleOBUs {
+				obu.TrackID = track.TrackID
+				obu.Chunk = uint32(nChunk)
+				obu.SampleID = uint32(si)
+				obu.Timestamp = presentationTime
+				obu.DecodeTime = decodeTime
+			}
+			obus = append(obus, sampleOBUs...)
+			dataOffset += uint64(sample.Size)
+		}
+	}
+
+	if track.AV1.SequenceHeader == nil {
+		track.AV1.SequenceHeader = sh
+	}
+
+	return obus, nil
+}
+
+// Nullify turns the OBU into a padding OBU so decoders skip it.
+// The size of the OBU and of the sample stays the same.
+func (o *OBU) Nullify(w io.WriteSeeker) error {
+	rw, ok := w.(interface {
+		io.WriterAt
+		io.ReaderAt
+	})
+	if !ok {
+		return fmt.Errorf("writer does not implement io.WriterAt and io.ReaderAt")
+	}
+
+	// Read back the header byte to keep the extension and size flags.
+	header := []byte{0}
+	if _, err := rw.ReadAt(header, o.Offset); err != nil {
+		return fmt.Errorf("failed to read the OBU header: %v", err)
+	}
+	header[0] = header[0]&0x87 | OBU_PADDING<<3
+
+	if _, err := rw.WriteAt(header, o.Offset); err != nil {
+		return fmt.Errorf("failed to write the OBU header: %v", err)
+	}
+	o.Type = OBU_PADDING
+	o.Frame = nil
+
+	return nil
+}
+
+// Payload returns the OBU data, header included.
+func (o *OBU) Payload(r io.ReadSeeker) ([]byte, error) {
+	return readPayload(r, o.Offset, o.Size())
+}
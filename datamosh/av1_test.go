@@ -0,0 +1,250 @@
+package datamosh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattetti/moshing-vfx/internal/bitio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBitWriter builds bitstreams field by field.
+type testBitWriter struct {
+	buf bytes.Buffer
+	w   bitio.Writer
+}
+
+func newTestBitWriter() *testBitWriter {
+	b := &testBitWriter{}
+	b.w = bitio.NewWriter(&b.buf)
+	return b
+}
+
+func (b *testBitWriter) put(value uint32, width uint) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	if err := b.w.WriteBits(data, width); err != nil {
+		panic(err)
+	}
+}
+
+// trailingBytes writes the trailing one bit, pads to the byte boundary and
+// returns the written bytes.
+func (b *testBitWriter) trailingBytes() []byte {
+	b.put(1, 1)
+	// Write only succeeds once the writer is byte aligned.
+	for {
+		if _, err := b.w.Write(nil); err == nil {
+			break
+		}
+		b.put(0, 1)
+	}
+	return b.buf.Bytes()
+}
+
+func testOBU(obuType byte, payload []byte) []byte {
+	return append([]byte{obuType<<3 | 0x02, byte(len(payload))}, payload...)
+}
+
+func testSequenceHeader() []byte {
+	b := newTestBitWriter()
+	b.put(0, 3)    // seq_profile
+	b.put(0, 1)    // still_picture
+	b.put(0, 1)    // reduced_still_picture_header
+	b.put(0, 1)    // timing_info_present_flag
+	b.put(0, 1)    // initial_display_delay_present_flag
+	b.put(0, 5)    // operating_points_cnt_minus_1
+	b.put(0, 12)   // operating_point_idc
+	b.put(8, 5)    // seq_level_idx
+	b.put(0, 1)    // seq_tier
+	b.put(15, 4)   // frame_width_bits_minus_1
+	b.put(15, 4)   // frame_height_bits_minus_1
+	b.put(319, 16) // max_frame_width_minus_1
+	b.put(239, 16) // max_frame_height_minus_1
+	b.put(0, 1)    // frame_id_numbers_present_flag
+	b.put(0, 3)    // use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+	b.put(0, 4)    // compound tools
+	b.put(1, 1)    // enable_order_hint
+	b.put(0, 2)    // enable_jnt_comp, enable_ref_frame_mvs
+	b.put(1, 1)    // seq_choose_screen_content_tools
+	b.put(1, 1)    // seq_choose_integer_mv
+	b.put(6, 3)    // order_hint_bits_minus_1
+	b.put(0, 1)    // enable_superres
+	b.put(1, 1)    // enable_cdef
+	b.put(0, 1)    // enable_restoration
+	b.put(0, 1)    // high_bitdepth
+	b.put(0, 1)    // mono_chrome
+	b.put(0, 1)    // color_description_present_flag
+	b.put(0, 1)    // color_range
+	b.put(0, 2)    // chroma_sample_position
+	b.put(0, 1)    // separate_uv_delta_q
+	b.put(0, 1)    // film_grain_params_present
+	return b.trailingBytes()
+}
+
+func testFrame(key bool, orderHint uint32) []byte {
+	b := newTestBitWriter()
+	b.put(0, 1) // show_existing_frame
+	if key {
+		b.put(AV1_KEY_FRAME, 2)
+		b.put(1, 1) // show_frame
+	} else {
+		b.put(AV1_INTER_FRAME, 2)
+		b.put(1, 1) // show_frame
+		b.put(0, 1) // error_resilient_mode
+	}
+	b.put(0, 1)         // disable_cdf_update
+	b.put(0, 1)         // allow_screen_content_tools
+	b.put(0, 1)         // frame_size_override_flag
+	b.put(orderHint, 7) // order_hint
+	if !key {
+		b.put(0, 3)    // primary_ref_frame
+		b.put(0x01, 8) // refresh_frame_flags
+	}
+	// fake tile data
+	b.put(0xabcd, 16)
+	return b.trailingBytes()
+}
+
+func testIVF(frames [][]byte) []byte {
+	buf := &bytes.Buffer{}
+	header := make([]byte, ivfHeaderSize)
+	copy(header[0:4], "DKIF")
+	binary.LittleEndian.PutUint16(header[6:8], ivfHeaderSize)
+	copy(header[8:12], "AV01")
+	binary.LittleEndian.PutUint16(header[12:14], 320)
+	binary.LittleEndian.PutUint16(header[14:16], 240)
+	binary.LittleEndian.PutUint32(header[16:20], 30)
+	binary.LittleEndian.PutUint32(header[20:24], 1)
+	binary.LittleEndian.PutUint32(header[24:28], uint32(len(frames)))
+	buf.Write(header)
+	for i, frame := range frames {
+		frameHeader := make([]byte, ivfFrameHeaderSize)
+		binary.LittleEndian.PutUint32(frameHeader[0:4], uint32(len(frame)))
+		binary.LittleEndian.PutUint64(frameHeader[4:12], uint64(i))
+		buf.Write(frameHeader)
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+func testAV1Frames() [][]byte {
+	td := testOBU(OBU_TEMPORAL_DELIMITER, nil)
+	sh := testOBU(OBU_SEQUENCE_HEADER, testSequenceHeader())
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	return [][]byte{
+		join(td, sh, testOBU(OBU_FRAME, testFrame(true, 0))),
+		join(td, testOBU(OBU_FRAME, testFrame(false, 1))),
+		join(td, sh, testOBU(OBU_FRAME, testFrame(true, 0))),
+		join(td, testOBU(OBU_FRAME, testFrame(false, 1))),
+	}
+}
+
+func TestParseAV1SequenceHeader(t *testing.T) {
+	sh, err := ParseAV1SequenceHeader(testSequenceHeader())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(319), sh.MaxFrameWidthMinus1)
+	assert.Equal(t, uint32(239), sh.MaxFrameHeightMinus1)
+	assert.Equal(t, []uint32{8}, sh.SeqLevelIdx)
+	assert.True(t, sh.EnableOrderHint)
+	assert.Equal(t, uint32(7), sh.OrderHintBits)
+	assert.Equal(t, uint32(av1SelectScreenContentTools), sh.SeqForceScreenContentTools)
+	assert.True(t, sh.EnableCdef)
+	assert.Equal(t, uint32(8), sh.BitDepth)
+	assert.Equal(t, uint32(1), sh.SubsamplingX)
+	assert.Equal(t, uint32(1), sh.SubsamplingY)
+}
+
+func TestParseAV1FrameHeader(t *testing.T) {
+	sh, err := ParseAV1SequenceHeader(testSequenceHeader())
+	require.NoError(t, err)
+
+	fh, err := ParseAV1FrameHeader(testFrame(true, 0), sh, 0, 0)
+	require.NoError(t, err)
+	assert.True(t, fh.IsKeyFrame())
+	assert.Equal(t, uint32(av1AllFrames), fh.RefreshFrameFlags)
+
+	fh, err = ParseAV1FrameHeader(testFrame(false, 5), sh, 0, 0)
+	require.NoError(t, err)
+	assert.False(t, fh.IsKeyFrame())
+	assert.Equal(t, uint32(5), fh.OrderHint)
+	assert.Equal(t, uint32(0x01), fh.RefreshFrameFlags)
+}
+
+func TestReadLEB128(t *testing.T) {
+	value, n, err := readLEB128([]byte{0xe5, 0x8e, 0x26})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(624485), value)
+	assert.Equal(t, 3, n)
+
+	_, _, err = readLEB128([]byte{0x80})
+	assert.Error(t, err)
+}
+
+func TestAV1IVFMosh(t *testing.T) {
+	data := testIVF(testAV1Frames())
+	header, track, err := ParseIVF(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NotNil(t, track.AV1)
+	assert.Equal(t, uint16(320), track.AV1.Width)
+	assert.Equal(t, uint16(240), track.AV1.Height)
+	assert.Equal(t, uint32(30), track.Timescale)
+	require.Len(t, track.Samples, 4)
+	assert.Len(t, track.OBUs, 10)
+
+	samples := DropKeyFrames(track)
+	assert.Equal(t, []uint32{0, 1, 3}, samples)
+	samples = RepeatInterFrames(track, samples, 2)
+	assert.Equal(t, []uint32{0, 1, 1, 1, 3, 3, 3}, samples)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, WriteIVF(out, bytes.NewReader(data), header, track, samples))
+
+	header, moshed, err := ParseIVF(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), header.FrameCount)
+	require.Len(t, moshed.Samples, 7)
+	assert.Equal(t, []uint32{0}, DropKeyFrames(moshed)[:1])
+	assert.Len(t, DropKeyFrames(moshed), 7)
+}
+
+func TestOBUStream(t *testing.T) {
+	data := bytes.Join(testAV1Frames(), nil)
+	track, err := ParseOBUStream(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Len(t, track.Samples, 4)
+	assert.Equal(t, []uint32{0, 1, 3}, DropKeyFrames(track))
+
+	out := &bytes.Buffer{}
+	require.NoError(t, WriteOBUStream(out, bytes.NewReader(data), track, DropKeyFrames(track)))
+	moshed, err := ParseOBUStream(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	assert.Len(t, moshed.Samples, 3)
+}
+
+func TestOBUNullify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stream.obu")
+	require.NoError(t, os.WriteFile(path, bytes.Join(testAV1Frames(), nil), 0o644))
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	track, err := ParseOBUStream(f)
+	require.NoError(t, err)
+	var keyFrame *OBU
+	for _, obu := range track.OBUs {
+		if obu.Frame != nil && obu.Frame.IsKeyFrame() && obu.SampleID == 2 {
+			keyFrame = obu
+		}
+	}
+	require.NotNil(t, keyFrame)
+	require.NoError(t, keyFrame.Nullify(f))
+
+	track, err = ParseOBUStream(f)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{0, 1, 2, 3}, DropKeyFrames(track))
+}
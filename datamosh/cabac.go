@@ -0,0 +1,1416 @@
+package datamosh
+
+import "errors"
+
+// cabacContext is the state of a context variable.
+type cabacContext struct {
+	state uint8 // pStateIdx
+	mps   uint8 // valMPS
+}
+
+// cabacContexts holds the context variables of a slice indexed by ctxIdx.
+type cabacContexts [460]cabacContext
+
+// init initializes the context variables for the slice.
+// See 9.3.1.1 Initialisation process for context variables
+func (c *cabacContexts) init(h *H264SliceHeader) {
+	model := 0
+	if h.Type() != SLICE_I && h.Type() != SLICE_SI {
+		model = int(h.CabacInitIDC) + 1
+	}
+	qp := clampInt(h.QP(), 0, 51)
+	for i := range c {
+		m, n := int(cabacInitMN[i][model][0]), int(cabacInitMN[i][model][1])
+		pre := clampInt((m*qp)>>4+n, 1, 126)
+		if pre <= 63 {
+			c[i] = cabacContext{state: uint8(63 - pre)}
+		} else {
+			c[i] = cabacContext{state: uint8(pre - 64), mps: 1}
+		}
+	}
+}
+
+// ctxIdxOffset of the syntax elements, the one of the mb_type suffix in P
+// slices for ctxMbTypePIntra.
+// See Table 9-34
+const (
+	ctxMbTypeI         = 3
+	ctxMbSkipP         = 11
+	ctxMbTypeP         = 14
+	ctxMbTypePIntra    = 17
+	ctxSubMbTypeP      = 21
+	ctxMVDX            = 40
+	ctxMVDY            = 47
+	ctxRefIdx          = 54
+	ctxMbQPDelta       = 60
+	ctxChromaPredMode  = 64
+	ctxPrevPredMode    = 68
+	ctxRemPredMode     = 69
+	ctxCBPLuma         = 73
+	ctxCBPChroma       = 77
+	ctxCodedBlockFlag  = 85
+	ctxSignificant     = 105
+	ctxLastSignificant = 166
+	ctxAbsLevel        = 227
+	ctxTransform8x8    = 399
+
+	// of the luma 8x8 blocks of frame macroblocks
+	ctxSignificant8x8     = 402
+	ctxLastSignificant8x8 = 417
+	ctxAbsLevel8x8        = 426
+)
+
+// ctxIdx of the bins of the I macroblock types but the terminating one: the
+// first one, whether the luma is coded, whether the chroma is, whether the
+// chroma AC is and the two bits of the Intra_16x16 prediction mode. The first
+// one is incremented by ctxIdxInc in I slices.
+// See Table 9-39 and 9.3.3.1.2
+var (
+	mbTypeICtxIdx      = [6]int{3, 6, 7, 8, 9, 10}
+	mbTypePIntraCtxIdx = [6]int{17, 18, 19, 19, 20, 20}
+)
+
+// Categories of the residual blocks, ctxBlockCat.
+// See Table 9-42
+const (
+	blockLumaDC = iota
+	blockLumaAC
+	blockLuma4x4
+	blockChromaDC
+	blockChromaAC
+	blockLuma8x8
+)
+
+// ctxBlockCatOffset of coded_block_flag, of significant_coeff_flag and
+// last_significant_coeff_flag, and of coeff_abs_level_minus1 by ctxBlockCat.
+// See Table 9-40
+var (
+	codedBlockFlagCatOffset = [5]int{0, 4, 8, 12, 16}
+	significantCatOffset    = [5]int{0, 15, 29, 44, 47}
+	absLevelCatOffset       = [5]int{0, 10, 20, 30, 39}
+)
+
+// ctxIdxInc of significant_coeff_flag and last_significant_coeff_flag of the
+// luma 8x8 blocks of frame macroblocks, by scanning position.
+// See Table 9-43
+var (
+	significant8x8CtxIdxInc = [63]uint8{
+		0, 1, 2, 3, 4, 5, 5, 4, 4, 3, 3, 4, 4, 4, 5, 5,
+		4, 4, 4, 4, 3, 3, 6, 7, 7, 7, 8, 9, 10, 9, 8, 7,
+		7, 6, 11, 12, 13, 11, 6, 7, 8, 9, 14, 10, 9, 8, 6, 11,
+		12, 13, 11, 6, 9, 14, 10, 9, 11, 12, 13, 11, 14, 10, 12,
+	}
+	lastSignificant8x8CtxIdxInc = [63]uint8{
+		0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+		3, 3, 3, 3, 3, 3, 3, 3, 4, 4, 4, 4, 4, 4, 4, 4,
+		5, 5, 5, 5, 6, 6, 6, 6, 7, 7, 7, 7, 8, 8, 8,
+	}
+)
+
+// significanceCtxIdx returns the ctxIdx of significant_coeff_flag and of
+// last_significant_coeff_flag at the scanning position i of a block of
+// category cat.
+// See 9.3.3.1.3
+func significanceCtxIdx(cat, i int) (sig, last int) {
+	switch cat {
+	case blockLuma8x8:
+		return ctxSignificant8x8 + int(significant8x8CtxIdxInc[i]), ctxLastSignificant8x8 + int(lastSignificant8x8CtxIdxInc[i])
+	case blockChromaDC:
+		i = min(i, 2)
+	}
+	return ctxSignificant + significantCatOffset[cat] + i, ctxLastSignificant + significantCatOffset[cat] + i
+}
+
+// absLevelCtxIdxOffset returns the ctxIdx of the first context variable of
+// coeff_abs_level_minus1 for a block of category cat.
+func absLevelCtxIdxOffset(cat int) int {
+	if cat == blockLuma8x8 {
+		return ctxAbsLevel8x8
+	}
+	return ctxAbsLevel + absLevelCatOffset[cat]
+}
+
+// cbpUnavailable is the coded_block_pattern of the unavailable macroblocks
+// for the contexts of coded_block_pattern: their luma counts as coded and
+// their chroma as not. cbpPCM is the one of I_PCM macroblocks.
+// See 9.3.3.1.1.4
+const (
+	cbpUnavailable = 0x0f
+	cbpPCM         = 0x2f
+)
+
+// cbpLumaCtxIdx returns the ctxIdx of the bin of the 8x8 luma block b8 of
+// coded_block_pattern, cbp holding the bins of the previous blocks, left and
+// top the coded_block_pattern of the neighbouring macroblocks.
+func cbpLumaCtxIdx(cbp, left, top uint8, b8 int) int {
+	a, aIdx := left, b8+1
+	if b8%2 == 1 {
+		a, aIdx = cbp, b8-1
+	}
+	b, bIdx := top, b8+2
+	if b8 >= 2 {
+		b, bIdx = cbp, b8-2
+	}
+	ctxIdx := ctxCBPLuma
+	if a>>aIdx&1 == 0 {
+		ctxIdx++
+	}
+	if b>>bIdx&1 == 0 {
+		ctxIdx += 2
+	}
+	return ctxIdx
+}
+
+// cbpChromaCtxIdx returns the ctxIdx of the chroma bin binIdx of
+// coded_block_pattern.
+func cbpChromaCtxIdx(left, top uint8, binIdx int) int {
+	ctxIdx := ctxCBPChroma + 4*binIdx
+	for i, cbp := range [2]uint8{left, top} {
+		chroma := cbp >> 4
+		if (binIdx == 0 && chroma != 0) || chroma == 2 {
+			ctxIdx += i + 1
+		}
+	}
+	return ctxIdx
+}
+
+// absMVDCompCtxIdxInc returns ctxIdxInc of the first bin of mvd_l0 given the
+// sum of the absolute values of the neighbouring motion vector differences.
+// See 9.3.3.1.1.7
+func absMVDCompCtxIdxInc(sum int32) int {
+	switch {
+	case sum < 3:
+		return 0
+	case sum <= 32:
+		return 1
+	}
+	return 2
+}
+
+// cabacBin is a decoded bin with its ctxIdx, negative for the bins decoded
+// without context variable and the syntax elements coded again from their
+// values.
+type cabacBin struct {
+	ctxIdx int16
+	val    int32
+}
+
+// ctxIdx of the bins without context variable, val is the index of the
+// motion vector difference in the slice times 2 plus the component for
+// cabacMVD, and the index of the residual block in the slice for
+// cabacResidual.
+const (
+	cabacBypass = -1 - iota
+	cabacTerminate
+	cabacMVD
+	cabacPCM
+	cabacResidual
+)
+
+var errCABACSuffix = errors.New("invalid CABAC Exp-Golomb suffix")
+
+// cabacDecoder is the CABAC arithmetic decoding engine and the parsing of the
+// syntax elements. The ctxIdxInc of the bins depending on the neighbouring
+// macroblocks are derived by the slice decoder.
+// See 9.3.1.2 and 9.3.3.2 Arithmetic decoding process
+type cabacDecoder struct {
+	r      *rbspReader
+	ctx    cabacContexts
+	rng    uint32 // codIRange
+	offset uint32 // codIOffset
+
+	// record appends the decoded bins to bins, for them to be encoded again
+	record bool
+	bins   []cabacBin
+}
+
+// newCABACDecoder skips the cabac_alignment_one_bits of the slice data read by
+// r and initializes the context variables and the decoding engine.
+func newCABACDecoder(r *rbspReader, h *H264SliceHeader) *cabacDecoder {
+	for !r.byteAligned() && r.err == nil {
+		r.u(1)
+	}
+	d := &cabacDecoder{r: r}
+	d.ctx.init(h)
+	d.initEngine()
+	return d
+}
+
+// initEngine initializes the decoding engine, at the start of the slice data
+// and after the samples of I_PCM macroblocks.
+func (d *cabacDecoder) initEngine() {
+	d.rng = 510
+	d.offset = d.r.u(9)
+	if d.offset >= 510 {
+		d.r.fail(errors.New("invalid CABAC codIOffset"))
+	}
+}
+
+func (d *cabacDecoder) renorm() {
+	for d.rng < 256 {
+		d.rng <<= 1
+		d.offset = d.offset<<1 | d.r.u(1)
+	}
+}
+
+// decision decodes a bin with the context variable ctxIdx.
+// See 9.3.3.2.1 Arithmetic decoding process for a binary decision
+func (d *cabacDecoder) decision(ctxIdx int) uint32 {
+	c := &d.ctx[ctxIdx]
+	lps := uint32(rangeTabLPS[c.state][d.rng>>6&3])
+	d.rng -= lps
+	bin := uint32(c.mps)
+	if d.offset >= d.rng {
+		bin ^= 1
+		d.offset -= d.rng
+		d.rng = lps
+		if c.state == 0 {
+			c.mps ^= 1
+		}
+		c.state = transIdxLPS[c.state]
+	} else if c.state < 62 {
+		c.state++
+	}
+	d.renorm()
+	if d.record {
+		d.bins = append(d.bins, cabacBin{ctxIdx: int16(ctxIdx), val: int32(bin)})
+	}
+	return bin
+}
+
+// bypass decodes a bin with equiprobable values.
+// See 9.3.3.2.3 Bypass decoding process for binary decisions
+func (d *cabacDecoder) bypass() uint32 {
+	d.offset = d.offset<<1 | d.r.u(1)
+	var bin uint32
+	if d.offset >= d.rng {
+		bin = 1
+		d.offset -= d.rng
+	}
+	if d.record {
+		d.bins = append(d.bins, cabacBin{ctxIdx: cabacBypass, val: int32(bin)})
+	}
+	return bin
+}
+
+// terminate decodes end_of_slice_flag or the bin of mb_type telling I_PCM
+// macroblocks, the decoding engine reads no more bits once it returns 1.
+// See 9.3.3.2.2.3 Decoding process for binary decisions before termination
+func (d *cabacDecoder) terminate() uint32 {
+	d.rng -= 2
+	bin := uint32(1)
+	if d.offset < d.rng {
+		bin = 0
+		d.renorm()
+	}
+	if d.record {
+		d.bins = append(d.bins, cabacBin{ctxIdx: cabacTerminate, val: int32(bin)})
+	}
+	return bin
+}
+
+// expGolomb decodes the k-th order Exp-Golomb suffix of the UEGk
+// binarizations.
+// See 9.3.2.3 Concatenated unary/ k-th order Exp-Golomb (UEGk) binarization process
+func (d *cabacDecoder) expGolomb(k int) int32 {
+	var v int32
+	for d.bypass() == 1 {
+		v += 1 << k
+		if k++; k > 24 {
+			d.r.fail(errCABACSuffix)
+			return 0
+		}
+	}
+	for k--; k >= 0; k-- {
+		v += int32(d.bypass()) << k
+	}
+	return v
+}
+
+// mbTypeI decodes the mb_type of an I macroblock, in the I slice numbering.
+// ctxIdx lists the contexts of its bins, see mbTypeICtxIdx.
+// See 9.3.2.5 Binarization process for macroblock type and sub-macroblock type
+func (d *cabacDecoder) mbTypeI(ctxIdx *[6]int, ctxIdxInc int) uint32 {
+	if d.decision(ctxIdx[0]+ctxIdxInc) == 0 {
+		return 0 // I_NxN
+	}
+	if d.terminate() == 1 {
+		return 25 // I_PCM
+	}
+	mbType := 1 + 12*d.decision(ctxIdx[1])
+	if d.decision(ctxIdx[2]) == 1 {
+		mbType += 4 + 4*d.decision(ctxIdx[3])
+	}
+	mbType += 2 * d.decision(ctxIdx[4])
+	return mbType + d.decision(ctxIdx[5])
+}
+
+// mbTypeP decodes the mb_type of a P macroblock, in the P slice numbering.
+func (d *cabacDecoder) mbTypeP() uint32 {
+	if d.decision(ctxMbTypeP) == 1 {
+		return 5 + d.mbTypeI(&mbTypePIntraCtxIdx, 0)
+	}
+	if d.decision(ctxMbTypeP+1) == 0 {
+		return 3 * d.decision(ctxMbTypeP+2) // P_L0_16x16 or P_8x8
+	}
+	return 2 - d.decision(ctxMbTypeP+3) // P_L0_L0_8x16 or P_L0_L0_16x8
+}
+
+// subMbTypeP decodes the sub_mb_type of a P macroblock.
+func (d *cabacDecoder) subMbTypeP() uint32 {
+	if d.decision(ctxSubMbTypeP) == 1 {
+		return 0 // P_L0_8x8
+	}
+	if d.decision(ctxSubMbTypeP+1) == 0 {
+		return 1 // P_L0_8x4
+	}
+	return 3 - d.decision(ctxSubMbTypeP+2) // P_L0_4x8 or P_L0_4x4
+}
+
+// refIdx decodes ref_idx_l0, up to 32 for corrupted slices.
+func (d *cabacDecoder) refIdx(ctxIdxInc int) uint32 {
+	if d.decision(ctxRefIdx+ctxIdxInc) == 0 {
+		return 0
+	}
+	v := uint32(1)
+	for ctxIdx := ctxRefIdx + 4; v < 32 && d.decision(ctxIdx) == 1; ctxIdx = ctxRefIdx + 5 {
+		v++
+	}
+	return v
+}
+
+// mvd decodes a component of mvd_l0, ctxIdxOffset is ctxMVDX or ctxMVDY.
+func (d *cabacDecoder) mvd(ctxIdxOffset, ctxIdxInc int) int32 {
+	var abs int32
+	for ctxIdx := ctxIdxOffset + ctxIdxInc; abs < 9 && d.decision(ctxIdx) == 1; {
+		abs++
+		ctxIdx = ctxIdxOffset + min(int(abs)+2, 6)
+	}
+	if abs == 9 {
+		abs += d.expGolomb(3)
+	}
+	if abs != 0 && d.bypass() == 1 {
+		return -abs
+	}
+	return abs
+}
+
+// cbp decodes coded_block_pattern given the ones of the neighbouring
+// macroblocks, cbpUnavailable when they aren't available.
+func (d *cabacDecoder) cbp(left, top uint8) uint8 {
+	var cbp uint8
+	for b8 := 0; b8 < 4; b8++ {
+		cbp |= uint8(d.decision(cbpLumaCtxIdx(cbp, left, top, b8))) << b8
+	}
+	if d.decision(cbpChromaCtxIdx(left, top, 0)) == 1 {
+		cbp |= uint8(1+d.decision(cbpChromaCtxIdx(left, top, 1))) << 4
+	}
+	return cbp
+}
+
+// mbQPDelta decodes mb_qp_delta, ctxIdxInc is 1 when the previous macroblock
+// has a non zero one. It returns an out of range value for corrupted slices.
+func (d *cabacDecoder) mbQPDelta(ctxIdxInc int) int32 {
+	var k int32
+	for ctxIdx := ctxMbQPDelta + ctxIdxInc; k < 53 && d.decision(ctxIdx) == 1; {
+		k++
+		ctxIdx = ctxMbQPDelta + min(int(k)+1, 3)
+	}
+	// Table 9-3
+	if k%2 == 1 {
+		return (k + 1) / 2
+	}
+	return -k / 2
+}
+
+// intraChromaPredMode decodes intra_chroma_pred_mode.
+func (d *cabacDecoder) intraChromaPredMode(ctxIdxInc int) uint32 {
+	mode := uint32(0)
+	for ctxIdx := ctxChromaPredMode + ctxIdxInc; mode < 3 && d.decision(ctxIdx) == 1; ctxIdx = ctxChromaPredMode + 3 {
+		mode++
+	}
+	return mode
+}
+
+// intra4x4PredMode decodes prev_intra4x4_pred_mode_flag and
+// rem_intra4x4_pred_mode.
+func (d *cabacDecoder) intra4x4PredMode() (prev bool, rem uint32) {
+	if d.decision(ctxPrevPredMode) == 1 {
+		return true, 0
+	}
+	for i := 0; i < 3; i++ {
+		rem |= d.decision(ctxRemPredMode) << i
+	}
+	return false, rem
+}
+
+// residualBlock decodes the coefficients of a block of category cat, in
+// scanning order, maxNumCoeff being the length of coeffLevel, and returns
+// the number of non-zero ones. ctxIdxInc is the one of coded_block_flag,
+// which the luma 8x8 blocks of 4:2:0 pictures don't have.
+// See 7.3.5.3.3 Residual block CABAC syntax
+func (d *cabacDecoder) residualBlock(coeffLevel []int32, cat int, ctxIdxInc int) int {
+	for i := range coeffLevel {
+		coeffLevel[i] = 0
+	}
+	if cat != blockLuma8x8 && d.decision(ctxCodedBlockFlag+codedBlockFlagCatOffset[cat]+ctxIdxInc) == 0 {
+		return 0
+	}
+
+	// significance map
+	var significant [64]bool
+	numCoeff := len(coeffLevel)
+	for i := 0; i < numCoeff-1; i++ {
+		sig, last := significanceCtxIdx(cat, i)
+		if d.decision(sig) == 1 {
+			significant[i] = true
+			if d.decision(last) == 1 {
+				numCoeff = i + 1
+			}
+		}
+	}
+	significant[numCoeff-1] = true
+
+	// levels in reverse scanning order
+	n, numGt1, numEq1 := 0, 0, 0
+	abs := absLevelCtxIdxOffset(cat)
+	for i := numCoeff - 1; i >= 0; i-- {
+		if !significant[i] {
+			continue
+		}
+		ctxIdx := abs
+		if numGt1 == 0 {
+			ctxIdx += min(4, 1+numEq1)
+		}
+		// coeff_abs_level_minus1, UEG0 with a prefix of up to 14 bins
+		var level int32
+		if d.decision(ctxIdx) == 1 {
+			level = 1
+			ctxIdx = abs + 5 + min(4-boolInt(cat == blockChromaDC), numGt1)
+			for level < 14 && d.decision(ctxIdx) == 1 {
+				level++
+			}
+			if level == 14 {
+				level += d.expGolomb(0)
+			}
+		}
+		if level == 0 {
+			numEq1++
+		} else {
+			numGt1++
+		}
+		level++
+		if d.bypass() == 1 { // coeff_sign_flag
+			level = -level
+		}
+		coeffLevel[i] = level
+		n++
+	}
+	return n
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// cabacEncoder is the CABAC arithmetic encoding engine and the binarization
+// of the syntax elements, mirroring cabacDecoder.
+// See 9.3.4 Arithmetic encoding process
+type cabacEncoder struct {
+	w           *rbspWriter
+	ctx         cabacContexts
+	low         uint32 // codILow
+	rng         uint32 // codIRange
+	outstanding int    // bitsOutstanding
+	firstBit    bool   // firstBitFlag
+}
+
+// newCABACEncoder writes the cabac_alignment_one_bits of the slice data and
+// initializes the context variables and the encoding engine.
+func newCABACEncoder(w *rbspWriter, h *H264SliceHeader) *cabacEncoder {
+	for !w.byteAligned() && w.err == nil {
+		w.u(1, 1)
+	}
+	e := &cabacEncoder{w: w}
+	e.ctx.init(h)
+	e.initEngine()
+	return e
+}
+
+// initEngine initializes the encoding engine, at the start of the slice data
+// and after the samples of I_PCM macroblocks.
+func (e *cabacEncoder) initEngine() {
+	e.low, e.rng, e.outstanding, e.firstBit = 0, 510, 0, true
+}
+
+// renorm renormalizes the encoding engine.
+// See 9.3.4.3 Renormalization process in the arithmetic encoding engine
+func (e *cabacEncoder) renorm() {
+	for e.rng < 256 {
+		switch {
+		case e.low < 256:
+			e.putBit(0)
+		case e.low >= 512:
+			e.low -= 512
+			e.putBit(1)
+		default:
+			e.low -= 256
+			e.outstanding++
+		}
+		e.rng <<= 1
+		e.low <<= 1
+	}
+}
+
+func (e *cabacEncoder) putBit(b uint32) {
+	if e.firstBit {
+		e.firstBit = false
+	} else {
+		e.w.u(1, b)
+	}
+	for ; e.outstanding > 0; e.outstanding-- {
+		e.w.u(1, 1-b)
+	}
+}
+
+// decision encodes a bin with the context variable ctxIdx.
+// See 9.3.4.2 Encoding process for a binary decision
+func (e *cabacEncoder) decision(ctxIdx int, bin uint32) {
+	c := &e.ctx[ctxIdx]
+	lps := uint32(rangeTabLPS[c.state][e.rng>>6&3])
+	e.rng -= lps
+	if bin != uint32(c.mps) {
+		e.low += e.rng
+		e.rng = lps
+		if c.state == 0 {
+			c.mps ^= 1
+		}
+		c.state = transIdxLPS[c.state]
+	} else if c.state < 62 {
+		c.state++
+	}
+	e.renorm()
+}
+
+// bypass encodes a bin with equiprobable values.
+// See 9.3.4.4 Bypass encoding process for binary decisions
+func (e *cabacEncoder) bypass(bin uint32) {
+	e.low <<= 1
+	if bin != 0 {
+		e.low += e.rng
+	}
+	switch {
+	case e.low >= 1024:
+		e.putBit(1)
+		e.low -= 1024
+	case e.low < 512:
+		e.putBit(0)
+	default:
+		e.low -= 512
+		e.outstanding++
+	}
+}
+
+// terminate encodes end_of_slice_flag or the bin of mb_type telling I_PCM
+// macroblocks. The engine is flushed when bin is 1, the last bit it writes
+// is the rbsp_stop_one_bit at the end of the slice.
+// See 9.3.4.5 Encoding process for a binary decision before termination
+func (e *cabacEncoder) terminate(bin uint32) {
+	e.rng -= 2
+	if bin == 0 {
+		e.renorm()
+		return
+	}
+	e.low += e.rng
+	e.rng = 2
+	e.renorm()
+	e.putBit(e.low >> 9 & 1)
+	e.w.u(2, e.low>>7&3|1)
+}
+
+// pcm writes the pcm_alignment_zero_bits and the samples of an I_PCM
+// macroblock following its mb_type, and initializes the encoding engine.
+func (e *cabacEncoder) pcm(samples []byte) {
+	for !e.w.byteAligned() && e.w.err == nil {
+		e.w.u(1, 0)
+	}
+	for _, sample := range samples {
+		e.w.u(8, uint32(sample))
+	}
+	e.initEngine()
+}
+
+// expGolomb encodes the k-th order Exp-Golomb suffix of the UEGk
+// binarizations.
+func (e *cabacEncoder) expGolomb(k int, v int32) {
+	for v >= 1<<k {
+		e.bypass(1)
+		v -= 1 << k
+		k++
+	}
+	e.bypass(0)
+	for k--; k >= 0; k-- {
+		e.bypass(uint32(v>>k) & 1)
+	}
+}
+
+// mbTypeI encodes the mb_type of an I macroblock, in the I slice numbering.
+func (e *cabacEncoder) mbTypeI(ctxIdx *[6]int, ctxIdxInc int, mbType uint32) {
+	if mbType == 0 {
+		e.decision(ctxIdx[0]+ctxIdxInc, 0)
+		return
+	}
+	e.decision(ctxIdx[0]+ctxIdxInc, 1)
+	if mbType == 25 {
+		e.terminate(1)
+		return
+	}
+	e.terminate(0)
+	t := mbType - 1
+	e.decision(ctxIdx[1], uint32(boolInt(t >= 12)))
+	chroma := t / 4 % 3
+	e.decision(ctxIdx[2], uint32(boolInt(chroma != 0)))
+	if chroma != 0 {
+		e.decision(ctxIdx[3], chroma-1)
+	}
+	e.decision(ctxIdx[4], t>>1&1)
+	e.decision(ctxIdx[5], t&1)
+}
+
+// mbTypeP encodes the mb_type of a P macroblock, in the P slice numbering.
+// P_8x8ref0 can't be coded with CABAC.
+func (e *cabacEncoder) mbTypeP(mbType uint32) {
+	switch mbType {
+	case 0, 3:
+		e.decision(ctxMbTypeP, 0)
+		e.decision(ctxMbTypeP+1, 0)
+		e.decision(ctxMbTypeP+2, mbType/3)
+	case 1, 2:
+		e.decision(ctxMbTypeP, 0)
+		e.decision(ctxMbTypeP+1, 1)
+		e.decision(ctxMbTypeP+3, 2-mbType)
+	default:
+		e.decision(ctxMbTypeP, 1)
+		e.mbTypeI(&mbTypePIntraCtxIdx, 0, mbType-5)
+	}
+}
+
+// subMbTypeP encodes the sub_mb_type of a P macroblock.
+func (e *cabacEncoder) subMbTypeP(subMbType uint32) {
+	e.decision(ctxSubMbTypeP, uint32(boolInt(subMbType == 0)))
+	if subMbType != 0 {
+		e.decision(ctxSubMbTypeP+1, uint32(boolInt(subMbType != 1)))
+	}
+	if subMbType >= 2 {
+		e.decision(ctxSubMbTypeP+2, 3-subMbType)
+	}
+}
+
+// refIdx encodes ref_idx_l0.
+func (e *cabacEncoder) refIdx(ctxIdxInc int, v uint32) {
+	ctxIdx := ctxRefIdx + ctxIdxInc
+	for i := uint32(0); i < v; i++ {
+		e.decision(ctxIdx, 1)
+		ctxIdx = ctxRefIdx + 4 + boolInt(i > 0)
+	}
+	e.decision(ctxIdx, 0)
+}
+
+// mvd encodes a component of mvd_l0, ctxIdxOffset is ctxMVDX or ctxMVDY.
+func (e *cabacEncoder) mvd(ctxIdxOffset, ctxIdxInc int, v int32) {
+	abs := v
+	if v < 0 {
+		abs = -v
+	}
+	ctxIdx := ctxIdxOffset + ctxIdxInc
+	prefix := min(abs, 9)
+	for i := int32(1); i <= prefix; i++ {
+		e.decision(ctxIdx, 1)
+		ctxIdx = ctxIdxOffset + min(int(i)+2, 6)
+	}
+	if prefix < 9 {
+		e.decision(ctxIdx, 0)
+	} else {
+		e.expGolomb(3, abs-9)
+	}
+	if abs != 0 {
+		e.bypass(uint32(boolInt(v < 0)))
+	}
+}
+
+// cbp encodes coded_block_pattern given the ones of the neighbouring
+// macroblocks, cbpUnavailable when they aren't available.
+func (e *cabacEncoder) cbp(left, top, cbp uint8) {
+	for b8 := 0; b8 < 4; b8++ {
+		e.decision(cbpLumaCtxIdx(cbp&(1<<b8-1), left, top, b8), uint32(cbp>>b8&1))
+	}
+	chroma := uint32(cbp >> 4)
+	e.decision(cbpChromaCtxIdx(left, top, 0), uint32(boolInt(chroma != 0)))
+	if chroma != 0 {
+		e.decision(cbpChromaCtxIdx(left, top, 1), chroma-1)
+	}
+}
+
+// mbQPDelta encodes mb_qp_delta, ctxIdxInc is 1 when the previous macroblock
+// has a non zero one.
+func (e *cabacEncoder) mbQPDelta(ctxIdxInc int, delta int32) {
+	k := -2 * delta
+	if delta > 0 {
+		k = 2*delta - 1
+	}
+	ctxIdx := ctxMbQPDelta + ctxIdxInc
+	for i := int32(1); i <= k; i++ {
+		e.decision(ctxIdx, 1)
+		ctxIdx = ctxMbQPDelta + min(int(i)+1, 3)
+	}
+	e.decision(ctxIdx, 0)
+}
+
+// intraChromaPredMode encodes intra_chroma_pred_mode.
+func (e *cabacEncoder) intraChromaPredMode(ctxIdxInc int, mode uint32) {
+	ctxIdx := ctxChromaPredMode + ctxIdxInc
+	for i := uint32(0); i < mode; i++ {
+		e.decision(ctxIdx, 1)
+		ctxIdx = ctxChromaPredMode + 3
+	}
+	if mode < 3 {
+		e.decision(ctxIdx, 0)
+	}
+}
+
+// intra4x4PredMode encodes prev_intra4x4_pred_mode_flag and
+// rem_intra4x4_pred_mode.
+func (e *cabacEncoder) intra4x4PredMode(prev bool, rem uint32) {
+	e.decision(ctxPrevPredMode, uint32(boolInt(prev)))
+	if prev {
+		return
+	}
+	for i := 0; i < 3; i++ {
+		e.decision(ctxRemPredMode, rem>>i&1)
+	}
+}
+
+// residualBlock encodes the coefficients of a block of category cat, in
+// scanning order, and returns the number of non-zero ones. ctxIdxInc is the
+// one of coded_block_flag. The luma 8x8 blocks, without coded_block_flag,
+// must have a non-zero coefficient.
+func (e *cabacEncoder) residualBlock(coeffLevel []int32, cat int, ctxIdxInc int) int {
+	numCoeff := 0
+	for i, level := range coeffLevel {
+		if level != 0 {
+			numCoeff = i + 1
+		}
+	}
+	if cat != blockLuma8x8 {
+		e.decision(ctxCodedBlockFlag+codedBlockFlagCatOffset[cat]+ctxIdxInc, uint32(boolInt(numCoeff > 0)))
+	}
+	if numCoeff == 0 {
+		return 0
+	}
+
+	for i := 0; i < numCoeff && i < len(coeffLevel)-1; i++ {
+		sig, last := significanceCtxIdx(cat, i)
+		e.decision(sig, uint32(boolInt(coeffLevel[i] != 0)))
+		if coeffLevel[i] != 0 {
+			e.decision(last, uint32(boolInt(i == numCoeff-1)))
+		}
+	}
+
+	n, numGt1, numEq1 := 0, 0, 0
+	abs := absLevelCtxIdxOffset(cat)
+	for i := numCoeff - 1; i >= 0; i-- {
+		level := coeffLevel[i]
+		if level == 0 {
+			continue
+		}
+		absLevel := abs32(level) - 1
+		ctxIdx := abs
+		if numGt1 == 0 {
+			ctxIdx += min(4, 1+numEq1)
+		}
+		prefix := min(absLevel, 14)
+		for j := int32(1); j <= prefix; j++ {
+			e.decision(ctxIdx, 1)
+			ctxIdx = abs + 5 + min(4-boolInt(cat == blockChromaDC), numGt1)
+		}
+		if prefix < 14 {
+			e.decision(ctxIdx, 0)
+		} else {
+			e.expGolomb(0, absLevel-14)
+		}
+		if absLevel == 0 {
+			numEq1++
+		} else {
+			numGt1++
+		}
+		e.bypass(uint32(boolInt(level < 0)))
+		n++
+	}
+	return n
+}
+
+// rangeTabLPS indexed by pStateIdx and qCodIRangeIdx.
+// See Table 9-44
+var rangeTabLPS = [64][4]uint8{
+	{128, 176, 208, 240},
+	{128, 167, 197, 227},
+	{128, 158, 187, 216},
+	{123, 150, 178, 205},
+	{116, 142, 169, 195},
+	{111, 135, 160, 185},
+	{105, 128, 152, 175},
+	{100, 122, 144, 166},
+	{95, 116, 137, 158},
+	{90, 110, 130, 150},
+	{85, 104, 123, 142},
+	{81, 99, 117, 135},
+	{77, 94, 111, 128},
+	{73, 89, 105, 122},
+	{69, 85, 100, 116},
+	{66, 80, 95, 110},
+	{62, 76, 90, 104},
+	{59, 72, 86, 99},
+	{56, 69, 81, 94},
+	{53, 65, 77, 89},
+	{51, 62, 73, 85},
+	{48, 59, 69, 80},
+	{46, 56, 66, 76},
+	{43, 53, 63, 72},
+	{41, 50, 59, 69},
+	{39, 48, 56, 65},
+	{37, 45, 54, 62},
+	{35, 43, 51, 59},
+	{33, 41, 48, 56},
+	{32, 39, 46, 53},
+	{30, 37, 43, 50},
+	{29, 35, 41, 48},
+	{27, 33, 39, 45},
+	{26, 31, 37, 43},
+	{24, 30, 35, 41},
+	{23, 28, 33, 39},
+	{22, 27, 32, 37},
+	{21, 26, 30, 35},
+	{20, 24, 29, 33},
+	{19, 23, 27, 31},
+	{18, 22, 26, 30},
+	{17, 21, 25, 28},
+	{16, 20, 23, 27},
+	{15, 19, 22, 25},
+	{14, 18, 21, 24},
+	{14, 17, 20, 23},
+	{13, 16, 19, 22},
+	{12, 15, 18, 21},
+	{12, 14, 17, 20},
+	{11, 14, 16, 19},
+	{11, 13, 15, 18},
+	{10, 12, 15, 17},
+	{10, 12, 14, 16},
+	{9, 11, 13, 15},
+	{9, 11, 12, 14},
+	{8, 10, 12, 14},
+	{8, 9, 11, 13},
+	{7, 9, 11, 12},
+	{7, 9, 10, 12},
+	{7, 8, 10, 11},
+	{6, 8, 9, 11},
+	{6, 7, 9, 10},
+	{6, 7, 8, 9},
+	{2, 2, 2, 2},
+}
+
+// transIdxLPS, the state transition after decoding the least probable
+// symbol, transIdxMPS being pStateIdx+1 up to 62.
+// See Table 9-45
+var transIdxLPS = [64]uint8{
+	0, 0, 1, 2, 2, 4, 4, 5, 6, 7, 8, 9, 9, 11, 11, 12,
+	13, 13, 15, 15, 16, 16, 18, 18, 19, 19, 21, 21, 22, 22, 23, 24,
+	24, 25, 26, 26, 27, 27, 28, 29, 29, 30, 30, 30, 31, 32, 32, 33,
+	33, 33, 34, 34, 35, 35, 35, 36, 36, 36, 37, 37, 37, 38, 38, 63,
+}
+
+// cabacInitMN holds the values of m and n initializing the context variables
+// indexed by ctxIdx, for I slices then for cabac_init_idc 0 to 2.
+// See Tables 9-12 to 9-33
+var cabacInitMN = [460][4][2]int8{
+	// mb_type of SI and I slices
+	{{20, -15}, {20, -15}, {20, -15}, {20, -15}},
+	{{2, 54}, {2, 54}, {2, 54}, {2, 54}},
+	{{3, 74}, {3, 74}, {3, 74}, {3, 74}},
+	{{20, -15}, {20, -15}, {20, -15}, {20, -15}},
+	{{2, 54}, {2, 54}, {2, 54}, {2, 54}},
+	{{3, 74}, {3, 74}, {3, 74}, {3, 74}},
+	{{-28, 127}, {-28, 127}, {-28, 127}, {-28, 127}},
+	{{-23, 104}, {-23, 104}, {-23, 104}, {-23, 104}},
+	{{-6, 53}, {-6, 53}, {-6, 53}, {-6, 53}},
+	{{-1, 54}, {-1, 54}, {-1, 54}, {-1, 54}},
+	{{7, 51}, {7, 51}, {7, 51}, {7, 51}},
+	// mb_skip_flag, mb_type and sub_mb_type of P slices
+	{{0, 0}, {23, 33}, {22, 25}, {29, 16}},
+	{{0, 0}, {23, 2}, {34, 0}, {25, 0}},
+	{{0, 0}, {21, 0}, {16, 0}, {14, 0}},
+	{{0, 0}, {1, 9}, {-2, 9}, {-10, 51}},
+	{{0, 0}, {0, 49}, {4, 41}, {-3, 62}},
+	{{0, 0}, {-37, 118}, {-29, 118}, {-27, 99}},
+	{{0, 0}, {5, 57}, {2, 65}, {26, 16}},
+	{{0, 0}, {-13, 78}, {-6, 71}, {-4, 85}},
+	{{0, 0}, {-11, 65}, {-13, 79}, {-24, 102}},
+	{{0, 0}, {1, 62}, {5, 52}, {5, 57}},
+	{{0, 0}, {12, 49}, {9, 50}, {6, 57}},
+	{{0, 0}, {-4, 73}, {-3, 70}, {-17, 73}},
+	{{0, 0}, {17, 50}, {10, 54}, {14, 57}},
+	// mb_skip_flag, mb_type and sub_mb_type of B slices
+	{{0, 0}, {18, 64}, {26, 34}, {20, 40}},
+	{{0, 0}, {9, 43}, {19, 22}, {20, 10}},
+	{{0, 0}, {29, 0}, {40, 0}, {29, 0}},
+	{{0, 0}, {26, 67}, {57, 2}, {54, 0}},
+	{{0, 0}, {16, 90}, {41, 36}, {37, 42}},
+	{{0, 0}, {9, 104}, {26, 69}, {12, 97}},
+	{{0, 0}, {-46, 127}, {-45, 127}, {-32, 127}},
+	{{0, 0}, {-20, 104}, {-15, 101}, {-22, 117}},
+	{{0, 0}, {1, 67}, {-4, 76}, {-2, 74}},
+	{{0, 0}, {-13, 78}, {-6, 71}, {-4, 85}},
+	{{0, 0}, {-11, 65}, {-13, 79}, {-24, 102}},
+	{{0, 0}, {1, 62}, {5, 52}, {5, 57}},
+	{{0, 0}, {-6, 86}, {6, 69}, {-6, 93}},
+	{{0, 0}, {-17, 95}, {-13, 90}, {-14, 88}},
+	{{0, 0}, {-6, 61}, {0, 52}, {-6, 44}},
+	{{0, 0}, {9, 45}, {8, 43}, {4, 55}},
+	// mvd_l0 and mvd_l1
+	{{0, 0}, {-3, 69}, {-2, 69}, {-11, 89}},
+	{{0, 0}, {-6, 81}, {-5, 82}, {-15, 103}},
+	{{0, 0}, {-11, 96}, {-10, 96}, {-21, 116}},
+	{{0, 0}, {6, 55}, {2, 59}, {19, 57}},
+	{{0, 0}, {7, 67}, {2, 75}, {20, 58}},
+	{{0, 0}, {-5, 86}, {-3, 87}, {4, 84}},
+	{{0, 0}, {2, 88}, {-3, 100}, {6, 96}},
+	{{0, 0}, {0, 58}, {1, 56}, {1, 63}},
+	{{0, 0}, {-3, 76}, {-3, 74}, {-5, 85}},
+	{{0, 0}, {-10, 94}, {-6, 85}, {-13, 106}},
+	{{0, 0}, {5, 54}, {0, 59}, {5, 63}},
+	{{0, 0}, {4, 69}, {-3, 81}, {6, 75}},
+	{{0, 0}, {-3, 81}, {-7, 86}, {-3, 90}},
+	{{0, 0}, {0, 88}, {-5, 95}, {-1, 101}},
+	// ref_idx_l0 and ref_idx_l1
+	{{0, 0}, {-7, 67}, {-1, 66}, {3, 55}},
+	{{0, 0}, {-5, 74}, {-1, 77}, {-4, 79}},
+	{{0, 0}, {-4, 74}, {1, 70}, {-2, 75}},
+	{{0, 0}, {-5, 80}, {-2, 86}, {-12, 97}},
+	{{0, 0}, {-7, 72}, {-5, 72}, {-7, 50}},
+	{{0, 0}, {1, 58}, {0, 61}, {1, 60}},
+	// mb_qp_delta
+	{{0, 41}, {0, 41}, {0, 41}, {0, 41}},
+	{{0, 63}, {0, 63}, {0, 63}, {0, 63}},
+	{{0, 63}, {0, 63}, {0, 63}, {0, 63}},
+	{{0, 63}, {0, 63}, {0, 63}, {0, 63}},
+	// intra_chroma_pred_mode
+	{{-9, 83}, {-9, 83}, {-9, 83}, {-9, 83}},
+	{{4, 86}, {4, 86}, {4, 86}, {4, 86}},
+	{{0, 97}, {0, 97}, {0, 97}, {0, 97}},
+	{{-7, 72}, {-7, 72}, {-7, 72}, {-7, 72}},
+	// prev_intra4x4_pred_mode_flag and rem_intra4x4_pred_mode
+	{{13, 41}, {13, 41}, {13, 41}, {13, 41}},
+	{{3, 62}, {3, 62}, {3, 62}, {3, 62}},
+	// mb_field_decoding_flag
+	{{0, 11}, {0, 45}, {13, 15}, {7, 34}},
+	{{1, 55}, {-4, 78}, {7, 51}, {-9, 88}},
+	{{0, 69}, {-3, 96}, {2, 80}, {-20, 127}},
+	// coded_block_pattern
+	{{-17, 127}, {-27, 126}, {-39, 127}, {-36, 127}},
+	{{-13, 102}, {-28, 98}, {-18, 91}, {-17, 91}},
+	{{0, 82}, {-25, 101}, {-17, 96}, {-14, 95}},
+	{{-7, 74}, {-23, 67}, {-26, 81}, {-25, 84}},
+	{{-21, 107}, {-28, 82}, {-35, 98}, {-25, 86}},
+	{{-27, 127}, {-20, 94}, {-24, 102}, {-12, 89}},
+	{{-31, 127}, {-16, 83}, {-23, 97}, {-17, 91}},
+	{{-24, 127}, {-22, 110}, {-27, 119}, {-31, 127}},
+	{{-18, 95}, {-21, 91}, {-24, 99}, {-14, 76}},
+	{{-27, 127}, {-18, 102}, {-21, 110}, {-18, 103}},
+	{{-21, 114}, {-13, 93}, {-18, 102}, {-13, 90}},
+	{{-30, 127}, {-29, 127}, {-36, 127}, {-37, 127}},
+	// coded_block_flag
+	{{-17, 123}, {-7, 92}, {0, 80}, {11, 80}},
+	{{-12, 115}, {-5, 89}, {-5, 89}, {5, 76}},
+	{{-16, 122}, {-7, 96}, {-7, 94}, {2, 84}},
+	{{-11, 115}, {-13, 108}, {-4, 92}, {5, 78}},
+	{{-12, 63}, {-3, 46}, {0, 39}, {-6, 55}},
+	{{-2, 68}, {-1, 65}, {0, 65}, {4, 61}},
+	{{-15, 84}, {-1, 57}, {-15, 84}, {-14, 83}},
+	{{-13, 104}, {-9, 93}, {-35, 127}, {-37, 127}},
+	{{-3, 70}, {-3, 74}, {-2, 73}, {-5, 79}},
+	{{-8, 93}, {-9, 92}, {-12, 104}, {-11, 104}},
+	{{-10, 90}, {-8, 87}, {-9, 91}, {-11, 91}},
+	{{-30, 127}, {-23, 126}, {-31, 127}, {-30, 127}},
+	{{-1, 74}, {5, 54}, {3, 55}, {0, 65}},
+	{{-6, 97}, {6, 60}, {7, 56}, {-2, 79}},
+	{{-7, 91}, {6, 59}, {7, 55}, {0, 72}},
+	{{-20, 127}, {6, 69}, {8, 61}, {-4, 92}},
+	{{-4, 56}, {-1, 48}, {-3, 53}, {-6, 56}},
+	{{-5, 82}, {0, 68}, {0, 68}, {3, 68}},
+	{{-7, 76}, {-4, 69}, {-7, 74}, {-8, 71}},
+	{{-22, 125}, {-8, 88}, {-9, 88}, {-13, 98}},
+	// significant_coeff_flag and last_significant_coeff_flag of frame macroblocks
+	{{-7, 93}, {-2, 85}, {-13, 103}, {-4, 86}},
+	{{-11, 87}, {-6, 78}, {-13, 91}, {-12, 88}},
+	{{-3, 77}, {-1, 75}, {-9, 89}, {-5, 82}},
+	{{-5, 71}, {-7, 77}, {-14, 92}, {-3, 72}},
+	{{-4, 63}, {2, 54}, {-8, 76}, {-4, 67}},
+	{{-4, 68}, {5, 50}, {-12, 87}, {-8, 72}},
+	{{-12, 84}, {-3, 68}, {-23, 110}, {-16, 89}},
+	{{-7, 62}, {1, 50}, {-24, 105}, {-9, 69}},
+	{{-7, 65}, {6, 42}, {-10, 78}, {-1, 59}},
+	{{8, 61}, {-4, 81}, {-20, 112}, {5, 66}},
+	{{5, 56}, {1, 63}, {-17, 99}, {4, 57}},
+	{{-2, 66}, {-4, 70}, {-78, 127}, {-4, 71}},
+	{{1, 64}, {0, 67}, {-70, 127}, {-2, 71}},
+	{{0, 61}, {2, 57}, {-50, 127}, {2, 58}},
+	{{-2, 78}, {-2, 76}, {-46, 127}, {-1, 74}},
+	{{1, 50}, {11, 35}, {-4, 66}, {-4, 44}},
+	{{7, 52}, {4, 64}, {-5, 78}, {-1, 69}},
+	{{10, 35}, {1, 61}, {-4, 71}, {0, 62}},
+	{{0, 44}, {11, 35}, {-8, 72}, {-7, 51}},
+	{{11, 38}, {18, 25}, {2, 59}, {-4, 47}},
+	{{1, 45}, {12, 24}, {-1, 55}, {-6, 42}},
+	{{0, 46}, {13, 29}, {-7, 70}, {-3, 41}},
+	{{5, 44}, {13, 36}, {-6, 75}, {-6, 53}},
+	{{31, 17}, {-10, 93}, {-8, 89}, {8, 76}},
+	{{1, 51}, {-7, 73}, {-34, 119}, {-9, 78}},
+	{{7, 50}, {-2, 73}, {-3, 75}, {-11, 83}},
+	{{28, 19}, {13, 46}, {32, 20}, {9, 52}},
+	{{16, 33}, {9, 49}, {30, 22}, {0, 67}},
+	{{14, 62}, {-7, 100}, {-44, 127}, {-5, 90}},
+	{{-13, 108}, {9, 53}, {0, 54}, {1, 67}},
+	{{-15, 100}, {2, 53}, {-5, 61}, {-15, 72}},
+	{{-13, 101}, {5, 53}, {0, 58}, {-5, 75}},
+	{{-13, 91}, {-2, 61}, {-1, 60}, {-8, 80}},
+	{{-12, 94}, {0, 56}, {-3, 61}, {-21, 83}},
+	{{-10, 88}, {0, 56}, {-8, 67}, {-21, 64}},
+	{{-16, 84}, {-13, 63}, {-25, 84}, {-13, 31}},
+	{{-10, 86}, {-5, 60}, {-14, 74}, {-25, 64}},
+	{{-7, 83}, {-1, 62}, {-5, 65}, {-29, 94}},
+	{{-13, 87}, {4, 57}, {5, 52}, {9, 75}},
+	{{-19, 94}, {-6, 69}, {2, 57}, {17, 63}},
+	{{1, 70}, {4, 57}, {0, 61}, {-8, 74}},
+	{{0, 72}, {14, 39}, {-9, 69}, {-5, 35}},
+	{{-5, 74}, {4, 51}, {-11, 70}, {-2, 27}},
+	{{18, 59}, {13, 68}, {18, 55}, {13, 91}},
+	{{-8, 102}, {3, 64}, {-4, 71}, {3, 65}},
+	{{-15, 100}, {1, 61}, {0, 58}, {-7, 69}},
+	{{0, 95}, {9, 63}, {7, 61}, {8, 77}},
+	{{-4, 75}, {7, 50}, {9, 41}, {-10, 66}},
+	{{2, 72}, {16, 39}, {18, 25}, {3, 62}},
+	{{-11, 75}, {5, 44}, {9, 32}, {-3, 68}},
+	{{-3, 71}, {4, 52}, {5, 43}, {-20, 81}},
+	{{15, 46}, {11, 48}, {9, 47}, {0, 30}},
+	{{-13, 69}, {-5, 60}, {0, 44}, {1, 7}},
+	{{0, 62}, {-1, 59}, {0, 51}, {-3, 23}},
+	{{0, 65}, {0, 59}, {2, 46}, {-21, 74}},
+	{{21, 37}, {22, 33}, {19, 38}, {16, 66}},
+	{{-15, 72}, {5, 44}, {-4, 66}, {-23, 124}},
+	{{9, 57}, {14, 43}, {15, 38}, {17, 37}},
+	{{16, 54}, {-1, 78}, {12, 42}, {44, -18}},
+	{{0, 62}, {0, 60}, {9, 34}, {50, -34}},
+	{{12, 72}, {9, 69}, {0, 89}, {-22, 127}},
+	{{24, 0}, {11, 28}, {4, 45}, {4, 39}},
+	{{15, 9}, {2, 40}, {10, 28}, {0, 42}},
+	{{8, 25}, {3, 44}, {10, 31}, {7, 34}},
+	{{13, 18}, {0, 49}, {33, -11}, {11, 29}},
+	{{15, 9}, {0, 46}, {52, -43}, {8, 31}},
+	{{13, 19}, {2, 44}, {18, 15}, {6, 37}},
+	{{10, 37}, {2, 51}, {28, 0}, {7, 42}},
+	{{12, 18}, {0, 47}, {35, -22}, {3, 40}},
+	{{6, 29}, {4, 39}, {38, -25}, {8, 33}},
+	{{20, 33}, {2, 62}, {34, 0}, {13, 43}},
+	{{15, 30}, {6, 46}, {39, -18}, {13, 36}},
+	{{4, 45}, {0, 54}, {32, -12}, {4, 47}},
+	{{1, 58}, {3, 54}, {102, -94}, {3, 55}},
+	{{0, 62}, {2, 58}, {0, 0}, {2, 58}},
+	{{7, 61}, {4, 63}, {56, -15}, {6, 60}},
+	{{12, 38}, {6, 51}, {33, -4}, {8, 44}},
+	{{11, 45}, {6, 57}, {29, 10}, {11, 44}},
+	{{15, 39}, {7, 53}, {37, -5}, {14, 42}},
+	{{11, 42}, {6, 52}, {51, -29}, {7, 48}},
+	{{13, 44}, {6, 55}, {39, -9}, {4, 56}},
+	{{16, 45}, {11, 45}, {52, -34}, {4, 52}},
+	{{12, 41}, {14, 36}, {69, -58}, {13, 37}},
+	{{10, 49}, {8, 53}, {67, -63}, {9, 49}},
+	{{30, 34}, {-1, 82}, {44, -5}, {19, 58}},
+	{{18, 42}, {7, 55}, {32, 7}, {10, 48}},
+	{{10, 55}, {-3, 78}, {55, -29}, {12, 45}},
+	{{17, 51}, {15, 46}, {32, 1}, {0, 69}},
+	{{17, 46}, {22, 31}, {0, 0}, {20, 33}},
+	{{0, 89}, {-1, 84}, {27, 36}, {8, 63}},
+	{{26, -19}, {25, 7}, {33, -25}, {35, -18}},
+	{{22, -17}, {30, -7}, {34, -30}, {33, -25}},
+	{{26, -17}, {28, 3}, {36, -28}, {28, -3}},
+	{{30, -25}, {28, 4}, {38, -28}, {24, 10}},
+	{{28, -20}, {32, 0}, {38, -27}, {27, 0}},
+	{{33, -23}, {34, -1}, {34, -18}, {34, -14}},
+	{{37, -27}, {30, 6}, {35, -16}, {52, -44}},
+	{{33, -23}, {30, 6}, {34, -14}, {39, -24}},
+	{{40, -28}, {32, 9}, {32, -8}, {19, 17}},
+	{{38, -17}, {31, 19}, {37, -6}, {31, 25}},
+	{{33, -11}, {26, 27}, {35, 0}, {36, 29}},
+	{{40, -15}, {26, 30}, {30, 10}, {24, 33}},
+	{{41, -6}, {37, 20}, {28, 18}, {34, 15}},
+	{{38, 1}, {28, 34}, {26, 25}, {30, 20}},
+	{{41, 17}, {17, 70}, {29, 41}, {22, 73}},
+	{{30, -6}, {1, 67}, {0, 75}, {20, 34}},
+	{{27, 3}, {5, 59}, {2, 72}, {19, 31}},
+	{{26, 22}, {9, 67}, {8, 77}, {27, 44}},
+	{{37, -16}, {16, 30}, {14, 35}, {19, 16}},
+	{{35, -4}, {18, 32}, {18, 31}, {15, 36}},
+	{{38, -8}, {18, 35}, {17, 35}, {15, 36}},
+	{{38, -3}, {22, 29}, {21, 30}, {21, 28}},
+	{{37, 3}, {24, 31}, {17, 45}, {25, 21}},
+	{{38, 5}, {23, 38}, {20, 42}, {30, 20}},
+	{{42, 0}, {18, 43}, {18, 45}, {31, 12}},
+	{{35, 16}, {20, 41}, {27, 26}, {27, 16}},
+	{{39, 22}, {11, 63}, {16, 54}, {24, 42}},
+	{{14, 48}, {9, 59}, {7, 66}, {0, 93}},
+	{{27, 37}, {9, 64}, {16, 56}, {14, 56}},
+	{{21, 60}, {-1, 94}, {11, 73}, {15, 57}},
+	{{12, 68}, {-2, 89}, {10, 67}, {26, 38}},
+	{{2, 97}, {-9, 108}, {-10, 116}, {-24, 127}},
+	// coeff_abs_level_minus1
+	{{-3, 71}, {-6, 76}, {-23, 112}, {-24, 115}},
+	{{-6, 42}, {-2, 44}, {-15, 71}, {-22, 82}},
+	{{-5, 50}, {0, 45}, {-7, 61}, {-9, 62}},
+	{{-3, 54}, {0, 52}, {0, 53}, {0, 53}},
+	{{-2, 62}, {-3, 64}, {-5, 66}, {0, 59}},
+	{{0, 58}, {-2, 59}, {-11, 77}, {-14, 85}},
+	{{1, 63}, {-4, 70}, {-9, 80}, {-13, 89}},
+	{{-2, 72}, {-4, 75}, {-9, 84}, {-13, 94}},
+	{{-1, 74}, {-8, 82}, {-10, 87}, {-11, 92}},
+	{{-9, 91}, {-17, 102}, {-34, 127}, {-29, 127}},
+	{{-5, 67}, {-9, 77}, {-21, 101}, {-21, 100}},
+	{{-5, 27}, {3, 24}, {-3, 39}, {-14, 57}},
+	{{-3, 39}, {0, 42}, {-5, 53}, {-12, 67}},
+	{{-2, 44}, {0, 48}, {-7, 61}, {-11, 71}},
+	{{0, 46}, {0, 55}, {-11, 75}, {-10, 77}},
+	{{-16, 64}, {-6, 59}, {-15, 77}, {-21, 85}},
+	{{-8, 68}, {-7, 71}, {-17, 91}, {-16, 88}},
+	{{-10, 78}, {-12, 83}, {-25, 107}, {-23, 104}},
+	{{-6, 77}, {-11, 87}, {-25, 111}, {-15, 98}},
+	{{-10, 86}, {-30, 119}, {-28, 122}, {-37, 127}},
+	{{-12, 92}, {1, 58}, {-11, 76}, {-10, 82}},
+	{{-15, 55}, {-3, 29}, {-10, 44}, {-8, 48}},
+	{{-10, 60}, {-1, 36}, {-10, 52}, {-8, 61}},
+	{{-6, 62}, {1, 38}, {-10, 57}, {-8, 66}},
+	{{-4, 65}, {2, 43}, {-9, 58}, {-7, 70}},
+	{{-12, 73}, {-6, 55}, {-16, 72}, {-14, 75}},
+	{{-8, 76}, {0, 58}, {-7, 69}, {-10, 79}},
+	{{-7, 80}, {0, 64}, {-4, 69}, {-9, 83}},
+	{{-9, 88}, {-3, 74}, {-5, 74}, {-12, 92}},
+	{{-17, 110}, {-10, 90}, {-9, 86}, {-18, 108}},
+	{{-11, 97}, {0, 70}, {2, 66}, {-4, 79}},
+	{{-20, 84}, {-4, 29}, {-9, 34}, {-22, 69}},
+	{{-11, 79}, {5, 31}, {1, 32}, {-16, 75}},
+	{{-6, 73}, {7, 42}, {11, 31}, {-2, 58}},
+	{{-4, 74}, {1, 59}, {5, 52}, {1, 58}},
+	{{-13, 86}, {-2, 58}, {-2, 55}, {-13, 78}},
+	{{-13, 96}, {-3, 72}, {-2, 67}, {-9, 83}},
+	{{-11, 97}, {-3, 81}, {0, 73}, {-4, 81}},
+	{{-19, 117}, {-11, 97}, {-8, 89}, {-13, 99}},
+	{{-8, 78}, {0, 58}, {3, 52}, {-13, 81}},
+	{{-5, 33}, {8, 5}, {7, 4}, {-6, 38}},
+	{{-4, 48}, {10, 14}, {10, 8}, {-13, 62}},
+	{{-2, 53}, {14, 18}, {17, 8}, {-6, 58}},
+	{{-3, 62}, {13, 27}, {16, 19}, {-2, 59}},
+	{{-13, 71}, {2, 40}, {3, 37}, {-16, 73}},
+	{{-10, 79}, {0, 58}, {-1, 61}, {-10, 76}},
+	{{-12, 86}, {-3, 70}, {-5, 73}, {-13, 86}},
+	{{-13, 90}, {-6, 79}, {-1, 70}, {-9, 83}},
+	{{-14, 97}, {-8, 85}, {-4, 78}, {-10, 87}},
+	// end_of_slice_flag, not used
+	{{0, 0}, {0, 0}, {0, 0}, {0, 0}},
+	// significant_coeff_flag and last_significant_coeff_flag of field macroblocks
+	{{-6, 93}, {-13, 106}, {-21, 126}, {-22, 127}},
+	{{-6, 84}, {-16, 106}, {-23, 124}, {-25, 127}},
+	{{-8, 79}, {-10, 87}, {-20, 110}, {-25, 120}},
+	{{0, 66}, {-21, 114}, {-26, 126}, {-27, 127}},
+	{{-1, 71}, {-18, 110}, {-25, 124}, {-19, 114}},
+	{{0, 62}, {-14, 98}, {-17, 105}, {-23, 117}},
+	{{-2, 60}, {-22, 110}, {-27, 121}, {-25, 118}},
+	{{-2, 59}, {-21, 106}, {-27, 117}, {-26, 117}},
+	{{-5, 75}, {-18, 103}, {-17, 102}, {-24, 113}},
+	{{-3, 62}, {-21, 107}, {-26, 117}, {-28, 118}},
+	{{-4, 58}, {-23, 108}, {-27, 116}, {-31, 120}},
+	{{-9, 66}, {-26, 112}, {-33, 122}, {-37, 124}},
+	{{-1, 79}, {-10, 96}, {-10, 95}, {-10, 94}},
+	{{0, 71}, {-12, 95}, {-14, 100}, {-15, 102}},
+	{{3, 68}, {-5, 91}, {-8, 95}, {-10, 99}},
+	{{10, 44}, {-9, 93}, {-17, 111}, {-13, 106}},
+	{{-7, 62}, {-22, 94}, {-28, 114}, {-50, 127}},
+	{{15, 36}, {-5, 86}, {-6, 89}, {-5, 92}},
+	{{14, 40}, {9, 67}, {-2, 80}, {17, 57}},
+	{{16, 27}, {-4, 80}, {-4, 82}, {-5, 86}},
+	{{12, 29}, {-10, 85}, {-9, 85}, {-13, 94}},
+	{{1, 44}, {-1, 70}, {-8, 81}, {-12, 91}},
+	{{20, 36}, {7, 60}, {-1, 72}, {-2, 77}},
+	{{18, 32}, {9, 58}, {5, 64}, {0, 71}},
+	{{5, 42}, {5, 61}, {1, 67}, {-1, 73}},
+	{{1, 48}, {12, 50}, {9, 56}, {4, 64}},
+	{{10, 62}, {15, 50}, {0, 69}, {-7, 81}},
+	{{17, 46}, {18, 49}, {1, 69}, {5, 64}},
+	{{9, 64}, {17, 54}, {7, 69}, {15, 57}},
+	{{-12, 104}, {10, 41}, {-7, 69}, {1, 67}},
+	{{-11, 97}, {7, 46}, {-6, 67}, {0, 68}},
+	{{-16, 96}, {-1, 51}, {-16, 77}, {-10, 67}},
+	{{-7, 88}, {7, 49}, {-2, 64}, {1, 68}},
+	{{-8, 85}, {8, 52}, {2, 61}, {0, 77}},
+	{{-7, 85}, {9, 41}, {-6, 67}, {2, 64}},
+	{{-9, 85}, {6, 47}, {-3, 64}, {0, 68}},
+	{{-13, 88}, {2, 55}, {2, 57}, {-5, 78}},
+	{{4, 66}, {13, 41}, {-3, 65}, {7, 55}},
+	{{-3, 77}, {10, 44}, {-3, 66}, {5, 59}},
+	{{-3, 76}, {6, 50}, {0, 62}, {2, 65}},
+	{{-6, 76}, {5, 53}, {9, 51}, {14, 54}},
+	{{10, 58}, {13, 49}, {-1, 66}, {15, 44}},
+	{{-1, 76}, {4, 63}, {-2, 71}, {5, 60}},
+	{{-1, 83}, {6, 64}, {-2, 75}, {2, 70}},
+	{{-7, 99}, {-2, 69}, {-1, 70}, {-2, 76}},
+	{{-14, 95}, {-2, 59}, {-9, 72}, {-18, 86}},
+	{{2, 95}, {6, 70}, {14, 60}, {12, 70}},
+	{{0, 76}, {10, 44}, {16, 37}, {5, 64}},
+	{{-5, 74}, {9, 31}, {0, 47}, {-12, 70}},
+	{{0, 70}, {12, 43}, {18, 35}, {11, 55}},
+	{{-11, 75}, {3, 53}, {11, 37}, {5, 56}},
+	{{1, 68}, {14, 34}, {12, 41}, {0, 69}},
+	{{0, 65}, {10, 38}, {10, 41}, {2, 65}},
+	{{-14, 73}, {-3, 52}, {2, 48}, {-6, 74}},
+	{{3, 62}, {13, 40}, {12, 41}, {5, 54}},
+	{{4, 62}, {17, 32}, {13, 41}, {7, 54}},
+	{{-1, 68}, {7, 44}, {0, 59}, {-6, 76}},
+	{{-13, 75}, {7, 38}, {3, 50}, {-11, 82}},
+	{{11, 55}, {13, 50}, {19, 40}, {-2, 77}},
+	{{5, 64}, {10, 57}, {3, 66}, {-2, 77}},
+	{{12, 70}, {26, 43}, {18, 50}, {25, 42}},
+	{{15, 6}, {14, 11}, {19, -6}, {17, -13}},
+	{{6, 19}, {11, 14}, {18, -6}, {16, -9}},
+	{{7, 16}, {9, 11}, {14, 0}, {17, -12}},
+	{{12, 14}, {18, 11}, {26, -12}, {27, -21}},
+	{{18, 13}, {21, 9}, {31, -16}, {37, -30}},
+	{{13, 11}, {23, -2}, {33, -25}, {41, -40}},
+	{{13, 15}, {32, -15}, {33, -22}, {42, -41}},
+	{{15, 16}, {32, -15}, {37, -28}, {48, -47}},
+	{{12, 23}, {34, -21}, {39, -30}, {39, -32}},
+	{{13, 23}, {39, -23}, {42, -30}, {46, -40}},
+	{{15, 20}, {42, -33}, {47, -42}, {52, -51}},
+	{{14, 26}, {41, -31}, {45, -36}, {46, -41}},
+	{{14, 44}, {46, -28}, {49, -34}, {52, -39}},
+	{{17, 40}, {38, -12}, {41, -17}, {43, -19}},
+	{{17, 47}, {21, 29}, {32, 9}, {32, 11}},
+	{{24, 17}, {45, -24}, {69, -71}, {61, -55}},
+	{{21, 21}, {53, -45}, {63, -63}, {56, -46}},
+	{{25, 22}, {48, -26}, {66, -64}, {62, -50}},
+	{{31, 27}, {65, -43}, {77, -74}, {81, -67}},
+	{{22, 29}, {43, -19}, {54, -39}, {45, -20}},
+	{{19, 35}, {39, -10}, {52, -35}, {35, -2}},
+	{{14, 50}, {30, 9}, {41, -10}, {28, 15}},
+	{{10, 57}, {18, 26}, {36, 0}, {34, 1}},
+	{{7, 63}, {20, 27}, {40, -1}, {39, 1}},
+	{{-2, 77}, {0, 57}, {30, 14}, {30, 17}},
+	{{-4, 82}, {-14, 82}, {28, 26}, {20, 38}},
+	{{-3, 94}, {-5, 75}, {23, 37}, {18, 45}},
+	{{9, 69}, {-19, 97}, {12, 55}, {15, 54}},
+	{{-12, 109}, {-35, 125}, {11, 65}, {0, 79}},
+	{{36, -35}, {27, 0}, {37, -33}, {36, -16}},
+	{{36, -34}, {28, 0}, {39, -36}, {37, -14}},
+	{{32, -26}, {31, -4}, {40, -37}, {37, -17}},
+	{{37, -30}, {27, 6}, {38, -30}, {32, 1}},
+	{{44, -32}, {34, 8}, {46, -33}, {34, 15}},
+	{{34, -18}, {30, 10}, {42, -30}, {29, 15}},
+	{{34, -15}, {24, 22}, {40, -24}, {24, 25}},
+	{{40, -15}, {33, 19}, {49, -29}, {34, 22}},
+	{{33, -7}, {22, 32}, {38, -12}, {31, 16}},
+	{{35, -5}, {26, 31}, {40, -10}, {35, 18}},
+	{{33, 0}, {21, 41}, {38, -3}, {31, 28}},
+	{{38, 2}, {26, 44}, {46, -5}, {33, 41}},
+	{{33, 13}, {23, 47}, {31, 20}, {36, 28}},
+	{{23, 35}, {16, 65}, {29, 30}, {27, 47}},
+	{{13, 58}, {14, 71}, {25, 44}, {21, 62}},
+	{{29, -3}, {8, 60}, {12, 48}, {18, 31}},
+	{{26, 0}, {6, 63}, {11, 49}, {19, 26}},
+	{{22, 30}, {17, 65}, {26, 45}, {36, 24}},
+	{{31, -7}, {21, 24}, {22, 22}, {24, 23}},
+	{{35, -15}, {23, 20}, {23, 22}, {27, 16}},
+	{{34, -3}, {26, 23}, {27, 21}, {24, 30}},
+	{{34, 3}, {27, 32}, {33, 20}, {31, 29}},
+	{{36, -1}, {28, 23}, {26, 28}, {22, 41}},
+	{{34, 5}, {28, 24}, {30, 24}, {22, 42}},
+	{{32, 11}, {23, 40}, {27, 34}, {16, 60}},
+	{{35, 5}, {24, 32}, {18, 42}, {15, 52}},
+	{{34, 12}, {28, 29}, {25, 39}, {14, 60}},
+	{{39, 11}, {23, 42}, {18, 50}, {3, 78}},
+	{{30, 29}, {19, 57}, {12, 70}, {-16, 123}},
+	{{34, 26}, {22, 53}, {21, 54}, {21, 53}},
+	{{29, 39}, {22, 61}, {14, 71}, {22, 56}},
+	{{19, 66}, {11, 86}, {11, 83}, {25, 61}},
+	// transform_size_8x8_flag
+	{{31, 21}, {12, 40}, {25, 32}, {21, 33}},
+	{{31, 31}, {11, 51}, {21, 49}, {19, 50}},
+	{{25, 50}, {14, 59}, {21, 54}, {17, 61}},
+	// 8x8 residual blocks
+	{{-17, 120}, {-4, 79}, {-5, 85}, {-3, 78}},
+	{{-20, 112}, {-7, 71}, {-6, 81}, {-8, 74}},
+	{{-18, 114}, {-5, 69}, {-10, 77}, {-9, 72}},
+	{{-11, 85}, {-9, 70}, {-7, 81}, {-10, 72}},
+	{{-15, 92}, {-8, 66}, {-17, 80}, {-18, 75}},
+	{{-14, 89}, {-10, 68}, {-18, 73}, {-12, 71}},
+	{{-26, 71}, {-19, 73}, {-4, 74}, {-11, 63}},
+	{{-15, 81}, {-12, 69}, {-10, 83}, {-5, 70}},
+	{{-14, 80}, {-16, 70}, {-9, 71}, {-17, 75}},
+	{{0, 68}, {-15, 67}, {-9, 67}, {-14, 72}},
+	{{-14, 70}, {-20, 62}, {-1, 61}, {-16, 67}},
+	{{-24, 56}, {-19, 70}, {-8, 66}, {-8, 53}},
+	{{-23, 68}, {-16, 66}, {-14, 66}, {-14, 59}},
+	{{-24, 50}, {-22, 65}, {0, 59}, {-9, 52}},
+	{{-11, 74}, {-20, 63}, {2, 59}, {-11, 68}},
+	{{23, -13}, {9, -2}, {17, -10}, {9, -2}},
+	{{26, -13}, {26, -9}, {32, -13}, {30, -10}},
+	{{40, -15}, {33, -9}, {42, -9}, {31, -4}},
+	{{49, -14}, {39, -7}, {49, -5}, {33, -1}},
+	{{44, 3}, {41, -2}, {53, 0}, {33, 7}},
+	{{45, 6}, {45, 3}, {64, 3}, {31, 12}},
+	{{44, 34}, {49, 9}, {68, 10}, {37, 23}},
+	{{33, 54}, {45, 27}, {66, 27}, {31, 38}},
+	{{19, 82}, {36, 59}, {47, 57}, {20, 64}},
+	{{-3, 75}, {-6, 66}, {-5, 71}, {-9, 71}},
+	{{-1, 23}, {-7, 35}, {0, 24}, {-7, 37}},
+	{{1, 34}, {-7, 42}, {-1, 36}, {-8, 44}},
+	{{1, 43}, {-8, 45}, {-2, 42}, {-11, 49}},
+	{{0, 54}, {-5, 48}, {-2, 52}, {-10, 56}},
+	{{-2, 55}, {-12, 56}, {-9, 57}, {-12, 59}},
+	{{0, 61}, {-6, 60}, {-6, 63}, {-8, 63}},
+	{{1, 64}, {-5, 62}, {-4, 65}, {-9, 67}},
+	{{0, 68}, {-8, 66}, {-4, 67}, {-6, 68}},
+	{{-9, 92}, {-8, 76}, {-7, 82}, {-10, 79}},
+	{{-14, 106}, {-5, 85}, {-3, 81}, {-3, 78}},
+	{{-13, 97}, {-6, 81}, {-3, 76}, {-8, 74}},
+	{{-15, 90}, {-10, 77}, {-7, 72}, {-9, 72}},
+	{{-12, 90}, {-7, 81}, {-6, 78}, {-10, 72}},
+	{{-18, 88}, {-17, 80}, {-12, 72}, {-18, 75}},
+	{{-10, 73}, {-18, 73}, {-14, 68}, {-12, 71}},
+	{{-9, 79}, {-4, 74}, {-3, 70}, {-11, 63}},
+	{{-14, 86}, {-10, 83}, {-6, 76}, {-5, 70}},
+	{{-10, 73}, {-9, 71}, {-5, 66}, {-17, 75}},
+	{{-10, 70}, {-9, 67}, {-5, 62}, {-14, 72}},
+	{{-10, 69}, {-1, 61}, {0, 57}, {-16, 67}},
+	{{-5, 66}, {-8, 66}, {-4, 61}, {-8, 53}},
+	{{-9, 64}, {-14, 66}, {-9, 60}, {-14, 59}},
+	{{-5, 58}, {0, 59}, {1, 54}, {-9, 52}},
+	{{2, 59}, {2, 59}, {2, 58}, {-11, 68}},
+	{{21, -10}, {21, -13}, {17, -10}, {9, -2}},
+	{{24, -11}, {33, -14}, {32, -13}, {30, -10}},
+	{{28, -8}, {39, -7}, {42, -9}, {31, -4}},
+	{{28, -1}, {46, -2}, {49, -5}, {33, -1}},
+	{{29, 3}, {51, 2}, {53, 0}, {33, 7}},
+	{{29, 9}, {60, 6}, {64, 3}, {31, 12}},
+	{{35, 20}, {61, 17}, {68, 10}, {37, 23}},
+	{{29, 36}, {55, 34}, {66, 27}, {31, 38}},
+	{{14, 67}, {42, 62}, {47, 57}, {20, 64}},
+}
@@ -0,0 +1,281 @@
+package datamosh
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testH264CABACSlice returns an IDR I slice or a P slice of testH264PPS(true),
+// with cabac_init_idc 0 and SliceQPY 26, whose macroblocks are written by mbs
+// with their end_of_slice_flag.
+func testH264CABACSlice(idr bool, frameNum uint32, mbs func(e *cabacEncoder)) []byte {
+	h := &H264SliceHeader{SliceType: 5, pps: &H264PPS{}}
+	header := byte(0x41)
+	w := newRBSPWriter()
+	w.ue(0) // first_mb_in_slice
+	if idr {
+		h.SliceType, header = 7, 0x65
+		w.ue(7)       // slice_type
+		w.ue(0)       // pic_parameter_set_id
+		w.u(4, 0)     // frame_num
+		w.ue(0)       // idr_pic_id
+		w.u(4, 0)     // pic_order_cnt_lsb
+		w.flag(false) // no_output_of_prior_pics_flag
+		w.flag(false) // long_term_reference_flag
+	} else {
+		w.ue(5) // slice_type
+		w.ue(0) // pic_parameter_set_id
+		w.u(4, frameNum)
+		w.u(4, frameNum*2) // pic_order_cnt_lsb
+		w.flag(false)      // num_ref_idx_active_override_flag
+		w.flag(false)      // ref_pic_list_modification_flag_l0
+		w.flag(false)      // adaptive_ref_pic_marking_mode_flag
+		w.ue(0)            // cabac_init_idc
+	}
+	w.se(0) // slice_qp_delta
+	mbs(newCABACEncoder(w, h))
+	rbsp, err := w.alignedBytes()
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{header}, escapeRBSP(rbsp)...)
+}
+
+// testH264CABACPCMSlice returns the slice of testH264PCMSlice coded with
+// CABAC.
+func testH264CABACPCMSlice(widthMbs int) []byte {
+	return testH264CABACSlice(true, 0, func(e *cabacEncoder) {
+		for mb := 0; mb < widthMbs; mb++ {
+			// the left macroblock isn't I_NxN
+			e.mbTypeI(&mbTypeICtxIdx, min(mb, 1), 25)
+			var samples []byte
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					samples = append(samples, testH264Sample(mb*16+x, y))
+				}
+			}
+			for i := 0; i < 2*8*8; i++ {
+				samples = append(samples, byte(40+mb*100+i%64))
+			}
+			e.pcm(samples)
+			e.terminate(uint32(boolInt(mb == widthMbs-1)))
+		}
+	})
+}
+
+// testH264CABACMotionSlice returns the slice of testH264MotionSlice coded with
+// CABAC.
+func testH264CABACMotionSlice(mvds [2]MotionVector) []byte {
+	return testH264CABACSlice(false, 1, func(e *cabacEncoder) {
+		e.decision(ctxMbSkipP, 0)
+		e.mbTypeP(0) // P_L0_16x16
+		e.mvd(ctxMVDX, 0, mvds[0].X)
+		e.mvd(ctxMVDY, 0, mvds[0].Y)
+		e.cbp(cbpUnavailable, cbpUnavailable, 1)
+		e.mbQPDelta(0, -3)
+		// the coded_block_flag of the blocks of the first 8x8 block depend
+		// on the one of the first block, on their left and on top
+		e.residualBlock([]int32{5, -1, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, blockLuma4x4, 0)
+		zeros := make([]int32, 16)
+		e.residualBlock(zeros, blockLuma4x4, 1)
+		e.residualBlock(zeros, blockLuma4x4, 2)
+		e.residualBlock(zeros, blockLuma4x4, 0)
+		e.terminate(0)
+
+		// the first macroblock isn't skipped
+		e.decision(ctxMbSkipP+1, 0)
+		e.mbTypeP(0)
+		e.mvd(ctxMVDX, absMVDCompCtxIdxInc(abs32(mvds[0].X)), mvds[1].X)
+		e.mvd(ctxMVDY, absMVDCompCtxIdxInc(abs32(mvds[0].Y)), mvds[1].Y)
+		e.cbp(1, cbpUnavailable, 0)
+		e.terminate(1)
+	})
+}
+
+func TestCABACEngine(t *testing.T) {
+	// bins of all kinds and syntax elements coded and decoded back
+	rng := rand.New(rand.NewSource(1))
+	type bin struct {
+		kind, ctxIdx int
+		val          uint32
+	}
+	var bins []bin
+	for i := 0; i < 5000; i++ {
+		b := bin{kind: rng.Intn(3), ctxIdx: rng.Intn(8)}
+		// skewed decisions for the contexts to adapt
+		if b.kind != 0 || rng.Intn(8) == 0 {
+			b.val = uint32(rng.Intn(2))
+		}
+		if b.kind == 2 {
+			b.val = 0
+		}
+		bins = append(bins, b)
+	}
+	mvds := []int32{0, 1, -2, 8, -9, 10, 100, -1000, maxMVD, minMVD + 1}
+	qpDeltas := []int32{0, 1, -1, 25, -26}
+	coeffs := [][]int32{
+		{1},
+		{0, 0, 3, 0, -1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{-15, 16, 2000, -1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7},
+		{1, -1, 0, 2},
+	}
+	cats := []int{blockLumaDC, blockLuma4x4, blockLuma4x4, blockChromaDC}
+
+	h := &H264SliceHeader{SliceType: 0, CabacInitIDC: 2, SliceQPDelta: 4, pps: &H264PPS{}}
+	w := newRBSPWriter()
+	w.u(3, 5) // slice header bits
+	e := newCABACEncoder(w, h)
+	for _, b := range bins {
+		switch b.kind {
+		case 0:
+			e.decision(ctxMbQPDelta+b.ctxIdx, b.val)
+		case 1:
+			e.bypass(b.val)
+		default:
+			e.terminate(b.val)
+		}
+	}
+	for _, v := range mvds {
+		e.mvd(ctxMVDY, 2, v)
+	}
+	for _, v := range qpDeltas {
+		e.mbQPDelta(1, v)
+	}
+	for v := uint32(0); v < 4; v++ {
+		e.subMbTypeP(v)
+		e.refIdx(int(v), v*3)
+		e.intraChromaPredMode(int(v%3), v)
+		e.intra4x4PredMode(v == 0, v*2)
+	}
+	for mbType := uint32(0); mbType < 30; mbType++ {
+		if mbType != 4 { // P_8x8ref0, I_PCM is 30
+			e.mbTypeP(mbType)
+		}
+	}
+	for cbp := uint8(0); cbp < 48; cbp++ {
+		e.cbp(cbp, 47-cbp, cbp)
+	}
+	for i, c := range coeffs {
+		e.residualBlock(c, cats[i], i%4)
+	}
+	e.residualBlock(make([]int32, 15), blockLumaAC, 3)
+	e.terminate(1)
+	rbsp, err := w.alignedBytes()
+	require.NoError(t, err)
+
+	r := newRBSPReader(rbsp)
+	assert.Equal(t, uint32(5), r.u(3))
+	d := newCABACDecoder(r, h)
+	for i, b := range bins {
+		var got uint32
+		switch b.kind {
+		case 0:
+			got = d.decision(ctxMbQPDelta + b.ctxIdx)
+		case 1:
+			got = d.bypass()
+		default:
+			got = d.terminate()
+		}
+		require.Equal(t, b.val, got, "bin %d", i)
+	}
+	for _, v := range mvds {
+		assert.Equal(t, v, d.mvd(ctxMVDY, 2))
+	}
+	for _, v := range qpDeltas {
+		assert.Equal(t, v, d.mbQPDelta(1))
+	}
+	for v := uint32(0); v < 4; v++ {
+		assert.Equal(t, v, d.subMbTypeP())
+		assert.Equal(t, v*3, d.refIdx(int(v)))
+		assert.Equal(t, v, d.intraChromaPredMode(int(v%3)))
+		prev, rem := d.intra4x4PredMode()
+		assert.Equal(t, v == 0, prev)
+		if !prev {
+			assert.Equal(t, v*2, rem)
+		}
+	}
+	for mbType := uint32(0); mbType < 30; mbType++ {
+		if mbType != 4 {
+			assert.Equal(t, mbType, d.mbTypeP())
+		}
+	}
+	for cbp := uint8(0); cbp < 48; cbp++ {
+		assert.Equal(t, cbp, d.cbp(cbp, 47-cbp))
+	}
+	for i, c := range coeffs {
+		got := make([]int32, len(c))
+		d.residualBlock(got, cats[i], i%4)
+		assert.Equal(t, c, got)
+	}
+	assert.Zero(t, d.residualBlock(make([]int32, 15), blockLumaAC, 3))
+	assert.Equal(t, uint32(1), d.terminate())
+	require.NoError(t, r.err)
+	// the decoding engine stops at the rbsp_stop_one_bit
+	assert.Equal(t, r.end+1, r.pos)
+}
+
+func TestH264DecoderCABAC(t *testing.T) {
+	// the pictures of slices coded with CABAC are the ones of the same
+	// macroblocks coded with CAVLC
+	decode := func(cabac bool, nals ...[]byte) [][]byte {
+		d, err := NewH264Decoder(nil)
+		require.NoError(t, err)
+		require.NoError(t, d.DecodeNAL(testH264SPS(2, 1, 0)))
+		require.NoError(t, d.DecodeNAL(testH264PPS(cabac)))
+		var planes [][]byte
+		for _, nal := range nals {
+			img, err := d.DecodeAccessUnit([][]byte{nal})
+			require.NoError(t, err)
+			planes = append(planes, img.Y, img.Cb, img.Cr)
+		}
+		return planes
+	}
+
+	want := decode(false, testH264PCMSlice(2))
+	assert.Equal(t, want, decode(true, testH264CABACPCMSlice(2)))
+
+	mvds := [2]MotionVector{{6, -3}, {-17, 40}}
+	want = decode(false, testH264PCMSlice(2), testH264MotionSlice(mvds))
+	assert.Equal(t, want, decode(true, testH264CABACPCMSlice(2), testH264CABACMotionSlice(mvds)))
+
+	dcLevel := func(level int32) []int32 {
+		coeffLevel := make([]int32, 16)
+		coeffLevel[0] = level
+		return coeffLevel
+	}
+	intra := testH264CABACSlice(true, 0, func(e *cabacEncoder) {
+		e.mbTypeI(&mbTypeICtxIdx, 0, 3) // I_16x16_2_0_0, DC prediction
+		e.intraChromaPredMode(0, 0)
+		e.mbQPDelta(0, 0)
+		// the neighbours of the intra macroblock are unavailable
+		e.residualBlock(dcLevel(1), blockLumaDC, 3)
+		e.terminate(0)
+		e.mbTypeI(&mbTypeICtxIdx, 1, 3)
+		e.intraChromaPredMode(0, 0)
+		e.mbQPDelta(0, 0)
+		e.residualBlock(dcLevel(-1), blockLumaDC, 3)
+		e.terminate(1)
+	})
+	planes := decode(true, intra)
+	for y := 0; y < 16; y++ {
+		// a DC level of 1 at QP 26 raises the samples by 1, the second
+		// macroblock predicts from them
+		assert.Equal(t, byte(129), planes[0][y*32+3])
+		assert.Equal(t, byte(128), planes[0][y*32+20])
+	}
+
+	d, err := NewH264Decoder(nil)
+	require.NoError(t, err)
+	// three macroblocks for a picture of two
+	_, err = d.DecodeAccessUnit([][]byte{testH264SPS(2, 1, 0), testH264PPS(true), testH264CABACSlice(true, 0, func(e *cabacEncoder) {
+		for mb := 0; mb < 3; mb++ {
+			e.mbTypeI(&mbTypeICtxIdx, min(mb, 1), 25)
+			e.pcm(make([]byte, 384))
+			e.terminate(uint32(mb / 2))
+		}
+	})})
+	assert.Equal(t, errSlicePastEnd, err)
+}
@@ -0,0 +1,476 @@
+package datamosh
+
+import (
+	"errors"
+	"fmt"
+)
+
+// vlcTable maps the codes of a variable length code table to their symbols,
+// the symbol of a code is its index in the lengths and codes tables.
+type vlcTable struct {
+	maxLen int
+	codes  map[uint32]int // code length << 16 | code
+}
+
+func newVLCTable(lens, codes []uint8) *vlcTable {
+	t := &vlcTable{codes: make(map[uint32]int, len(lens))}
+	for i, n := range lens {
+		if n == 0 {
+			continue
+		}
+		t.codes[uint32(n)<<16|uint32(codes[i])] = i
+		if int(n) > t.maxLen {
+			t.maxLen = int(n)
+		}
+	}
+	return t
+}
+
+var errInvalidVLC = errors.New("invalid variable length code")
+
+// vlc reads a code of the table and returns its symbol.
+func (r *rbspReader) vlc(t *vlcTable) int {
+	var code uint32
+	for n := 1; n <= t.maxLen && r.err == nil; n++ {
+		code = code<<1 | r.u(1)
+		if symbol, ok := t.codes[uint32(n)<<16|code]; ok {
+			return symbol
+		}
+	}
+	r.fail(errInvalidVLC)
+	return 0
+}
+
+// coeff_token tables, indexed by TotalCoeff * 4 + TrailingOnes, for 0 <= nC < 2,
+// 2 <= nC < 4, 4 <= nC < 8 and 8 <= nC.
+// See Table 9-5
+var coeffTokenLens = [4][4 * 17]uint8{
+	{
+		1, 0, 0, 0,
+		6, 2, 0, 0, 8, 6, 3, 0, 9, 8, 7, 5, 10, 9, 8, 6,
+		11, 10, 9, 7, 13, 11, 10, 8, 13, 13, 11, 9, 13, 13, 13, 10,
+		14, 14, 13, 11, 14, 14, 14, 13, 15, 15, 14, 14, 15, 15, 15, 14,
+		16, 15, 15, 15, 16, 16, 16, 15, 16, 16, 16, 16, 16, 16, 16, 16,
+	},
+	{
+		2, 0, 0, 0,
+		6, 2, 0, 0, 6, 5, 3, 0, 7, 6, 6, 4, 8, 6, 6, 4,
+		8, 7, 7, 5, 9, 8, 8, 6, 11, 9, 9, 6, 11, 11, 11, 7,
+		12, 11, 11, 9, 12, 12, 12, 11, 12, 12, 12, 11, 13, 13, 13, 12,
+		13, 13, 13, 13, 13, 14, 13, 13, 14, 14, 14, 13, 14, 14, 14, 14,
+	},
+	{
+		4, 0, 0, 0,
+		6, 4, 0, 0, 6, 5, 4, 0, 6, 5, 5, 4, 7, 5, 5, 4,
+		7, 5, 5, 4, 7, 6, 6, 4, 7, 6, 6, 4, 8, 7, 7, 5,
+		8, 8, 7, 6, 9, 8, 8, 7, 9, 9, 8, 8, 9, 9, 9, 8,
+		10, 9, 9, 9, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10,
+	},
+	{
+		6, 0, 0, 0,
+		6, 6, 0, 0, 6, 6, 6, 0, 6, 6, 6, 6, 6, 6, 6, 6,
+		6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+		6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+		6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+	},
+}
+
+var coeffTokenCodes = [4][4 * 17]uint8{
+	{
+		1, 0, 0, 0,
+		5, 1, 0, 0, 7, 4, 1, 0, 7, 6, 5, 3, 7, 6, 5, 3,
+		7, 6, 5, 4, 15, 6, 5, 4, 11, 14, 5, 4, 8, 10, 13, 4,
+		15, 14, 9, 4, 11, 10, 13, 12, 15, 14, 9, 12, 11, 10, 13, 8,
+		15, 1, 9, 12, 11, 14, 13, 8, 7, 10, 9, 12, 4, 6, 5, 8,
+	},
+	{
+		3, 0, 0, 0,
+		11, 2, 0, 0, 7, 7, 3, 0, 7, 10, 9, 5, 7, 6, 5, 4,
+		4, 6, 5, 6, 7, 6, 5, 8, 15, 6, 5, 4, 11, 14, 13, 4,
+		15, 10, 9, 4, 11, 14, 13, 12, 8, 10, 9, 8, 15, 14, 13, 12,
+		11, 10, 9, 12, 7, 11, 6, 8, 9, 8, 10, 1, 7, 6, 5, 4,
+	},
+	{
+		15, 0, 0, 0,
+		15, 14, 0, 0, 11, 15, 13, 0, 8, 12, 14, 12, 15, 10, 11, 11,
+		11, 8, 9, 10, 9, 14, 13, 9, 8, 10, 9, 8, 15, 14, 13, 13,
+		11, 14, 10, 12, 15, 10, 13, 12, 11, 14, 9, 12, 8, 10, 13, 8,
+		13, 7, 9, 12, 9, 12, 11, 10, 5, 8, 7, 6, 1, 4, 3, 2,
+	},
+	{
+		3, 0, 0, 0,
+		0, 1, 0, 0, 4, 5, 6, 0, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+		32, 33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47,
+		48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63,
+	},
+}
+
+// coeff_token table for nC == -1, the chroma DC coefficients in 4:2:0
+var chromaDCCoeffTokenLens = [4 * 5]uint8{
+	2, 0, 0, 0,
+	6, 1, 0, 0,
+	6, 6, 3, 0,
+	6, 7, 7, 6,
+	6, 8, 8, 7,
+}
+
+var chromaDCCoeffTokenCodes = [4 * 5]uint8{
+	1, 0, 0, 0,
+	7, 1, 0, 0,
+	4, 6, 1, 0,
+	3, 3, 2, 5,
+	2, 3, 2, 0,
+}
+
+// total_zeros tables for 4x4 blocks, indexed by tzVlcIndex - 1 and total_zeros.
+// See Tables 9-7 and 9-8
+var totalZerosLens = [15][]uint8{
+	{1, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 9},
+	{3, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 6, 6, 6, 6},
+	{4, 3, 3, 3, 4, 4, 3, 3, 4, 5, 5, 6, 5, 6},
+	{5, 3, 4, 4, 3, 3, 3, 4, 3, 4, 5, 5, 5},
+	{4, 4, 4, 3, 3, 3, 3, 3, 4, 5, 4, 5},
+	{6, 5, 3, 3, 3, 3, 3, 3, 4, 3, 6},
+	{6, 5, 3, 3, 3, 2, 3, 4, 3, 6},
+	{6, 4, 5, 3, 2, 2, 3, 3, 6},
+	{6, 6, 4, 2, 2, 3, 2, 5},
+	{5, 5, 3, 2, 2, 2, 4},
+	{4, 4, 3, 3, 1, 3},
+	{4, 4, 2, 1, 3},
+	{3, 3, 1, 2},
+	{2, 2, 1},
+	{1, 1},
+}
+
+var totalZerosCodes = [15][]uint8{
+	{1, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 1},
+	{7, 6, 5, 4, 3, 5, 4, 3, 2, 3, 2, 3, 2, 1, 0},
+	{5, 7, 6, 5, 4, 3, 4, 3, 2, 3, 2, 1, 1, 0},
+	{3, 7, 5, 4, 6, 5, 4, 3, 3, 2, 2, 1, 0},
+	{5, 4, 3, 7, 6, 5, 4, 3, 2, 1, 1, 0},
+	{1, 1, 7, 6, 5, 4, 3, 2, 1, 1, 0},
+	{1, 1, 5, 4, 3, 3, 2, 1, 1, 0},
+	{1, 1, 1, 3, 3, 2, 2, 1, 0},
+	{1, 0, 1, 3, 2, 1, 1, 1},
+	{1, 0, 1, 3, 2, 1, 1},
+	{0, 1, 1, 2, 1, 3},
+	{0, 1, 1, 1, 1},
+	{0, 1, 1, 1},
+	{0, 1, 1},
+	{0, 1},
+}
+
+// total_zeros tables for the 2x2 chroma DC blocks.
+// See Table 9-9 (a)
+var chromaDCTotalZerosLens = [3][]uint8{
+	{1, 2, 3, 3},
+	{1, 2, 2},
+	{1, 1},
+}
+
+var chromaDCTotalZerosCodes = [3][]uint8{
+	{1, 1, 1, 0},
+	{1, 1, 0},
+	{1, 0},
+}
+
+// run_before tables, indexed by Min(zerosLeft, 7) - 1 and run_before.
+// See Table 9-10
+var runBeforeLens = [7][]uint8{
+	{1, 1},
+	{1, 2, 2},
+	{2, 2, 2, 2},
+	{2, 2, 2, 3, 3},
+	{2, 2, 3, 3, 3, 3},
+	{2, 3, 3, 3, 3, 3, 3},
+	{3, 3, 3, 3, 3, 3, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+}
+
+var runBeforeCodes = [7][]uint8{
+	{1, 0},
+	{1, 1, 0},
+	{3, 2, 1, 0},
+	{3, 2, 1, 1, 0},
+	{3, 2, 3, 2, 1, 0},
+	{3, 0, 1, 3, 2, 5, 4},
+	{7, 6, 5, 4, 3, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+}
+
+var (
+	coeffTokenVLC         [4]*vlcTable
+	chromaDCCoeffTokenVLC = newVLCTable(chromaDCCoeffTokenLens[:], chromaDCCoeffTokenCodes[:])
+	totalZerosVLC         [15]*vlcTable
+	chromaDCTotalZerosVLC [3]*vlcTable
+	runBeforeVLC          [7]*vlcTable
+)
+
+func init() {
+	for i := range coeffTokenVLC {
+		coeffTokenVLC[i] = newVLCTable(coeffTokenLens[i][:], coeffTokenCodes[i][:])
+	}
+	for i := range totalZerosVLC {
+		totalZerosVLC[i] = newVLCTable(totalZerosLens[i], totalZerosCodes[i])
+	}
+	for i := range chromaDCTotalZerosVLC {
+		chromaDCTotalZerosVLC[i] = newVLCTable(chromaDCTotalZerosLens[i], chromaDCTotalZerosCodes[i])
+	}
+	for i := range runBeforeVLC {
+		runBeforeVLC[i] = newVLCTable(runBeforeLens[i], runBeforeCodes[i])
+	}
+}
+
+// coeffTokenTable returns the coeff_token table to use for nC, -1 selects the
+// chroma DC table.
+func coeffTokenTable(nC int) *vlcTable {
+	switch {
+	case nC < 0:
+		return chromaDCCoeffTokenVLC
+	case nC < 2:
+		return coeffTokenVLC[0]
+	case nC < 4:
+		return coeffTokenVLC[1]
+	case nC < 8:
+		return coeffTokenVLC[2]
+	}
+	return coeffTokenVLC[3]
+}
+
+// residualBlock reads residual_block_cavlc() into coeffLevel, which holds
+// maxNumCoeff coefficients in scanning order. It returns TotalCoeff.
+// See 7.3.5.3.2 Residual block CAVLC syntax
+func (r *rbspReader) residualBlock(coeffLevel []int32, maxNumCoeff int, nC int) int {
+	for i := range coeffLevel[:maxNumCoeff] {
+		coeffLevel[i] = 0
+	}
+	token := r.vlc(coeffTokenTable(nC))
+	totalCoeff, trailingOnes := token/4, token%4
+	if r.err != nil || totalCoeff == 0 {
+		return 0
+	}
+	if totalCoeff > maxNumCoeff {
+		r.fail(fmt.Errorf("invalid coeff_token: %d coefficients in a block of %d", totalCoeff, maxNumCoeff))
+		return 0
+	}
+
+	var levelVal [16]int32
+	suffixLength := 0
+	if totalCoeff > 10 && trailingOnes < 3 {
+		suffixLength = 1
+	}
+	for i := 0; i < totalCoeff; i++ {
+		if i < trailingOnes {
+			levelVal[i] = 1 - 2*int32(r.u(1))
+			continue
+		}
+		levelPrefix := 0
+		for r.u(1) == 0 {
+			if r.err != nil {
+				return 0
+			}
+			levelPrefix++
+			if levelPrefix > 28 {
+				r.fail(errors.New("invalid level_prefix"))
+				return 0
+			}
+		}
+		levelCode := min(15, levelPrefix) << uint(suffixLength)
+		if suffixLength > 0 || levelPrefix >= 14 {
+			levelSuffixSize := suffixLength
+			if levelPrefix == 14 && suffixLength == 0 {
+				levelSuffixSize = 4
+			} else if levelPrefix >= 15 {
+				levelSuffixSize = levelPrefix - 3
+			}
+			if levelSuffixSize > 0 {
+				levelCode += int(r.u(levelSuffixSize))
+			}
+		}
+		if levelPrefix >= 15 && suffixLength == 0 {
+			levelCode += 15
+		}
+		if levelPrefix >= 16 {
+			levelCode += (1 << uint(levelPrefix-3)) - 4096
+		}
+		if i == trailingOnes && trailingOnes < 3 {
+			levelCode += 2
+		}
+		if levelCode%2 == 0 {
+			levelVal[i] = int32(levelCode+2) >> 1
+		} else {
+			levelVal[i] = int32(-levelCode-1) >> 1
+		}
+		if suffixLength == 0 {
+			suffixLength = 1
+		}
+		if abs32(levelVal[i]) > 3<<uint(suffixLength-1) && suffixLength < 6 {
+			suffixLength++
+		}
+	}
+
+	zerosLeft := 0
+	if totalCoeff < maxNumCoeff {
+		if nC < 0 {
+			zerosLeft = r.vlc(chromaDCTotalZerosVLC[totalCoeff-1])
+		} else {
+			zerosLeft = r.vlc(totalZerosVLC[totalCoeff-1])
+		}
+		if zerosLeft > maxNumCoeff-totalCoeff {
+			r.fail(fmt.Errorf("invalid total_zeros: %d", zerosLeft))
+			return 0
+		}
+	}
+
+	var runVal [16]int
+	for i := 0; i < totalCoeff-1; i++ {
+		if zerosLeft > 0 {
+			runVal[i] = r.vlc(runBeforeVLC[min(zerosLeft, 7)-1])
+			if runVal[i] > zerosLeft {
+				r.fail(fmt.Errorf("invalid run_before: %d", runVal[i]))
+				return 0
+			}
+		}
+		zerosLeft -= runVal[i]
+	}
+	runVal[totalCoeff-1] = zerosLeft
+
+	coeffNum := -1
+	for i := totalCoeff - 1; i >= 0; i-- {
+		coeffNum += runVal[i] + 1
+		coeffLevel[coeffNum] = levelVal[i]
+	}
+	if r.err != nil {
+		return 0
+	}
+	return totalCoeff
+}
+
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// coeffTokenCode returns the lengths and codes of the coeff_token table to
+// use for nC, -1 selects the chroma DC table.
+func coeffTokenCode(nC int) (lens, codes []uint8) {
+	switch {
+	case nC < 0:
+		return chromaDCCoeffTokenLens[:], chromaDCCoeffTokenCodes[:]
+	case nC < 2:
+		return coeffTokenLens[0][:], coeffTokenCodes[0][:]
+	case nC < 4:
+		return coeffTokenLens[1][:], coeffTokenCodes[1][:]
+	case nC < 8:
+		return coeffTokenLens[2][:], coeffTokenCodes[2][:]
+	}
+	return coeffTokenLens[3][:], coeffTokenCodes[3][:]
+}
+
+// vlc writes the code of a symbol of a variable length code table.
+func (w *rbspWriter) vlc(lens, codes []uint8, symbol int) {
+	if symbol >= len(lens) || lens[symbol] == 0 {
+		w.fail(errInvalidVLC)
+		return
+	}
+	w.u(int(lens[symbol]), uint32(codes[symbol]))
+}
+
+// maxCAVLCLevel is the largest coefficient level residualBlock writes, the
+// escape codes of the Baseline profile can't code much larger ones.
+const maxCAVLCLevel = 2047
+
+// residualBlock writes residual_block_cavlc() for the maxNumCoeff
+// coefficients of coeffLevel, in scanning order, reverting
+// rbspReader.residualBlock. It returns TotalCoeff.
+func (w *rbspWriter) residualBlock(coeffLevel []int32, maxNumCoeff int, nC int) int {
+	// the coefficients from the highest frequency, and their positions
+	var levelVal [16]int32
+	var pos [16]int
+	totalCoeff := 0
+	for i := maxNumCoeff - 1; i >= 0; i-- {
+		if coeffLevel[i] != 0 {
+			levelVal[totalCoeff] = coeffLevel[i]
+			pos[totalCoeff] = i
+			totalCoeff++
+		}
+	}
+	trailingOnes := 0
+	for trailingOnes < totalCoeff && trailingOnes < 3 && abs32(levelVal[trailingOnes]) == 1 {
+		trailingOnes++
+	}
+	lens, codes := coeffTokenCode(nC)
+	w.vlc(lens, codes, totalCoeff*4+trailingOnes)
+	if totalCoeff == 0 {
+		return 0
+	}
+
+	suffixLength := 0
+	if totalCoeff > 10 && trailingOnes < 3 {
+		suffixLength = 1
+	}
+	for i := 0; i < totalCoeff; i++ {
+		level := levelVal[i]
+		if i < trailingOnes {
+			if level < 0 {
+				w.u(1, 1)
+			} else {
+				w.u(1, 0)
+			}
+			continue
+		}
+		if abs32(level) > maxCAVLCLevel {
+			w.fail(fmt.Errorf("coefficient level %d too large", level))
+			return 0
+		}
+		levelCode := int(2*level - 2)
+		if level < 0 {
+			levelCode = int(-2*level - 1)
+		}
+		if i == trailingOnes && trailingOnes < 3 {
+			levelCode -= 2
+		}
+
+		var levelPrefix, levelSuffixSize, levelSuffix int
+		switch {
+		case suffixLength == 0 && levelCode < 14:
+			levelPrefix = levelCode
+		case suffixLength == 0 && levelCode < 30:
+			levelPrefix, levelSuffixSize, levelSuffix = 14, 4, levelCode-14
+		case suffixLength == 0:
+			levelPrefix, levelSuffixSize, levelSuffix = 15, 12, levelCode-30
+		case levelCode < 15<<uint(suffixLength):
+			levelPrefix, levelSuffixSize, levelSuffix = levelCode>>uint(suffixLength), suffixLength, levelCode&(1<<uint(suffixLength)-1)
+		default:
+			levelPrefix, levelSuffixSize, levelSuffix = 15, 12, levelCode-15<<uint(suffixLength)
+		}
+		w.u(levelPrefix+1, 1)
+		if levelSuffixSize > 0 {
+			w.u(levelSuffixSize, uint32(levelSuffix))
+		}
+
+		if suffixLength == 0 {
+			suffixLength = 1
+		}
+		if abs32(level) > 3<<uint(suffixLength-1) && suffixLength < 6 {
+			suffixLength++
+		}
+	}
+
+	totalZeros := pos[0] + 1 - totalCoeff
+	if totalCoeff < maxNumCoeff {
+		if nC < 0 {
+			w.vlc(chromaDCTotalZerosLens[totalCoeff-1], chromaDCTotalZerosCodes[totalCoeff-1], totalZeros)
+		} else {
+			w.vlc(totalZerosLens[totalCoeff-1], totalZerosCodes[totalCoeff-1], totalZeros)
+		}
+	}
+	zerosLeft := totalZeros
+	for i := 0; i < totalCoeff-1 && zerosLeft > 0; i++ {
+		run := pos[i] - pos[i+1] - 1
+		w.vlc(runBeforeLens[min(zerosLeft, 7)-1], runBeforeCodes[min(zerosLeft, 7)-1], run)
+		zerosLeft -= run
+	}
+	return totalCoeff
+}
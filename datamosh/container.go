@@ -0,0 +1,405 @@
+package datamosh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ContainerFormat identifies a file format holding the tracks.
+type ContainerFormat int
+
+const (
+	ContainerUnknown ContainerFormat = iota
+	ContainerMP4
+	ContainerMatroska
+	ContainerWebM
+	ContainerIVF
+	ContainerOBU
+	ContainerFMP4 // fragmented MP4, read as MP4
+)
+
+func (f ContainerFormat) String() string {
+	switch f {
+	case ContainerMP4:
+		return "mp4"
+	case ContainerMatroska:
+		return "mkv"
+	case ContainerWebM:
+		return "webm"
+	case ContainerIVF:
+		return "ivf"
+	case ContainerOBU:
+		return "obu"
+	case ContainerFMP4:
+		return "fmp4"
+	}
+	return "unknown"
+}
+
+// Extension returns the usual file extension of the format, dot included.
+func (f ContainerFormat) Extension() string {
+	switch f {
+	case ContainerUnknown:
+		return ""
+	case ContainerFMP4:
+		return ".mp4"
+	}
+	return "." + f.String()
+}
+
+// ParseContainerFormat returns the format matching a name or a file extension
+// such as "mkv" or ".mp4".
+func ParseContainerFormat(name string) (ContainerFormat, error) {
+	switch strings.TrimPrefix(strings.ToLower(name), ".") {
+	case "mp4", "m4v", "mov":
+		return ContainerMP4, nil
+	case "mkv", "matroska":
+		return ContainerMatroska, nil
+	case "webm":
+		return ContainerWebM, nil
+	case "ivf":
+		return ContainerIVF, nil
+	case "obu":
+		return ContainerOBU, nil
+	case "fmp4", "cmaf", "m4s":
+		return ContainerFMP4, nil
+	}
+	return ContainerUnknown, fmt.Errorf("unknown container format %q", name)
+}
+
+// DetectContainer guesses the format of a file from its first bytes. The
+// reader is rewound to the start of the file.
+func DetectContainer(r io.ReadSeeker) (ContainerFormat, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return ContainerUnknown, err
+	}
+	head := make([]byte, 12)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return ContainerUnknown, fmt.Errorf("failed to read the file header: %v", err)
+	}
+	head = head[:n]
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return ContainerUnknown, err
+	}
+
+	switch {
+	case len(head) >= 4 && string(head[0:4]) == "DKIF":
+		return ContainerIVF, nil
+	case len(head) >= 4 && bytes.Equal(head[0:4], []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		docType, err := readEBMLDocType(r)
+		if err != nil {
+			return ContainerUnknown, err
+		}
+		if docType == "webm" {
+			return ContainerWebM, nil
+		}
+		return ContainerMatroska, nil
+	case len(head) >= 8 && isMP4BoxType(head[4:8]):
+		return ContainerMP4, nil
+	case len(head) >= 2 && head[0]&0x80 == 0 && (head[0]>>3)&0x0f == OBU_TEMPORAL_DELIMITER && head[0]&0x02 != 0 && head[1] == 0:
+		return ContainerOBU, nil
+	}
+	return ContainerUnknown, errors.New("unknown container format")
+}
+
+func isMP4BoxType(boxType []byte) bool {
+	switch string(boxType) {
+	case "ftyp", "styp", "moov", "mdat", "free", "skip", "wide", "pnot":
+		return true
+	}
+	return false
+}
+
+// readEBMLDocType returns the DocType of the EBML header and rewinds the
+// reader.
+func readEBMLDocType(r io.ReadSeeker) (string, error) {
+	defer r.Seek(0, io.SeekStart)
+	header, err := readEBMLElement(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read EBML header: %v", err)
+	}
+	docType := "matroska"
+	_, err = walkEBML(r, header.DataOffset, header.end(), nil, func(e *ebmlElement) (bool, error) {
+		if e.ID == ebmlIDDocType {
+			data, err := readEBMLData(r, e)
+			if err != nil {
+				return true, err
+			}
+			docType = string(bytes.TrimRight(data, "\x00"))
+		}
+		return true, nil
+	})
+	return docType, err
+}
+
+// A Demuxer reads the tracks of a file. The frames of the tracks using a
+// supported codec are parsed, and the samples point to the file data.
+type Demuxer interface {
+	Demux(r io.ReadSeeker) ([]*Track, error)
+}
+
+// MuxTrack is a track to write and the ids of its samples to write, in order.
+// Samples can be repeated or omitted, a nil list writes every sample.
+type MuxTrack struct {
+	Track   *Track
+	Samples []uint32
+	// Data holds the sample data of the track when it isn't in the reader
+	// given to the muxer, such as slices rewritten in memory.
+	Data io.ReadSeeker
+}
+
+// reader returns the reader of the sample data of the track.
+func (t MuxTrack) reader(r io.ReadSeeker) io.ReadSeeker {
+	if t.Data != nil {
+		return t.Data
+	}
+	return r
+}
+
+// sampleIDs returns the ids of the samples to write.
+func (t MuxTrack) sampleIDs() []uint32 {
+	if t.Samples != nil {
+		return t.Samples
+	}
+	ids := make([]uint32, len(t.Track.Samples))
+	for i := range ids {
+		ids[i] = uint32(i)
+	}
+	return ids
+}
+
+// A Muxer writes tracks to a new file, reading the sample data from the
+// original file.
+type Muxer interface {
+	// Supports returns true if the track can be written by the muxer.
+	Supports(track *Track) bool
+	Mux(w io.Writer, r io.ReadSeeker, tracks []MuxTrack) error
+}
+
+// NewDemuxer returns the demuxer of a container format.
+func NewDemuxer(format ContainerFormat) (Demuxer, error) {
+	switch format {
+	case ContainerMP4, ContainerFMP4:
+		return &MP4Demuxer{}, nil
+	case ContainerMatroska, ContainerWebM:
+		return &WebMDemuxer{}, nil
+	case ContainerIVF:
+		return &IVFDemuxer{}, nil
+	case ContainerOBU:
+		return &OBUDemuxer{}, nil
+	}
+	return nil, fmt.Errorf("no demuxer for %s files", format)
+}
+
+// NewMuxer returns the muxer of a container format.
+func NewMuxer(format ContainerFormat) (Muxer, error) {
+	switch format {
+	case ContainerMP4:
+		return &MP4Muxer{}, nil
+	case ContainerMatroska:
+		return &MKVMuxer{}, nil
+	case ContainerWebM:
+		return &MKVMuxer{WebM: true}, nil
+	case ContainerIVF:
+		return &IVFMuxer{}, nil
+	case ContainerOBU:
+		return &OBUMuxer{}, nil
+	case ContainerFMP4:
+		return &FMP4Muxer{}, nil
+	}
+	return nil, fmt.Errorf("no muxer for %s files", format)
+}
+
+// Demux detects the container format of r and reads its tracks.
+func Demux(r io.ReadSeeker) ([]*Track, ContainerFormat, error) {
+	format, err := DetectContainer(r)
+	if err != nil {
+		return nil, format, err
+	}
+	demuxer, err := NewDemuxer(format)
+	if err != nil {
+		return nil, format, err
+	}
+	tracks, err := demuxer.Demux(r)
+	return tracks, format, err
+}
+
+// Remux reads the tracks of r, whatever its container, and writes them to w
+// in the given container format. selectSamples returns the ids of the samples
+// to write for each track, nil keeps them all. Tracks the muxer doesn't
+// support are skipped.
+func Remux(w io.Writer, r io.ReadSeeker, format ContainerFormat, selectSamples func(track *Track) []uint32) error {
+	tracks, _, err := Demux(r)
+	if err != nil {
+		return err
+	}
+	muxer, err := NewMuxer(format)
+	if err != nil {
+		return err
+	}
+
+	muxTracks := []MuxTrack{}
+	for _, track := range tracks {
+		if !muxer.Supports(track) {
+			if Debug {
+				fmt.Printf("Skipping track %d, not supported in %s files\n", track.TrackID, format)
+			}
+			continue
+		}
+		muxTrack := MuxTrack{Track: track}
+		if selectSamples != nil {
+			muxTrack.Samples = selectSamples(track)
+		}
+		muxTracks = append(muxTracks, muxTrack)
+	}
+	if len(muxTracks) == 0 {
+		return fmt.Errorf("no track can be written in %s files", format)
+	}
+	return muxer.Mux(w, r, muxTracks)
+}
+
+// MP4Demuxer reads MP4/ISOBMFF files.
+type MP4Demuxer struct{}
+
+func (d *MP4Demuxer) Demux(r io.ReadSeeker) ([]*Track, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ParseTracks(r)
+}
+
+// WebMDemuxer reads WebM and Matroska files.
+type WebMDemuxer struct{}
+
+func (d *WebMDemuxer) Demux(r io.ReadSeeker) ([]*Track, error) {
+	return ParseWebM(r)
+}
+
+// IVFDemuxer reads IVF files.
+type IVFDemuxer struct{}
+
+func (d *IVFDemuxer) Demux(r io.ReadSeeker) ([]*Track, error) {
+	_, track, err := ParseIVF(r)
+	if err != nil {
+		return nil, err
+	}
+	return []*Track{track}, nil
+}
+
+// OBUDemuxer reads low overhead bitstream format AV1 files.
+type OBUDemuxer struct{}
+
+func (d *OBUDemuxer) Demux(r io.ReadSeeker) ([]*Track, error) {
+	track, err := ParseOBUStream(r)
+	if err != nil {
+		return nil, err
+	}
+	return []*Track{track}, nil
+}
+
+// IVFMuxer writes the first track as an IVF file.
+type IVFMuxer struct{}
+
+func (m *IVFMuxer) Supports(track *Track) bool {
+	return track.AV1 != nil || track.VPX != nil
+}
+
+func (m *IVFMuxer) Mux(w io.Writer, r io.ReadSeeker, tracks []MuxTrack) error {
+	if len(tracks) == 0 {
+		return errors.New("no track to write")
+	}
+	header, err := NewIVFHeader(tracks[0].Track)
+	if err != nil {
+		return err
+	}
+	return WriteIVF(w, tracks[0].reader(r), header, tracks[0].Track, tracks[0].sampleIDs())
+}
+
+// OBUMuxer writes the first track as a low overhead bitstream format AV1
+// file.
+type OBUMuxer struct{}
+
+func (m *OBUMuxer) Supports(track *Track) bool {
+	return track.AV1 != nil
+}
+
+func (m *OBUMuxer) Mux(w io.Writer, r io.ReadSeeker, tracks []MuxTrack) error {
+	if len(tracks) == 0 {
+		return errors.New("no track to write")
+	}
+	return WriteOBUStream(w, tracks[0].reader(r), tracks[0].Track, tracks[0].sampleIDs())
+}
+
+// muxSample is a sample as written by a muxer.
+type muxSample struct {
+	offset   uint64 // in the source file
+	size     uint32
+	dts      uint64 // in the timescale of the track, rebuilt from the durations
+	duration uint32
+	cto      int64
+	key      bool
+	flags    SampleFlags // of the container, Sync aside
+}
+
+func (s muxSample) pts() int64 {
+	return int64(s.dts) + s.cto
+}
+
+// muxSamples returns the samples to write. The sync samples are the ones of
+// the container but for the key frames nullified in place, so the random
+// access points that aren't IDR pictures, such as open GOP I frames, stay
+// sync samples. The tracks without sample flags, built from elementary
+// streams or by effects, use the key frames of their bitstream. The nullified
+// key frames lose their intra and random access flags.
+func (t MuxTrack) muxSamples() ([]muxSample, error) {
+	track := t.Track
+	offsets := track.sampleOffsets()
+	nullified := nullifiedSamples(track)
+	var keys map[uint32]bool
+	if track.SampleFlags == nil && len(track.Frames()) > 0 {
+		keys = keySamples(track)
+	}
+
+	ids := t.sampleIDs()
+	samples := make([]muxSample, 0, len(ids))
+	var dts uint64
+	for _, id := range ids {
+		if int(id) >= len(track.Samples) {
+			return nil, fmt.Errorf("sample %d out of range", id)
+		}
+		sample := track.Samples[id]
+		var flags SampleFlags
+		if int(id) < len(track.SampleFlags) {
+			flags = track.SampleFlags[id]
+		}
+		if nullified[id] {
+			flags.DependsOn, flags.Roll, flags.RandomAccess = 0, false, false
+		}
+		samples = append(samples, muxSample{
+			offset:   offsets[id],
+			size:     sample.Size,
+			dts:      dts,
+			duration: sample.TimeDelta,
+			cto:      sample.CompositionTimeOffset,
+			key:      (keys == nil || keys[id]) && track.IsSyncSample(id) && !nullified[id],
+			flags:    flags,
+		})
+		dts += uint64(sample.TimeDelta)
+	}
+	return samples, nil
+}
+
+// copySample copies the data of a sample from r to w.
+func copySample(w io.Writer, r io.ReadSeeker, s muxSample) error {
+	if _, err := r.Seek(int64(s.offset), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, r, int64(s.size)); err != nil {
+		return fmt.Errorf("failed to copy sample at offset %d: %v", s.offset, err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package datamosh
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testVP8Frames() [][]byte {
+	return [][]byte{
+		testVP8Frame(true, false),
+		testVP8Frame(false, false),
+		testVP8Frame(false, true),
+		testVP8Frame(true, false),
+		testVP8Frame(false, false),
+	}
+}
+
+func TestDetectContainer(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want ContainerFormat
+	}{
+		{"ivf", testIVF(testAV1Frames()), ContainerIVF},
+		{"obu", bytes.Join(testAV1Frames(), nil), ContainerOBU},
+		{"webm", testEBML(ebmlIDHeader, testEBML(ebmlIDDocType, []byte("webm"))), ContainerWebM},
+		{"mkv", testEBML(ebmlIDHeader, testEBML(ebmlIDDocType, []byte("matroska"))), ContainerMatroska},
+		{"mp4", []byte{0, 0, 0, 16, 'f', 't', 'y', 'p', 'i', 's', 'o', 'm', 0, 0, 0, 0}, ContainerMP4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := DetectContainer(bytes.NewReader(tt.data))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, format)
+		})
+	}
+
+	_, err := DetectContainer(bytes.NewReader([]byte("not a video file")))
+	assert.Error(t, err)
+}
+
+func TestRemuxMP4ToMKV(t *testing.T) {
+	frames := testVP8Frames()
+	ivf := testVPXIVF("VP80", frames)
+
+	// IVF in, MP4 out
+	mp4File := &bytes.Buffer{}
+	require.NoError(t, Remux(mp4File, bytes.NewReader(ivf), ContainerMP4, nil))
+
+	tracks, format, err := Demux(bytes.NewReader(mp4File.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, ContainerMP4, format)
+	require.Len(t, tracks, 1)
+	require.NotNil(t, tracks[0].VPX)
+	assert.Equal(t, uint16(320), tracks[0].VPX.Width)
+	assert.Equal(t, handlerVideo, tracks[0].Handler)
+	require.Len(t, tracks[0].VPXFrames, len(frames))
+	assert.Equal(t, []uint32{0, 1, 2, 4}, DropKeyFrames(tracks[0]))
+
+	// MP4 in, MKV out, without the second key frame
+	mkvFile := &bytes.Buffer{}
+	require.NoError(t, Remux(mkvFile, bytes.NewReader(mp4File.Bytes()), ContainerMatroska, DropKeyFrames))
+
+	tracks, format, err = Demux(bytes.NewReader(mkvFile.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, ContainerMatroska, format)
+	require.Len(t, tracks, 1)
+	track := tracks[0]
+	assert.Equal(t, mkvCodecVP8, track.WebM.CodecID)
+	require.Len(t, track.VPXFrames, 4)
+	assert.Equal(t, []uint32{0, 1, 2, 3}, DropKeyFrames(track))
+	assert.Equal(t, uint64(100), track.VPXFrames[3].Timestamp)
+
+	r := bytes.NewReader(mkvFile.Bytes())
+	for i, id := range []int{0, 1, 2, 4} {
+		payload, err := track.VPXFrames[i].Payload(r)
+		require.NoError(t, err)
+		assert.Equal(t, frames[id], payload)
+	}
+}
+
+func TestRemuxMP4Fixtures(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture mp4Fixture
+		kept    []int // decoding order index of the video samples written
+	}{
+		{name: "b frames", fixture: mp4Fixture{gop: "IBBPIBP", audio: true}, kept: []int{0, 1, 2, 3, 5, 6}},
+		{name: "slices", fixture: mp4Fixture{gop: "IPPIPP", heightMbs: 3, slices: 2, co64: true, audio: true}, kept: []int{0, 1, 2, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := tt.fixture.withDefaults()
+			out := &bytes.Buffer{}
+			require.NoError(t, Remux(out, bytes.NewReader(fixture.build(t)), ContainerMP4, DropKeyFrames))
+
+			r := bytes.NewReader(out.Bytes())
+			tracks, _, err := Demux(r)
+			require.NoError(t, err)
+			require.Len(t, tracks, 2)
+			video, audio := tracks[0], tracks[1]
+
+			frames := fixture.frames()
+			require.Len(t, video.Samples, len(tt.kept))
+			i := 0
+			for id, index := range tt.kept {
+				frame := frames[index]
+				assert.Equal(t, int64(frame.pts-frame.dts), video.Samples[id].CompositionTimeOffset)
+				for _, want := range frame.nals {
+					require.Less(t, i, len(video.NALs))
+					payload, err := video.NALs[i].Payload(r)
+					require.NoError(t, err)
+					assert.Equal(t, want, payload, "sample %d", id)
+					i++
+				}
+			}
+
+			// the audio track is copied as is
+			assert.True(t, audio.IsAudio())
+			audioFrames := fixture.audioFrames()
+			require.Len(t, audio.Samples, len(audioFrames))
+			for id, offset := range audio.sampleOffsets() {
+				got := make([]byte, audio.Samples[id].Size)
+				_, err := r.ReadAt(got, int64(offset))
+				require.NoError(t, err)
+				assert.Equal(t, audioFrames[id], got, "audio sample %d", id)
+			}
+		})
+	}
+}
+
+func TestMP4MuxerFaststart(t *testing.T) {
+	fixture := mp4Fixture{gop: "IBBPIBP", audio: true}.withDefaults()
+	input := bytes.NewReader(fixture.build(t))
+	tracks, err := ParseTracks(input)
+	require.NoError(t, err)
+	muxTracks := []MuxTrack{{Track: tracks[0], Samples: DropKeyFrames(tracks[0])}, {Track: tracks[1]}}
+
+	files := map[bool][]byte{}
+	for _, faststart := range []bool{false, true} {
+		out := &bytes.Buffer{}
+		require.NoError(t, (&MP4Muxer{Faststart: faststart}).Mux(out, input, muxTracks))
+		files[faststart] = out.Bytes()
+	}
+	require.Equal(t, len(files[false]), len(files[true]))
+
+	var boxes []string
+	_, err = mp4.ReadBoxStructure(bytes.NewReader(files[true]), func(h *mp4.ReadHandle) (interface{}, error) {
+		boxes = append(boxes, h.BoxInfo.Type.String())
+		return nil, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ftyp", "moov", "mdat"}, boxes)
+
+	// the chunk offsets point to the same samples
+	r, fastR := bytes.NewReader(files[false]), bytes.NewReader(files[true])
+	want, _, err := Demux(r)
+	require.NoError(t, err)
+	got, _, err := Demux(fastR)
+	require.NoError(t, err)
+	require.Len(t, got, len(want))
+	for i := range want {
+		wantOffsets, gotOffsets := want[i].sampleOffsets(), got[i].sampleOffsets()
+		require.Len(t, gotOffsets, len(wantOffsets))
+		for id := range wantOffsets {
+			size := want[i].Samples[id].Size
+			wantData, gotData := make([]byte, size), make([]byte, size)
+			_, err := r.ReadAt(wantData, int64(wantOffsets[id]))
+			require.NoError(t, err)
+			_, err = fastR.ReadAt(gotData, int64(gotOffsets[id]))
+			require.NoError(t, err)
+			assert.Equal(t, wantData, gotData, "track %d sample %d", i, id)
+		}
+	}
+	assert.Len(t, got[0].NALs, len(want[0].NALs))
+}
+
+func TestMP4MuxerSyncSamples(t *testing.T) {
+	fixture := mp4Fixture{gop: "IPiPIP", recoveryPoints: true}.withDefaults()
+	data := fixture.build(t)
+	tracks, _, err := Demux(bytes.NewReader(data))
+	require.NoError(t, err)
+	video := tracks[0]
+	for id, flags := range video.SampleFlags {
+		assert.Equal(t, id == 2, flags.RecoveryPoint, "sample %d", id)
+	}
+	assert.Equal(t, uint32(2), video.SampleFlags[2].RecoveryFrameCnt)
+
+	// the recovery point listed by the container stays a sync sample
+	video.SampleFlags[2].Sync = true
+	out := &bytes.Buffer{}
+	require.NoError(t, (&MP4Muxer{}).Mux(out, bytes.NewReader(data), []MuxTrack{{Track: video}}))
+	got, _, err := Demux(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	var syncSamples []uint32
+	for id := range got[0].Samples {
+		if got[0].IsSyncSample(uint32(id)) {
+			syncSamples = append(syncSamples, uint32(id))
+		}
+	}
+	assert.Equal(t, []uint32{0, 2, 4}, syncSamples)
+}
+
+func TestMP4MuxerSampleFlags(t *testing.T) {
+	fixture := mp4Fixture{gop: "IBPiBPIBP"}.withDefaults()
+	data := fixture.build(t)
+	tracks, err := ParseTracks(bytes.NewReader(data))
+	require.NoError(t, err)
+	video := tracks[0]
+	video.SampleFlags[2].Roll, video.SampleFlags[2].RollDistance = true, 3
+	video.SampleFlags[5].Roll, video.SampleFlags[5].RollDistance = true, -1
+
+	// the sdtp box and the sample groups are written back
+	out := &bytes.Buffer{}
+	require.NoError(t, (&MP4Muxer{}).Mux(out, bytes.NewReader(data), []MuxTrack{{Track: video}}))
+	got, err := ParseTracks(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, video.SampleFlags, got[0].SampleFlags)
+}
+
+func TestMP4MuxerFaststartNullified(t *testing.T) {
+	fixture := mp4Fixture{gop: "IPPIPPIPP", audio: true}.withDefaults()
+	path := filepath.Join(t.TempDir(), "moshed.mp4")
+	require.NoError(t, os.WriteFile(path, fixture.build(t), 0o644))
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = StreamFrames(context.Background(), f, NullifyIFrames)
+	require.NoError(t, err)
+
+	// the key frames nullified in place stay out of the stss box once remuxed
+	syncSamples := func(track *Track) []uint32 {
+		var ids []uint32
+		for id, flags := range track.SampleFlags {
+			if flags.Sync {
+				ids = append(ids, uint32(id))
+			}
+		}
+		return ids
+	}
+	tracks, _, err := Demux(f)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0}, syncSamples(tracks[0]))
+	out := &bytes.Buffer{}
+	require.NoError(t, (&MP4Muxer{Faststart: true}).Mux(out, f, []MuxTrack{{Track: tracks[0]}, {Track: tracks[1]}}))
+
+	got, _, err := Demux(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, []uint32{0}, syncSamples(got[0]))
+	assert.Len(t, syncSamples(got[1]), len(got[1].Samples))
+	// nor are they listed as intra frames
+	for _, id := range []int{3, 6} {
+		assert.Zero(t, got[0].SampleFlags[id].DependsOn, "sample %d", id)
+	}
+}
+
+func TestMuxWebM(t *testing.T) {
+	ivf := testIVF(testAV1Frames())
+	out := &bytes.Buffer{}
+	require.NoError(t, Remux(out, bytes.NewReader(ivf), ContainerWebM, nil))
+
+	tracks, format, err := Demux(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, ContainerWebM, format)
+	require.Len(t, tracks, 1)
+	require.NotNil(t, tracks[0].AV1)
+	assert.Equal(t, uint16(320), tracks[0].AV1.Width)
+	assert.Len(t, tracks[0].Samples, 4)
+	assert.Equal(t, []uint32{0, 1, 3}, DropKeyFrames(tracks[0]))
+
+	assert.False(t, (&MKVMuxer{WebM: true}).Supports(&Track{AVC: &AVCDecoderConfig{}}))
+}
@@ -18,6 +18,10 @@ const (
 	TrackKey
 	IFrameRemovedCountKey
 	InteractiveKey
+
+	lastKeySampleKey
+	keepKeySampleKey
+	nullifiedSamplesKey // map[uint32]bool of the samples nullified in the track
 )
 
 // readBitsInt reads the specified number of bits from the reader and returns as an int.
@@ -0,0 +1,248 @@
+package datamosh
+
+// alpha' and beta' as a function of indexA and indexB.
+// See Table 8-16
+var (
+	deblockAlpha = [52]int32{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		4, 4, 5, 6, 7, 8, 9, 10, 12, 13, 15, 17, 20, 22, 25, 28,
+		32, 36, 40, 45, 50, 56, 63, 71, 80, 90, 101, 113, 127, 144, 162, 182,
+		203, 226, 255, 255,
+	}
+	deblockBeta = [52]int32{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 6, 6, 7, 7, 8, 8,
+		9, 9, 10, 10, 11, 11, 12, 12, 13, 13, 14, 14, 15, 15, 16, 16,
+		17, 17, 18, 18,
+	}
+)
+
+// tC0' as a function of indexA and bS, for bS 1 to 3.
+// See Table 8-17
+var deblockTC0 = [52][3]int32{
+	{0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0},
+	{0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0},
+	{0, 0, 0}, {0, 0, 1}, {0, 0, 1}, {0, 0, 1}, {0, 0, 1}, {0, 1, 1}, {0, 1, 1}, {1, 1, 1},
+	{1, 1, 1}, {1, 1, 1}, {1, 1, 1}, {1, 1, 2}, {1, 1, 2}, {1, 1, 2}, {1, 1, 2}, {1, 2, 3},
+	{1, 2, 3}, {2, 2, 3}, {2, 2, 4}, {2, 3, 4}, {2, 3, 4}, {3, 3, 5}, {3, 4, 6}, {3, 4, 6},
+	{4, 5, 7}, {4, 5, 8}, {4, 6, 9}, {5, 7, 10}, {6, 8, 11}, {6, 8, 13}, {7, 10, 14}, {8, 11, 16},
+	{9, 12, 18}, {10, 13, 20}, {11, 15, 23}, {13, 17, 25},
+}
+
+// deblock applies the deblocking filter to the decoded macroblocks.
+// See 8.7 Deblocking filter process
+func (p *h264Picture) deblock() {
+	for mbAddr := range p.mbs {
+		p.deblockMacroblock(mbAddr)
+	}
+}
+
+// deblockQP returns the QPY of a macroblock for the deblocking filter.
+func deblockQP(mb *h264Macroblock) int {
+	if mb.kind == mbIPCM {
+		return 0
+	}
+	return mb.qp
+}
+
+func (p *h264Picture) deblockMacroblock(mbAddr int) {
+	mb := &p.mbs[mbAddr]
+	if mb.slice == 0 {
+		return
+	}
+	h := p.slices[mb.slice-1]
+	if h.DisableDeblockingFilterIDC == 1 {
+		return
+	}
+	mbX, mbY := mbAddr%p.widthMbs, mbAddr/p.widthMbs
+
+	// the macroblocks on the other side of the left and top edges
+	var left, top *h264Macroblock
+	if mbX > 0 {
+		left = &p.mbs[mbAddr-1]
+	}
+	if mbY > 0 {
+		top = &p.mbs[mbAddr-p.widthMbs]
+	}
+	for _, n := range []**h264Macroblock{&left, &top} {
+		if *n != nil && ((*n).slice == 0 || (h.DisableDeblockingFilterIDC == 2 && (*n).slice != mb.slice)) {
+			*n = nil
+		}
+	}
+
+	img := p.img
+	f := edgeFilter{
+		offsetA: 2 * h.SliceAlphaC0OffsetDiv2,
+		offsetB: 2 * h.SliceBetaOffsetDiv2,
+	}
+	chromaOffsets := [2]int32{h.pps.ChromaQPIndexOffset, h.pps.SecondChromaQPIndexOffset}
+
+	for _, vertical := range []bool{true, false} {
+		neighbour := top
+		if vertical {
+			neighbour = left
+		}
+		for edge := 0; edge < 4; edge++ {
+			pMB := mb
+			if edge == 0 {
+				if neighbour == nil {
+					continue
+				}
+				pMB = neighbour
+			}
+			var bS [4]int
+			for k := range bS {
+				// the 4x4 blocks on both sides of the edge
+				qBlk, pBlk := k*4+edge, k*4+(edge+3)%4
+				if !vertical {
+					qBlk, pBlk = edge*4+k, (edge+3)%4*4+k
+				}
+				bS[k] = boundaryStrength(pMB, mb, pBlk, qBlk, edge == 0)
+			}
+
+			x, y := mbX*16+edge*4, mbY*16
+			if !vertical {
+				x, y = mbX*16, mbY*16+edge*4
+			}
+			// the luma edges inside the 8x8 transform blocks aren't filtered
+			if edge%2 == 0 || !mb.transform8x8 {
+				f.qp = (deblockQP(pMB) + deblockQP(mb) + 1) >> 1
+				f.filter(img.Y, img.YOffset(x, y), img.YStride, vertical, bS, false)
+			}
+
+			// the chroma edges are on the luma edges 0 and 2
+			if edge%2 != 0 {
+				continue
+			}
+			for c, plane := range [][]byte{img.Cb, img.Cr} {
+				f.qp = (chromaQP(deblockQP(pMB), chromaOffsets[c]) + chromaQP(deblockQP(mb), chromaOffsets[c]) + 1) >> 1
+				f.filter(plane, img.COffset(x, y), img.CStride, vertical, bS, true)
+			}
+		}
+	}
+}
+
+// boundaryStrength returns bS for the edge between the luma blocks pBlk of
+// pMB and qBlk of qMB, given in raster order.
+// See 8.7.2.1 Derivation process for the luma content dependent boundary filtering strength
+func boundaryStrength(pMB, qMB *h264Macroblock, pBlk, qBlk int, mbEdge bool) int {
+	switch {
+	case (pMB.isIntra() || qMB.isIntra()) && mbEdge:
+		return 4
+	case pMB.isIntra() || qMB.isIntra():
+		return 3
+	case pMB.codedLuma(pBlk) || qMB.codedLuma(qBlk):
+		return 2
+	case pMB.refIDs[pBlk/8*2+pBlk%4/2] != qMB.refIDs[qBlk/8*2+qBlk%4/2]:
+		return 1
+	}
+	pMV, qMV := pMB.mvs[pBlk], qMB.mvs[qBlk]
+	if abs32(pMV[0]-qMV[0]) >= 4 || abs32(pMV[1]-qMV[1]) >= 4 {
+		return 1
+	}
+	return 0
+}
+
+// edgeFilter holds the parameters of the filtering of an edge.
+type edgeFilter struct {
+	offsetA, offsetB int32
+	qp               int // qPav
+}
+
+// filter filters the samples across an edge of a macroblock, 16 samples long
+// for luma and 8 for chroma, starting at plane[origin]. bS is given for each
+// quarter of the edge.
+// See 8.7.2 Filtering process for a set of samples separating two blocks
+func (f *edgeFilter) filter(plane []byte, origin, stride int, vertical bool, bS [4]int, chroma bool) {
+	indexA := clip3(0, 51, int32(f.qp)+f.offsetA)
+	indexB := clip3(0, 51, int32(f.qp)+f.offsetB)
+	alpha, beta := deblockAlpha[indexA], deblockBeta[indexB]
+	if alpha == 0 || beta == 0 {
+		return
+	}
+
+	// across is the distance between the samples on both sides of the edge
+	across, along := 1, stride
+	if !vertical {
+		across, along = stride, 1
+	}
+	length := 16
+	if chroma {
+		length = 8
+	}
+	for i := 0; i < length; i++ {
+		bs := bS[i*4/length]
+		if bs == 0 {
+			continue
+		}
+		q := origin + i*along
+		p0, q0 := int32(plane[q-across]), int32(plane[q])
+		p1, q1 := int32(plane[q-2*across]), int32(plane[q+across])
+		if abs32(p0-q0) >= alpha || abs32(p1-p0) >= beta || abs32(q1-q0) >= beta {
+			continue
+		}
+
+		if chroma {
+			if bs < 4 {
+				tc := deblockTC0[indexA][bs-1] + 1
+				delta := clip3(-tc, tc, ((q0-p0)<<2+(p1-q1)+4)>>3)
+				plane[q-across] = clip1(p0 + delta)
+				plane[q] = clip1(q0 - delta)
+			} else {
+				plane[q-across] = byte((2*p1 + p0 + q1 + 2) >> 2)
+				plane[q] = byte((2*q1 + q0 + p1 + 2) >> 2)
+			}
+			continue
+		}
+
+		p2, q2 := int32(plane[q-3*across]), int32(plane[q+2*across])
+		ap, aq := abs32(p2-p0), abs32(q2-q0)
+		if bs < 4 {
+			tc0 := deblockTC0[indexA][bs-1]
+			tc := tc0
+			if ap < beta {
+				tc++
+			}
+			if aq < beta {
+				tc++
+			}
+			delta := clip3(-tc, tc, ((q0-p0)<<2+(p1-q1)+4)>>3)
+			plane[q-across] = clip1(p0 + delta)
+			plane[q] = clip1(q0 - delta)
+			if ap < beta {
+				plane[q-2*across] = clip1(p1 + clip3(-tc0, tc0, (p2+((p0+q0+1)>>1)-(p1<<1))>>1))
+			}
+			if aq < beta {
+				plane[q+across] = clip1(q1 + clip3(-tc0, tc0, (q2+((p0+q0+1)>>1)-(q1<<1))>>1))
+			}
+			continue
+		}
+
+		p3, q3 := int32(plane[q-4*across]), int32(plane[q+3*across])
+		strong := abs32(p0-q0) < (alpha>>2)+2
+		if ap < beta && strong {
+			plane[q-across] = byte((p2 + 2*p1 + 2*p0 + 2*q0 + q1 + 4) >> 3)
+			plane[q-2*across] = byte((p2 + p1 + p0 + q0 + 2) >> 2)
+			plane[q-3*across] = byte((2*p3 + 3*p2 + p1 + p0 + q0 + 4) >> 3)
+		} else {
+			plane[q-across] = byte((2*p1 + p0 + q1 + 2) >> 2)
+		}
+		if aq < beta && strong {
+			plane[q] = byte((p1 + 2*p0 + 2*q0 + 2*q1 + q2 + 4) >> 3)
+			plane[q+across] = byte((p0 + q0 + q1 + q2 + 2) >> 2)
+			plane[q+2*across] = byte((2*q3 + 3*q2 + q1 + q0 + p0 + 4) >> 3)
+		} else {
+			plane[q] = byte((2*q1 + q0 + p1 + 2) >> 2)
+		}
+	}
+}
+
+func clip3(lo, hi, v int32) int32 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
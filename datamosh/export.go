@@ -0,0 +1,181 @@
+package datamosh
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+)
+
+// TimeRange selects frames by presentation time, in seconds, as given by
+// Track.PresentationTime. The start is
+// inclusive and the end exclusive, an End of 0 or less selects the frames
+// up to the end of the track.
+type TimeRange struct {
+	Start float64
+	End   float64
+}
+
+// Contains returns true if the time range contains t, in seconds.
+func (r TimeRange) Contains(t float64) bool {
+	return t >= r.Start && (r.End <= 0 || t < r.End)
+}
+
+// FrameWriter writes decoded frames, pts being their presentation time in
+// seconds.
+type FrameWriter interface {
+	WriteFrame(img *image.YCbCr, pts float64) error
+}
+
+// ExportFrames decodes the H.264 video of the track and writes the frames
+// presented within the time range to fw. The frames are written in decoding
+// order, which is the presentation order of the streams without B slices the
+// decoder supports. Timestamps come from the NAL units of the samples, the
+// frames the edit list doesn't present being skipped.
+func (t *Track) ExportFrames(r io.ReadSeeker, tr TimeRange, fw FrameWriter) error {
+	if t.Timescale == 0 {
+		return errors.New("track timescale is not set")
+	}
+	timestamps := make(map[uint32]uint64, len(t.Samples))
+	for _, nal := range t.NALs {
+		timestamps[nal.SampleID] = nal.Timestamp
+	}
+	errDone := errors.New("done")
+	err := t.DecodeFrames(r, func(sampleID uint32, img *image.YCbCr) error {
+		ts, shown := t.PresentationTime(int64(timestamps[sampleID]))
+		if !shown {
+			return nil
+		}
+		pts := ts.Seconds()
+		if tr.End > 0 && pts >= tr.End {
+			return errDone
+		}
+		if !tr.Contains(pts) {
+			return nil
+		}
+		return fw.WriteFrame(img, pts)
+	})
+	if err == errDone {
+		return nil
+	}
+	return err
+}
+
+// FrameRate returns the frame rate of a video track as a fraction, from the
+// most common sample duration.
+func (t *Track) FrameRate() (num, den uint32) {
+	counts := map[uint32]int{}
+	var delta uint32
+	for _, sample := range t.Samples {
+		counts[sample.TimeDelta]++
+		if sample.TimeDelta != 0 && (delta == 0 || counts[sample.TimeDelta] > counts[delta]) {
+			delta = sample.TimeDelta
+		}
+	}
+	if delta == 0 || t.Timescale == 0 {
+		return 25, 1
+	}
+	g := gcd(t.Timescale, delta)
+	return t.Timescale / g, delta / g
+}
+
+func gcd(a, b uint32) uint32 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Y4MWriter writes 4:2:0 frames to a YUV4MPEG2 stream, the stream header is
+// written with the first frame, whose size all the frames must have.
+type Y4MWriter struct {
+	w              io.Writer
+	fpsNum, fpsDen uint32
+	width, height  int
+	headerWritten  bool
+}
+
+// NewY4MWriter returns a writer of YUV4MPEG2 streams with the given frame
+// rate, see Track.FrameRate.
+func NewY4MWriter(w io.Writer, fpsNum, fpsDen uint32) *Y4MWriter {
+	return &Y4MWriter{w: w, fpsNum: fpsNum, fpsDen: fpsDen}
+}
+
+// WriteFrame writes a frame, its timestamp is ignored as YUV4MPEG2 streams
+// have a constant frame rate.
+func (y *Y4MWriter) WriteFrame(img *image.YCbCr, pts float64) error {
+	if img.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return fmt.Errorf("unsupported chroma subsampling: %v", img.SubsampleRatio)
+	}
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if !y.headerWritten {
+		// H.264 places the 4:2:0 chroma samples as MPEG-2 does
+		header := fmt.Sprintf("YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C420mpeg2\n", width, height, y.fpsNum, y.fpsDen)
+		if _, err := io.WriteString(y.w, header); err != nil {
+			return err
+		}
+		y.width, y.height = width, height
+		y.headerWritten = true
+	} else if width != y.width || height != y.height {
+		return fmt.Errorf("frame size %dx%d doesn't match the stream size %dx%d", width, height, y.width, y.height)
+	}
+
+	if _, err := io.WriteString(y.w, "FRAME\n"); err != nil {
+		return err
+	}
+	min := img.Rect.Min
+	for j := 0; j < height; j++ {
+		offset := img.YOffset(min.X, min.Y+j)
+		if _, err := y.w.Write(img.Y[offset : offset+width]); err != nil {
+			return err
+		}
+	}
+	chromaW, chromaH := (width+1)/2, (height+1)/2
+	for _, plane := range [][]byte{img.Cb, img.Cr} {
+		for j := 0; j < chromaH; j++ {
+			offset := img.COffset(min.X, min.Y+j*2)
+			if _, err := y.w.Write(plane[offset : offset+chromaW]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PNGSequenceWriter writes frames to numbered PNG files.
+type PNGSequenceWriter struct {
+	// Pattern is the path of the files with a verb for the frame number,
+	// for instance "frames/mosh-%05d.png".
+	Pattern string
+	// Start is the number of the first frame.
+	Start int
+
+	count int
+}
+
+// NewPNGSequenceWriter returns a writer of PNG files named after pattern,
+// which must have a verb for the frame number.
+func NewPNGSequenceWriter(pattern string) (*PNGSequenceWriter, error) {
+	if !strings.Contains(pattern, "%") {
+		return nil, fmt.Errorf("the PNG file pattern %q has no frame number verb, such as %%05d", pattern)
+	}
+	return &PNGSequenceWriter{Pattern: pattern}, nil
+}
+
+// WriteFrame writes a frame to the next file of the sequence.
+func (p *PNGSequenceWriter) WriteFrame(img *image.YCbCr, pts float64) error {
+	name := fmt.Sprintf(p.Pattern, p.Start+p.count)
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to encode %s: %v", name, err)
+	}
+	p.count++
+	return f.Close()
+}
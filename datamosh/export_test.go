@@ -0,0 +1,135 @@
+package datamosh
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testH264Track returns a 25 fps track of 2x1 macroblocks with a key frame
+// followed by skipped P frames, and its sample data.
+func testH264Track(frames int) (*Track, []byte) {
+	sps, pps := testH264SPS(2, 1, 8), testH264PPS(false)
+	track := &Track{Timescale: 1000, AVC: &AVCDecoderConfig{}}
+	track.AVC.SequenceParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(sps)), NALUnit: sps}}
+	track.AVC.PictureParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(pps)), NALUnit: pps}}
+	var data []byte
+	for i := 0; i < frames; i++ {
+		nal := testH264PCMSlice(2)
+		if i > 0 {
+			nal = testH264PSlice(uint32(i), func(w *rbspWriter) { w.ue(2) })
+		}
+		track.Samples = append(track.Samples, &mp4.Sample{Size: uint32(len(nal)), TimeDelta: 40})
+		track.NALs = append(track.NALs, &NALUnit{Offset: int64(len(data)), Length: uint32(len(nal)), SampleID: uint32(i), Timestamp: uint64(i * 40)})
+		data = append(data, nal...)
+	}
+	return track, data
+}
+
+type testFrameWriter struct {
+	pts []float64
+}
+
+func (w *testFrameWriter) WriteFrame(img *image.YCbCr, pts float64) error {
+	w.pts = append(w.pts, pts)
+	return nil
+}
+
+func TestTrackExportFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		tr   TimeRange
+		want []float64
+	}{
+		{name: "all", want: []float64{0, 0.04, 0.08, 0.12, 0.16}},
+		{name: "start", tr: TimeRange{Start: 0.08}, want: []float64{0.08, 0.12, 0.16}},
+		{name: "range", tr: TimeRange{Start: 0.03, End: 0.12}, want: []float64{0.04, 0.08}},
+		{name: "empty", tr: TimeRange{Start: 1}},
+	}
+	track, data := testH264Track(5)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testFrameWriter{}
+			require.NoError(t, track.ExportFrames(bytes.NewReader(data), tt.tr, w))
+			assert.InDeltaSlice(t, tt.want, w.pts, 1e-9)
+		})
+	}
+}
+
+func TestTrackFrameRate(t *testing.T) {
+	track, _ := testH264Track(3)
+	num, den := track.FrameRate()
+	assert.Equal(t, []uint32{25, 1}, []uint32{num, den})
+
+	track = &Track{Timescale: 30000}
+	for i := 0; i < 3; i++ {
+		track.Samples = append(track.Samples, &mp4.Sample{TimeDelta: 1001})
+	}
+	num, den = track.FrameRate()
+	assert.Equal(t, []uint32{30000, 1001}, []uint32{num, den})
+}
+
+func TestY4MWriter(t *testing.T) {
+	img := image.NewYCbCr(image.Rect(0, 0, 6, 4), image.YCbCrSubsampleRatio420)
+	for i := range img.Y {
+		img.Y[i] = byte(i)
+	}
+	for i := range img.Cb {
+		img.Cb[i] = byte(100 + i)
+		img.Cr[i] = byte(200 + i)
+	}
+	// the cropped picture of the decoder starts at the origin but the
+	// writer shouldn't rely on it
+	sub := img.SubImage(image.Rect(2, 2, 6, 4)).(*image.YCbCr)
+
+	var buf bytes.Buffer
+	w := NewY4MWriter(&buf, 30000, 1001)
+	require.NoError(t, w.WriteFrame(sub, 0))
+	require.NoError(t, w.WriteFrame(sub, 1001.0/30000))
+
+	frame := append([]byte("FRAME\n"), 14, 15, 16, 17, 20, 21, 22, 23, 104, 105, 204, 205)
+	want := append([]byte("YUV4MPEG2 W4 H2 F30000:1001 Ip A1:1 C420mpeg2\n"), frame...)
+	want = append(want, frame...)
+	assert.Equal(t, want, buf.Bytes())
+
+	err := w.WriteFrame(img, 0)
+	assert.EqualError(t, err, "frame size 6x4 doesn't match the stream size 4x2")
+	err = w.WriteFrame(image.NewYCbCr(image.Rect(0, 0, 4, 2), image.YCbCrSubsampleRatio444), 0)
+	assert.Error(t, err)
+}
+
+func TestPNGSequenceWriter(t *testing.T) {
+	_, err := NewPNGSequenceWriter("frame.png")
+	assert.Error(t, err)
+
+	dir := t.TempDir()
+	w, err := NewPNGSequenceWriter(filepath.Join(dir, "mosh-%03d.png"))
+	require.NoError(t, err)
+	w.Start = 1
+	track, data := testH264Track(3)
+	require.NoError(t, track.ExportFrames(bytes.NewReader(data), TimeRange{Start: 0.04}, w))
+	// the P frames are skipped, showing the key frame
+	key, err := track.DecodeKeyframe(bytes.NewReader(data), track.NALs[0])
+	require.NoError(t, err)
+
+	for i := 1; i <= 2; i++ {
+		f, err := os.Open(filepath.Join(dir, fmt.Sprintf("mosh-%03d.png", i)))
+		require.NoError(t, err)
+		img, err := png.Decode(f)
+		f.Close()
+		require.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, 24, 16), img.Bounds())
+		assert.Equal(t, color.RGBAModel.Convert(key.At(5, 3)), color.RGBAModel.Convert(img.At(5, 3)))
+	}
+	_, err = os.Stat(filepath.Join(dir, "mosh-003.png"))
+	assert.True(t, os.IsNotExist(err))
+}
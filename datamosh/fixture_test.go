@@ -0,0 +1,519 @@
+package datamosh
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/require"
+)
+
+// Timing of the fixtures: 25 fps video and 48 kHz AAC frames.
+const (
+	fixtureTimescale     = 12800
+	fixtureFrameDuration = 512
+	fixtureSampleRate    = 48000
+	fixtureAudioFrame    = 1024 // samples per AAC frame
+)
+
+// mp4Fixture describes a small deterministic H.264 MP4 file built for tests,
+// so the parsing and moshing code can be covered without sample videos.
+type mp4Fixture struct {
+	widthMbs, heightMbs int    // 2x2 by default
+	gop                 string // frame types in presentation order: I (IDR), i (non IDR I), P and B
+	slices              int    // per frame, splitting the macroblock rows
+	chunk               int    // video samples per chunk, 4 by default
+	editList            []mp4.ElstEntry
+	co64                bool // use 64 bit chunk offsets
+	audio               bool // add an AAC track interleaved with the video
+	interlaced          bool // unset frame_mbs_only_flag, the pictures being coded as frames
+	recoveryPoints      bool // prefix the non IDR I frames with a recovery point SEI
+	noStss              bool // leave out the stss box, all the samples being sync samples
+}
+
+// fixtureFrame is a coded frame of a fixture.
+type fixtureFrame struct {
+	kind     byte // as in mp4Fixture.gop
+	index    int  // in presentation order
+	pts, dts uint64
+	nals     [][]byte // one per slice
+}
+
+// fixtureNALHeaders are the NAL header and slice_type of the frame kinds.
+var fixtureNALHeaders = map[byte][2]uint32{
+	'I': {0x65, 7},
+	'i': {0x61, 7},
+	'P': {0x41, 5},
+	'B': {0x01, 6},
+}
+
+// fixtureRecoveryPoint is an SEI NAL unit holding a recovery point message
+// with a recovery_frame_cnt of 2.
+var fixtureRecoveryPoint = []byte{
+	0x06,
+	0x06, 0x01, // payloadType, payloadSize
+	0x71, // recovery_frame_cnt, exact_match_flag, broken_link_flag, changing_slice_group_idc
+	0x80,
+}
+
+// fixtureSample is the value of the luma samples of the I frame at index.
+func fixtureSample(index, x, y int) byte {
+	return byte(x*7 + y*13 + index*29 + 1)
+}
+
+func (f mp4Fixture) withDefaults() mp4Fixture {
+	if f.widthMbs == 0 {
+		f.widthMbs = 2
+	}
+	if f.heightMbs == 0 {
+		f.heightMbs = 2
+	}
+	if f.slices == 0 {
+		f.slices = 1
+	}
+	if f.chunk == 0 {
+		f.chunk = 4
+	}
+	return f
+}
+
+// sps returns a Main profile SPS with 8 bit picture order counts and two
+// reference frames, for B frames.
+func (f mp4Fixture) sps() []byte {
+	w := newRBSPWriter()
+	w.u(8, 77) // profile_idc
+	w.u(8, 0)  // constraint flags
+	w.u(8, 30) // level_idc
+	w.ue(0)    // seq_parameter_set_id
+	w.ue(0)    // log2_max_frame_num_minus4
+	w.ue(0)    // pic_order_cnt_type
+	w.ue(4)    // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(2)    // max_num_ref_frames
+	w.flag(false)
+	w.ue(uint32(f.widthMbs - 1))
+	w.ue(uint32(f.heightMbs - 1))
+	w.flag(!f.interlaced) // frame_mbs_only_flag
+	if f.interlaced {
+		w.flag(false) // mb_adaptive_frame_field_flag
+	}
+	w.flag(true)  // direct_8x8_inference_flag
+	w.flag(false) // frame_cropping_flag
+	w.flag(false) // vui_parameters_present_flag
+	return testH264NAL(0x67, w)
+}
+
+// frames returns the frames of the fixture in decoding order, B frames
+// following the next I or P frame. The presentation times are delayed by a
+// frame when there are B frames so they are never before the decoding times.
+func (f mp4Fixture) frames() []fixtureFrame {
+	var delay uint64
+	for _, kind := range f.gop {
+		if kind == 'B' {
+			delay = 1
+		}
+	}
+	order := make([]int, 0, len(f.gop))
+	var pending []int
+	for i := range f.gop {
+		if f.gop[i] == 'B' {
+			pending = append(pending, i)
+			continue
+		}
+		order = append(order, i)
+		order = append(order, pending...)
+		pending = nil
+	}
+	order = append(order, pending...)
+
+	frames := make([]fixtureFrame, 0, len(order))
+	var frameNum, idrIndex int
+	var idrPicID uint32
+	prevRefFrameNum := -1
+	for n, i := range order {
+		frame := fixtureFrame{
+			kind:  f.gop[i],
+			index: i,
+			pts:   (uint64(i) + delay) * fixtureFrameDuration,
+			dts:   uint64(n) * fixtureFrameDuration,
+		}
+		if frame.kind == 'I' {
+			if n > 0 {
+				idrPicID ^= 1
+			}
+			idrIndex, frameNum, prevRefFrameNum = i, 0, -1
+		} else {
+			frameNum = (prevRefFrameNum + 1) % 16
+		}
+		if frame.kind != 'B' {
+			prevRefFrameNum = frameNum
+		}
+		poc := uint32(2*(i-idrIndex)) % 256
+		if f.recoveryPoints && frame.kind == 'i' {
+			frame.nals = append(frame.nals, fixtureRecoveryPoint)
+		}
+		for s := 0; s < f.slices; s++ {
+			first, end := s*f.heightMbs/f.slices, (s+1)*f.heightMbs/f.slices
+			frame.nals = append(frame.nals, f.slice(frame, uint32(frameNum), poc, idrPicID, first, end))
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// slice returns a slice of the macroblock rows first to end of a frame. I
+// slices are made of I_PCM macroblocks, the other ones are skipped.
+// See 7.3.3 Slice header syntax
+func (f mp4Fixture) slice(frame fixtureFrame, frameNum, poc, idrPicID uint32, first, end int) []byte {
+	header := fixtureNALHeaders[frame.kind]
+	w := newRBSPWriter()
+	w.ue(uint32(first * f.widthMbs)) // first_mb_in_slice
+	w.ue(header[1])                  // slice_type
+	w.ue(0)                          // pic_parameter_set_id
+	w.u(4, frameNum)
+	if f.interlaced {
+		w.flag(false) // field_pic_flag
+	}
+	if frame.kind == 'I' {
+		w.ue(idrPicID)
+	}
+	w.u(8, poc) // pic_order_cnt_lsb
+	if frame.kind == 'B' {
+		w.flag(true) // direct_spatial_mv_pred_flag
+	}
+	if frame.kind == 'P' || frame.kind == 'B' {
+		w.flag(false) // num_ref_idx_active_override_flag
+		w.flag(false) // ref_pic_list_modification_flag_l0
+	}
+	if frame.kind == 'B' {
+		w.flag(false) // ref_pic_list_modification_flag_l1
+	}
+	switch frame.kind {
+	case 'I':
+		w.flag(false) // no_output_of_prior_pics_flag
+		w.flag(false) // long_term_reference_flag
+	case 'i', 'P':
+		w.flag(false) // adaptive_ref_pic_marking_mode_flag
+	}
+	w.se(0) // slice_qp_delta
+
+	if frame.kind == 'P' || frame.kind == 'B' {
+		w.ue(uint32((end - first) * f.widthMbs)) // mb_skip_run
+		return testH264NAL(byte(header[0]), w)
+	}
+	for row := first; row < end; row++ {
+		for col := 0; col < f.widthMbs; col++ {
+			w.ue(25) // mb_type I_PCM
+			for !w.byteAligned() {
+				w.u(1, 0)
+			}
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					w.u(8, uint32(fixtureSample(frame.index, col*16+x, row*16+y)))
+				}
+			}
+			for i := 0; i < 2*8*8; i++ {
+				w.u(8, uint32(40+frame.index*8+i%64))
+			}
+		}
+	}
+	return testH264NAL(byte(header[0]), w)
+}
+
+// audioFrames returns the AAC frames covering the video, filled with
+// deterministic noise.
+func (f mp4Fixture) audioFrames() [][]byte {
+	duration := uint64(len(f.gop)) * fixtureFrameDuration * fixtureSampleRate
+	perFrame := uint64(fixtureTimescale * fixtureAudioFrame)
+	rng := rand.New(rand.NewSource(int64(len(f.gop))))
+	frames := make([][]byte, (duration+perFrame-1)/perFrame)
+	for i := range frames {
+		frames[i] = make([]byte, 100+rng.Intn(64))
+		rng.Read(frames[i])
+	}
+	return frames
+}
+
+// fixtureChunk is a chunk of samples of a track.
+type fixtureChunk struct {
+	offset uint64
+	sizes  []uint32
+}
+
+// build returns the MP4 file: the media data, interleaving the video and
+// audio chunks, followed by the moov box.
+func (f mp4Fixture) build(t testing.TB) []byte {
+	t.Helper()
+	f = f.withDefaults()
+	require.LessOrEqual(t, f.slices, f.heightMbs, "more slices than macroblock rows")
+
+	ftyp := &mp4.Ftyp{MajorBrand: [4]byte{'i', 's', 'o', 'm'}, MinorVersion: 0x200}
+	ftyp.AddCompatibleBrand([4]byte{'i', 's', 'o', 'm'})
+	ftyp.AddCompatibleBrand([4]byte{'a', 'v', 'c', '1'})
+	ftypData, err := marshalMP4Box(ftyp)
+	require.NoError(t, err)
+
+	frames := f.frames()
+	var audio [][]byte
+	if f.audio {
+		audio = f.audioFrames()
+	}
+	// the audio frames go in the chunk of the video frames they start with
+	chunkCount := (len(frames) + f.chunk - 1) / f.chunk
+	audioChunk := func(i int) int {
+		c := i * fixtureAudioFrame * fixtureTimescale / (fixtureSampleRate * fixtureFrameDuration * f.chunk)
+		return min(c, chunkCount-1)
+	}
+
+	var data []byte
+	offset := uint64(len(ftypData) + 8)
+	var videoChunks, audioChunks []fixtureChunk
+	for c, a := 0, 0; c < chunkCount; c++ {
+		chunk := fixtureChunk{offset: offset + uint64(len(data))}
+		for _, frame := range frames[c*f.chunk : min((c+1)*f.chunk, len(frames))] {
+			var size uint32
+			for _, nal := range frame.nals {
+				data = binary.BigEndian.AppendUint32(data, uint32(len(nal)))
+				data = append(data, nal...)
+				size += 4 + uint32(len(nal))
+			}
+			chunk.sizes = append(chunk.sizes, size)
+		}
+		videoChunks = append(videoChunks, chunk)
+
+		chunk = fixtureChunk{offset: offset + uint64(len(data))}
+		for ; a < len(audio) && audioChunk(a) == c; a++ {
+			data = append(data, audio[a]...)
+			chunk.sizes = append(chunk.sizes, uint32(len(audio[a])))
+		}
+		if len(chunk.sizes) > 0 {
+			audioChunks = append(audioChunks, chunk)
+		}
+	}
+	mdat := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	mdat = append(append(mdat, "mdat"...), data...)
+
+	duration := uint64(len(frames)) * fixtureFrameDuration
+	traks := [][]byte{f.videoTrak(t, frames, videoChunks)}
+	if f.audio {
+		traks = append(traks, f.audioTrak(t, len(audio), audioChunks))
+	}
+	mvhd := &mp4.Mvhd{
+		Timescale:   mp4MovieTimescale,
+		DurationV0:  uint32(duration * mp4MovieTimescale / fixtureTimescale),
+		Rate:        0x00010000,
+		Volume:      0x0100,
+		Matrix:      [9]int32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000},
+		NextTrackID: uint32(len(traks) + 1),
+	}
+	mvhdData, err := marshalMP4Box(mvhd)
+	require.NoError(t, err)
+	moov, err := marshalMP4Box(&mp4.Moov{}, append([][]byte{mvhdData}, traks...)...)
+	require.NoError(t, err)
+
+	file := append(ftypData, mdat...)
+	return append(file, moov...)
+}
+
+// file writes the fixture to a temporary file and returns its path.
+func (f mp4Fixture) file(t testing.TB) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fixture.mp4")
+	require.NoError(t, os.WriteFile(path, f.build(t), 0o644))
+	return path
+}
+
+func (f mp4Fixture) videoTrak(t testing.TB, frames []fixtureFrame, chunks []fixtureChunk) []byte {
+	sps, pps := f.sps(), testH264PPS(false)
+	avc := &AVCDecoderConfig{
+		LengthSize: 4,
+		Width:      uint16(f.widthMbs * 16),
+		Height:     uint16(f.heightMbs * 16),
+	}
+	avc.Type = mp4.BoxTypeAvcC()
+	avc.ConfigurationVersion = 1
+	avc.Profile = 77
+	avc.Level = 30
+	avc.LengthSizeMinusOne = 3
+	avc.NumOfSequenceParameterSets = 1
+	avc.SequenceParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(sps)), NALUnit: sps}}
+	avc.NumOfPictureParameterSets = 1
+	avc.PictureParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(pps)), NALUnit: pps}}
+	stsd, err := newMP4Stsd(&Track{TrackID: 1, AVC: avc})
+	require.NoError(t, err)
+
+	stts := &mp4.Stts{EntryCount: 1, Entries: []mp4.SttsEntry{{SampleCount: uint32(len(frames)), SampleDelta: fixtureFrameDuration}}}
+	ctts := &mp4.Ctts{}
+	stss := &mp4.Stss{}
+	sdtp := &mp4.Sdtp{}
+	// the non IDR I frames are open GOP random access points
+	sgpd := &mp4.Sgpd{
+		FullBox:                   mp4.FullBox{Version: 1},
+		GroupingType:              groupingTypeRap,
+		DefaultLength:             1,
+		EntryCount:                1,
+		VisualRandomAccessEntries: []mp4.VisualRandomAccessEntry{{}},
+	}
+	sbgp := &mp4.Sbgp{GroupingType: binary.BigEndian.Uint32(groupingTypeRap[:])}
+	for i, frame := range frames {
+		ctts.Entries = append(ctts.Entries, mp4.CttsEntry{SampleCount: 1, SampleOffsetV0: uint32(frame.pts - frame.dts)})
+		if frame.kind == 'I' {
+			stss.SampleNumber = append(stss.SampleNumber, uint32(i+1))
+		}
+		elem := mp4.SdtpSampleElem{SampleDependsOn: 1, SampleIsDependedOn: 1}
+		switch frame.kind {
+		case 'I', 'i':
+			elem.SampleDependsOn = 2
+		case 'B':
+			elem.SampleIsDependedOn = 2
+		}
+		sdtp.Samples = append(sdtp.Samples, elem)
+		var index uint32
+		if frame.kind == 'i' {
+			index = 1
+		}
+		if n := len(sbgp.Entries); n > 0 && sbgp.Entries[n-1].GroupDescriptionIndex == index {
+			sbgp.Entries[n-1].SampleCount++
+		} else {
+			sbgp.Entries = append(sbgp.Entries, mp4.SbgpEntry{SampleCount: 1, GroupDescriptionIndex: index})
+		}
+	}
+	ctts.EntryCount = uint32(len(ctts.Entries))
+	stss.EntryCount = uint32(len(stss.SampleNumber))
+	sbgp.EntryCount = uint32(len(sbgp.Entries))
+	boxes := []mp4.IImmutableBox{stts, ctts, stss, sdtp, sgpd, sbgp}
+	if f.noStss {
+		boxes = []mp4.IImmutableBox{stts, ctts, sdtp, sgpd, sbgp}
+	}
+	stbl := f.stbl(t, stsd, boxes, chunks)
+	return f.trak(t, 1, handlerVideo, uint64(len(frames))*fixtureFrameDuration, fixtureTimescale, f.editList, stbl)
+}
+
+func (f mp4Fixture) audioTrak(t testing.TB, count int, chunks []fixtureChunk) []byte {
+	// AAC LC, 48 kHz, stereo
+	asc := []byte{0x11, 0x90}
+	esds := &mp4.Esds{Descriptors: []mp4.Descriptor{
+		{Tag: mp4.ESDescrTag, Size: 3 + 2 + 13 + 2 + uint32(len(asc)) + 2 + 1, ESDescriptor: &mp4.ESDescriptor{ESID: 2}},
+		{Tag: mp4.DecoderConfigDescrTag, Size: 13 + 2 + uint32(len(asc)), DecoderConfigDescriptor: &mp4.DecoderConfigDescriptor{
+			ObjectTypeIndication: 0x40,
+			StreamType:           5,
+			Reserved:             true,
+			BufferSizeDB:         512,
+			MaxBitrate:           128000,
+			AvgBitrate:           128000,
+		}},
+		{Tag: mp4.DecSpecificInfoTag, Size: uint32(len(asc)), Data: asc},
+		{Tag: mp4.SLConfigDescrTag, Size: 1, Data: []byte{2}},
+	}}
+	esdsData, err := marshalMP4Box(esds)
+	require.NoError(t, err)
+	entry := &mp4.AudioSampleEntry{
+		SampleEntry:  mp4.SampleEntry{AnyTypeBox: mp4.AnyTypeBox{Type: mp4.BoxTypeMp4a()}, DataReferenceIndex: 1},
+		ChannelCount: 2,
+		SampleSize:   16,
+		SampleRate:   fixtureSampleRate << 16,
+	}
+	entryData, err := marshalMP4Box(entry, esdsData)
+	require.NoError(t, err)
+	stsd, err := marshalMP4Box(&mp4.Stsd{EntryCount: 1}, entryData)
+	require.NoError(t, err)
+
+	stts := &mp4.Stts{EntryCount: 1, Entries: []mp4.SttsEntry{{SampleCount: uint32(count), SampleDelta: fixtureAudioFrame}}}
+	stbl := f.stbl(t, stsd, []mp4.IImmutableBox{stts}, chunks)
+	return f.trak(t, 2, handlerAudio, uint64(count)*fixtureAudioFrame, fixtureSampleRate, nil, stbl)
+}
+
+// stbl returns the sample table of a track, with the sample to chunk, sample
+// size and chunk offset boxes built from its chunks.
+func (f mp4Fixture) stbl(t testing.TB, stsd []byte, boxes []mp4.IImmutableBox, chunks []fixtureChunk) []byte {
+	stsc := &mp4.Stsc{}
+	stsz := &mp4.Stsz{}
+	stco := &mp4.Stco{}
+	co64 := &mp4.Co64{}
+	for i, chunk := range chunks {
+		stsc.Entries = append(stsc.Entries, mp4.StscEntry{
+			FirstChunk:             uint32(i + 1),
+			SamplesPerChunk:        uint32(len(chunk.sizes)),
+			SampleDescriptionIndex: 1,
+		})
+		stsz.EntrySize = append(stsz.EntrySize, chunk.sizes...)
+		stco.ChunkOffset = append(stco.ChunkOffset, uint32(chunk.offset))
+		co64.ChunkOffset = append(co64.ChunkOffset, chunk.offset)
+	}
+	stsc.EntryCount = uint32(len(stsc.Entries))
+	stsz.SampleCount = uint32(len(stsz.EntrySize))
+	stco.EntryCount = uint32(len(chunks))
+	co64.EntryCount = uint32(len(chunks))
+	boxes = append(boxes, stsc, stsz)
+	if f.co64 {
+		boxes = append(boxes, co64)
+	} else {
+		boxes = append(boxes, stco)
+	}
+
+	children := [][]byte{stsd}
+	for _, box := range boxes {
+		data, err := marshalMP4Box(box)
+		require.NoError(t, err)
+		children = append(children, data)
+	}
+	stbl, err := marshalMP4Box(&mp4.Stbl{}, children...)
+	require.NoError(t, err)
+	return stbl
+}
+
+func (f mp4Fixture) trak(t testing.TB, trackID uint32, handler [4]byte, duration uint64, timescale uint32, editList []mp4.ElstEntry, stbl []byte) []byte {
+	tkhd := &mp4.Tkhd{
+		TrackID:    trackID,
+		DurationV0: uint32(duration * mp4MovieTimescale / uint64(timescale)),
+		Matrix:     [9]int32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000},
+	}
+	tkhd.SetFlags(0x000003) // enabled, in movie
+	if handler == handlerVideo {
+		tkhd.Width, tkhd.Height = uint32(f.widthMbs*16)<<16, uint32(f.heightMbs*16)<<16
+	} else {
+		tkhd.Volume = 0x0100
+	}
+	tkhdData, err := marshalMP4Box(tkhd)
+	require.NoError(t, err)
+	children := [][]byte{tkhdData}
+	if editList != nil {
+		elst := &mp4.Elst{EntryCount: uint32(len(editList)), Entries: editList}
+		elst.SetVersion(1)
+		edts, err := marshalMP4Boxes(&mp4.Edts{}, elst)
+		require.NoError(t, err)
+		children = append(children, edts)
+	}
+
+	mdhd := &mp4.Mdhd{
+		Timescale:  timescale,
+		DurationV0: uint32(duration),
+		Language:   [3]byte{'u' - 0x60, 'n' - 0x60, 'd' - 0x60},
+	}
+	mdhdData, err := marshalMP4Box(mdhd)
+	require.NoError(t, err)
+	hdlrData, err := marshalMP4Box(&mp4.Hdlr{HandlerType: handler})
+	require.NoError(t, err)
+	var mediaHeader []byte
+	if handler == handlerVideo {
+		vmhd := &mp4.Vmhd{}
+		vmhd.SetFlags(0x000001)
+		mediaHeader, err = marshalMP4Box(vmhd)
+	} else {
+		mediaHeader, err = marshalMP4Box(&mp4.Smhd{})
+	}
+	require.NoError(t, err)
+	url := &mp4.Url{}
+	url.SetFlags(mp4.UrlSelfContained)
+	dinf, err := marshalMP4Boxes(&mp4.Dinf{}, &mp4.Dref{EntryCount: 1}, url)
+	require.NoError(t, err)
+	minf, err := marshalMP4Box(&mp4.Minf{}, mediaHeader, dinf, stbl)
+	require.NoError(t, err)
+	mdia, err := marshalMP4Box(&mp4.Mdia{}, mdhdData, hdlrData, minf)
+	require.NoError(t, err)
+	trak, err := marshalMP4Box(&mp4.Trak{}, append(children, mdia)...)
+	require.NoError(t, err)
+	return trak
+}
@@ -0,0 +1,247 @@
+package datamosh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abema/go-mp4"
+)
+
+// FMP4Muxer writes fragmented MP4 files (CMAF): an init segment, the ftyp and
+// moov boxes describing the tracks, followed by media segments, a moof and an
+// mdat box each. The output can be appended to a browser MediaSource segment
+// by segment, but it is written from tracks already moshed: nothing is output
+// while a file is being processed.
+type FMP4Muxer struct {
+	// FragmentDuration is the target duration of the media segments in
+	// seconds, mp4ChunkDuration when 0. Segments start at the key frames of the
+	// first video track, or at any frame after twice the target duration as
+	// moshed tracks have few key frames left.
+	FragmentDuration float64
+	// Segment, if set, is called after the init segment, whose sequence number
+	// is 0, and after each media segment, to flush the output to a client or
+	// start the file of the next segment.
+	Segment func(sequence uint32) error
+}
+
+// Supports returns true for the tracks the MP4 muxer supports.
+func (m *FMP4Muxer) Supports(track *Track) bool {
+	return (&MP4Muxer{}).Supports(track)
+}
+
+// fmp4Fragment is a run of consecutive samples of each track in a media
+// segment.
+type fmp4Fragment struct {
+	first []int // index of the first sample of each track
+	count []int
+}
+
+// Mux writes the tracks, whose samples must all be known: the moov box is built
+// from the sample tables first, then the media segments are written one after
+// the other, Segment being called after each.
+func (m *FMP4Muxer) Mux(w io.Writer, r io.ReadSeeker, tracks []MuxTrack) error {
+	if len(tracks) == 0 {
+		return errors.New("no track to write")
+	}
+	samples := make([][]muxSample, len(tracks))
+	for i, t := range tracks {
+		if !m.Supports(t.Track) {
+			return fmt.Errorf("track %d can't be written to MP4", t.Track.TrackID)
+		}
+		var err error
+		if samples[i], err = t.muxSamples(); err != nil {
+			return err
+		}
+	}
+
+	ftyp, err := newMP4Ftyp(tracks, [4]byte{'i', 's', 'o', '6'}, [4]byte{'c', 'm', 'f', 'c'})
+	if err != nil {
+		return err
+	}
+	moov, err := newMP4Moov(tracks, samples, nil, true)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(ftyp); err != nil {
+		return fmt.Errorf("failed to write ftyp box: %v", err)
+	}
+	if _, err := w.Write(moov); err != nil {
+		return fmt.Errorf("failed to write moov box: %v", err)
+	}
+	if m.Segment != nil {
+		if err := m.Segment(0); err != nil {
+			return err
+		}
+	}
+
+	for i, fragment := range m.fragments(tracks, samples) {
+		sequence := uint32(i + 1)
+		if err := writeFMP4Fragment(w, r, sequence, tracks, samples, fragment); err != nil {
+			return err
+		}
+		if m.Segment != nil {
+			if err := m.Segment(sequence); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fragments splits the samples of the tracks into fragments, cut on the
+// timeline of the first video track.
+func (m *FMP4Muxer) fragments(tracks []MuxTrack, samples [][]muxSample) []*fmp4Fragment {
+	target := m.FragmentDuration
+	if target <= 0 {
+		target = mp4ChunkDuration
+	}
+	ref := 0
+	for i, t := range tracks {
+		if t.Track.IsVideo() {
+			ref = i
+			break
+		}
+	}
+	seconds := func(track int, s muxSample) float64 {
+		timescale := tracks[track].Track.Timescale
+		if timescale == 0 {
+			timescale = 1
+		}
+		return float64(s.dts) / float64(timescale)
+	}
+
+	// start times of the fragments, in seconds
+	starts := []float64{0}
+	for _, s := range samples[ref] {
+		elapsed := seconds(ref, s) - starts[len(starts)-1]
+		if (s.key && elapsed >= target) || elapsed >= 2*target {
+			starts = append(starts, seconds(ref, s))
+		}
+	}
+
+	fragments := make([]*fmp4Fragment, len(starts))
+	for f := range fragments {
+		fragments[f] = &fmp4Fragment{first: make([]int, len(tracks)), count: make([]int, len(tracks))}
+	}
+	for t := range tracks {
+		f := 0
+		for i, s := range samples[t] {
+			for f < len(starts)-1 && seconds(t, s) >= starts[f+1] {
+				f++
+			}
+			if fragments[f].count[t] == 0 {
+				fragments[f].first[t] = i
+			}
+			fragments[f].count[t]++
+		}
+	}
+	return fragments
+}
+
+// writeFMP4Fragment writes the moof and mdat boxes of a fragment, the data of
+// each track following the data of the previous one. See ISO/IEC 14496-12
+// 8.8.4.
+func writeFMP4Fragment(w io.Writer, r io.ReadSeeker, sequence uint32, tracks []MuxTrack, samples [][]muxSample, fragment *fmp4Fragment) error {
+	var dataSize uint64
+	for t := range tracks {
+		for _, s := range samples[t][fragment.first[t] : fragment.first[t]+fragment.count[t]] {
+			dataSize += uint64(s.size)
+		}
+	}
+	mdatHeader := newMP4MdatHeader(dataSize)
+
+	// the data offsets are relative to the moof box, whose size doesn't depend
+	// on them
+	moof, err := newFMP4Moof(sequence, tracks, samples, fragment, 0)
+	if err != nil {
+		return err
+	}
+	if moof, err = newFMP4Moof(sequence, tracks, samples, fragment, len(moof)+len(mdatHeader)); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(moof); err != nil {
+		return fmt.Errorf("failed to write moof box: %v", err)
+	}
+	if _, err := w.Write(mdatHeader); err != nil {
+		return fmt.Errorf("failed to write mdat box: %v", err)
+	}
+	for t, track := range tracks {
+		r := track.reader(r)
+		for _, s := range samples[t][fragment.first[t] : fragment.first[t]+fragment.count[t]] {
+			if err := copySample(w, r, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newFMP4Moof returns the moof box of a fragment, with a track fragment for
+// each track having samples in it. dataOffset is the offset of the sample data
+// from the start of the moof box.
+func newFMP4Moof(sequence uint32, tracks []MuxTrack, samples [][]muxSample, fragment *fmp4Fragment, dataOffset int) ([]byte, error) {
+	mfhd, err := marshalMP4Box(&mp4.Mfhd{SequenceNumber: sequence})
+	if err != nil {
+		return nil, err
+	}
+	children := [][]byte{mfhd}
+	for t := range tracks {
+		trackSamples := samples[t][fragment.first[t] : fragment.first[t]+fragment.count[t]]
+		if len(trackSamples) == 0 {
+			continue
+		}
+		traf, err := newFMP4Traf(uint32(t+1), trackSamples, dataOffset)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, traf)
+		for _, s := range trackSamples {
+			dataOffset += int(s.size)
+		}
+	}
+	return marshalMP4Box(&mp4.Moof{}, children...)
+}
+
+// newFMP4Traf returns the traf box of the samples of a track in a fragment,
+// with a single track run.
+func newFMP4Traf(trackID uint32, samples []muxSample, dataOffset int) ([]byte, error) {
+	tfhd := &mp4.Tfhd{TrackID: trackID}
+	tfhd.SetFlags(mp4.TfhdDefaultBaseIsMoof)
+	tfdt := &mp4.Tfdt{BaseMediaDecodeTimeV1: samples[0].dts}
+	tfdt.SetVersion(1)
+
+	trun := &mp4.Trun{SampleCount: uint32(len(samples)), DataOffset: int32(dataOffset)}
+	flags := uint32(trunDataOffsetPresent | trunSampleDurationPresent | trunSampleSizePresent | trunSampleFlagsPresent)
+	for _, s := range samples {
+		sampleFlags := SampleFlags{Sync: s.key, DependsOn: 2}
+		if !s.key {
+			sampleFlags.DependsOn = 1
+		}
+		trun.Entries = append(trun.Entries, mp4.TrunEntry{
+			SampleDuration:                s.duration,
+			SampleSize:                    s.size,
+			SampleFlags:                   sampleFlags.fragmentFlags(),
+			SampleCompositionTimeOffsetV0: uint32(s.cto),
+			SampleCompositionTimeOffsetV1: int32(s.cto),
+		})
+		if s.cto != 0 {
+			flags |= trunSampleCTOPresent
+		}
+		if s.cto < 0 {
+			trun.SetVersion(1)
+		}
+	}
+	trun.SetFlags(flags)
+
+	var children [][]byte
+	for _, box := range []mp4.IImmutableBox{tfhd, tfdt, trun} {
+		data, err := marshalMP4Box(box)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, data)
+	}
+	return marshalMP4Box(&mp4.Traf{}, children...)
+}
@@ -0,0 +1,96 @@
+package datamosh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFMP4Muxer(t *testing.T) {
+	tests := []struct {
+		name     string
+		drop     bool
+		segments []uint32
+		keys     []uint32
+	}{
+		{name: "all samples", segments: []uint32{0, 1, 2, 3, 4}, keys: []uint32{0, 8}},
+		// without key frames to start them, segments last twice the target
+		{name: "dropped key frames", drop: true, segments: []uint32{0, 1, 2, 3}, keys: []uint32{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := mp4Fixture{gop: "IPPPPPPPIPPPPPPP", audio: true}.withDefaults()
+			input := bytes.NewReader(fixture.build(t))
+			tracks, err := ParseTracks(input)
+			require.NoError(t, err)
+			video := MuxTrack{Track: tracks[0]}
+			if tt.drop {
+				video.Samples = DropKeyFrames(tracks[0])
+			}
+
+			out := &bytes.Buffer{}
+			var segments []uint32
+			muxer := &FMP4Muxer{FragmentDuration: 0.09, Segment: func(sequence uint32) error {
+				segments = append(segments, sequence)
+				return nil
+			}}
+			require.NoError(t, muxer.Mux(out, input, []MuxTrack{video, {Track: tracks[1]}}))
+			assert.Equal(t, tt.segments, segments)
+
+			// an init segment, then a moof and an mdat box per media segment
+			var boxes []string
+			_, err = mp4.ReadBoxStructure(bytes.NewReader(out.Bytes()), func(h *mp4.ReadHandle) (interface{}, error) {
+				boxes = append(boxes, h.BoxInfo.Type.String())
+				return nil, nil
+			})
+			require.NoError(t, err)
+			want := []string{"ftyp", "moov"}
+			for range segments[1:] {
+				want = append(want, "moof", "mdat")
+			}
+			assert.Equal(t, want, boxes)
+
+			r := bytes.NewReader(out.Bytes())
+			got, format, err := Demux(r)
+			require.NoError(t, err)
+			assert.Equal(t, ContainerMP4, format)
+			require.Len(t, got, 2)
+
+			ids := video.sampleIDs()
+			frames := fixture.frames()
+			require.Len(t, got[0].Samples, len(ids))
+			i := 0
+			for id, index := range ids {
+				assert.Equal(t, tracks[0].Samples[index].CompositionTimeOffset, got[0].Samples[id].CompositionTimeOffset)
+				for _, want := range frames[index].nals {
+					require.Less(t, i, len(got[0].NALs))
+					payload, err := got[0].NALs[i].Payload(r)
+					require.NoError(t, err)
+					assert.Equal(t, want, payload, "sample %d", id)
+					i++
+				}
+			}
+			var keys []uint32
+			for id, flags := range got[0].SampleFlags {
+				if flags.Sync {
+					keys = append(keys, uint32(id))
+				}
+			}
+			assert.Equal(t, tt.keys, keys)
+
+			audio := got[1]
+			assert.True(t, audio.IsAudio())
+			audioFrames := fixture.audioFrames()
+			require.Len(t, audio.Samples, len(audioFrames))
+			for id, offset := range audio.sampleOffsets() {
+				data := make([]byte, audio.Samples[id].Size)
+				_, err := r.ReadAt(data, int64(offset))
+				require.NoError(t, err)
+				assert.Equal(t, audioFrames[id], data, "audio sample %d", id)
+			}
+		})
+	}
+}
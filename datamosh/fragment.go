@@ -0,0 +1,213 @@
+package datamosh
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/abema/go-mp4"
+)
+
+// Flags of the samples of track fragments. See ISO/IEC 14496-12 8.8.3.1.
+const sampleIsNonSync = 0x00010000
+
+// Flags of trun boxes. See ISO/IEC 14496-12 8.8.8.1.
+const (
+	trunDataOffsetPresent       = 0x000001
+	trunFirstSampleFlagsPresent = 0x000004
+	trunSampleDurationPresent   = 0x000100
+	trunSampleSizePresent       = 0x000200
+	trunSampleFlagsPresent      = 0x000400
+	trunSampleCTOPresent        = 0x000800
+)
+
+// fragmentFlags is a sample flags field of a trun box, which can be rewritten
+// in place.
+type fragmentFlags struct {
+	offset uint64 // in the file
+	flags  uint32
+}
+
+// newFragmentSampleFlags returns the flags of a sample of a track fragment.
+func newFragmentSampleFlags(flags uint32) SampleFlags {
+	return SampleFlags{
+		Sync:          flags&sampleIsNonSync == 0,
+		IsLeading:     uint8(flags >> 26 & 0x03),
+		DependsOn:     uint8(flags >> 24 & 0x03),
+		IsDependedOn:  uint8(flags >> 22 & 0x03),
+		HasRedundancy: uint8(flags >> 20 & 0x03),
+	}
+}
+
+// fragmentFlags returns the flags of a sample in track fragments.
+func (f SampleFlags) fragmentFlags() uint32 {
+	flags := uint32(f.IsLeading&0x03)<<26 | uint32(f.DependsOn&0x03)<<24 |
+		uint32(f.IsDependedOn&0x03)<<22 | uint32(f.HasRedundancy&0x03)<<20
+	if !f.Sync {
+		flags |= sampleIsNonSync
+	}
+	return flags
+}
+
+// readMoof appends the samples of the track fragments of a moof box to the
+// tracks, trex holding the defaults of the tracks. Each track run becomes a
+// chunk. See ISO/IEC 14496-12 8.8.
+func readMoof(r io.ReadSeeker, moof *mp4.BoxInfo, tracks []*Track, trex map[uint32]*mp4.Trex) error {
+	bips, err := mp4.ExtractBoxesWithPayload(r, moof, []mp4.BoxPath{
+		{mp4.BoxTypeTraf(), mp4.BoxTypeTfhd()},
+		{mp4.BoxTypeTraf(), mp4.BoxTypeTfdt()},
+		{mp4.BoxTypeTraf(), mp4.BoxTypeTrun()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read moof box: %v", err)
+	}
+
+	var track *Track
+	var tfhd *mp4.Tfhd
+	var defaults mp4.Trex
+	// dataEnd is the end of the data of the previous track fragment, the
+	// default base offset of the next ones
+	base, dataEnd := moof.Offset, moof.Offset
+	var next uint64 // offset of the data of the next track run
+	firstRun := false
+	for _, bip := range bips {
+		switch box := bip.Payload.(type) {
+		case *mp4.Tfhd:
+			tfhd, track = box, nil
+			for _, t := range tracks {
+				if t.TrackID == box.TrackID {
+					track = t
+				}
+			}
+			if track == nil {
+				return fmt.Errorf("track fragment of unknown track %d", box.TrackID)
+			}
+			if d, ok := trex[box.TrackID]; ok {
+				defaults = *d
+			} else {
+				defaults = mp4.Trex{}
+			}
+			flags := box.GetFlags()
+			switch {
+			case flags&mp4.TfhdBaseDataOffsetPresent != 0:
+				base = box.BaseDataOffset
+			case flags&mp4.TfhdDefaultBaseIsMoof != 0:
+				base = moof.Offset
+			default:
+				base = dataEnd
+			}
+			if flags&mp4.TfhdDefaultSampleDurationPresent != 0 {
+				defaults.DefaultSampleDuration = box.DefaultSampleDuration
+			}
+			if flags&mp4.TfhdDefaultSampleSizePresent != 0 {
+				defaults.DefaultSampleSize = box.DefaultSampleSize
+			}
+			if flags&mp4.TfhdDefaultSampleFlagsPresent != 0 {
+				defaults.DefaultSampleFlags = box.DefaultSampleFlags
+			}
+			next, firstRun = base, true
+		case *mp4.Tfdt:
+			if track == nil {
+				return fmt.Errorf("tfdt box without tfhd box")
+			}
+			// fill the gaps between the fragments, times start at 0
+			times := track.decodeTimes()
+			if end := times[len(times)-1]; len(track.Samples) > 0 && box.GetBaseMediaDecodeTime() > end {
+				track.Samples[len(track.Samples)-1].TimeDelta += uint32(box.GetBaseMediaDecodeTime() - end)
+			}
+		case *mp4.Trun:
+			if tfhd == nil {
+				return fmt.Errorf("trun box without tfhd box")
+			}
+			flags := box.GetFlags()
+			if flags&trunDataOffsetPresent != 0 {
+				next = uint64(int64(base) + int64(box.DataOffset))
+			} else if !firstRun {
+				next = dataEnd
+			}
+			firstRun = false
+			track.Chunks = append(track.Chunks, &mp4.Chunk{DataOffset: next, SamplesPerChunk: box.SampleCount})
+
+			// the offsets of the flags fields of the run
+			fieldOffset := bip.Info.Offset + bip.Info.HeaderSize + 8
+			if flags&trunDataOffsetPresent != 0 {
+				fieldOffset += 4
+			}
+			firstFlagsOffset := fieldOffset
+			if flags&trunFirstSampleFlagsPresent != 0 {
+				fieldOffset += 4
+			}
+			entrySize := uint64(4 * bits.OnesCount32(flags&0xf00))
+			var flagsOffset uint64 // in the entries
+			if flags&trunSampleDurationPresent != 0 {
+				flagsOffset += 4
+			}
+			if flags&trunSampleSizePresent != 0 {
+				flagsOffset += 4
+			}
+
+			for i := 0; i < int(box.SampleCount); i++ {
+				sample := &mp4.Sample{
+					TimeDelta: defaults.DefaultSampleDuration,
+					Size:      defaults.DefaultSampleSize,
+				}
+				var entry mp4.TrunEntry
+				if i < len(box.Entries) {
+					entry = box.Entries[i]
+				}
+				if flags&trunSampleDurationPresent != 0 {
+					sample.TimeDelta = entry.SampleDuration
+				}
+				if flags&trunSampleSizePresent != 0 {
+					sample.Size = entry.SampleSize
+				}
+				if i < len(box.Entries) {
+					sample.CompositionTimeOffset = box.GetSampleCompositionTimeOffset(i)
+				}
+				field := fragmentFlags{flags: defaults.DefaultSampleFlags}
+				switch {
+				case flags&trunSampleFlagsPresent != 0:
+					field = fragmentFlags{offset: fieldOffset + uint64(i)*entrySize + flagsOffset, flags: entry.SampleFlags}
+				case i == 0 && flags&trunFirstSampleFlagsPresent != 0:
+					field = fragmentFlags{offset: firstFlagsOffset, flags: box.FirstSampleFlags}
+				}
+				sampleFlags := newFragmentSampleFlags(field.flags)
+				if sampleFlags.Sync && field.offset != 0 {
+					if track.fragmentFlags == nil {
+						track.fragmentFlags = map[uint32]fragmentFlags{}
+					}
+					track.fragmentFlags[uint32(len(track.Samples))] = field
+				}
+				track.Samples = append(track.Samples, sample)
+				track.SampleFlags = append(track.SampleFlags, sampleFlags)
+				next += uint64(sample.Size)
+			}
+			dataEnd = next
+		}
+	}
+	return nil
+}
+
+// removeFragmentSyncSamples sets in place the non sync flag of the given
+// samples of a fragmented track, when their flags aren't defaults shared with
+// other samples.
+func (t *Track) removeFragmentSyncSamples(w io.WriteSeeker, ids map[uint32]bool) error {
+	for id := range ids {
+		field, ok := t.fragmentFlags[id]
+		if !ok {
+			continue
+		}
+		field.flags |= sampleIsNonSync
+		if _, err := w.Seek(int64(field.offset), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{byte(field.flags >> 24), byte(field.flags >> 16), byte(field.flags >> 8), byte(field.flags)}); err != nil {
+			return fmt.Errorf("failed to write trun box: %v", err)
+		}
+		delete(t.fragmentFlags, id)
+		if int(id) < len(t.SampleFlags) {
+			t.SampleFlags[id].Sync = false
+		}
+	}
+	return nil
+}
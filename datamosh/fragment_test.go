@@ -0,0 +1,201 @@
+package datamosh
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fragmented returns the video track of the fixture as a fragmented MP4 file,
+// one moof and mdat box per GOP. Even GOPs use a single track fragment based on
+// the moof box, the sample flags coming from the tfhd box and the first sample
+// flags. Odd GOPs are split in two track fragments, the first one with an
+// explicit base data offset, the second one following its data.
+func (f mp4Fixture) fragmented(t testing.TB) []byte {
+	t.Helper()
+	data := f.build(t)
+	tracks, err := ParseTracks(bytes.NewReader(data))
+	require.NoError(t, err)
+	track := tracks[0]
+	offsets := track.sampleOffsets()
+
+	ftyp := &mp4.Ftyp{MajorBrand: [4]byte{'i', 's', 'o', '6'}}
+	ftyp.AddCompatibleBrand([4]byte{'i', 's', 'o', '6'})
+	file, err := marshalMP4Box(ftyp)
+	require.NoError(t, err)
+
+	stbl := f.stbl(t, track.stsd, []mp4.IImmutableBox{&mp4.Stts{}}, nil)
+	trak := f.trak(t, track.TrackID, handlerVideo, 0, track.Timescale, nil, stbl)
+	mvhd := &mp4.Mvhd{Timescale: mp4MovieTimescale, Rate: 0x00010000, Volume: 0x0100, NextTrackID: 2}
+	mvhdData, err := marshalMP4Box(mvhd)
+	require.NoError(t, err)
+	mvex, err := marshalMP4Boxes(&mp4.Mvex{}, &mp4.Trex{
+		TrackID:                       track.TrackID,
+		DefaultSampleDescriptionIndex: 1,
+		DefaultSampleDuration:         fixtureFrameDuration,
+		DefaultSampleFlags:            sampleIsNonSync,
+	})
+	require.NoError(t, err)
+	moov, err := marshalMP4Box(&mp4.Moov{}, mvhdData, trak, mvex)
+	require.NoError(t, err)
+	file = append(file, moov...)
+
+	// the runs of each GOP
+	var gops [][]uint32
+	for id := range track.Samples {
+		if track.SampleFlags[id].Sync {
+			gops = append(gops, nil)
+		}
+		gops[len(gops)-1] = append(gops[len(gops)-1], uint32(id))
+	}
+	var dts uint64
+	for g, gop := range gops {
+		runs := [][]uint32{gop}
+		if g%2 == 1 && len(gop) > 1 {
+			runs = [][]uint32{gop[:1], gop[1:]}
+		}
+		var mdat []byte
+		for _, run := range runs {
+			for _, id := range run {
+				offset := offsets[id]
+				mdat = append(mdat, data[offset:offset+uint64(track.Samples[id].Size)]...)
+			}
+		}
+
+		moofFor := func(moofOffset uint64, moofSize int) []byte {
+			mfhd, err := marshalMP4Box(&mp4.Mfhd{SequenceNumber: uint32(g + 1)})
+			require.NoError(t, err)
+			children := [][]byte{mfhd}
+			runDTS := dts
+			for r, run := range runs {
+				tfhd := &mp4.Tfhd{TrackID: track.TrackID}
+				trun := &mp4.Trun{SampleCount: uint32(len(run))}
+				trun.SetVersion(1)
+				trunFlags := uint32(trunSampleSizePresent | trunSampleCTOPresent)
+				switch {
+				case g%2 == 0:
+					tfhd.SetFlags(mp4.TfhdDefaultBaseIsMoof | mp4.TfhdDefaultSampleFlagsPresent)
+					tfhd.DefaultSampleFlags = sampleIsNonSync | 1<<24
+					trunFlags |= trunDataOffsetPresent | trunFirstSampleFlagsPresent
+					trun.DataOffset = int32(moofSize + 8)
+					trun.FirstSampleFlags = track.SampleFlags[run[0]].fragmentFlags()
+				case r == 0:
+					tfhd.SetFlags(mp4.TfhdBaseDataOffsetPresent)
+					tfhd.BaseDataOffset = moofOffset + uint64(moofSize) + 8
+					trunFlags |= trunDataOffsetPresent | trunSampleFlagsPresent | trunSampleDurationPresent
+				default:
+					trunFlags |= trunSampleFlagsPresent
+				}
+				trun.SetFlags(trunFlags)
+				for _, id := range run {
+					sample := track.Samples[id]
+					trun.Entries = append(trun.Entries, mp4.TrunEntry{
+						SampleDuration:                sample.TimeDelta,
+						SampleSize:                    sample.Size,
+						SampleFlags:                   track.SampleFlags[id].fragmentFlags(),
+						SampleCompositionTimeOffsetV1: int32(sample.CompositionTimeOffset),
+					})
+				}
+				tfdt := &mp4.Tfdt{BaseMediaDecodeTimeV1: runDTS}
+				tfdt.SetVersion(1)
+				var trafChildren [][]byte
+				for _, box := range []mp4.IImmutableBox{tfhd, tfdt, trun} {
+					data, err := marshalMP4Box(box)
+					require.NoError(t, err)
+					trafChildren = append(trafChildren, data)
+				}
+				traf, err := marshalMP4Box(&mp4.Traf{}, trafChildren...)
+				require.NoError(t, err)
+				children = append(children, traf)
+				for _, id := range run {
+					runDTS += uint64(track.Samples[id].TimeDelta)
+				}
+			}
+			moof, err := marshalMP4Box(&mp4.Moof{}, children...)
+			require.NoError(t, err)
+			return moof
+		}
+		moof := moofFor(uint64(len(file)), 0)
+		moof = moofFor(uint64(len(file)), len(moof))
+		file = append(file, moof...)
+		mdatData, err := marshalMP4Box(&mp4.Mdat{Data: mdat})
+		require.NoError(t, err)
+		file = append(file, mdatData...)
+		for _, id := range gop {
+			dts += uint64(track.Samples[id].TimeDelta)
+		}
+	}
+	return file
+}
+
+func TestParseFragmentedTracks(t *testing.T) {
+	for _, fixture := range []mp4Fixture{
+		{gop: "IPPPIPPPIP"},
+		{gop: "IBBPBBPIBP", slices: 2},
+		{gop: "IPiPIPPIPP", heightMbs: 3, slices: 3},
+	} {
+		t.Run(fixture.gop, func(t *testing.T) {
+			fixture = fixture.withDefaults()
+			want, err := ParseTracks(bytes.NewReader(fixture.build(t)))
+			require.NoError(t, err)
+			data := fixture.fragmented(t)
+			r := bytes.NewReader(data)
+			tracks, err := ParseTracks(r)
+			require.NoError(t, err)
+			require.Len(t, tracks, 1)
+
+			track := tracks[0]
+			assert.Equal(t, want[0].Duration, track.Duration)
+			require.Len(t, track.Samples, len(want[0].Samples))
+			for id, sample := range track.Samples {
+				assert.Equal(t, want[0].Samples[id].Size, sample.Size, "sample %d", id)
+				assert.Equal(t, want[0].Samples[id].TimeDelta, sample.TimeDelta, "sample %d", id)
+				assert.Equal(t, want[0].Samples[id].CompositionTimeOffset, sample.CompositionTimeOffset, "sample %d", id)
+				assert.Equal(t, want[0].SampleFlags[id].Sync, track.SampleFlags[id].Sync, "sample %d", id)
+			}
+			assert.Equal(t, keySamplesList(want[0]), keySamplesList(track))
+
+			frames := fixture.frames()
+			require.Len(t, track.NALs, len(want[0].NALs))
+			i := 0
+			for id, frame := range frames {
+				for _, payload := range frame.nals {
+					nal := track.NALs[i]
+					i++
+					assert.Equal(t, uint32(id), nal.SampleID)
+					assert.Equal(t, frame.pts, nal.PTS(), "sample %d", id)
+					got, err := nal.Payload(r)
+					require.NoError(t, err)
+					assert.Equal(t, payload, got, "sample %d", id)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessFragmentedFramesNullifyIFrames(t *testing.T) {
+	fixture := mp4Fixture{gop: "IPPIPPIPPIPP"}.withDefaults()
+	path := filepath.Join(t.TempDir(), "fragmented.mp4")
+	require.NoError(t, os.WriteFile(path, fixture.fragmented(t), 0o644))
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	ctx, err := ProcessFrames(context.Background(), f, NullifyIFrames)
+	require.NoError(t, err)
+	assert.Equal(t, 4, ctx.Value(IFrameCountKey))
+	assert.Equal(t, 3, ctx.Value(IFrameRemovedCountKey))
+
+	tracks, err := ParseTracks(f)
+	require.NoError(t, err)
+	// the trun boxes no longer flag the nullified key frames as sync samples
+	for id, flags := range tracks[0].SampleFlags {
+		assert.Equal(t, id == 0, flags.Sync, "sample %d", id)
+	}
+}
@@ -0,0 +1,161 @@
+package datamosh
+
+import (
+	"fmt"
+	"io"
+)
+
+// FrameKind describes how a frame is predicted.
+type FrameKind int
+
+const (
+	FrameKindUnknown FrameKind = iota
+	FrameKindI
+	FrameKindP
+	FrameKindB
+	// FrameKindNone is used for units that don't carry picture data such as
+	// parameter sets, SEI, sequence headers or temporal delimiters.
+	FrameKindNone
+)
+
+func (k FrameKind) String() string {
+	switch k {
+	case FrameKindI:
+		return "I"
+	case FrameKindP:
+		return "P"
+	case FrameKindB:
+		return "B"
+	case FrameKindNone:
+		return "-"
+	}
+	return "Unknown"
+}
+
+// Frame is a codec neutral view over the coded units of a track: H.264 NAL
+// units, AV1 OBUs and VP8/VP9 frames.
+type Frame interface {
+	// Kind returns the prediction type of the frame.
+	Kind() FrameKind
+	// IsKeyframe returns true for random access points: IDR slices, shown AV1
+	// key frames and VP8/VP9 key frames.
+	IsKeyframe() bool
+	// IsReference returns true if later frames can be predicted from this one.
+	IsReference() bool
+	// Size returns the size of the coded unit in bytes.
+	Size() int
+	// PTS returns the presentation time in the timescale of the track.
+	PTS() uint64
+	// DTS returns the decode time in the timescale of the track.
+	DTS() uint64
+	// Sample returns the id of the sample holding the frame.
+	Sample() uint32
+	// Payload returns the coded bytes of the unit.
+	Payload(r io.ReadSeeker) ([]byte, error)
+	// Nullify neutralizes the unit in place, without changing its size.
+	Nullify(w io.WriteSeeker) error
+}
+
+// Frames returns the coded units of the track, whatever its codec.
+func (t *Track) Frames() []Frame {
+	frames := make([]Frame, 0, len(t.NALs)+len(t.OBUs)+len(t.VPXFrames))
+	for _, nal := range t.NALs {
+		frames = append(frames, nal)
+	}
+	for _, obu := range t.OBUs {
+		frames = append(frames, obu)
+	}
+	for _, frame := range t.VPXFrames {
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// readPayload reads size bytes at offset.
+func readPayload(r io.ReadSeeker, offset int64, size int) ([]byte, error) {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek to the frame data: %v", err)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read the frame data: %v", err)
+	}
+	return payload, nil
+}
+
+// H.264
+
+func (n *NALUnit) Kind() FrameKind {
+	switch n.Type {
+	case NAL_IDR_SLICE:
+		return FrameKindI
+	case NAL_SLICE, NAL_DPA, NAL_AUX_SLICE:
+		switch n.SliceType {
+		case SLICE_P, SLICE_SP:
+			return FrameKindP
+		case SLICE_B:
+			return FrameKindB
+		case SLICE_I, SLICE_SI:
+			return FrameKindI
+		}
+		return FrameKindUnknown
+	case NAL_DPB, NAL_DPC:
+		return FrameKindUnknown
+	}
+	return FrameKindNone
+}
+
+func (n *NALUnit) IsKeyframe() bool  { return n.Type == NAL_IDR_SLICE }
+func (n *NALUnit) IsReference() bool { return n.RefIdc != 0 }
+func (n *NALUnit) Size() int         { return int(n.Length) }
+func (n *NALUnit) PTS() uint64       { return n.Timestamp }
+func (n *NALUnit) DTS() uint64       { return n.DecodeTime }
+func (n *NALUnit) Sample() uint32    { return n.SampleID }
+
+// Payload returns the NAL unit data, header byte included.
+func (n *NALUnit) Payload(r io.ReadSeeker) ([]byte, error) {
+	return readPayload(r, n.Offset, int(n.Length))
+}
+
+// AV1
+
+func (o *OBU) Kind() FrameKind {
+	if o.Frame == nil {
+		return FrameKindNone
+	}
+	if o.Frame.IsIntra() {
+		return FrameKindI
+	}
+	return FrameKindP
+}
+
+func (o *OBU) IsKeyframe() bool  { return o.Frame != nil && o.Frame.IsKeyFrame() }
+func (o *OBU) IsReference() bool { return o.Frame != nil && o.Frame.RefreshFrameFlags != 0 }
+func (o *OBU) Size() int         { return int(o.HeaderSize + o.Length) }
+func (o *OBU) PTS() uint64       { return o.Timestamp }
+func (o *OBU) DTS() uint64       { return o.DecodeTime }
+func (o *OBU) Sample() uint32    { return o.SampleID }
+
+// VP8/VP9
+
+func (f *VPXFrame) Kind() FrameKind {
+	if f.Header.KeyFrame || f.Header.IntraOnly {
+		return FrameKindI
+	}
+	if f.Header.ShowExistingFrame {
+		return FrameKindNone
+	}
+	return FrameKindP
+}
+
+func (f *VPXFrame) IsKeyframe() bool  { return f.Header.KeyFrame }
+func (f *VPXFrame) IsReference() bool { return f.Header.RefreshFrameFlags != 0 }
+func (f *VPXFrame) Size() int         { return int(f.Length) }
+func (f *VPXFrame) PTS() uint64       { return f.Timestamp }
+func (f *VPXFrame) DTS() uint64       { return f.DecodeTime }
+func (f *VPXFrame) Sample() uint32    { return f.SampleID }
+
+// Payload returns the frame data.
+func (f *VPXFrame) Payload(r io.ReadSeeker) ([]byte, error) {
+	return readPayload(r, f.Offset, int(f.Length))
+}
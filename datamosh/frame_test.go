@@ -0,0 +1,73 @@
+package datamosh
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameKinds(t *testing.T) {
+	_, track, err := ParseIVF(bytes.NewReader(testIVF(testAV1Frames())))
+	require.NoError(t, err)
+	var kinds []FrameKind
+	for _, frame := range track.Frames() {
+		if frame.Kind() != FrameKindNone {
+			kinds = append(kinds, frame.Kind())
+		}
+	}
+	assert.Equal(t, []FrameKind{FrameKindI, FrameKindP, FrameKindI, FrameKindP}, kinds)
+
+	frames := [][]byte{
+		testVP9Frame(true, true, 0),
+		testVP9Frame(false, true, 0x01),
+	}
+	_, track, err = ParseIVF(bytes.NewReader(testVPXIVF("VP90", frames)))
+	require.NoError(t, err)
+	require.Len(t, track.Frames(), 2)
+	assert.True(t, track.Frames()[0].IsKeyframe())
+	assert.Equal(t, FrameKindP, track.Frames()[1].Kind())
+	assert.True(t, track.Frames()[1].IsReference())
+}
+
+func TestParseSliceType(t *testing.T) {
+	b := newTestBitWriter()
+	b.put(1, 1)    // first_mb_in_slice: 0
+	b.put(0x08, 7) // slice_type: 7 (I, all slices)
+	b.put(1, 1)    // pic_parameter_set_id: 0
+	assert.Equal(t, SLICE_I, parseSliceType(b.trailingBytes()))
+	assert.Equal(t, sliceTypeUnknown, parseSliceType(nil))
+}
+
+func TestNullifyIFrames(t *testing.T) {
+	frames := [][]byte{
+		testVP9Frame(true, true, 0),
+		testVP9Frame(false, true, 0x01),
+		testVP9Frame(true, true, 0),
+		testVP9Frame(false, true, 0x01),
+	}
+	path := filepath.Join(t.TempDir(), "stream.ivf")
+	require.NoError(t, os.WriteFile(path, testVPXIVF("VP90", frames), 0o644))
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, track, err := ParseIVF(f)
+	require.NoError(t, err)
+	ctx := context.WithValue(context.Background(), TrackKey, track)
+	for _, frame := range track.Frames() {
+		ctx, err = NullifyIFrames(ctx, f, frame)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, ctx.Value(IFrameCountKey))
+	assert.Equal(t, 1, ctx.Value(IFrameRemovedCountKey))
+
+	_, track, err = ParseIVF(f)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{0, 1, 2, 3}, DropKeyFrames(track))
+	assert.True(t, track.VPXFrames[2].Header.ShowExistingFrame)
+}
@@ -8,34 +8,42 @@ import (
 	"strings"
 )
 
-// function type to process frames/NAL units
-type FrameProcessor func(context.Context, io.WriteSeeker, *NALUnit) (context.Context, error)
+// function type to process frames: NAL units, OBUs or VP8/VP9 frames
+type FrameProcessor func(context.Context, io.WriteSeeker, Frame) (context.Context, error)
 
-// NullifyIFrames nullifies I-frames
-func NullifyIFrames(ctx context.Context, w io.WriteSeeker, nalUnit *NALUnit) (context.Context, error) {
+// NullifyIFrames nullifies key frames: IDR slices, AV1 key frames and VP8/VP9
+// key frames. The units of the first key frame are kept so the video starts
+// properly.
+func NullifyIFrames(ctx context.Context, w io.WriteSeeker, frame Frame) (context.Context, error) {
 
-	if nalUnit.Type != NAL_IDR_SLICE {
+	if !frame.IsKeyframe() {
 		return ctx, nil
 	}
 
-	// Retrieve and update I-frame count from context
+	// A key frame can be made of several units (slices, tile groups), count
+	// each sample once.
 	iFrameCount := 0
 	if value, ok := ctx.Value(IFrameCountKey).(int); ok {
 		iFrameCount = value
 	}
-	iFrameCount++
-	ctx = context.WithValue(ctx, IFrameCountKey, iFrameCount)
+	lastSample, seen := ctx.Value(lastKeySampleKey).(uint32)
+	newSample := !seen || lastSample != frame.Sample()
+	if newSample {
+		iFrameCount++
+		ctx = context.WithValue(ctx, IFrameCountKey, iFrameCount)
+		ctx = context.WithValue(ctx, lastKeySampleKey, frame.Sample())
+	}
 
 	// Retrieve track and interactive flag from context
 	track, _ := ctx.Value(TrackKey).(*Track)
 	isInteractive, _ := ctx.Value(InteractiveKey).(bool)
 	debug, _ := ctx.Value(DebugKey).(bool)
 
-	if debug {
+	if debug && newSample {
 		if track != nil {
-			fmt.Printf("I-Frame #%d: pts: %.2f\n", iFrameCount, float32(nalUnit.Timestamp)/float32(track.Timescale))
+			fmt.Printf("I-Frame #%d: pts: %s\n", iFrameCount, track.frameTime(frame))
 		} else {
-			fmt.Printf("I-Frame #%d: offset: %d, length: %d\n", iFrameCount, nalUnit.Offset, nalUnit.Length)
+			fmt.Printf("I-Frame #%d: sample: %d, size: %d\n", iFrameCount, frame.Sample(), frame.Size())
 		}
 	}
 
@@ -44,74 +52,143 @@ func NullifyIFrames(ctx context.Context, w io.WriteSeeker, nalUnit *NALUnit) (co
 		return ctx, nil
 	}
 
-	var handleInteractiveMode = func(ctx context.Context, nalUnit *NALUnit, track *Track) (context.Context, bool) {
-		fmt.Printf("Nullify I-frame at %.2f seconds? (y/n/a): ", float32(nalUnit.Timestamp)/float32(track.Timescale))
-		var response string
-		_, err := fmt.Scanln(&response)
-		if err != nil {
-			log.Printf("Error reading user input: %v", err)
-			return ctx, false
-		}
-
-		if strings.Contains(strings.ToLower(response), "n") {
-			return ctx, false
-		}
-		// a means yes to all from now on
-		if strings.Contains(strings.ToLower(response), "a") {
-			ctx = context.WithValue(ctx, InteractiveKey, false)
+	// The answer given for the first unit of a sample applies to the others.
+	if !newSample {
+		if keep, _ := ctx.Value(keepKeySampleKey).(bool); keep {
+			return ctx, nil
 		}
-		return ctx, true
 	}
 
-	var err error
-	if isInteractive {
+	if isInteractive && newSample {
 		if track == nil {
 			log.Printf("Track not found in context, can't nullify I-frame in interactive mode")
-			err = nalUnit.Nullify(w)
 		} else {
 			var shouldNullify bool
-			ctx, shouldNullify = handleInteractiveMode(ctx, nalUnit, track)
+			ctx, shouldNullify = confirmNullify(ctx, track.frameTime(frame))
+			ctx = context.WithValue(ctx, keepKeySampleKey, !shouldNullify)
 			if !shouldNullify {
 				return ctx, nil
 			}
 		}
-	} else {
-		err = nalUnit.Nullify(w)
+	} else if newSample {
+		ctx = context.WithValue(ctx, keepKeySampleKey, false)
 	}
+	err := frame.Nullify(w)
 
 	// Update I-frame removed count in context if nullification was successful
-	if err == nil {
+	if err == nil && newSample {
 		iFrameRemovedCount := 0
 		if value, ok := ctx.Value(IFrameRemovedCountKey).(int); ok {
 			iFrameRemovedCount = value
 		}
 		iFrameRemovedCount++
 		ctx = context.WithValue(ctx, IFrameRemovedCountKey, iFrameRemovedCount)
+		if nullified, ok := ctx.Value(nullifiedSamplesKey).(map[uint32]bool); ok {
+			nullified[frame.Sample()] = true
+		}
 	}
 
 	return ctx, err
 }
 
+// confirmNullify asks the user whether the frame shown at the given time should
+// be nullified.
+func confirmNullify(ctx context.Context, at string) (context.Context, bool) {
+	fmt.Printf("Nullify I-frame at %s? (y/n/a): ", at)
+	var response string
+	_, err := fmt.Scanln(&response)
+	if err != nil {
+		log.Printf("Error reading user input: %v", err)
+		return ctx, false
+	}
+
+	if strings.Contains(strings.ToLower(response), "n") {
+		return ctx, false
+	}
+	// a means yes to all from now on
+	if strings.Contains(strings.ToLower(response), "a") {
+		ctx = context.WithValue(ctx, InteractiveKey, false)
+	}
+	return ctx, true
+}
+
 // DuplicatePFrames duplicates P-frames for glitch effect
-func DuplicatePFrames(track *Track) {
-	nals := []*NALUnit{}
-	// track.Chunks
-	for _, nal := range track.NALs {
-		nals = append(nals, nal)
-		if nal.Type == NAL_SLICE {
-			// nal.Chunk
-			duplicate := *nal // Make a copy
-			nals = append(nals, &duplicate)
+func DuplicatePFrames(track *Track) []Frame {
+	frames := []Frame{}
+	for _, frame := range track.Frames() {
+		frames = append(frames, frame)
+		if frame.Kind() == FrameKindP {
+			frames = append(frames, frame)
 		}
 	}
+	return frames
 }
 
 // SwapPAndBFrames swaps P-frames and B-frames
-func SwapPAndBFrames(nals []*NALUnit) []*NALUnit {
-	for i := 0; i < len(nals)-1; i++ {
-		if nals[i].Type == NAL_SLICE && (nals[i+1].Type == NAL_DPB || nals[i+1].Type == NAL_DPC) {
-			nals[i], nals[i+1] = nals[i+1], nals[i]
+func SwapPAndBFrames(frames []Frame) []Frame {
+	for i := 0; i < len(frames)-1; i++ {
+		if frames[i].Kind() == FrameKindP && frames[i+1].Kind() == FrameKindB {
+			frames[i], frames[i+1] = frames[i+1], frames[i]
+		}
+	}
+	return frames
+}
+
+// nullifiedSamples returns the ids of the samples whose key frames were
+// nullified in place: their NAL units keep the IDR type, the zeroed slice
+// header having no slice type.
+func nullifiedSamples(track *Track) map[uint32]bool {
+	ids := map[uint32]bool{}
+	for _, nal := range track.NALs {
+		if nal.Type == NAL_IDR_SLICE && nal.SliceType == sliceTypeUnknown {
+			ids[nal.SampleID] = true
+		}
+	}
+	return ids
+}
+
+// keySamples returns the ids of the samples holding a key frame.
+func keySamples(track *Track) map[uint32]bool {
+	keys := map[uint32]bool{}
+	for _, frame := range track.Frames() {
+		if frame.IsKeyframe() {
+			keys[frame.Sample()] = true
+		}
+	}
+	return keys
+}
+
+// DropKeyFrames returns the ids of the samples of the track without its key
+// frames, except for the first one so the video starts properly.
+func DropKeyFrames(track *Track) []uint32 {
+	keys := keySamples(track)
+	samples := make([]uint32, 0, len(track.Samples))
+	sawFirstKeyFrame := false
+	for i := range track.Samples {
+		id := uint32(i)
+		if keys[id] {
+			if sawFirstKeyFrame {
+				continue
+			}
+			sawFirstKeyFrame = true
+		}
+		samples = append(samples, id)
+	}
+	return samples
+}
+
+// RepeatInterFrames repeats every inter frame sample n extra times.
+func RepeatInterFrames(track *Track, samples []uint32, n int) []uint32 {
+	keys := keySamples(track)
+	repeated := make([]uint32, 0, len(samples))
+	for _, id := range samples {
+		repeated = append(repeated, id)
+		if keys[id] {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			repeated = append(repeated, id)
 		}
 	}
-	return nals
+	return repeated
 }
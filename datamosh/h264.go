@@ -0,0 +1,607 @@
+package datamosh
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrH264Unsupported is returned when a stream uses a coding tool the preview
+// decoder doesn't implement.
+var ErrH264Unsupported = errors.New("unsupported H.264 feature")
+
+// H264SPS represents the parsed sequence parameter set.
+// See 7.3.2.1.1 Sequence parameter set data syntax
+type H264SPS struct {
+	ProfileIDC                  uint32
+	ConstraintSetFlags          uint32 // constraint_set0_flag is the most significant of the 6 bits
+	LevelIDC                    uint32
+	ID                          uint32
+	ChromaFormatIDC             uint32
+	SeparateColourPlane         bool
+	BitDepthLumaMinus8          uint32
+	BitDepthChromaMinus8        uint32
+	QpprimeYZeroTransformBypass bool
+	ScalingMatrixPresent        bool
+	Log2MaxFrameNumMinus4       uint32
+	PicOrderCntType             uint32
+	Log2MaxPicOrderCntLsbMinus4 uint32
+	DeltaPicOrderAlwaysZero     bool
+	OffsetForNonRefPic          int32
+	OffsetForTopToBottomField   int32
+	OffsetForRefFrame           []int32
+	MaxNumRefFrames             uint32
+	GapsInFrameNumAllowed       bool
+	PicWidthInMbsMinus1         uint32
+	PicHeightInMapUnitsMinus1   uint32
+	FrameMbsOnly                bool
+	MbAdaptiveFrameField        bool
+	Direct8x8Inference          bool
+	FrameCropping               bool
+	FrameCropLeftOffset         uint32
+	FrameCropRightOffset        uint32
+	FrameCropTopOffset          uint32
+	FrameCropBottomOffset       uint32
+	VUIParametersPresent        bool
+}
+
+// Width returns the width of the cropped pictures in luma samples.
+func (s *H264SPS) Width() int {
+	w := int(s.PicWidthInMbsMinus1+1) * 16
+	if s.FrameCropping {
+		w -= int(s.FrameCropLeftOffset+s.FrameCropRightOffset) * s.cropUnitX()
+	}
+	return w
+}
+
+// Height returns the height of the cropped pictures in luma samples.
+func (s *H264SPS) Height() int {
+	h := s.frameHeightInMbs() * 16
+	if s.FrameCropping {
+		h -= int(s.FrameCropTopOffset+s.FrameCropBottomOffset) * s.cropUnitY()
+	}
+	return h
+}
+
+func (s *H264SPS) frameHeightInMbs() int {
+	h := int(s.PicHeightInMapUnitsMinus1 + 1)
+	if !s.FrameMbsOnly {
+		h *= 2
+	}
+	return h
+}
+
+// See 7.4.2.1.1, CropUnitX and CropUnitY
+func (s *H264SPS) cropUnitX() int {
+	if s.ChromaFormatIDC == 1 || s.ChromaFormatIDC == 2 {
+		return 2
+	}
+	return 1
+}
+
+func (s *H264SPS) cropUnitY() int {
+	unit := 1
+	if s.ChromaFormatIDC == 1 {
+		unit = 2
+	}
+	if !s.FrameMbsOnly {
+		unit *= 2
+	}
+	return unit
+}
+
+// H264PPS represents the parsed picture parameter set.
+// See 7.3.2.2 Picture parameter set RBSP syntax
+type H264PPS struct {
+	ID                                uint32
+	SPSID                             uint32
+	EntropyCodingMode                 bool // CABAC when set, CAVLC otherwise
+	BottomFieldPicOrderInFramePresent bool
+	NumSliceGroupsMinus1              uint32
+	SliceGroupMapType                 uint32
+	SliceGroupChangeRateMinus1        uint32
+	NumRefIdxL0DefaultActiveMinus1    uint32
+	NumRefIdxL1DefaultActiveMinus1    uint32
+	WeightedPred                      bool
+	WeightedBipredIDC                 uint32
+	PicInitQPMinus26                  int32
+	PicInitQSMinus26                  int32
+	ChromaQPIndexOffset               int32
+	DeblockingFilterControlPresent    bool
+	ConstrainedIntraPred              bool
+	RedundantPicCntPresent            bool
+	Transform8x8Mode                  bool
+	ScalingMatrixPresent              bool
+	SecondChromaQPIndexOffset         int32
+
+	picInitQPPos [2]int // bit range of pic_init_qp_minus26 in the RBSP
+}
+
+// H264SliceHeader represents the parsed slice header.
+// See 7.3.3 Slice header syntax
+type H264SliceHeader struct {
+	NalUnitType                byte
+	NalRefIdc                  byte
+	FirstMbInSlice             uint32
+	SliceType                  uint32 // as coded, use Type for slice_type % 5
+	PPSID                      uint32
+	ColourPlaneID              uint32
+	FrameNum                   uint32
+	FieldPic                   bool
+	BottomField                bool
+	IdrPicID                   uint32
+	PicOrderCntLsb             uint32
+	DeltaPicOrderCntBottom     int32
+	DeltaPicOrderCnt           [2]int32
+	RedundantPicCnt            uint32
+	DirectSpatialMvPred        bool
+	NumRefIdxActiveOverride    bool
+	NumRefIdxL0ActiveMinus1    uint32
+	NumRefIdxL1ActiveMinus1    uint32
+	RefPicListModificationL0   []H264RefPicListModification
+	RefPicListModificationL1   []H264RefPicListModification
+	LumaLog2WeightDenom        uint32
+	ChromaLog2WeightDenom      uint32
+	PredWeightsL0              []H264PredWeight
+	PredWeightsL1              []H264PredWeight
+	NoOutputOfPriorPics        bool
+	LongTermReference          bool
+	AdaptiveRefPicMarking      bool
+	MMCOs                      []H264MMCO
+	CabacInitIDC               uint32
+	SliceQPDelta               int32
+	SPForSwitch                bool
+	SliceQSDelta               int32
+	DisableDeblockingFilterIDC uint32
+	SliceAlphaC0OffsetDiv2     int32
+	SliceBetaOffsetDiv2        int32
+	SliceGroupChangeCycle      uint32
+
+	sps *H264SPS
+	pps *H264PPS
+	pos h264SliceHeaderPos
+}
+
+// h264SliceHeaderPos holds the bit ranges in the RBSP of the slice header
+// syntax elements the moshers rewrite.
+type h264SliceHeaderPos struct {
+	ppsID, frameNum, picOrderCntLsb, sliceQPDelta [2]int
+}
+
+// H264RefPicListModification is an entry of ref_pic_list_modification().
+type H264RefPicListModification struct {
+	ModificationOfPicNumsIDC uint32
+	AbsDiffPicNumMinus1      uint32
+	LongTermPicNum           uint32
+}
+
+// H264PredWeight holds the explicit weighted prediction factors of a
+// reference index. The weights default to 1<<log2_weight_denom, the offsets
+// to 0.
+type H264PredWeight struct {
+	LumaWeight, LumaOffset     int32
+	ChromaWeight, ChromaOffset [2]int32
+}
+
+// H264MMCO is a memory management control operation of dec_ref_pic_marking().
+type H264MMCO struct {
+	Operation                 uint32
+	DifferenceOfPicNumsMinus1 uint32
+	LongTermPicNum            uint32
+	LongTermFrameIdx          uint32
+	MaxLongTermFrameIdxPlus1  uint32
+}
+
+// Type returns slice_type % 5.
+func (h *H264SliceHeader) Type() uint32 {
+	return h.SliceType % 5
+}
+
+// IsIDR returns true for slices of IDR pictures.
+func (h *H264SliceHeader) IsIDR() bool {
+	return h.NalUnitType == NAL_IDR_SLICE
+}
+
+// QP returns SliceQPY, the luma quantization parameter of the first macroblock.
+func (h *H264SliceHeader) QP() int {
+	return 26 + int(h.pps.PicInitQPMinus26) + int(h.SliceQPDelta)
+}
+
+// nalRBSP checks the NAL unit header and returns its RBSP.
+func nalRBSP(nal []byte, nalType byte) ([]byte, error) {
+	if len(nal) < 2 {
+		return nil, errors.New("NAL unit data is empty")
+	}
+	if nal[0]&0x80 != 0 {
+		return nil, errors.New("forbidden_zero_bit is not 0")
+	}
+	if nal[0]&0x1f != nalType {
+		return nil, errors.New("unexpected NAL unit type")
+	}
+	return unescapeRBSP(nal[1:]), nil
+}
+
+// ParseH264SPS parses a sequence parameter set NAL unit, header byte included.
+func ParseH264SPS(nal []byte) (*H264SPS, error) {
+	rbsp, err := nalRBSP(nal, NAL_SPS)
+	if err != nil {
+		return nil, err
+	}
+	r := newRBSPReader(rbsp)
+	s := &H264SPS{}
+
+	s.ProfileIDC = r.u(8)
+	s.ConstraintSetFlags = r.u(6)
+	r.u(2) // reserved_zero_2bits
+	s.LevelIDC = r.u(8)
+	s.ID = r.ueMax("seq_parameter_set_id", 31)
+	s.ChromaFormatIDC = 1
+	switch s.ProfileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		s.ChromaFormatIDC = r.ueMax("chroma_format_idc", 3)
+		if s.ChromaFormatIDC == 3 {
+			s.SeparateColourPlane = r.flag()
+		}
+		s.BitDepthLumaMinus8 = r.ueMax("bit_depth_luma_minus8", 6)
+		s.BitDepthChromaMinus8 = r.ueMax("bit_depth_chroma_minus8", 6)
+		s.QpprimeYZeroTransformBypass = r.flag()
+		s.ScalingMatrixPresent = r.flag()
+		if s.ScalingMatrixPresent {
+			n := 8
+			if s.ChromaFormatIDC == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.flag() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+	s.Log2MaxFrameNumMinus4 = r.ueMax("log2_max_frame_num_minus4", 12)
+	s.PicOrderCntType = r.ueMax("pic_order_cnt_type", 2)
+	switch s.PicOrderCntType {
+	case 0:
+		s.Log2MaxPicOrderCntLsbMinus4 = r.ueMax("log2_max_pic_order_cnt_lsb_minus4", 12)
+	case 1:
+		s.DeltaPicOrderAlwaysZero = r.flag()
+		s.OffsetForNonRefPic = r.se()
+		s.OffsetForTopToBottomField = r.se()
+		n := r.ueMax("num_ref_frames_in_pic_order_cnt_cycle", 255)
+		s.OffsetForRefFrame = make([]int32, n)
+		for i := range s.OffsetForRefFrame {
+			s.OffsetForRefFrame[i] = r.se()
+		}
+	}
+	s.MaxNumRefFrames = r.ue()
+	s.GapsInFrameNumAllowed = r.flag()
+	s.PicWidthInMbsMinus1 = r.ue()
+	s.PicHeightInMapUnitsMinus1 = r.ue()
+	s.FrameMbsOnly = r.flag()
+	if !s.FrameMbsOnly {
+		s.MbAdaptiveFrameField = r.flag()
+	}
+	s.Direct8x8Inference = r.flag()
+	s.FrameCropping = r.flag()
+	if s.FrameCropping {
+		s.FrameCropLeftOffset = r.ue()
+		s.FrameCropRightOffset = r.ue()
+		s.FrameCropTopOffset = r.ue()
+		s.FrameCropBottomOffset = r.ue()
+	}
+	s.VUIParametersPresent = r.flag()
+	// the VUI parameters don't change the decoding process
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to parse SPS: %v", r.err)
+	}
+	return s, nil
+}
+
+// skipScalingList reads a scaling_list() syntax structure.
+// See 7.3.2.1.1.1 Scaling list syntax
+func skipScalingList(r *rbspReader, size int) {
+	lastScale, nextScale := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if nextScale != 0 {
+			delta := r.se()
+			nextScale = (lastScale + delta + 256) % 256
+		}
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+}
+
+// ParseH264PPS parses a picture parameter set NAL unit, header byte included.
+// Scaling lists are skipped assuming a chroma format other than 4:4:4.
+func ParseH264PPS(nal []byte) (*H264PPS, error) {
+	rbsp, err := nalRBSP(nal, NAL_PPS)
+	if err != nil {
+		return nil, err
+	}
+	r := newRBSPReader(rbsp)
+	p := &H264PPS{}
+
+	p.ID = r.ueMax("pic_parameter_set_id", 255)
+	p.SPSID = r.ueMax("seq_parameter_set_id", 31)
+	p.EntropyCodingMode = r.flag()
+	p.BottomFieldPicOrderInFramePresent = r.flag()
+	p.NumSliceGroupsMinus1 = r.ueMax("num_slice_groups_minus1", 7)
+	if p.NumSliceGroupsMinus1 > 0 {
+		p.SliceGroupMapType = r.ueMax("slice_group_map_type", 6)
+		switch p.SliceGroupMapType {
+		case 0:
+			for i := uint32(0); i <= p.NumSliceGroupsMinus1; i++ {
+				r.ue() // run_length_minus1
+			}
+		case 2:
+			for i := uint32(0); i < p.NumSliceGroupsMinus1; i++ {
+				r.ue() // top_left
+				r.ue() // bottom_right
+			}
+		case 3, 4, 5:
+			r.flag() // slice_group_change_direction_flag
+			p.SliceGroupChangeRateMinus1 = r.ue()
+		case 6:
+			n := r.ue() + 1 // pic_size_in_map_units_minus1
+			bits := ceilLog2(p.NumSliceGroupsMinus1 + 1)
+			for i := uint32(0); i < n && r.err == nil; i++ {
+				r.u(bits) // slice_group_id
+			}
+		}
+	}
+	p.NumRefIdxL0DefaultActiveMinus1 = r.ueMax("num_ref_idx_l0_default_active_minus1", 31)
+	p.NumRefIdxL1DefaultActiveMinus1 = r.ueMax("num_ref_idx_l1_default_active_minus1", 31)
+	p.WeightedPred = r.flag()
+	p.WeightedBipredIDC = r.u(2)
+	p.picInitQPPos[0] = r.pos
+	p.PicInitQPMinus26 = r.se()
+	p.picInitQPPos[1] = r.pos
+	p.PicInitQSMinus26 = r.se()
+	p.ChromaQPIndexOffset = r.se()
+	p.DeblockingFilterControlPresent = r.flag()
+	p.ConstrainedIntraPred = r.flag()
+	p.RedundantPicCntPresent = r.flag()
+	p.SecondChromaQPIndexOffset = p.ChromaQPIndexOffset
+	if r.moreRBSPData() {
+		p.Transform8x8Mode = r.flag()
+		p.ScalingMatrixPresent = r.flag()
+		if p.ScalingMatrixPresent {
+			n := 6
+			if p.Transform8x8Mode {
+				n += 2
+			}
+			for i := 0; i < n; i++ {
+				if r.flag() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+		p.SecondChromaQPIndexOffset = r.se()
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to parse PPS: %v", r.err)
+	}
+	return p, nil
+}
+
+// ceilLog2 returns Ceil(Log2(v)).
+func ceilLog2(v uint32) int {
+	n := 0
+	for (uint32(1) << uint(n)) < v {
+		n++
+	}
+	return n
+}
+
+// parseH264SliceHeader reads the slice header from r, leaving it at the start of
+// the slice data. The parameter sets are looked up by id.
+func parseH264SliceHeader(r *rbspReader, nalHeader byte, spss map[uint32]*H264SPS, ppss map[uint32]*H264PPS) (*H264SliceHeader, error) {
+	h := &H264SliceHeader{
+		NalUnitType: nalHeader & 0x1f,
+		NalRefIdc:   (nalHeader >> 5) & 0x03,
+	}
+	h.FirstMbInSlice = r.ue()
+	h.SliceType = r.ueMax("slice_type", 9)
+	h.pos.ppsID[0] = r.pos
+	h.PPSID = r.ueMax("pic_parameter_set_id", 255)
+	h.pos.ppsID[1] = r.pos
+	if r.err != nil {
+		return nil, r.err
+	}
+	pps := ppss[h.PPSID]
+	if pps == nil {
+		return nil, fmt.Errorf("unknown PPS id %d", h.PPSID)
+	}
+	sps := spss[pps.SPSID]
+	if sps == nil {
+		return nil, fmt.Errorf("unknown SPS id %d", pps.SPSID)
+	}
+	h.sps, h.pps = sps, pps
+	sliceType := h.Type()
+
+	if sps.SeparateColourPlane {
+		h.ColourPlaneID = r.u(2)
+	}
+	h.pos.frameNum[0] = r.pos
+	h.FrameNum = r.u(int(sps.Log2MaxFrameNumMinus4 + 4))
+	h.pos.frameNum[1] = r.pos
+	if !sps.FrameMbsOnly {
+		h.FieldPic = r.flag()
+		if h.FieldPic {
+			h.BottomField = r.flag()
+		}
+	}
+	if h.IsIDR() {
+		h.IdrPicID = r.ueMax("idr_pic_id", 65535)
+	}
+	if sps.PicOrderCntType == 0 {
+		h.pos.picOrderCntLsb[0] = r.pos
+		h.PicOrderCntLsb = r.u(int(sps.Log2MaxPicOrderCntLsbMinus4 + 4))
+		h.pos.picOrderCntLsb[1] = r.pos
+		if pps.BottomFieldPicOrderInFramePresent && !h.FieldPic {
+			h.DeltaPicOrderCntBottom = r.se()
+		}
+	}
+	if sps.PicOrderCntType == 1 && !sps.DeltaPicOrderAlwaysZero {
+		h.DeltaPicOrderCnt[0] = r.se()
+		if pps.BottomFieldPicOrderInFramePresent && !h.FieldPic {
+			h.DeltaPicOrderCnt[1] = r.se()
+		}
+	}
+	if pps.RedundantPicCntPresent {
+		h.RedundantPicCnt = r.ueMax("redundant_pic_cnt", 127)
+	}
+	if sliceType == SLICE_B {
+		h.DirectSpatialMvPred = r.flag()
+	}
+	h.NumRefIdxL0ActiveMinus1 = pps.NumRefIdxL0DefaultActiveMinus1
+	h.NumRefIdxL1ActiveMinus1 = pps.NumRefIdxL1DefaultActiveMinus1
+	if sliceType == SLICE_P || sliceType == SLICE_SP || sliceType == SLICE_B {
+		h.NumRefIdxActiveOverride = r.flag()
+		if h.NumRefIdxActiveOverride {
+			h.NumRefIdxL0ActiveMinus1 = r.ueMax("num_ref_idx_l0_active_minus1", 31)
+			if sliceType == SLICE_B {
+				h.NumRefIdxL1ActiveMinus1 = r.ueMax("num_ref_idx_l1_active_minus1", 31)
+			}
+		}
+	}
+
+	// 7.3.3.1 Reference picture list modification syntax
+	if sliceType != SLICE_I && sliceType != SLICE_SI {
+		h.RefPicListModificationL0 = parseRefPicListModification(r)
+	}
+	if sliceType == SLICE_B {
+		h.RefPicListModificationL1 = parseRefPicListModification(r)
+	}
+
+	if (pps.WeightedPred && (sliceType == SLICE_P || sliceType == SLICE_SP)) ||
+		(pps.WeightedBipredIDC == 1 && sliceType == SLICE_B) {
+		h.parsePredWeightTable(r)
+	}
+
+	// 7.3.3.3 Decoded reference picture marking syntax
+	if h.NalRefIdc != 0 {
+		if h.IsIDR() {
+			h.NoOutputOfPriorPics = r.flag()
+			h.LongTermReference = r.flag()
+		} else {
+			h.AdaptiveRefPicMarking = r.flag()
+			for h.AdaptiveRefPicMarking && r.err == nil {
+				op := H264MMCO{Operation: r.ueMax("memory_management_control_operation", 6)}
+				if op.Operation == 0 {
+					break
+				}
+				if op.Operation == 1 || op.Operation == 3 {
+					op.DifferenceOfPicNumsMinus1 = r.ue()
+				}
+				if op.Operation == 2 {
+					op.LongTermPicNum = r.ue()
+				}
+				if op.Operation == 3 || op.Operation == 6 {
+					op.LongTermFrameIdx = r.ue()
+				}
+				if op.Operation == 4 {
+					op.MaxLongTermFrameIdxPlus1 = r.ue()
+				}
+				h.MMCOs = append(h.MMCOs, op)
+			}
+		}
+	}
+
+	if pps.EntropyCodingMode && sliceType != SLICE_I && sliceType != SLICE_SI {
+		h.CabacInitIDC = r.ueMax("cabac_init_idc", 2)
+	}
+	h.pos.sliceQPDelta[0] = r.pos
+	h.SliceQPDelta = r.se()
+	h.pos.sliceQPDelta[1] = r.pos
+	if sliceType == SLICE_SP || sliceType == SLICE_SI {
+		if sliceType == SLICE_SP {
+			h.SPForSwitch = r.flag()
+		}
+		h.SliceQSDelta = r.se()
+	}
+	if pps.DeblockingFilterControlPresent {
+		h.DisableDeblockingFilterIDC = r.ueMax("disable_deblocking_filter_idc", 2)
+		if h.DisableDeblockingFilterIDC != 1 {
+			h.SliceAlphaC0OffsetDiv2 = r.se()
+			h.SliceBetaOffsetDiv2 = r.se()
+		}
+	}
+	if pps.NumSliceGroupsMinus1 > 0 && pps.SliceGroupMapType >= 3 && pps.SliceGroupMapType <= 5 {
+		picSizeInMapUnits := (sps.PicWidthInMbsMinus1 + 1) * (sps.PicHeightInMapUnitsMinus1 + 1)
+		rate := pps.SliceGroupChangeRateMinus1 + 1
+		h.SliceGroupChangeCycle = r.u(ceilLog2(picSizeInMapUnits/rate + 1))
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to parse slice header: %v", r.err)
+	}
+	if qp := h.QP(); qp < 0 || qp > 51 {
+		return nil, fmt.Errorf("invalid slice QP: %d", qp)
+	}
+	return h, nil
+}
+
+func parseRefPicListModification(r *rbspReader) []H264RefPicListModification {
+	var mods []H264RefPicListModification
+	if !r.flag() {
+		return nil
+	}
+	for r.err == nil {
+		mod := H264RefPicListModification{ModificationOfPicNumsIDC: r.ueMax("modification_of_pic_nums_idc", 5)}
+		switch mod.ModificationOfPicNumsIDC {
+		case 0, 1:
+			mod.AbsDiffPicNumMinus1 = r.ue()
+		case 2:
+			mod.LongTermPicNum = r.ue()
+		case 3:
+			return mods
+		}
+		mods = append(mods, mod)
+	}
+	return mods
+}
+
+// parsePredWeightTable reads pred_weight_table().
+// See 7.3.3.2 Prediction weight table syntax
+func (h *H264SliceHeader) parsePredWeightTable(r *rbspReader) {
+	h.LumaLog2WeightDenom = r.ueMax("luma_log2_weight_denom", 7)
+	chroma := h.sps.ChromaFormatIDC != 0 && !h.sps.SeparateColourPlane
+	if chroma {
+		h.ChromaLog2WeightDenom = r.ueMax("chroma_log2_weight_denom", 7)
+	}
+	lists := []*[]H264PredWeight{&h.PredWeightsL0}
+	counts := []uint32{h.NumRefIdxL0ActiveMinus1}
+	if h.Type() == SLICE_B {
+		lists = append(lists, &h.PredWeightsL1)
+		counts = append(counts, h.NumRefIdxL1ActiveMinus1)
+	}
+	for l, weights := range lists {
+		for i := uint32(0); i <= counts[l] && r.err == nil; i++ {
+			w := H264PredWeight{LumaWeight: 1 << h.LumaLog2WeightDenom}
+			w.ChromaWeight[0] = 1 << h.ChromaLog2WeightDenom
+			w.ChromaWeight[1] = w.ChromaWeight[0]
+			if r.flag() { // luma_weight_flag
+				w.LumaWeight = r.se()
+				w.LumaOffset = r.se()
+			}
+			if chroma && r.flag() { // chroma_weight_flag
+				for j := 0; j < 2; j++ {
+					w.ChromaWeight[j] = r.se()
+					w.ChromaOffset[j] = r.se()
+				}
+			}
+			*weights = append(*weights, w)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package datamosh
+
+import "fmt"
+
+// decodeCABAC reads the slice data coded with CABAC.
+// See 7.3.4 Slice data syntax
+func (s *h264SliceDecoder) decodeCABAC() error {
+	s.cabac = newCABACDecoder(s.r, s.h)
+	s.cabac.record = s.cabacOut != nil
+	picSize := len(s.pic.mbs)
+	for mbAddr := int(s.h.FirstMbInSlice); ; mbAddr++ {
+		if mbAddr >= picSize {
+			return errSlicePastEnd
+		}
+		s.startMacroblock(mbAddr)
+		if s.h.Type() == SLICE_P && s.cabac.decision(ctxMbSkipP+s.mbSkipFlagCtxIdxInc()) == 1 {
+			s.skipMacroblock(mbAddr)
+		} else if err := s.decodeMacroblock(mbAddr); err != nil {
+			return fmt.Errorf("failed to decode macroblock %d: %v", mbAddr, err)
+		}
+		endOfSlice := s.cabac.terminate() == 1
+		if s.r.err != nil {
+			return s.r.err
+		}
+		// the decoding engine reads up to the rbsp_stop_one_bit
+		if s.r.bitsLeft() < -1 {
+			return errRBSPOverrun
+		}
+		if s.cabacOut != nil {
+			s.reencode()
+		}
+		if endOfSlice {
+			return nil
+		}
+	}
+}
+
+// reencode codes the bins of the macroblock decoded last with cabacOut, and
+// its motion vector differences and residual blocks as rewritten.
+func (s *h264SliceDecoder) reencode() {
+	e := s.cabacOut
+	for _, bin := range s.cabac.bins {
+		switch bin.ctxIdx {
+		case cabacBypass:
+			e.bypass(uint32(bin.val))
+		case cabacTerminate:
+			e.terminate(uint32(bin.val))
+		case cabacMVD:
+			mvd, comp := s.mvds[bin.val/2], bin.val%2
+			e.mvd(ctxMVDX+7*int(comp), mvd.ctxIdxInc[comp], mvd.mvd[comp])
+		case cabacResidual:
+			res := &s.residuals[bin.val]
+			e.residualBlock(s.rewrittenLevels[bin.val], res.cat, res.ctxIdxInc)
+		case cabacPCM:
+			e.pcm(s.pcmSamples())
+		default:
+			e.decision(int(bin.ctxIdx), uint32(bin.val))
+		}
+	}
+	s.cabac.bins = s.cabac.bins[:0]
+}
+
+// pcmSamples returns the samples of the current macroblock in the order of
+// the I_PCM syntax.
+func (s *h264SliceDecoder) pcmSamples() []byte {
+	img := s.pic.img
+	samples := make([]byte, 0, 16*16+2*8*8)
+	for y := 0; y < 16; y++ {
+		offset := img.YOffset(s.mbX*16, s.mbY*16+y)
+		samples = append(samples, img.Y[offset:offset+16]...)
+	}
+	for _, plane := range [][]byte{img.Cb, img.Cr} {
+		for y := 0; y < 8; y++ {
+			offset := img.COffset(s.mbX*16, s.mbY*16+y*2)
+			samples = append(samples, plane[offset:offset+8]...)
+		}
+	}
+	return samples
+}
+
+// readMbType reads mb_type, in the P slice numbering in P slices.
+func (s *h264SliceDecoder) readMbType() uint32 {
+	if s.cabac == nil {
+		return s.r.ue()
+	}
+	if s.h.Type() == SLICE_P {
+		return s.cabac.mbTypeP()
+	}
+	// 9.3.3.1.1.3, the neighbours other than I_NxN increment the context
+	inc := 0
+	for _, mb := range s.neighbourMBs() {
+		if mb != nil && mb.kind != mbI4x4 {
+			inc++
+		}
+	}
+	return s.cabac.mbTypeI(&mbTypeICtxIdx, inc)
+}
+
+// readSubMbType reads sub_mb_type.
+func (s *h264SliceDecoder) readSubMbType() uint32 {
+	if s.cabac == nil {
+		return s.r.ueMax("sub_mb_type", 3)
+	}
+	return s.cabac.subMbTypeP()
+}
+
+// readTransformSize8x8Flag reads transform_size_8x8_flag.
+func (s *h264SliceDecoder) readTransformSize8x8Flag() bool {
+	if s.cabac == nil {
+		return s.r.flag()
+	}
+	// 9.3.3.1.1.10, the neighbours using the 8x8 transform increment the
+	// context
+	inc := 0
+	for _, mb := range s.neighbourMBs() {
+		if mb != nil && mb.transform8x8 {
+			inc++
+		}
+	}
+	return s.cabac.decision(ctxTransform8x8+inc) == 1
+}
+
+// readIntra4x4PredMode reads prev_intra4x4_pred_mode_flag and
+// rem_intra4x4_pred_mode.
+func (s *h264SliceDecoder) readIntra4x4PredMode() (prev bool, rem uint32) {
+	if s.cabac != nil {
+		return s.cabac.intra4x4PredMode()
+	}
+	if s.r.flag() {
+		return true, 0
+	}
+	return false, s.r.u(3)
+}
+
+// readIntraChromaPredMode reads intra_chroma_pred_mode.
+func (s *h264SliceDecoder) readIntraChromaPredMode() int {
+	if s.cabac == nil {
+		return int(s.r.ueMax("intra_chroma_pred_mode", 3))
+	}
+	// 9.3.3.1.1.8
+	inc := 0
+	for _, mb := range s.neighbourMBs() {
+		if mb != nil && mb.isIntra() && mb.kind != mbIPCM && mb.chromaPredMode != 0 {
+			inc++
+		}
+	}
+	return int(s.cabac.intraChromaPredMode(inc))
+}
+
+// readCBP reads coded_block_pattern, mapped with table from the codeNum of
+// CAVLC, and returns its luma and chroma parts.
+func (s *h264SliceDecoder) readCBP(table []uint8) (luma, chroma int) {
+	var cbp uint8
+	if s.cabac == nil {
+		cbp = table[s.r.ueMax("coded_block_pattern", 47)]
+	} else {
+		var neighbours [2]uint8
+		for i, mb := range s.neighbourMBs() {
+			neighbours[i] = cbpUnavailable
+			if mb != nil {
+				neighbours[i] = mb.cbp
+			}
+		}
+		cbp = s.cabac.cbp(neighbours[0], neighbours[1])
+	}
+	return int(cbp % 16), int(cbp / 16)
+}
+
+// readMbQPDelta reads mb_qp_delta.
+func (s *h264SliceDecoder) readMbQPDelta() int32 {
+	if s.cabac == nil {
+		return s.r.se()
+	}
+	// 9.3.3.1.1.5, the previous macroblock in decoding order
+	inc := 0
+	if mbAddr := s.mbY*s.pic.widthMbs + s.mbX; mbAddr > 0 {
+		prev := &s.pic.mbs[mbAddr-1]
+		if prev.slice == s.slice && prev.qpDelta != 0 {
+			inc = 1
+		}
+	}
+	return s.cabac.mbQPDelta(inc)
+}
+
+// readRefIdx reads the ref_idx_l0 of the partition at (x, y), in luma
+// samples.
+func (s *h264SliceDecoder) readRefIdx(x, y int, max uint32) uint32 {
+	if s.cabac == nil {
+		return s.r.te(max)
+	}
+	// 9.3.3.1.1.6, the neighbouring partitions predicting from a reference
+	// picture other than the first one increment the context
+	inc := 0
+	for i, n := range s.neighbourPartitions(x, y) {
+		if n.mb != nil && !n.mb.skipped && n.mb.refIdx[n.blk/8*2+n.blk%4/2] > 0 {
+			inc += i + 1
+		}
+	}
+	return s.cabac.refIdx(inc)
+}
+
+// readMVD reads the component comp of the mvd_l0 of the partition at (x, y),
+// in luma samples.
+func (s *h264SliceDecoder) readMVD(x, y, comp int) int32 {
+	if s.cabac == nil {
+		return s.r.se()
+	}
+	d := s.cabac
+	n := len(d.bins)
+	mvd := d.mvd(ctxMVDX+7*comp, s.mvdCtxIdxInc(x, y, comp, false))
+	if d.record && s.rewriteMVD != nil {
+		// coded again from its rewritten value, see reencode
+		d.bins = append(d.bins[:n], cabacBin{ctxIdx: cabacMVD, val: int32(2*len(s.mvds) + comp)})
+	}
+	return mvd
+}
+
+// mvdCtxIdxInc returns the ctxIdxInc of the first bin of the component comp
+// of the mvd_l0 of the partition at (x, y), in luma samples, from the motion
+// vector differences of the neighbouring partitions as coded or as
+// rewritten.
+// See 9.3.3.1.1.7
+func (s *h264SliceDecoder) mvdCtxIdxInc(x, y, comp int, rewritten bool) int {
+	var sum int32
+	for _, n := range s.neighbourPartitions(x, y) {
+		// the motion vector differences of skipped and intra macroblocks
+		// are zero
+		switch {
+		case n.mb == nil:
+		case rewritten:
+			sum += abs32(n.mb.rewrittenMVD[n.blk][comp])
+		default:
+			sum += abs32(n.mb.mvd[n.blk][comp])
+		}
+	}
+	return absMVDCompCtxIdxInc(sum)
+}
+
+// codedBlockFlagCtxIdxInc returns the ctxIdxInc of the coded_block_flag of a
+// block of category cat, (x, y) being the position of the luma or chroma AC
+// block in block units and c the chroma component, from the neighbouring
+// blocks as coded or as rewritten.
+// See 9.3.3.1.1.9
+func (s *h264SliceDecoder) codedBlockFlagCtxIdxInc(cat, c, x, y int, rewritten bool) int {
+	inc := 0
+	for i, d := range [2][2]int{{-1, 0}, {0, -1}} {
+		var mb *h264Macroblock
+		var coded bool
+		switch cat {
+		case blockLumaDC:
+			mb = s.neighbourMB(d[0], d[1], false)
+			coded = mb != nil && mb.coeffCounts(rewritten).codedDC&1 != 0
+		case blockChromaDC:
+			mb = s.neighbourMB(d[0], d[1], false)
+			coded = mb != nil && mb.coeffCounts(rewritten).codedDC&(2<<uint(c)) != 0
+		case blockChromaAC:
+			var blk int
+			mb, blk = s.neighbourBlock(x+d[0], y+d[1], 2, false)
+			coded = mb != nil && mb.coeffCounts(rewritten).totalCoeffC[c][blk] != 0
+		default:
+			var blk int
+			mb, blk = s.neighbourBlock(x+d[0], y+d[1], 4, false)
+			coded = mb != nil && mb.coeffCounts(rewritten).totalCoeff[blk] != 0
+		}
+		// the blocks of unavailable macroblocks count as coded for intra
+		// macroblocks, the ones of I_PCM macroblocks always do
+		if (mb == nil && s.mb.isIntra()) || (mb != nil && mb.kind == mbIPCM) || coded {
+			inc += i + 1
+		}
+	}
+	return inc
+}
+
+// mbSkipFlagCtxIdxInc returns the ctxIdxInc of mb_skip_flag.
+// See 9.3.3.1.1.1
+func (s *h264SliceDecoder) mbSkipFlagCtxIdxInc() int {
+	inc := 0
+	for _, mb := range s.neighbourMBs() {
+		if mb != nil && !mb.skipped {
+			inc++
+		}
+	}
+	return inc
+}
+
+// neighbourMBs returns the macroblocks on the left and on top of the current
+// one, nil when they aren't available.
+func (s *h264SliceDecoder) neighbourMBs() [2]*h264Macroblock {
+	return [2]*h264Macroblock{s.neighbourMB(-1, 0, false), s.neighbourMB(0, -1, false)}
+}
+
+// h264BlockRef is a luma block of a macroblock, in raster order.
+type h264BlockRef struct {
+	mb  *h264Macroblock
+	blk int
+}
+
+// neighbourPartitions returns the luma blocks on the left and on top of the
+// partition at (x, y), in luma samples. They belong to partitions parsed
+// before it.
+func (s *h264SliceDecoder) neighbourPartitions(x, y int) [2]h264BlockRef {
+	var refs [2]h264BlockRef
+	refs[0].mb, refs[0].blk = s.neighbourBlock(x/4-1, y/4, 4, false)
+	refs[1].mb, refs[1].blk = s.neighbourBlock(x/4, y/4-1, 4, false)
+	return refs
+}
@@ -0,0 +1,948 @@
+package datamosh
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// H264Decoder is a pure Go H.264 decoder meant for previews, for instance to
+// render thumbnails of key frames and check mosh points without leaving Go.
+// It supports the coding tools of the Constrained Baseline profile, the CABAC
+// entropy coding and the weighted prediction of the Main profile and the 8x8
+// transform of the High profile: 4:2:0 8 bit progressive pictures, I and P
+// slices with intra prediction, motion compensation, the 4x4 and 8x8 inverse
+// transforms and the deblocking filter. Scaling matrices and B slices aren't
+// supported.
+//
+// Moshed streams reference pictures that were never decoded, the decoder
+// predicts from the last decoded picture instead, or from a gray one at the
+// start of the stream, and conceals the macroblocks it couldn't decode with
+// the ones of the previous picture.
+type H264Decoder struct {
+	sps  map[uint32]*H264SPS
+	pps  map[uint32]*H264PPS
+	pic  *h264Picture   // being decoded
+	last *h264Picture   // last decoded picture
+	dpb  []*h264Picture // reference pictures
+	gray *h264Picture   // reference of the P slices without any
+
+	maxLongTermFrameIdx int // -1 for "no long-term frame indices"
+	count               int // of the decoded pictures
+}
+
+// NewH264Decoder returns a decoder primed with the parameter sets of the avcC
+// box of a track, avc can be nil if the parameter sets are in the stream.
+func NewH264Decoder(avc *AVCDecoderConfig) (*H264Decoder, error) {
+	d := &H264Decoder{
+		sps:                 make(map[uint32]*H264SPS),
+		pps:                 make(map[uint32]*H264PPS),
+		maxLongTermFrameIdx: -1,
+	}
+	if avc == nil {
+		return d, nil
+	}
+	for _, ps := range avc.SequenceParameterSets {
+		if err := d.DecodeNAL(ps.NALUnit); err != nil {
+			return nil, err
+		}
+	}
+	for _, ps := range avc.PictureParameterSets {
+		if err := d.DecodeNAL(ps.NALUnit); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// DecodeNAL decodes a NAL unit, header byte included and emulation prevention
+// bytes not removed. A slice starting at the first macroblock begins a new
+// picture, the previous one is dropped if Picture wasn't called.
+func (d *H264Decoder) DecodeNAL(nal []byte) error {
+	if len(nal) == 0 {
+		return errors.New("NAL unit data is empty")
+	}
+	switch nal[0] & 0x1f {
+	case NAL_SPS:
+		sps, err := ParseH264SPS(nal)
+		if err != nil {
+			return err
+		}
+		d.sps[sps.ID] = sps
+	case NAL_PPS:
+		pps, err := ParseH264PPS(nal)
+		if err != nil {
+			return err
+		}
+		d.pps[pps.ID] = pps
+	case NAL_SLICE, NAL_IDR_SLICE:
+		return d.decodeSlice(nal)
+	case NAL_DPA, NAL_DPB, NAL_DPC:
+		return fmt.Errorf("%w: data partitioning", ErrH264Unsupported)
+	}
+	return nil
+}
+
+// Picture finishes the picture being decoded and returns it, cropped. It
+// returns nil if no slice was decoded since the previous call. The picture
+// may be used as a reference by the next ones and must not be modified.
+func (d *H264Decoder) Picture() *image.YCbCr {
+	pic := d.finishPicture()
+	if pic == nil {
+		return nil
+	}
+	return pic.cropped()
+}
+
+// DecodeAccessUnit decodes the NAL units of an access unit, a sample in MP4
+// files, and returns the decoded picture.
+func (d *H264Decoder) DecodeAccessUnit(nals [][]byte) (*image.YCbCr, error) {
+	for _, nal := range nals {
+		if err := d.DecodeNAL(nal); err != nil {
+			return nil, err
+		}
+	}
+	img := d.Picture()
+	if img == nil {
+		return nil, errors.New("no picture in the access unit")
+	}
+	return img, nil
+}
+
+// DecodeKeyframe decodes the picture of the sample holding nal, usually an IDR
+// slice, for instance to render a thumbnail of a mosh point.
+func (t *Track) DecodeKeyframe(r io.ReadSeeker, nal *NALUnit) (*image.YCbCr, error) {
+	if t.AVC == nil {
+		return nil, errors.New("AVC configuration not found")
+	}
+	d, err := NewH264Decoder(t.AVC)
+	if err != nil {
+		return nil, err
+	}
+	nals, err := t.sampleNALs(r, nal.SampleID)
+	if err != nil {
+		return nil, err
+	}
+	return d.DecodeAccessUnit(nals)
+}
+
+// DecodeFrames decodes the samples of an H.264 track in decoding order and
+// calls fn with the id and the picture of each, to render moshed output. The
+// samples that fail to decode, like nullified key frames, are dropped as a
+// player would and the next frames predict from the previous pictures, which
+// is what shows the mosh. An error wrapping ErrH264Unsupported is returned if
+// the stream uses coding tools the decoder doesn't implement.
+func (t *Track) DecodeFrames(r io.ReadSeeker, fn func(sampleID uint32, img *image.YCbCr) error) error {
+	if t.AVC == nil {
+		return errors.New("AVC configuration not found")
+	}
+	d, err := NewH264Decoder(t.AVC)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(t.NALs); {
+		sampleID := t.NALs[i].SampleID
+		for ; i < len(t.NALs) && t.NALs[i].SampleID == sampleID; i++ {
+			payload, err := t.NALs[i].Payload(r)
+			if err != nil {
+				return err
+			}
+			if err := d.DecodeNAL(payload); err != nil {
+				if errors.Is(err, ErrH264Unsupported) {
+					return err
+				}
+				if Debug {
+					fmt.Printf("Sample %d: %v\n", sampleID, err)
+				}
+			}
+		}
+		if img := d.Picture(); img != nil {
+			if err := fn(sampleID, img); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sampleNALs reads the NAL units of a sample.
+func (t *Track) sampleNALs(r io.ReadSeeker, sampleID uint32) ([][]byte, error) {
+	var nals [][]byte
+	for _, nal := range t.NALs {
+		if nal.SampleID != sampleID {
+			continue
+		}
+		payload, err := nal.Payload(r)
+		if err != nil {
+			return nil, err
+		}
+		nals = append(nals, payload)
+	}
+	return nals, nil
+}
+
+// checkH264Support returns an error wrapping ErrH264Unsupported if the slice
+// uses coding tools the decoder doesn't implement.
+func checkH264Support(h *H264SliceHeader) error {
+	var feature string
+	switch {
+	case h.sps.ChromaFormatIDC != 1:
+		feature = fmt.Sprintf("chroma_format_idc %d", h.sps.ChromaFormatIDC)
+	case h.sps.BitDepthLumaMinus8 != 0 || h.sps.BitDepthChromaMinus8 != 0:
+		feature = "high bit depth"
+	case !h.sps.FrameMbsOnly:
+		feature = "interlaced pictures"
+	case h.sps.QpprimeYZeroTransformBypass:
+		feature = "lossless macroblocks"
+	case h.sps.ScalingMatrixPresent || h.pps.ScalingMatrixPresent:
+		feature = "scaling matrices"
+	case h.pps.NumSliceGroupsMinus1 > 0:
+		feature = "slice groups"
+	case h.Type() != SLICE_I && h.Type() != SLICE_P:
+		feature = fmt.Sprintf("slice type %d", h.Type())
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrH264Unsupported, feature)
+}
+
+func (d *H264Decoder) decodeSlice(nal []byte) error {
+	r := newRBSPReader(unescapeRBSP(nal[1:]))
+	h, err := parseH264SliceHeader(r, nal[0], d.sps, d.pps)
+	if err != nil {
+		return err
+	}
+	if err := checkH264Support(h); err != nil {
+		return err
+	}
+	if h.RedundantPicCnt > 0 {
+		// the primary coded picture is enough
+		return nil
+	}
+
+	if d.pic == nil || h.FirstMbInSlice == 0 {
+		d.finishPicture()
+		d.pic = newH264Picture(h.sps)
+		d.pic.id = d.count
+		d.pic.frameNum = h.FrameNum
+		d.count++
+	}
+	pic := d.pic
+	if int(h.sps.PicWidthInMbsMinus1+1) != pic.widthMbs || h.sps.frameHeightInMbs() != pic.heightMbs {
+		return errors.New("slice and picture sizes don't match")
+	}
+	pic.slices = append(pic.slices, h)
+
+	s := &h264SliceDecoder{
+		r:     r,
+		h:     h,
+		pic:   pic,
+		slice: len(pic.slices),
+		qp:    h.QP(),
+	}
+	if h.Type() == SLICE_P {
+		s.refs = d.refPicList0(h)
+		for i, ref := range s.refs {
+			if ref == nil || !ref.sameSize(pic) {
+				s.refs[i] = d.missingReference(pic)
+			}
+		}
+	}
+	return s.decode()
+}
+
+// missingReference returns the picture used in place of a reference picture
+// missing from the stream: the last decoded picture, or a gray one.
+func (d *H264Decoder) missingReference(pic *h264Picture) *h264Picture {
+	if d.last != nil && d.last.sameSize(pic) {
+		return d.last
+	}
+	if d.gray == nil || !d.gray.sameSize(pic) {
+		d.gray = newH264Picture(pic.sps)
+		d.gray.id = -1
+		fill(d.gray.img.Y, unavailableSample)
+		fill(d.gray.img.Cb, unavailableSample)
+		fill(d.gray.img.Cr, unavailableSample)
+	}
+	return d.gray
+}
+
+func fill(b []byte, v byte) {
+	for i := range b {
+		b[i] = v
+	}
+}
+
+func (d *H264Decoder) finishPicture() *h264Picture {
+	pic := d.pic
+	if pic == nil {
+		return nil
+	}
+	d.pic = nil
+	d.conceal(pic)
+	pic.deblock()
+	d.markReference(pic)
+	d.last = pic
+	return pic
+}
+
+// conceal copies the macroblocks that weren't decoded, because their slice
+// was lost or broken, from the previous picture.
+func (d *H264Decoder) conceal(pic *h264Picture) {
+	var prev *h264Picture
+	for mbAddr, mb := range pic.mbs {
+		if mb.slice != 0 {
+			continue
+		}
+		if prev == nil {
+			prev = d.missingReference(pic)
+		}
+		x, y := mbAddr%pic.widthMbs*16, mbAddr/pic.widthMbs*16
+		for j := 0; j < 16; j++ {
+			offset := pic.img.YOffset(x, y+j)
+			copy(pic.img.Y[offset:offset+16], prev.img.Y[offset:])
+		}
+		for j := 0; j < 16; j += 2 {
+			offset := pic.img.COffset(x, y+j)
+			copy(pic.img.Cb[offset:offset+8], prev.img.Cb[offset:])
+			copy(pic.img.Cr[offset:offset+8], prev.img.Cr[offset:])
+		}
+	}
+}
+
+// Macroblock prediction modes, mb_type values are mapped to them.
+const (
+	mbI4x4 = iota
+	mbI16x16
+	mbIPCM
+	mbInter
+)
+
+// h264CoeffCounts are the numbers of non-zero coefficients of the residual
+// blocks of a macroblock, nC and the coded_block_flag contexts derive from.
+type h264CoeffCounts struct {
+	totalCoeff  [16]uint8   // of the luma blocks, in raster order
+	totalCoeffC [2][4]uint8 // of the chroma AC blocks, in raster order
+	codedDC     uint8       // coded_block_flag of the luma, Cb and Cr DC blocks in bits 0 to 2
+}
+
+type h264Macroblock struct {
+	slice     int // 1 based index of the slice in the picture, 0 until decoded
+	kind      int
+	qp        int      // QPY
+	predModes [16]int8 // Intra4x4PredMode or Intra8x8PredMode of the luma blocks, in raster order
+
+	transform8x8 bool // transform_size_8x8_flag
+	h264CoeffCounts
+	// the counts of the residual blocks as rewritten, for the contexts of
+	// the next ones, see ResidualMosher
+	rewrittenCoeffs h264CoeffCounts
+
+	// syntax elements the CABAC contexts depend on
+	skipped        bool
+	cbp            uint8 // coded_block_pattern, see cbpPCM
+	qpDelta        int8
+	chromaPredMode uint8
+
+	// motion of inter macroblocks
+	mvs    [16][2]int32 // of the luma blocks in quarter samples, in raster order
+	refIdx [4]int8      // of the 8x8 blocks in raster order, -1 for intra macroblocks
+	refIDs [4]int       // id of the pictures refIdx points to
+
+	// mvd_l0 of the luma blocks in raster order, as coded and as rewritten
+	// for the CABAC contexts of the next ones, see MotionMosher
+	mvd          [16][2]int32
+	rewrittenMVD [16][2]int32
+}
+
+func (mb *h264Macroblock) isIntra() bool {
+	return mb.kind <= mbIPCM
+}
+
+// codedLuma returns whether the transform block holding the luma 4x4 block
+// blk, in raster order, has non-zero coefficients.
+func (mb *h264Macroblock) codedLuma(blk int) bool {
+	if !mb.transform8x8 {
+		return mb.totalCoeff[blk] != 0
+	}
+	b := blk/8*8 + blk%4/2*2
+	return mb.totalCoeff[b]|mb.totalCoeff[b+1]|mb.totalCoeff[b+4]|mb.totalCoeff[b+5] != 0
+}
+
+// coeffCounts returns the coefficient counts of the residual blocks as coded,
+// or as rewritten.
+func (mb *h264Macroblock) coeffCounts(rewritten bool) *h264CoeffCounts {
+	if rewritten {
+		return &mb.rewrittenCoeffs
+	}
+	return &mb.h264CoeffCounts
+}
+
+// h264Picture is a decoded frame, its size is a multiple of the macroblock size.
+type h264Picture struct {
+	id        int // in decoding order
+	sps       *H264SPS
+	img       *image.YCbCr
+	widthMbs  int
+	heightMbs int
+	mbs       []h264Macroblock
+	slices    []*H264SliceHeader
+
+	frameNum         uint32
+	ref              int // reference marking
+	longTermFrameIdx uint32
+}
+
+func newH264Picture(sps *H264SPS) *h264Picture {
+	w, h := int(sps.PicWidthInMbsMinus1+1), sps.frameHeightInMbs()
+	return &h264Picture{
+		sps:       sps,
+		img:       image.NewYCbCr(image.Rect(0, 0, w*16, h*16), image.YCbCrSubsampleRatio420),
+		widthMbs:  w,
+		heightMbs: h,
+		mbs:       make([]h264Macroblock, w*h),
+	}
+}
+
+func (p *h264Picture) sameSize(o *h264Picture) bool {
+	return p.widthMbs == o.widthMbs && p.heightMbs == o.heightMbs
+}
+
+// cropped returns the picture within the SPS cropping window.
+func (p *h264Picture) cropped() *image.YCbCr {
+	sps := p.sps
+	rect := p.img.Rect
+	if sps.FrameCropping {
+		rect = image.Rect(
+			int(sps.FrameCropLeftOffset)*sps.cropUnitX(),
+			int(sps.FrameCropTopOffset)*sps.cropUnitY(),
+			rect.Max.X-int(sps.FrameCropRightOffset)*sps.cropUnitX(),
+			rect.Max.Y-int(sps.FrameCropBottomOffset)*sps.cropUnitY(),
+		)
+	}
+	return p.img.SubImage(rect).(*image.YCbCr)
+}
+
+// Luma 4x4 block positions, in 4x4 block units, indexed by luma4x4BlkIdx.
+// See 6.4.3 Inverse 4x4 luma block scanning process
+var (
+	blkX = [16]int{0, 1, 0, 1, 2, 3, 2, 3, 0, 1, 0, 1, 2, 3, 2, 3}
+	blkY = [16]int{0, 0, 1, 1, 0, 0, 1, 1, 2, 2, 3, 3, 2, 2, 3, 3}
+)
+
+// coded_block_pattern of Intra_4x4 macroblocks indexed by codeNum, for
+// ChromaArrayType 1 and 2.
+// See Table 9-4
+var intraCBP = [48]uint8{
+	47, 31, 15, 0, 23, 27, 29, 30, 7, 11, 13, 14, 39, 43, 45, 46,
+	16, 3, 5, 10, 12, 19, 21, 26, 28, 35, 37, 42, 44, 1, 2, 4,
+	8, 17, 18, 20, 24, 6, 9, 22, 25, 32, 33, 34, 36, 40, 38, 41,
+}
+
+// h264SliceDecoder holds the state of the decoding of a slice.
+type h264SliceDecoder struct {
+	r     *rbspReader
+	h     *H264SliceHeader
+	pic   *h264Picture
+	slice int
+	qp    int            // QPY of the previous macroblock
+	refs  []*h264Picture // RefPicList0 of P slices
+
+	// rewriteMVD returns the motion vector difference to code in place of
+	// mvd given the predicted motion vector, the rewritten ones are listed in
+	// mvds. See MotionMosher.
+	rewriteMVD func(pred, mvd [2]int32) [2]int32
+	mvds       []h264MVD
+
+	cabac    *cabacDecoder // nil for CAVLC slices
+	cabacOut *cabacEncoder // codes the slice data again with the rewritten mvds and levels
+
+	// residual rewriting, see ResidualMosher
+	recordResiduals bool
+	residuals       []h264Residual
+	rewrittenLevels [][]int32 // of the residuals, in parsing order
+
+	// bit ranges of the pcm_alignment_zero_bits of the I_PCM macroblocks of
+	// CAVLC slices, realigned when the bits before them are rewritten
+	pcm [][2]int
+
+	// current macroblock
+	mb         *h264Macroblock
+	mbX, mbY   int
+	motionDone uint16 // luma blocks whose motion is known, in raster order
+	lumaDC     [16]int32
+	luma       [16][16]int32 // coefficients of the luma blocks in raster order
+	luma8x8    [4][64]int32  // coefficients of the luma 8x8 blocks in raster order
+	chromaDC   [2][4]int32
+	chromaAC   [2][4][16]int32
+}
+
+// decode reads the slice data.
+// See 7.3.4 Slice data syntax
+func (s *h264SliceDecoder) decode() error {
+	if s.h.pps.EntropyCodingMode {
+		return s.decodeCABAC()
+	}
+	picSize := len(s.pic.mbs)
+	for mbAddr := int(s.h.FirstMbInSlice); ; mbAddr++ {
+		if s.h.Type() == SLICE_P {
+			skipRun := s.r.ue()
+			if s.r.err != nil {
+				return s.r.err
+			}
+			for i := uint32(0); i < skipRun; i++ {
+				if mbAddr >= picSize {
+					return errSlicePastEnd
+				}
+				s.skipMacroblock(mbAddr)
+				mbAddr++
+			}
+			if skipRun > 0 && !s.r.moreRBSPData() {
+				return s.r.err
+			}
+		}
+		if mbAddr >= picSize {
+			return errSlicePastEnd
+		}
+		if err := s.decodeMacroblock(mbAddr); err != nil {
+			return fmt.Errorf("failed to decode macroblock %d: %v", mbAddr, err)
+		}
+		if s.r.bitsLeft() < 0 {
+			return errRBSPOverrun
+		}
+		if !s.r.moreRBSPData() {
+			return s.r.err
+		}
+	}
+}
+
+var errSlicePastEnd = errors.New("slice data past the end of the picture")
+
+// decodeMacroblock reads and reconstructs a macroblock.
+// See 7.3.5 Macroblock layer syntax
+func (s *h264SliceDecoder) decodeMacroblock(mbAddr int) error {
+	s.startMacroblock(mbAddr)
+	mbType := s.readMbType()
+	if s.r.err != nil {
+		return s.r.err
+	}
+	if s.h.Type() == SLICE_P {
+		if mbType < 5 {
+			return s.decodeInterMacroblock(mbType)
+		}
+		mbType -= 5
+	}
+	return s.decodeIntraMacroblock(mbType)
+}
+
+// startMacroblock makes the macroblock at mbAddr the current one.
+func (s *h264SliceDecoder) startMacroblock(mbAddr int) {
+	s.mb = &s.pic.mbs[mbAddr]
+	*s.mb = h264Macroblock{slice: s.slice, qp: s.qp, refIdx: [4]int8{-1, -1, -1, -1}}
+	s.mbX, s.mbY = mbAddr%s.pic.widthMbs, mbAddr/s.pic.widthMbs
+	s.motionDone = 0
+}
+
+// decodeIntraMacroblock decodes a macroblock of type mbType in the I slice
+// numbering, see Table 7-11.
+func (s *h264SliceDecoder) decodeIntraMacroblock(mbType uint32) error {
+	r, mb := s.r, s.mb
+	switch {
+	case mbType == 0:
+		mb.kind = mbI4x4
+	case mbType <= 24:
+		mb.kind = mbI16x16
+	case mbType == 25:
+		mb.kind = mbIPCM
+		return s.decodePCM()
+	default:
+		return fmt.Errorf("invalid mb_type: %d", mbType)
+	}
+
+	var cbpLuma, cbpChroma int
+	var predMode16x16 int
+	var prevPredModeFlag [16]bool
+	var remPredMode [16]uint32
+	if mb.kind == mbI4x4 {
+		// I_NxN, with Intra_8x8 prediction for the 8x8 transform
+		mb.transform8x8 = s.h.pps.Transform8x8Mode && s.readTransformSize8x8Flag()
+		blocks := 16
+		if mb.transform8x8 {
+			blocks = 4
+		}
+		for blk := 0; blk < blocks; blk++ {
+			prevPredModeFlag[blk], remPredMode[blk] = s.readIntra4x4PredMode()
+		}
+	} else {
+		predMode16x16 = int(mbType-1) % 4
+		cbpChroma = int(mbType-1) / 4 % 3
+		if mbType >= 13 {
+			cbpLuma = 15
+		}
+	}
+	chromaPredMode := s.readIntraChromaPredMode()
+	mb.chromaPredMode = uint8(chromaPredMode)
+	if mb.kind == mbI4x4 {
+		cbpLuma, cbpChroma = s.readCBP(intraCBP[:])
+	}
+	mb.cbp = uint8(cbpLuma | cbpChroma<<4)
+	if cbpLuma > 0 || cbpChroma > 0 || mb.kind == mbI16x16 {
+		s.decodeQPDelta()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if mb.kind == mbI4x4 {
+		// 8.3.1.1 Derivation process for Intra4x4PredMode and 8.3.2.1 for
+		// Intra8x8PredMode, the mode of an 8x8 block being set for its four
+		// 4x4 blocks
+		size, step := 1, 1
+		if mb.transform8x8 {
+			size, step = 2, 4
+		}
+		for blk := 0; blk < 16; blk += step {
+			x, y := blkX[blk], blkY[blk]
+			predicted := s.predIntra4x4PredMode(x, y)
+			mode := predicted
+			if !prevPredModeFlag[blk/step] {
+				mode = int8(remPredMode[blk/step])
+				if mode >= predicted {
+					mode++
+				}
+			}
+			for j := 0; j < size; j++ {
+				for i := 0; i < size; i++ {
+					mb.predModes[(y+j)*4+x+i] = mode
+				}
+			}
+		}
+	}
+
+	s.residual(mb.kind == mbI16x16, cbpLuma, cbpChroma)
+	if r.err != nil {
+		return r.err
+	}
+
+	if mb.kind == mbI4x4 && mb.transform8x8 {
+		for b8 := 0; b8 < 4; b8++ {
+			s.predIntra8x8(b8, mb.predModes[b8/2*8+b8%2*2])
+			s.addLumaResidual8x8(b8)
+		}
+	} else if mb.kind == mbI4x4 {
+		for blk := 0; blk < 16; blk++ {
+			x, y := blkX[blk], blkY[blk]
+			s.predIntra4x4(x, y, mb.predModes[y*4+x])
+			s.addLumaResidual(x, y, false, 0)
+		}
+	} else {
+		s.predIntra16x16(predMode16x16)
+		dc := lumaDCDequant(&s.lumaDC, mb.qp)
+		for i := 0; i < 16; i++ {
+			s.addLumaResidual(i%4, i/4, true, dc[i])
+		}
+	}
+	s.predIntraChroma(chromaPredMode)
+	s.addChromaResidual()
+	return nil
+}
+
+// decodeQPDelta reads mb_qp_delta and updates the QP of the macroblock.
+func (s *h264SliceDecoder) decodeQPDelta() {
+	delta := s.readMbQPDelta()
+	if delta < -26 || delta > 25 {
+		s.r.fail(fmt.Errorf("invalid mb_qp_delta: %d", delta))
+		return
+	}
+	s.qp = (s.qp + int(delta) + 52) % 52
+	s.mb.qp = s.qp
+	s.mb.qpDelta = int8(delta)
+}
+
+// decodePCM reads the samples of an I_PCM macroblock.
+func (s *h264SliceDecoder) decodePCM() error {
+	r, mb, img := s.r, s.mb, s.pic.img
+	start := r.pos
+	for !r.byteAligned() && r.err == nil {
+		r.u(1) // pcm_alignment_zero_bit
+	}
+	if s.cabac == nil {
+		s.pcm = append(s.pcm, [2]int{start, r.pos})
+	}
+	for y := 0; y < 16; y++ {
+		row := img.YOffset(s.mbX*16, s.mbY*16+y)
+		for x := 0; x < 16; x++ {
+			img.Y[row+x] = byte(r.u(8))
+		}
+	}
+	for _, plane := range [][]byte{img.Cb, img.Cr} {
+		for y := 0; y < 8; y++ {
+			row := img.COffset(s.mbX*16, s.mbY*16+y*2)
+			for x := 0; x < 8; x++ {
+				plane[row+x] = byte(r.u(8))
+			}
+		}
+	}
+	for i := range mb.totalCoeff {
+		mb.totalCoeff[i] = 16
+	}
+	for c := range mb.totalCoeffC {
+		for i := range mb.totalCoeffC[c] {
+			mb.totalCoeffC[c][i] = 16
+		}
+	}
+	mb.cbp, mb.codedDC = cbpPCM, 7
+	mb.rewrittenCoeffs = mb.h264CoeffCounts
+	if s.cabac != nil {
+		if s.cabac.record {
+			s.cabac.bins = append(s.cabac.bins, cabacBin{ctxIdx: cabacPCM})
+		}
+		s.cabac.initEngine()
+	}
+	return r.err
+}
+
+// residual reads the residual of the macroblock.
+// See 7.3.5.3 Residual data syntax
+func (s *h264SliceDecoder) residual(intra16x16 bool, cbpLuma, cbpChroma int) {
+	mb := s.mb
+	if intra16x16 && s.residualBlock(s.lumaDC[:], blockLumaDC, 0, 0, 0) > 0 {
+		mb.codedDC |= 1
+	}
+	for blk := 0; blk < 16; blk++ {
+		x, y := blkX[blk], blkY[blk]
+		coeffs := &s.luma[y*4+x]
+		if cbpLuma&(1<<uint(blk/4)) == 0 {
+			*coeffs = [16]int32{}
+			mb.totalCoeff[y*4+x] = 0
+			if blk%4 == 0 {
+				s.luma8x8[blk/4] = [64]int32{}
+			}
+			continue
+		}
+		var n int
+		switch {
+		case mb.transform8x8 && s.cabac != nil:
+			// the 4x4 blocks of an 8x8 block share its count
+			if blk%4 == 0 {
+				n = s.residualBlock(s.luma8x8[blk/4][:], blockLuma8x8, 0, x, y)
+				for i := 0; i < 4; i++ {
+					mb.totalCoeff[blkY[blk+i]*4+blkX[blk+i]] = uint8(n)
+				}
+			}
+			continue
+		case mb.transform8x8:
+			// CAVLC codes the 8x8 blocks as 4 interleaved 4x4 blocks
+			n = s.residualBlock(coeffs[:], blockLuma4x4, 0, x, y)
+			for i, level := range coeffs {
+				s.luma8x8[blk/4][4*i+blk%4] = level
+			}
+		case intra16x16:
+			coeffs[0] = 0
+			n = s.residualBlock(coeffs[1:], blockLumaAC, 0, x, y)
+		default:
+			n = s.residualBlock(coeffs[:], blockLuma4x4, 0, x, y)
+		}
+		mb.totalCoeff[y*4+x] = uint8(n)
+	}
+
+	for c := 0; c < 2; c++ {
+		if cbpChroma&3 == 0 {
+			s.chromaDC[c] = [4]int32{}
+		} else if s.residualBlock(s.chromaDC[c][:], blockChromaDC, c, 0, 0) > 0 {
+			mb.codedDC |= 2 << uint(c)
+		}
+	}
+	for c := 0; c < 2; c++ {
+		for blk := 0; blk < 4; blk++ {
+			coeffs := &s.chromaAC[c][blk]
+			*coeffs = [16]int32{}
+			if cbpChroma&2 == 0 {
+				mb.totalCoeffC[c][blk] = 0
+				continue
+			}
+			n := s.residualBlock(coeffs[1:], blockChromaAC, c, blk%2, blk/2)
+			mb.totalCoeffC[c][blk] = uint8(n)
+		}
+	}
+}
+
+// residualBlock reads the coefficients of a block of category cat and returns
+// the number of non-zero ones. (x, y) is the position of the luma or chroma
+// AC block in block units and c the chroma component.
+func (s *h264SliceDecoder) residualBlock(coeffLevel []int32, cat, c, x, y int) int {
+	start := s.r.pos
+	var n int
+	if s.cabac != nil {
+		bins := len(s.cabac.bins)
+		n = s.cabac.residualBlock(coeffLevel, cat, s.codedBlockFlagCtxIdxInc(cat, c, x, y, false))
+		if s.rewrittenLevels != nil && s.cabac.record {
+			// coded again from its rewritten levels, see reencode
+			s.cabac.bins = append(s.cabac.bins[:bins], cabacBin{ctxIdx: cabacResidual, val: int32(len(s.residuals))})
+		}
+	} else {
+		n = s.r.residualBlock(coeffLevel, len(coeffLevel), s.nC(cat, c, x, y, false))
+	}
+	if s.recordResiduals {
+		s.recordResidual(coeffLevel, cat, c, x, y, start)
+	}
+	return n
+}
+
+// nC returns the nC of a block of category cat, see residualBlock.
+func (s *h264SliceDecoder) nC(cat, c, x, y int, rewritten bool) int {
+	switch cat {
+	case blockLumaDC, blockLumaAC, blockLuma4x4, blockLuma8x8:
+		return s.lumaNC(x, y, rewritten)
+	case blockChromaAC:
+		return s.chromaNC(c, x, y, rewritten)
+	}
+	return -1
+}
+
+// neighbourMB returns the macroblock at (dx, dy) from the current one, or nil
+// if it isn't available. With intraPred set, inter macroblocks aren't
+// available when constrained_intra_pred_flag is set.
+// See 6.4.9 Derivation process for neighbouring macroblock addresses and their availability
+func (s *h264SliceDecoder) neighbourMB(dx, dy int, intraPred bool) *h264Macroblock {
+	if dx == 0 && dy == 0 {
+		return s.mb
+	}
+	x, y := s.mbX+dx, s.mbY+dy
+	if x < 0 || y < 0 || x >= s.pic.widthMbs || y >= s.pic.heightMbs {
+		return nil
+	}
+	mb := &s.pic.mbs[y*s.pic.widthMbs+x]
+	if mb.slice != s.slice {
+		return nil
+	}
+	if intraPred && !mb.isIntra() && s.h.pps.ConstrainedIntraPred {
+		return nil
+	}
+	return mb
+}
+
+// neighbourBlock returns the macroblock holding the block at (x, y), in block
+// units relative to the current macroblock, x or y being -1 for the blocks of
+// the neighbouring macroblocks. size is the number of blocks per row of a
+// macroblock. It also returns the position of the block in its macroblock.
+func (s *h264SliceDecoder) neighbourBlock(x, y, size int, intraPred bool) (*h264Macroblock, int) {
+	dx, dy := 0, 0
+	if x < 0 {
+		dx, x = -1, x+size
+	}
+	if y < 0 {
+		dy, y = -1, y+size
+	}
+	return s.neighbourMB(dx, dy, intraPred), y*size + x
+}
+
+// lumaNC returns nC for the luma block at (x, y), from the coefficient counts
+// of the neighbouring blocks as coded or as rewritten.
+// See 9.2.1 Parsing process for total number of non-zero transform coefficient levels and number of trailing ones
+func (s *h264SliceDecoder) lumaNC(x, y int, rewritten bool) int {
+	mbA, blkA := s.neighbourBlock(x-1, y, 4, false)
+	mbB, blkB := s.neighbourBlock(x, y-1, 4, false)
+	switch {
+	case mbA != nil && mbB != nil:
+		return (int(mbA.coeffCounts(rewritten).totalCoeff[blkA]) + int(mbB.coeffCounts(rewritten).totalCoeff[blkB]) + 1) >> 1
+	case mbA != nil:
+		return int(mbA.coeffCounts(rewritten).totalCoeff[blkA])
+	case mbB != nil:
+		return int(mbB.coeffCounts(rewritten).totalCoeff[blkB])
+	}
+	return 0
+}
+
+// chromaNC returns nC for the chroma AC block at (x, y) of the component c.
+func (s *h264SliceDecoder) chromaNC(c, x, y int, rewritten bool) int {
+	mbA, blkA := s.neighbourBlock(x-1, y, 2, false)
+	mbB, blkB := s.neighbourBlock(x, y-1, 2, false)
+	switch {
+	case mbA != nil && mbB != nil:
+		return (int(mbA.coeffCounts(rewritten).totalCoeffC[c][blkA]) + int(mbB.coeffCounts(rewritten).totalCoeffC[c][blkB]) + 1) >> 1
+	case mbA != nil:
+		return int(mbA.coeffCounts(rewritten).totalCoeffC[c][blkA])
+	case mbB != nil:
+		return int(mbB.coeffCounts(rewritten).totalCoeffC[c][blkB])
+	}
+	return 0
+}
+
+// predIntra4x4PredMode returns predIntra4x4PredMode for the luma block at (x, y).
+func (s *h264SliceDecoder) predIntra4x4PredMode(x, y int) int8 {
+	mbA, blkA := s.neighbourBlock(x-1, y, 4, true)
+	mbB, blkB := s.neighbourBlock(x, y-1, 4, true)
+	if mbA == nil || mbB == nil {
+		return intra4x4DC
+	}
+	modeA, modeB := int8(intra4x4DC), int8(intra4x4DC)
+	if mbA.kind == mbI4x4 {
+		modeA = mbA.predModes[blkA]
+	}
+	if mbB.kind == mbI4x4 {
+		modeB = mbB.predModes[blkB]
+	}
+	return min(modeA, modeB)
+}
+
+// addLumaResidual adds the residual of the luma block at (x, y) to its
+// prediction. For Intra_16x16 macroblocks dc is the scaled DC coefficient.
+func (s *h264SliceDecoder) addLumaResidual(x, y int, intra16x16 bool, dc int32) {
+	coeffs := &s.luma[y*4+x]
+	if intra16x16 {
+		coeffs[0] = dc
+	}
+	if s.mb.totalCoeff[y*4+x] == 0 && coeffs[0] == 0 {
+		return
+	}
+	img := s.pic.img
+	offset := img.YOffset(s.mbX*16+x*4, s.mbY*16+y*4)
+	addResidual4x4(img.Y[offset:], img.YStride, coeffs, s.mb.qp, intra16x16)
+}
+
+// addLumaResidual8x8 adds the residual of the luma 8x8 block b8 to its
+// prediction.
+func (s *h264SliceDecoder) addLumaResidual8x8(b8 int) {
+	if !s.mb.codedLuma(b8/2*8 + b8%2*2) {
+		return
+	}
+	img := s.pic.img
+	offset := img.YOffset(s.mbX*16+b8%2*8, s.mbY*16+b8/2*8)
+	addResidual8x8(img.Y[offset:], img.YStride, &s.luma8x8[b8], s.mb.qp)
+}
+
+// addLumaResiduals adds the residual of the luma blocks of an inter
+// macroblock to its prediction.
+func (s *h264SliceDecoder) addLumaResiduals() {
+	if s.mb.transform8x8 {
+		for b8 := 0; b8 < 4; b8++ {
+			s.addLumaResidual8x8(b8)
+		}
+		return
+	}
+	for i := 0; i < 16; i++ {
+		s.addLumaResidual(i%4, i/4, false, 0)
+	}
+}
+
+// addChromaResidual adds the residual of the chroma blocks to their prediction.
+func (s *h264SliceDecoder) addChromaResidual() {
+	img := s.pic.img
+	offsets := [2]int32{s.h.pps.ChromaQPIndexOffset, s.h.pps.SecondChromaQPIndexOffset}
+	for c, plane := range [][]byte{img.Cb, img.Cr} {
+		qpc := chromaQP(s.mb.qp, offsets[c])
+		dc := chromaDCDequant(&s.chromaDC[c], qpc)
+		for blk := 0; blk < 4; blk++ {
+			coeffs := &s.chromaAC[c][blk]
+			coeffs[0] = dc[blk]
+			if s.mb.totalCoeffC[c][blk] == 0 && dc[blk] == 0 {
+				continue
+			}
+			x, y := blk%2, blk/2
+			offset := img.COffset(s.mbX*16+x*8, s.mbY*16+y*8)
+			addResidual4x4(plane[offset:], img.CStride, coeffs, qpc, true)
+		}
+	}
+}
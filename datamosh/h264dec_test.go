@@ -0,0 +1,394 @@
+package datamosh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testH264NAL prefixes an RBSP with a NAL header and escapes it.
+func testH264NAL(header byte, w *rbspWriter) []byte {
+	rbsp, err := w.trailingBits()
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{header}, escapeRBSP(rbsp)...)
+}
+
+// testH264SPS returns a Constrained Baseline SPS, cropping cropRight luma
+// samples.
+func testH264SPS(widthMbs, heightMbs int, cropRight uint32) []byte {
+	w := newRBSPWriter()
+	w.u(8, 66)   // profile_idc
+	w.u(8, 0xc0) // constraint_set0_flag, constraint_set1_flag
+	w.u(8, 30)   // level_idc
+	w.ue(0)      // seq_parameter_set_id
+	w.ue(0)      // log2_max_frame_num_minus4
+	w.ue(0)      // pic_order_cnt_type
+	w.ue(0)      // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(1)      // max_num_ref_frames
+	w.flag(false)
+	w.ue(uint32(widthMbs - 1))
+	w.ue(uint32(heightMbs - 1))
+	w.flag(true) // frame_mbs_only_flag
+	w.flag(true) // direct_8x8_inference_flag
+	w.flag(cropRight > 0)
+	if cropRight > 0 {
+		w.ue(0)
+		w.ue(cropRight / 2)
+		w.ue(0)
+		w.ue(0)
+	}
+	w.flag(false) // vui_parameters_present_flag
+	return testH264NAL(0x67, w)
+}
+
+func testH264PPS(cabac bool) []byte {
+	w := newRBSPWriter()
+	w.ue(0) // pic_parameter_set_id
+	w.ue(0) // seq_parameter_set_id
+	w.flag(cabac)
+	w.flag(false) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)       // num_slice_groups_minus1
+	w.ue(0)       // num_ref_idx_l0_default_active_minus1
+	w.ue(0)       // num_ref_idx_l1_default_active_minus1
+	w.flag(false) // weighted_pred_flag
+	w.u(2, 0)     // weighted_bipred_idc
+	w.se(0)       // pic_init_qp_minus26
+	w.se(0)       // pic_init_qs_minus26
+	w.se(0)       // chroma_qp_index_offset
+	w.flag(false) // deblocking_filter_control_present_flag
+	w.flag(false) // constrained_intra_pred_flag
+	w.flag(false) // redundant_pic_cnt_present_flag
+	return testH264NAL(0x68, w)
+}
+
+// testH264IDRSlice returns an IDR I slice whose macroblocks are written by mbs.
+func testH264IDRSlice(mbs func(w *rbspWriter)) []byte {
+	w := newRBSPWriter()
+	w.ue(0)       // first_mb_in_slice
+	w.ue(7)       // slice_type
+	w.ue(0)       // pic_parameter_set_id
+	w.u(4, 0)     // frame_num
+	w.ue(0)       // idr_pic_id
+	w.u(4, 0)     // pic_order_cnt_lsb
+	w.flag(false) // no_output_of_prior_pics_flag
+	w.flag(false) // long_term_reference_flag
+	w.se(0)       // slice_qp_delta
+	mbs(w)
+	return testH264NAL(0x65, w)
+}
+
+// testH264PSlice returns a P slice whose macroblocks are written by mbs.
+func testH264PSlice(frameNum uint32, mbs func(w *rbspWriter)) []byte {
+	w := newRBSPWriter()
+	w.ue(0) // first_mb_in_slice
+	w.ue(5) // slice_type
+	w.ue(0) // pic_parameter_set_id
+	w.u(4, frameNum)
+	w.u(4, frameNum*2) // pic_order_cnt_lsb
+	w.flag(false)      // num_ref_idx_active_override_flag
+	w.flag(false)      // ref_pic_list_modification_flag_l0
+	w.flag(false)      // adaptive_ref_pic_marking_mode_flag
+	w.se(0)            // slice_qp_delta
+	mbs(w)
+	return testH264NAL(0x41, w)
+}
+
+// testH264Sample is the value of the luma samples of testH264PCMSlice.
+func testH264Sample(x, y int) byte {
+	return byte(x*7 + y*13 + 1)
+}
+
+// testH264PCMSlice returns an IDR slice of I_PCM macroblocks.
+func testH264PCMSlice(widthMbs int) []byte {
+	return testH264IDRSlice(func(w *rbspWriter) {
+		for mb := 0; mb < widthMbs; mb++ {
+			w.ue(25) // mb_type I_PCM
+			for !w.byteAligned() {
+				w.u(1, 0)
+			}
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					w.u(8, uint32(testH264Sample(mb*16+x, y)))
+				}
+			}
+			for i := 0; i < 2*8*8; i++ {
+				w.u(8, uint32(40+mb*100+i%64))
+			}
+		}
+	})
+}
+
+func TestParseH264ParameterSets(t *testing.T) {
+	sps, err := ParseH264SPS(testH264SPS(3, 2, 8))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(66), sps.ProfileIDC)
+	assert.Equal(t, uint32(0x30), sps.ConstraintSetFlags)
+	assert.Equal(t, uint32(30), sps.LevelIDC)
+	assert.Equal(t, uint32(1), sps.ChromaFormatIDC)
+	assert.Equal(t, uint32(1), sps.MaxNumRefFrames)
+	assert.True(t, sps.FrameMbsOnly)
+	assert.Equal(t, 40, sps.Width())
+	assert.Equal(t, 32, sps.Height())
+
+	pps, err := ParseH264PPS(testH264PPS(true))
+	require.NoError(t, err)
+	assert.True(t, pps.EntropyCodingMode)
+	assert.Equal(t, int32(0), pps.PicInitQPMinus26)
+
+	_, err = ParseH264PPS(testH264SPS(1, 1, 0))
+	assert.Error(t, err)
+}
+
+func TestH264DecoderIPCM(t *testing.T) {
+	// two I_PCM macroblocks, the picture is cropped to 24x16
+	d, err := NewH264Decoder(nil)
+	require.NoError(t, err)
+	img, err := d.DecodeAccessUnit([][]byte{testH264SPS(2, 1, 8), testH264PPS(false), testH264PCMSlice(2)})
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 24, 16), img.Rect)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 24; x++ {
+			require.Equal(t, testH264Sample(x, y), img.YCbCrAt(x, y).Y, "luma sample at %d,%d", x, y)
+		}
+	}
+	c := img.YCbCrAt(17, 2)
+	assert.Equal(t, byte(148), c.Cb)
+	assert.Equal(t, byte(148), c.Cr)
+	assert.Nil(t, d.Picture())
+}
+
+func TestH264DecoderIntra16x16(t *testing.T) {
+	tests := []struct {
+		dcLevel bool
+		want    byte
+	}{
+		{false, 128},
+		// a DC level of 1 at QP 26 raises all the samples by 1
+		{true, 129},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.dcLevel), func(t *testing.T) {
+			slice := testH264IDRSlice(func(w *rbspWriter) {
+				w.ue(3) // mb_type I_16x16_2_0_0, DC prediction
+				w.ue(0) // intra_chroma_pred_mode DC
+				w.se(0) // mb_qp_delta
+				if tt.dcLevel {
+					w.u(2, 1) // coeff_token, TotalCoeff 1 and TrailingOnes 1
+					w.u(1, 0) // trailing_ones_sign_flag
+					w.u(1, 1) // total_zeros 0
+				} else {
+					w.u(1, 1) // coeff_token, TotalCoeff 0
+				}
+			})
+			d, err := NewH264Decoder(nil)
+			require.NoError(t, err)
+			img, err := d.DecodeAccessUnit([][]byte{testH264SPS(1, 1, 0), testH264PPS(false), slice})
+			require.NoError(t, err)
+			for _, v := range img.Y {
+				require.Equal(t, tt.want, v)
+			}
+			for i := range img.Cb {
+				require.Equal(t, byte(128), img.Cb[i])
+				require.Equal(t, byte(128), img.Cr[i])
+			}
+		})
+	}
+}
+
+func TestH264DecoderPSlice(t *testing.T) {
+	tests := []struct {
+		name string
+		idr  bool
+		mbs  func(w *rbspWriter)
+		want func(x, y int) byte
+	}{
+		{
+			name: "skipped",
+			idr:  true,
+			mbs: func(w *rbspWriter) {
+				w.ue(2) // mb_skip_run
+			},
+			want: testH264Sample,
+		},
+		{
+			name: "motion",
+			idr:  true,
+			mbs: func(w *rbspWriter) {
+				w.ue(0) // mb_skip_run
+				w.ue(0) // mb_type P_L0_16x16
+				w.se(4) // mvd_l0, one sample to the right
+				w.se(0)
+				w.ue(0) // coded_block_pattern 0
+				// the motion vector of the second macroblock is predicted
+				// from the first one
+				w.ue(0)
+				w.ue(0)
+				w.se(0)
+				w.se(0)
+				w.ue(0)
+			},
+			want: func(x, y int) byte { return testH264Sample(min(x+1, 31), y) },
+		},
+		{
+			// the key frame was dropped, the prediction comes from gray
+			name: "moshed",
+			mbs: func(w *rbspWriter) {
+				w.ue(2)
+			},
+			want: func(x, y int) byte { return 128 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewH264Decoder(nil)
+			require.NoError(t, err)
+			nals := [][]byte{testH264SPS(2, 1, 8), testH264PPS(false)}
+			if tt.idr {
+				nals = append(nals, testH264PCMSlice(2))
+			}
+			_, err = d.DecodeAccessUnit(nals)
+			if tt.idr {
+				require.NoError(t, err)
+			}
+
+			img, err := d.DecodeAccessUnit([][]byte{testH264PSlice(1, tt.mbs)})
+			require.NoError(t, err)
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 24; x++ {
+					require.Equal(t, tt.want(x, y), img.YCbCrAt(x, y).Y, "luma sample at %d,%d", x, y)
+				}
+			}
+		})
+	}
+}
+
+func TestTrackDecodeFrames(t *testing.T) {
+	sps, pps := testH264SPS(2, 1, 8), testH264PPS(false)
+	idr := testH264PCMSlice(2)
+	// a nullified key frame followed by a P frame predicting from the first key frame
+	nullified := append([]byte{idr[0]}, make([]byte, len(idr)-1)...)
+	p := testH264PSlice(1, func(w *rbspWriter) { w.ue(2) })
+
+	track := &Track{AVC: &AVCDecoderConfig{}}
+	track.AVC.SequenceParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(sps)), NALUnit: sps}}
+	track.AVC.PictureParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(pps)), NALUnit: pps}}
+	var data []byte
+	for i, nal := range [][]byte{idr, nullified, p} {
+		track.NALs = append(track.NALs, &NALUnit{Offset: int64(len(data)), Length: uint32(len(nal)), SampleID: uint32(i)})
+		data = append(data, nal...)
+	}
+
+	var samples []uint32
+	var frames []*image.YCbCr
+	err := track.DecodeFrames(bytes.NewReader(data), func(sampleID uint32, img *image.YCbCr) error {
+		samples = append(samples, sampleID)
+		frames = append(frames, img)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{0, 2}, samples)
+	assert.Equal(t, frames[0].Y, frames[1].Y)
+	assert.Equal(t, frames[0].Cb, frames[1].Cb)
+
+	img, err := track.DecodeKeyframe(bytes.NewReader(data), track.NALs[0])
+	require.NoError(t, err)
+	assert.Equal(t, frames[0].Y, img.Y)
+}
+
+func TestH264DecoderHighProfile(t *testing.T) {
+	// an x264 High profile clip using CABAC, the 8x8 transform and explicit
+	// weighted prediction, the hashes are the frames decoded by OpenH264
+	want := map[uint32]string{
+		0: "7814841c434c7080ce720a68e32229d13bfedffb492f8d25a9ea98d0cf0dbc6f",
+		1: "bf4af6e59b5350b5fc9f7e0dcf1cb37010efea60c5f60e842d06eb44b575864c",
+		2: "1b13050c794f5dd7445239daa6cae5db1ddbe70da120d02ef23730f5e6f3ce98",
+	}
+	f, err := os.Open(filepath.Join("testdata", "x264.mp4"))
+	require.NoError(t, err)
+	defer f.Close()
+	tracks, err := ParseTracks(f)
+	require.NoError(t, err)
+	require.NotEmpty(t, tracks)
+
+	got := map[uint32]string{}
+	err = tracks[0].DecodeFrames(f, func(sampleID uint32, img *image.YCbCr) error {
+		hash := sha256.New()
+		r := img.Rect
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			hash.Write(img.Y[img.YOffset(r.Min.X, y):][:r.Dx()])
+		}
+		for _, plane := range [][]byte{img.Cb, img.Cr} {
+			for y := r.Min.Y; y < r.Max.Y; y += 2 {
+				hash.Write(plane[img.COffset(r.Min.X, y):][:r.Dx()/2])
+			}
+		}
+		got[sampleID] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+	// the fourth sample is a B frame
+	assert.True(t, errors.Is(err, ErrH264Unsupported), "unexpected error %v", err)
+	assert.Equal(t, want, got)
+}
+
+func TestH264DecoderUnsupported(t *testing.T) {
+	d, err := NewH264Decoder(nil)
+	require.NoError(t, err)
+	require.NoError(t, d.DecodeNAL(testH264SPS(1, 1, 0)))
+	require.NoError(t, d.DecodeNAL(testH264PPS(false)))
+	require.NoError(t, d.DecodeNAL(testH264PCMSlice(1)))
+	w := newRBSPWriter()
+	w.ue(0)       // first_mb_in_slice
+	w.ue(6)       // slice_type B
+	w.ue(0)       // pic_parameter_set_id
+	w.u(4, 1)     // frame_num
+	w.u(4, 2)     // pic_order_cnt_lsb
+	w.flag(true)  // direct_spatial_mv_pred_flag
+	w.flag(false) // num_ref_idx_active_override_flag
+	w.flag(false) // ref_pic_list_modification_flag_l0
+	w.flag(false) // ref_pic_list_modification_flag_l1
+	w.se(0)       // slice_qp_delta
+	w.ue(1)       // mb_skip_run
+	err = d.DecodeNAL(testH264NAL(0x01, w))
+	assert.True(t, errors.Is(err, ErrH264Unsupported), "unexpected error %v", err)
+}
+
+func TestCAVLCTables(t *testing.T) {
+	// every code must be a prefix of no other code of its table
+	check := func(name string, lens, codes []uint8) {
+		for i, l := range lens {
+			for j, m := range lens {
+				if l == 0 || m == 0 || i == j || m < l {
+					continue
+				}
+				if uint32(codes[j])>>(m-l) == uint32(codes[i]) {
+					t.Errorf("%s: code %d is a prefix of code %d", name, i, j)
+				}
+			}
+		}
+	}
+	for i := range coeffTokenLens {
+		check(fmt.Sprint("coeff_token ", i), coeffTokenLens[i][:], coeffTokenCodes[i][:])
+	}
+	check("chroma DC coeff_token", chromaDCCoeffTokenLens[:], chromaDCCoeffTokenCodes[:])
+	for i := range totalZerosLens {
+		check(fmt.Sprint("total_zeros ", i), totalZerosLens[i], totalZerosCodes[i])
+	}
+	for i := range chromaDCTotalZerosLens {
+		check(fmt.Sprint("chroma DC total_zeros ", i), chromaDCTotalZerosLens[i], chromaDCTotalZerosCodes[i])
+	}
+	for i := range runBeforeLens {
+		check(fmt.Sprint("run_before ", i), runBeforeLens[i], runBeforeCodes[i])
+	}
+}
@@ -0,0 +1,456 @@
+package datamosh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/abema/go-mp4"
+)
+
+// H264Encoder is a minimal pure Go H.264 encoder turning images into
+// Constrained Baseline streams, to mosh still images and synthetic content
+// and to build test files. Key frames are IDR pictures of Intra_16x16 DC
+// predicted macroblocks with CAVLC residuals, or of lossless I_PCM
+// macroblocks, and the other frames are P pictures of skipped macroblocks
+// repeating the previous picture.
+type H264Encoder struct {
+	// QP is the quantization parameter of the Intra_16x16 macroblocks, from
+	// 0 to 51. Lower values give better pictures and bigger frames.
+	QP int
+	// PCM codes the key frames with I_PCM macroblocks, storing the samples
+	// as they are.
+	PCM bool
+
+	width, height int // of the pictures, before rounding to even sizes
+	sps           *H264SPS
+	pps           *H264PPS
+	spsNAL        []byte
+	ppsNAL        []byte
+	frameNum      uint32
+	idrPicID      uint32
+	started       bool // once a key frame was encoded
+}
+
+// h264Levels lists level_idc and MaxFS, the maximum frame size in
+// macroblocks, of the levels.
+// See Table A-1
+var h264Levels = []struct {
+	idc   uint32
+	maxFS int
+}{
+	{10, 99}, {20, 396}, {21, 792}, {22, 1620}, {31, 3600}, {32, 5120},
+	{40, 8192}, {42, 8704}, {50, 22080}, {51, 36864}, {60, 139264},
+}
+
+// NewH264Encoder returns an encoder of pictures of the given size, odd sizes
+// being rounded up to even ones by repeating the last row or column.
+func NewH264Encoder(width, height int) (*H264Encoder, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid picture size %dx%d", width, height)
+	}
+	widthMbs, heightMbs := (width+15)/16, (height+15)/16
+	var levelIDC uint32
+	for _, level := range h264Levels {
+		// the width and height are also limited to Sqrt(MaxFS * 8)
+		if widthMbs*heightMbs <= level.maxFS && widthMbs*widthMbs <= 8*level.maxFS && heightMbs*heightMbs <= 8*level.maxFS {
+			levelIDC = level.idc
+			break
+		}
+	}
+	if levelIDC == 0 {
+		return nil, fmt.Errorf("picture size %dx%d too large", width, height)
+	}
+
+	e := &H264Encoder{QP: 26, width: width, height: height}
+	w := newRBSPWriter()
+	w.u(8, 66)   // profile_idc
+	w.u(8, 0xc0) // constraint_set0_flag, constraint_set1_flag
+	w.u(8, levelIDC)
+	w.ue(0) // seq_parameter_set_id
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(2) // pic_order_cnt_type, output order is decoding order
+	w.ue(1) // max_num_ref_frames
+	w.flag(false)
+	w.ue(uint32(widthMbs - 1))
+	w.ue(uint32(heightMbs - 1))
+	w.flag(true) // frame_mbs_only_flag
+	w.flag(true) // direct_8x8_inference_flag
+	cropRight, cropBottom := (widthMbs*16-width)/2, (heightMbs*16-height)/2
+	w.flag(cropRight > 0 || cropBottom > 0)
+	if cropRight > 0 || cropBottom > 0 {
+		w.ue(0)
+		w.ue(uint32(cropRight))
+		w.ue(0)
+		w.ue(uint32(cropBottom))
+	}
+	// the samples are full range BT.601 as in JPEG files and image.YCbCr
+	w.flag(true)  // vui_parameters_present_flag
+	w.flag(false) // aspect_ratio_info_present_flag
+	w.flag(false) // overscan_info_present_flag
+	w.flag(true)  // video_signal_type_present_flag
+	w.u(3, 5)     // video_format, unspecified
+	w.flag(true)  // video_full_range_flag
+	w.flag(true)  // colour_description_present_flag
+	w.u(8, 2)     // colour_primaries, unspecified
+	w.u(8, 2)     // transfer_characteristics, unspecified
+	w.u(8, 6)     // matrix_coefficients, BT.601
+	w.flag(false) // chroma_loc_info_present_flag
+	w.flag(false) // timing_info_present_flag
+	w.flag(false) // nal_hrd_parameters_present_flag
+	w.flag(false) // vcl_hrd_parameters_present_flag
+	w.flag(false) // pic_struct_present_flag
+	w.flag(false) // bitstream_restriction_flag
+	var err error
+	if e.spsNAL, err = h264NAL(0x67, w); err != nil {
+		return nil, err
+	}
+
+	w = newRBSPWriter()
+	w.ue(0)       // pic_parameter_set_id
+	w.ue(0)       // seq_parameter_set_id
+	w.flag(false) // entropy_coding_mode_flag
+	w.flag(false) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)       // num_slice_groups_minus1
+	w.ue(0)       // num_ref_idx_l0_default_active_minus1
+	w.ue(0)       // num_ref_idx_l1_default_active_minus1
+	w.flag(false) // weighted_pred_flag
+	w.u(2, 0)     // weighted_bipred_idc
+	w.se(0)       // pic_init_qp_minus26
+	w.se(0)       // pic_init_qs_minus26
+	w.se(0)       // chroma_qp_index_offset
+	w.flag(false) // deblocking_filter_control_present_flag
+	w.flag(false) // constrained_intra_pred_flag
+	w.flag(false) // redundant_pic_cnt_present_flag
+	if e.ppsNAL, err = h264NAL(0x68, w); err != nil {
+		return nil, err
+	}
+
+	if e.sps, err = ParseH264SPS(e.spsNAL); err != nil {
+		return nil, err
+	}
+	if e.pps, err = ParseH264PPS(e.ppsNAL); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// h264NAL prefixes an RBSP with a NAL header and escapes it.
+func h264NAL(header byte, w *rbspWriter) ([]byte, error) {
+	rbsp, err := w.trailingBits()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{header}, escapeRBSP(rbsp)...), nil
+}
+
+// SPS returns the sequence parameter set NAL unit of the stream.
+func (e *H264Encoder) SPS() []byte { return e.spsNAL }
+
+// PPS returns the picture parameter set NAL unit of the stream.
+func (e *H264Encoder) PPS() []byte { return e.ppsNAL }
+
+// AVCConfig returns the decoder configuration of the stream, as stored in
+// the avcC box of MP4 files.
+func (e *H264Encoder) AVCConfig() *AVCDecoderConfig {
+	// the decoded pictures have the sizes rounded to even ones
+	avc := &AVCDecoderConfig{LengthSize: 4, Width: uint16(e.width+1) &^ 1, Height: uint16(e.height+1) &^ 1}
+	avc.Type = mp4.BoxTypeAvcC()
+	avc.ConfigurationVersion = 1
+	avc.Profile = uint8(e.sps.ProfileIDC)
+	avc.ProfileCompatibility = uint8(e.sps.ConstraintSetFlags << 2)
+	avc.Level = uint8(e.sps.LevelIDC)
+	avc.LengthSizeMinusOne = 3
+	avc.NumOfSequenceParameterSets = 1
+	avc.SequenceParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(e.spsNAL)), NALUnit: e.spsNAL}}
+	avc.NumOfPictureParameterSets = 1
+	avc.PictureParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(e.ppsNAL)), NALUnit: e.ppsNAL}}
+	return avc
+}
+
+// sliceHeader writes the header of the slice of a picture, coded with qp.
+// See 7.3.3 Slice header syntax
+func (e *H264Encoder) sliceHeader(w *rbspWriter, idr bool, qp int) {
+	w.ue(0) // first_mb_in_slice
+	if idr {
+		w.ue(7) // slice_type, I for all the slices of the picture
+	} else {
+		w.ue(5) // P
+	}
+	w.ue(0) // pic_parameter_set_id
+	w.u(int(e.sps.Log2MaxFrameNumMinus4+4), e.frameNum)
+	if idr {
+		w.ue(e.idrPicID)
+		w.flag(false) // no_output_of_prior_pics_flag
+		w.flag(false) // long_term_reference_flag
+	} else {
+		w.flag(false) // num_ref_idx_active_override_flag
+		w.flag(false) // ref_pic_list_modification_flag_l0
+		w.flag(false) // adaptive_ref_pic_marking_mode_flag
+	}
+	w.se(int32(qp - 26)) // slice_qp_delta
+}
+
+// EncodeKeyframe encodes an image to the NAL unit of an IDR picture, header
+// byte included.
+func (e *H264Encoder) EncodeKeyframe(img image.Image) ([]byte, error) {
+	if e.QP < 0 || e.QP > 51 {
+		return nil, fmt.Errorf("invalid QP: %d", e.QP)
+	}
+	src, err := e.yuv420(img)
+	if err != nil {
+		return nil, err
+	}
+	if e.started {
+		e.idrPicID ^= 1 // consecutive IDR pictures must have different ids
+	}
+	e.frameNum = 0
+	w := newRBSPWriter()
+	e.sliceHeader(w, true, e.QP)
+
+	h := &H264SliceHeader{sps: e.sps, pps: e.pps}
+	s := &h264SliceEncoder{
+		h264SliceDecoder: h264SliceDecoder{h: h, pic: newH264Picture(e.sps), slice: 1, qp: e.QP},
+		w:                w,
+		src:              src,
+	}
+	for mbAddr := range s.pic.mbs {
+		s.startMacroblock(mbAddr)
+		if e.PCM {
+			s.encodePCM()
+		} else {
+			s.encodeIntra16x16()
+		}
+	}
+	nal, err := h264NAL(0x65, w)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key frame: %v", err)
+	}
+	e.started = true
+	return nal, nil
+}
+
+// EncodeSkipFrame returns the NAL unit of a P picture whose macroblocks are
+// all skipped, repeating the previous picture.
+func (e *H264Encoder) EncodeSkipFrame() ([]byte, error) {
+	if !e.started {
+		return nil, errors.New("no key frame to repeat")
+	}
+	e.frameNum = (e.frameNum + 1) % uint32(e.sps.maxFrameNum())
+	w := newRBSPWriter()
+	e.sliceHeader(w, false, 26)
+	w.ue(uint32(int(e.sps.PicWidthInMbsMinus1+1) * e.sps.frameHeightInMbs())) // mb_skip_run
+	return h264NAL(0x41, w)
+}
+
+// yuv420 converts an image to 4:2:0 samples, padded to whole macroblocks by
+// repeating the last row and column.
+func (e *H264Encoder) yuv420(img image.Image) (*image.YCbCr, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() != e.width || bounds.Dy() != e.height {
+		return nil, fmt.Errorf("image size %dx%d doesn't match the stream size %dx%d", bounds.Dx(), bounds.Dy(), e.width, e.height)
+	}
+	width, height := int(e.sps.PicWidthInMbsMinus1+1)*16, e.sps.frameHeightInMbs()*16
+	dst := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	for y := 0; y < height; y += 2 {
+		for x := 0; x < width; x += 2 {
+			var cb, cr int
+			for i := 0; i < 4; i++ {
+				sx, sy := min(x+i%2, e.width-1), min(y+i/2, e.height-1)
+				c := color.YCbCrModel.Convert(img.At(bounds.Min.X+sx, bounds.Min.Y+sy)).(color.YCbCr)
+				dst.Y[dst.YOffset(x+i%2, y+i/2)] = c.Y
+				cb += int(c.Cb)
+				cr += int(c.Cr)
+			}
+			offset := dst.COffset(x, y)
+			dst.Cb[offset] = byte((cb + 2) / 4)
+			dst.Cr[offset] = byte((cr + 2) / 4)
+		}
+	}
+	return dst, nil
+}
+
+// h264SliceEncoder codes the macroblocks of a key frame. It reconstructs them
+// with the prediction and the inverse transforms of the decoder so the next
+// macroblocks are predicted from the samples decoders see.
+type h264SliceEncoder struct {
+	h264SliceDecoder
+	w   *rbspWriter
+	src *image.YCbCr // same size as the picture
+}
+
+// encodePCM codes the current macroblock as I_PCM.
+func (s *h264SliceEncoder) encodePCM() {
+	w, mb, img := s.w, s.mb, s.pic.img
+	mb.kind = mbIPCM
+	w.ue(25) // mb_type I_PCM
+	for !w.byteAligned() {
+		w.u(1, 0) // pcm_alignment_zero_bit
+	}
+	for y := 0; y < 16; y++ {
+		offset := img.YOffset(s.mbX*16, s.mbY*16+y)
+		for _, v := range s.src.Y[offset : offset+16] {
+			w.u(8, uint32(v))
+		}
+		copy(img.Y[offset:offset+16], s.src.Y[offset:])
+	}
+	for c, plane := range [][]byte{img.Cb, img.Cr} {
+		src := [][]byte{s.src.Cb, s.src.Cr}[c]
+		for y := 0; y < 8; y++ {
+			offset := img.COffset(s.mbX*16, s.mbY*16+y*2)
+			for _, v := range src[offset : offset+8] {
+				w.u(8, uint32(v))
+			}
+			copy(plane[offset:offset+8], src[offset:])
+		}
+	}
+	for i := range mb.totalCoeff {
+		mb.totalCoeff[i] = 16
+	}
+	for c := range mb.totalCoeffC {
+		for i := range mb.totalCoeffC[c] {
+			mb.totalCoeffC[c][i] = 16
+		}
+	}
+}
+
+// encodeIntra16x16 codes the current macroblock as Intra_16x16 with DC
+// prediction, for luma and chroma.
+// See 7.3.5 Macroblock layer syntax
+func (s *h264SliceEncoder) encodeIntra16x16() {
+	w, mb, img := s.w, s.mb, s.pic.img
+	mb.kind = mbI16x16
+	s.predIntra16x16(intra16x16DC)
+	s.predIntraChroma(0) // DC
+
+	cbpLuma := 0
+	var dc [16]int32
+	for i := 0; i < 16; i++ {
+		offset := img.YOffset(s.mbX*16+i%4*4, s.mbY*16+i/4*4)
+		coeffs := forward4x4(s.src.Y, img.Y, offset, img.YStride)
+		dc[i] = coeffs[0]
+		mb.totalCoeff[i] = uint8(quantize4x4(&s.luma[i], &coeffs, mb.qp, 1))
+		if mb.totalCoeff[i] > 0 {
+			cbpLuma = 15
+		}
+	}
+	s.lumaDC = lumaDCQuant(&dc, mb.qp)
+
+	cbpChroma := 0
+	for c, plane := range [][]byte{img.Cb, img.Cr} {
+		src := [][]byte{s.src.Cb, s.src.Cr}[c]
+		qpc := chromaQP(mb.qp, [2]int32{s.h.pps.ChromaQPIndexOffset, s.h.pps.SecondChromaQPIndexOffset}[c])
+		var dc [4]int32
+		for blk := 0; blk < 4; blk++ {
+			offset := img.COffset(s.mbX*16+blk%2*8, s.mbY*16+blk/2*8)
+			coeffs := forward4x4(src, plane, offset, img.CStride)
+			dc[blk] = coeffs[0]
+			mb.totalCoeffC[c][blk] = uint8(quantize4x4(&s.chromaAC[c][blk], &coeffs, qpc, 1))
+			if mb.totalCoeffC[c][blk] > 0 {
+				cbpChroma = 2
+			}
+		}
+		s.chromaDC[c] = chromaDCQuant(&dc, qpc)
+		if cbpChroma == 0 && s.chromaDC[c] != [4]int32{} {
+			cbpChroma = 1
+		}
+	}
+
+	mbType := 1 + intra16x16DC + 4*cbpChroma
+	if cbpLuma > 0 {
+		mbType += 12
+	}
+	w.ue(uint32(mbType))
+	w.ue(0) // intra_chroma_pred_mode
+	w.se(0) // mb_qp_delta
+
+	// 7.3.5.3 Residual data syntax
+	w.residualBlock(s.lumaDC[:], 16, s.lumaNC(0, 0, false))
+	if cbpLuma > 0 {
+		for blk := 0; blk < 16; blk++ {
+			x, y := blkX[blk], blkY[blk]
+			w.residualBlock(s.luma[y*4+x][1:], 15, s.lumaNC(x, y, false))
+		}
+	}
+	if cbpChroma > 0 {
+		for c := 0; c < 2; c++ {
+			w.residualBlock(s.chromaDC[c][:], 4, -1)
+		}
+	}
+	if cbpChroma == 2 {
+		for c := 0; c < 2; c++ {
+			for blk := 0; blk < 4; blk++ {
+				w.residualBlock(s.chromaAC[c][blk][1:], 15, s.chromaNC(c, blk%2, blk/2, false))
+			}
+		}
+	}
+
+	dcY := lumaDCDequant(&s.lumaDC, mb.qp)
+	for i := 0; i < 16; i++ {
+		s.addLumaResidual(i%4, i/4, true, dcY[i])
+	}
+	s.addChromaResidual()
+}
+
+// EncodeTrack encodes frames to an H.264 track at fpsNum/fpsDen frames per
+// second, and returns the track with its sample data, which the NAL units
+// and the chunk of the track point into. A nil frame is coded as a P frame
+// repeating the previous one.
+func (e *H264Encoder) EncodeTrack(frames []image.Image, fpsNum, fpsDen uint32) (*Track, []byte, error) {
+	if fpsNum == 0 || fpsDen == 0 {
+		return nil, nil, fmt.Errorf("invalid frame rate %d/%d", fpsNum, fpsDen)
+	}
+	track := &Track{
+		TrackID:   1,
+		Timescale: fpsNum,
+		Duration:  uint64(len(frames)) * uint64(fpsDen),
+		Codec:     mp4.CodecAVC1,
+		Handler:   handlerVideo,
+		AVC:       e.AVCConfig(),
+	}
+	var data bytes.Buffer
+	for i, frame := range frames {
+		var nal []byte
+		var err error
+		if frame != nil {
+			nal, err = e.EncodeKeyframe(frame)
+		} else {
+			nal, err = e.EncodeSkipFrame()
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+
+		ts := uint64(i) * uint64(fpsDen)
+		track.NALs = append(track.NALs, &NALUnit{
+			Type:       nal[0] & 0x1f,
+			RefIdc:     nal[0] >> 5 & 3,
+			SliceType:  parseSliceType(nal[1:]),
+			Offset:     int64(data.Len() + 4),
+			Length:     uint32(len(nal)),
+			TrackID:    track.TrackID,
+			SampleID:   uint32(i),
+			Timestamp:  ts,
+			DecodeTime: ts,
+		})
+		track.Samples = append(track.Samples, &mp4.Sample{Size: uint32(len(nal) + 4), TimeDelta: fpsDen})
+		binary.Write(&data, binary.BigEndian, uint32(len(nal)))
+		data.Write(nal)
+	}
+	track.Chunks = mp4.Chunks{{DataOffset: 0, SamplesPerChunk: uint32(len(frames))}}
+	return track, data.Bytes(), nil
+}
+
+// WriteMP4 encodes frames as EncodeTrack does and writes them to an MP4
+// file.
+func (e *H264Encoder) WriteMP4(w io.Writer, frames []image.Image, fpsNum, fpsDen uint32) error {
+	track, data, err := e.EncodeTrack(frames, fpsNum, fpsDen)
+	if err != nil {
+		return err
+	}
+	return (&MP4Muxer{}).Mux(w, bytes.NewReader(data), []MuxTrack{{Track: track}})
+}
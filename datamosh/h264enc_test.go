@@ -0,0 +1,149 @@
+package datamosh
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testImage returns an RGB gradient with some noise.
+func testImage(width, height int, seed int64) image.Image {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			n := rng.Intn(32)
+			img.Set(x, y, color.RGBA{uint8(x*4 + n), uint8(y*4 + x + n), uint8(x * y / 8), 255})
+		}
+	}
+	return img
+}
+
+func TestH264EncoderMP4(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		pcm           bool
+		qp            int
+		maxDiff       int // of the luma samples
+	}{
+		{name: "pcm", width: 48, height: 32, pcm: true},
+		{name: "intra", width: 40, height: 24, qp: 26, maxDiff: 16},
+		{name: "lossy", width: 32, height: 32, qp: 51, maxDiff: 64},
+		{name: "fine", width: 30, height: 18, qp: 0, maxDiff: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewH264Encoder(tt.width, tt.height)
+			require.NoError(t, err)
+			e.PCM, e.QP = tt.pcm, tt.qp
+			frames := []image.Image{testImage(tt.width, tt.height, 1), nil, nil, testImage(tt.width, tt.height, 2), nil}
+			var out bytes.Buffer
+			require.NoError(t, e.WriteMP4(&out, frames, 25, 1))
+
+			tracks, format, err := Demux(bytes.NewReader(out.Bytes()))
+			require.NoError(t, err)
+			assert.Equal(t, ContainerMP4, format)
+			require.Len(t, tracks, 1)
+			track := tracks[0]
+			var keyframes []uint32
+			for _, frame := range track.Frames() {
+				if frame.IsKeyframe() {
+					keyframes = append(keyframes, frame.Sample())
+				}
+			}
+			assert.Equal(t, []uint32{0, 3}, keyframes)
+			num, den := track.FrameRate()
+			assert.Equal(t, []uint32{25, 1}, []uint32{num, den})
+
+			var decoded []*image.YCbCr
+			err = track.DecodeFrames(bytes.NewReader(out.Bytes()), func(sampleID uint32, img *image.YCbCr) error {
+				decoded = append(decoded, img)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Len(t, decoded, len(frames))
+			for i, img := range decoded {
+				src := frames[i]
+				if src == nil {
+					// skipped frames repeat the previous picture
+					assert.Equal(t, decoded[i-1].Y, img.Y)
+					assert.Equal(t, decoded[i-1].Cb, img.Cb)
+					continue
+				}
+				want, err := e.yuv420(src)
+				require.NoError(t, err)
+				assert.Equal(t, image.Rect(0, 0, tt.width, tt.height), img.Rect)
+				maxDiff := 0
+				for y := 0; y < tt.height; y++ {
+					for x := 0; x < tt.width; x++ {
+						d := int(want.Y[want.YOffset(x, y)]) - int(img.Y[img.YOffset(x, y)])
+						maxDiff = max(maxDiff, d, -d)
+					}
+				}
+				assert.LessOrEqual(t, maxDiff, tt.maxDiff, "frame %d", i)
+			}
+		})
+	}
+}
+
+func TestH264EncoderErrors(t *testing.T) {
+	_, err := NewH264Encoder(0, 16)
+	assert.Error(t, err)
+	_, err = NewH264Encoder(16384, 16384)
+	assert.Error(t, err)
+
+	e, err := NewH264Encoder(16, 16)
+	require.NoError(t, err)
+	_, err = e.EncodeSkipFrame()
+	assert.EqualError(t, err, "no key frame to repeat")
+	_, err = e.EncodeKeyframe(testImage(8, 8, 1))
+	assert.EqualError(t, err, "image size 8x8 doesn't match the stream size 16x16")
+	e.QP = 52
+	_, err = e.EncodeKeyframe(testImage(16, 16, 1))
+	assert.EqualError(t, err, "invalid QP: 52")
+}
+
+func TestCAVLCResidualBlockWriter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, nC := range []int{-1, 0, 1, 2, 3, 4, 7, 8, 16} {
+		maxNumCoeffs := []int{15, 16}
+		if nC < 0 {
+			maxNumCoeffs = []int{4}
+		}
+		for _, maxNumCoeff := range maxNumCoeffs {
+			for i := 0; i < 200; i++ {
+				coeffs := make([]int32, maxNumCoeff)
+				density := rng.Intn(maxNumCoeff + 1)
+				for j := range coeffs {
+					if rng.Intn(maxNumCoeff) >= density {
+						continue
+					}
+					switch rng.Intn(3) {
+					case 0:
+						coeffs[j] = 1 - 2*int32(rng.Intn(2))
+					case 1:
+						coeffs[j] = int32(rng.Intn(33) - 16)
+					default:
+						coeffs[j] = int32(rng.Intn(2*maxCAVLCLevel+1) - maxCAVLCLevel)
+					}
+				}
+				w := newRBSPWriter()
+				n := w.residualBlock(coeffs, maxNumCoeff, nC)
+				rbsp, err := w.trailingBits()
+				require.NoError(t, err)
+
+				r := newRBSPReader(rbsp)
+				got := make([]int32, maxNumCoeff)
+				assert.Equal(t, n, r.residualBlock(got, maxNumCoeff, nC))
+				require.NoError(t, r.err)
+				require.Equal(t, coeffs, got, "nC %d, %d coefficients", nC, maxNumCoeff)
+			}
+		}
+	}
+}
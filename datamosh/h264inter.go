@@ -0,0 +1,436 @@
+package datamosh
+
+import (
+	"fmt"
+	"image"
+)
+
+// Partitions of the P macroblock types and of the sub-macroblock types, with
+// their width and height in luma samples.
+// See Tables 7-13 and 7-17
+var (
+	pMbPartitions = [4]struct{ n, w, h int }{
+		{1, 16, 16}, // P_L0_16x16
+		{2, 16, 8},  // P_L0_L0_16x8
+		{2, 8, 16},  // P_L0_L0_8x16
+		{4, 8, 8},   // P_8x8 and P_8x8ref0
+	}
+	pSubMbPartitions = [4]struct{ n, w, h int }{
+		{1, 8, 8}, // P_L0_8x8
+		{2, 8, 4}, // P_L0_8x4
+		{2, 4, 8}, // P_L0_4x8
+		{4, 4, 4}, // P_L0_4x4
+	}
+)
+
+// coded_block_pattern of inter macroblocks indexed by codeNum, for
+// ChromaArrayType 1 and 2.
+// See Table 9-4
+var interCBP = [48]uint8{
+	0, 16, 1, 2, 4, 8, 32, 3, 5, 10, 12, 15, 47, 7, 11, 13,
+	14, 6, 9, 31, 35, 37, 42, 44, 33, 34, 36, 40, 39, 43, 45, 46,
+	17, 18, 20, 24, 19, 21, 26, 28, 23, 27, 29, 30, 22, 25, 38, 41,
+}
+
+// interPartition is a macroblock or sub-macroblock partition, its position
+// and size in luma samples within the macroblock.
+type interPartition struct {
+	x, y, w, h int
+	refIdx     int8
+	mvd        [2]int32
+}
+
+// decodeInterMacroblock decodes a macroblock of type mbType in the P slice
+// numbering, see Table 7-13.
+func (s *h264SliceDecoder) decodeInterMacroblock(mbType uint32) error {
+	r, mb := s.r, s.mb
+	mb.kind = mbInter
+	maxRefIdx := uint32(len(s.refs) - 1)
+
+	// 7.3.5.1 Macroblock prediction syntax and 7.3.5.2 Sub-macroblock
+	// prediction syntax
+	var parts []interPartition
+	var refIdx [4]uint32
+	noSubMbPartSizeLessThan8x8 := true
+	shape := pMbPartitions[min(mbType, 3)]
+	if shape.n < 4 {
+		for i := 0; i < shape.n; i++ {
+			parts = append(parts, interPartition{x: i * shape.w % 16, y: i * shape.w / 16 * shape.h, w: shape.w, h: shape.h})
+		}
+		for i := range parts {
+			p := &parts[i]
+			if maxRefIdx > 0 {
+				refIdx[i] = s.readRefIdx(p.x, p.y, maxRefIdx)
+			}
+			p.refIdx = int8(refIdx[i])
+			s.setRefIdx(p.x, p.y, p.w, p.h, p.refIdx)
+		}
+	} else {
+		var subMbTypes [4]uint32
+		for i := range subMbTypes {
+			subMbTypes[i] = s.readSubMbType()
+			if subMbTypes[i] != 0 {
+				noSubMbPartSizeLessThan8x8 = false
+			}
+		}
+		for i := range refIdx {
+			// P_8x8ref0 uses the first reference picture for all partitions
+			if maxRefIdx > 0 && mbType == 3 {
+				refIdx[i] = s.readRefIdx(i%2*8, i/2*8, maxRefIdx)
+			}
+			s.setRefIdx(i%2*8, i/2*8, 8, 8, int8(refIdx[i]))
+		}
+		for i, subMbType := range subMbTypes {
+			sub := pSubMbPartitions[subMbType]
+			for j := 0; j < sub.n; j++ {
+				parts = append(parts, interPartition{
+					x:      i%2*8 + j*sub.w%8,
+					y:      i/2*8 + j*sub.w/8*sub.h,
+					w:      sub.w,
+					h:      sub.h,
+					refIdx: int8(refIdx[i]),
+				})
+			}
+		}
+	}
+	firstMVD := len(s.mvds)
+	for i := range parts {
+		p := &parts[i]
+		start := r.pos
+		p.mvd[0] = s.readMVD(p.x, p.y, 0)
+		p.mvd[1] = s.readMVD(p.x, p.y, 1)
+		setMVD(&mb.mvd, p.x, p.y, p.w, p.h, p.mvd)
+		if s.rewriteMVD != nil {
+			s.mvds = append(s.mvds, h264MVD{start: start, end: r.pos})
+		}
+	}
+	for _, idx := range refIdx {
+		if idx > maxRefIdx {
+			r.fail(fmt.Errorf("invalid ref_idx_l0: %d", idx))
+		}
+	}
+
+	cbpLuma, cbpChroma := s.readCBP(interCBP[:])
+	mb.cbp = uint8(cbpLuma | cbpChroma<<4)
+	if cbpLuma > 0 && s.h.pps.Transform8x8Mode && noSubMbPartSizeLessThan8x8 {
+		mb.transform8x8 = s.readTransformSize8x8Flag()
+	}
+	if cbpLuma > 0 || cbpChroma > 0 {
+		s.decodeQPDelta()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	// 8.4.1 Derivation process for motion vector components and reference
+	// indices, in decoding order as the partitions predict from the previous
+	// ones
+	for i, p := range parts {
+		mv := s.predictMV(p.x, p.y, p.w, p.h, p.refIdx)
+		if s.rewriteMVD != nil {
+			p.mvd = s.rewriteMVD(mv, p.mvd)
+			rewritten := &s.mvds[firstMVD+i]
+			rewritten.mvd = p.mvd
+			if s.cabac != nil {
+				rewritten.ctxIdxInc = [2]int{s.mvdCtxIdxInc(p.x, p.y, 0, true), s.mvdCtxIdxInc(p.x, p.y, 1, true)}
+				setMVD(&mb.rewrittenMVD, p.x, p.y, p.w, p.h, p.mvd)
+			}
+		}
+		mv[0] += p.mvd[0]
+		mv[1] += p.mvd[1]
+		s.setMotion(p.x, p.y, p.w, p.h, p.refIdx, mv)
+	}
+
+	s.residual(false, cbpLuma, cbpChroma)
+	if r.err != nil {
+		return r.err
+	}
+	for _, p := range parts {
+		s.predInter(p.x, p.y, p.w, p.h)
+	}
+	s.addLumaResiduals()
+	s.addChromaResidual()
+	return nil
+}
+
+// skipMacroblock decodes a P_Skip macroblock.
+// See 8.4.1.1 Derivation process for luma motion vectors for skipped macroblocks in P and SP slices
+func (s *h264SliceDecoder) skipMacroblock(mbAddr int) {
+	s.startMacroblock(mbAddr)
+	s.mb.kind = mbInter
+	s.mb.skipped = true
+
+	var mv [2]int32
+	mvA, refA, _ := s.neighbourMotion(-1, 0)
+	mvB, refB, _ := s.neighbourMotion(0, -1)
+	switch {
+	case s.neighbourMB(-1, 0, false) == nil || s.neighbourMB(0, -1, false) == nil:
+	case refA == 0 && mvA == [2]int32{}:
+	case refB == 0 && mvB == [2]int32{}:
+	default:
+		mv = s.predictMV(0, 0, 16, 16, 0)
+	}
+	s.setMotion(0, 0, 16, 16, 0, mv)
+	s.predInter(0, 0, 16, 16)
+}
+
+// neighbourMotion returns the motion vector and reference index of the
+// partition covering the luma sample at (x, y), relative to the current
+// macroblock, and whether the partition is available. Intra partitions are
+// available with a reference index of -1.
+// See 8.4.1.3.2 Derivation process for motion data of neighbouring partitions
+func (s *h264SliceDecoder) neighbourMotion(x, y int) (mv [2]int32, refIdx int8, available bool) {
+	var mb *h264Macroblock
+	switch {
+	case y > 15 || (x > 15 && y >= 0):
+		// the partitions on the right and below aren't decoded yet
+		return mv, -1, false
+	case x >= 0 && x <= 15 && y >= 0:
+		if s.motionDone&(1<<uint(y/4*4+x/4)) == 0 {
+			return mv, -1, false
+		}
+		mb = s.mb
+	default:
+		dx, dy := 0, 0
+		if x < 0 {
+			dx, x = -1, x+16
+		} else if x > 15 {
+			dx, x = 1, x-16
+		}
+		if y < 0 {
+			dy, y = -1, y+16
+		}
+		if mb = s.neighbourMB(dx, dy, false); mb == nil {
+			return mv, -1, false
+		}
+	}
+	refIdx = mb.refIdx[y/8*2+x/8]
+	if refIdx < 0 {
+		return mv, -1, true
+	}
+	return mb.mvs[y/4*4+x/4], refIdx, true
+}
+
+// predictMV returns mvpLX, the motion vector prediction of the partition at
+// (x, y) of size w x h using the reference index refIdx.
+// See 8.4.1.3 Derivation process for luma motion vector prediction
+func (s *h264SliceDecoder) predictMV(x, y, w, h int, refIdx int8) [2]int32 {
+	mvA, refA, availableA := s.neighbourMotion(x-1, y)
+	mvB, refB, availableB := s.neighbourMotion(x, y-1)
+	mvC, refC, availableC := s.neighbourMotion(x+w, y-1)
+	if !availableC {
+		mvC, refC, availableC = s.neighbourMotion(x-1, y-1)
+	}
+
+	// directional prediction of the 16x8 and 8x16 partitions
+	switch {
+	case w == 16 && h == 8 && y == 0 && refB == refIdx:
+		return mvB
+	case w == 16 && h == 8 && y == 8 && refA == refIdx:
+		return mvA
+	case w == 8 && h == 16 && x == 0 && refA == refIdx:
+		return mvA
+	case w == 8 && h == 16 && x == 8 && refC == refIdx:
+		return mvC
+	}
+
+	// 8.4.1.3.1 Derivation process for median luma motion vector prediction
+	if !availableB && !availableC && availableA {
+		mvB, mvC = mvA, mvA
+		refB, refC = refA, refA
+	}
+	switch {
+	case refA == refIdx && refB != refIdx && refC != refIdx:
+		return mvA
+	case refA != refIdx && refB == refIdx && refC != refIdx:
+		return mvB
+	case refA != refIdx && refB != refIdx && refC == refIdx:
+		return mvC
+	}
+	return [2]int32{median3(mvA[0], mvB[0], mvC[0]), median3(mvA[1], mvB[1], mvC[1])}
+}
+
+func median3(a, b, c int32) int32 {
+	return max(min(a, b), min(max(a, b), c))
+}
+
+// setRefIdx sets the reference index of a partition of the current
+// macroblock as it is parsed, for the CABAC contexts of the next ones.
+func (s *h264SliceDecoder) setRefIdx(x, y, w, h int, refIdx int8) {
+	for j := y / 8; j < (y+h)/8; j++ {
+		for i := x / 8; i < (x+w)/8; i++ {
+			s.mb.refIdx[j*2+i] = refIdx
+		}
+	}
+}
+
+// setMVD sets the motion vector difference of the luma blocks of a partition.
+func setMVD(mvds *[16][2]int32, x, y, w, h int, mvd [2]int32) {
+	for j := y / 4; j < (y+h)/4; j++ {
+		for i := x / 4; i < (x+w)/4; i++ {
+			mvds[j*4+i] = mvd
+		}
+	}
+}
+
+// setMotion sets the motion vector and reference index of a partition of the
+// current macroblock.
+func (s *h264SliceDecoder) setMotion(x, y, w, h int, refIdx int8, mv [2]int32) {
+	mb := s.mb
+	for j := y / 4; j < (y+h)/4; j++ {
+		for i := x / 4; i < (x+w)/4; i++ {
+			mb.mvs[j*4+i] = mv
+			mb.refIdx[j/2*2+i/2] = refIdx
+			mb.refIDs[j/2*2+i/2] = s.refs[refIdx].id
+			s.motionDone |= 1 << uint(j*4+i)
+		}
+	}
+}
+
+// predInter writes the inter prediction of the samples of a partition of the
+// current macroblock.
+// See 8.4.2 Decoding process for Inter prediction samples
+func (s *h264SliceDecoder) predInter(x, y, w, h int) {
+	mb, img := s.mb, s.pic.img
+	blk := y/4*4 + x/4
+	mv, ref := mb.mvs[blk], s.refs[mb.refIdx[y/8*2+x/8]].img
+	xL, yL := s.mbX*16+x, s.mbY*16+y
+	predLuma(img.Y[img.YOffset(xL, yL):], img.YStride, ref, xL*4+int(mv[0]), yL*4+int(mv[1]), w, h)
+
+	// the chroma vectors are the luma ones in 1/8 chroma sample units for
+	// 4:2:0 frames
+	offset := img.COffset(xL, yL)
+	xC, yC := xL/2*8+int(mv[0]), yL/2*8+int(mv[1])
+	predChroma(img.Cb[offset:], img.CStride, ref.Cb, ref, xC, yC, w/2, h/2)
+	predChroma(img.Cr[offset:], img.CStride, ref.Cr, ref, xC, yC, w/2, h/2)
+
+	if s.h.pps.WeightedPred {
+		refIdx := int(mb.refIdx[y/8*2+x/8])
+		if refIdx >= len(s.h.PredWeightsL0) {
+			return
+		}
+		pw := s.h.PredWeightsL0[refIdx]
+		weightBlock(img.Y[img.YOffset(xL, yL):], img.YStride, w, h, pw.LumaWeight, pw.LumaOffset, s.h.LumaLog2WeightDenom)
+		weightBlock(img.Cb[offset:], img.CStride, w/2, h/2, pw.ChromaWeight[0], pw.ChromaOffset[0], s.h.ChromaLog2WeightDenom)
+		weightBlock(img.Cr[offset:], img.CStride, w/2, h/2, pw.ChromaWeight[1], pw.ChromaOffset[1], s.h.ChromaLog2WeightDenom)
+	}
+}
+
+// weightBlock applies the explicit weighted prediction of a P slice to the
+// w x h predicted block in dst.
+// See 8.4.2.3.2 Weighted sample prediction process
+func weightBlock(dst []byte, stride, w, h int, weight, offset int32, logWD uint32) {
+	for j := 0; j < h; j++ {
+		row := dst[j*stride:]
+		for i := 0; i < w; i++ {
+			v := int32(row[i]) * weight
+			if logWD >= 1 {
+				v = (v + 1<<(logWD-1)) >> logWD
+			}
+			row[i] = clip1(v + offset)
+		}
+	}
+}
+
+// predLuma writes the w x h block of ref at the quarter sample position
+// (qx, qy) to dst, interpolating the fractional positions.
+// See 8.4.2.2.1 Luma sample interpolation process
+func predLuma(dst []byte, stride int, ref *image.YCbCr, qx, qy, w, h int) {
+	ix, iy, fx, fy := qx>>2, qy>>2, qx&3, qy&3
+	width, height := ref.Rect.Dx(), ref.Rect.Dy()
+
+	// the integer samples from (ix-2, iy-2) to (ix+w+2, iy+h+2), the samples
+	// outside the picture are the ones on its edges
+	const size = 16 + 5
+	var win [size * size]int32
+	ww := w + 5
+	for j := 0; j < h+5; j++ {
+		row := ref.Y[clampInt(iy-2+j, 0, height-1)*ref.YStride:]
+		for i := 0; i < ww; i++ {
+			win[j*ww+i] = int32(row[clampInt(ix-2+i, 0, width-1)])
+		}
+	}
+	at := func(i, j int) int32 { return win[(j+2)*ww+i+2] }
+	tap := func(a, b, c, d, e, f int32) int32 { return a - 5*b + 20*c + 20*d - 5*e + f }
+	// b1 and h1 are the intermediate half sample values right of and below
+	// the sample at (i, j), j1 the one in between
+	b1 := func(i, j int) int32 { return tap(at(i-2, j), at(i-1, j), at(i, j), at(i+1, j), at(i+2, j), at(i+3, j)) }
+	h1 := func(i, j int) int32 { return tap(at(i, j-2), at(i, j-1), at(i, j), at(i, j+1), at(i, j+2), at(i, j+3)) }
+	b := func(i, j int) int32 { return int32(clip1((b1(i, j) + 16) >> 5)) }
+	hh := func(i, j int) int32 { return int32(clip1((h1(i, j) + 16) >> 5)) }
+	jj := func(i, j int) int32 {
+		j1 := tap(b1(i, j-2), b1(i, j-1), b1(i, j), b1(i, j+1), b1(i, j+2), b1(i, j+3))
+		return int32(clip1((j1 + 512) >> 10))
+	}
+	avg := func(a, b int32) int32 { return (a + b + 1) >> 1 }
+
+	for j := 0; j < h; j++ {
+		row := dst[j*stride:]
+		for i := 0; i < w; i++ {
+			var v int32
+			switch fx<<2 | fy {
+			case 0<<2 | 0:
+				v = at(i, j)
+			case 0<<2 | 1:
+				v = avg(at(i, j), hh(i, j))
+			case 0<<2 | 2:
+				v = hh(i, j)
+			case 0<<2 | 3:
+				v = avg(at(i, j+1), hh(i, j))
+			case 1<<2 | 0:
+				v = avg(at(i, j), b(i, j))
+			case 1<<2 | 1:
+				v = avg(b(i, j), hh(i, j))
+			case 1<<2 | 2:
+				v = avg(hh(i, j), jj(i, j))
+			case 1<<2 | 3:
+				v = avg(hh(i, j), b(i, j+1))
+			case 2<<2 | 0:
+				v = b(i, j)
+			case 2<<2 | 1:
+				v = avg(b(i, j), jj(i, j))
+			case 2<<2 | 2:
+				v = jj(i, j)
+			case 2<<2 | 3:
+				v = avg(jj(i, j), b(i, j+1))
+			case 3<<2 | 0:
+				v = avg(at(i+1, j), b(i, j))
+			case 3<<2 | 1:
+				v = avg(b(i, j), hh(i+1, j))
+			case 3<<2 | 2:
+				v = avg(jj(i, j), hh(i+1, j))
+			case 3<<2 | 3:
+				v = avg(hh(i+1, j), b(i, j+1))
+			}
+			row[i] = byte(v)
+		}
+	}
+}
+
+// predChroma writes the w x h block of the chroma plane of ref at the 1/8
+// sample position (qx, qy) to dst.
+// See 8.4.2.2.2 Chroma sample interpolation process
+func predChroma(dst []byte, stride int, plane []byte, ref *image.YCbCr, qx, qy, w, h int) {
+	ix, iy, fx, fy := qx>>3, qy>>3, int32(qx&7), int32(qy&7)
+	width, height := ref.Rect.Dx()/2, ref.Rect.Dy()/2
+	at := func(i, j int) int32 {
+		return int32(plane[clampInt(iy+j, 0, height-1)*ref.CStride+clampInt(ix+i, 0, width-1)])
+	}
+	for j := 0; j < h; j++ {
+		row := dst[j*stride:]
+		for i := 0; i < w; i++ {
+			row[i] = byte(((8-fx)*(8-fy)*at(i, j) + fx*(8-fy)*at(i+1, j) +
+				(8-fx)*fy*at(i, j+1) + fx*fy*at(i+1, j+1) + 32) >> 6)
+		}
+	}
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
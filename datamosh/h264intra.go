@@ -0,0 +1,442 @@
+package datamosh
+
+// Intra_4x4 prediction modes.
+// See Table 8-2
+const (
+	intra4x4Vertical = iota
+	intra4x4Horizontal
+	intra4x4DC
+	intra4x4DiagonalDownLeft
+	intra4x4DiagonalDownRight
+	intra4x4VerticalRight
+	intra4x4HorizontalDown
+	intra4x4VerticalLeft
+	intra4x4HorizontalUp
+)
+
+// Intra_16x16 prediction modes, the chroma modes use the same prediction
+// processes in a different order.
+// See Tables 8-4 and 8-5
+const (
+	intra16x16Vertical = iota
+	intra16x16Horizontal
+	intra16x16DC
+	intra16x16Plane
+)
+
+var intraChromaModes = [4]int{intra16x16DC, intra16x16Horizontal, intra16x16Vertical, intra16x16Plane}
+
+// unavailableSample is used in place of the neighbouring samples that aren't
+// available. Conforming streams don't use them, moshed ones might.
+const unavailableSample = 128
+
+func clip1(v int32) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// predIntra4x4 writes the Intra_4x4 prediction of the luma block at (x, y) of
+// the current macroblock.
+// See 8.3.1.2 Intra_4x4 sample prediction
+func (s *h264SliceDecoder) predIntra4x4(x, y int, mode int8) {
+	img := s.pic.img
+	stride := img.YStride
+	origin := img.YOffset(s.mbX*16+x*4, s.mbY*16+y*4)
+	plane := img.Y
+
+	left := x > 0 || s.neighbourMB(-1, 0, true) != nil
+	top := y > 0 || s.neighbourMB(0, -1, true) != nil
+	var topLeft, topRight bool
+	switch {
+	case x > 0 && y > 0:
+		topLeft = true
+	case y > 0:
+		topLeft = s.neighbourMB(-1, 0, true) != nil
+	case x > 0:
+		topLeft = s.neighbourMB(0, -1, true) != nil
+	default:
+		topLeft = s.neighbourMB(-1, -1, true) != nil
+	}
+	switch {
+	case y == 0 && x < 3:
+		topRight = s.neighbourMB(0, -1, true) != nil
+	case y == 0:
+		topRight = s.neighbourMB(1, -1, true) != nil
+	case x < 3:
+		// the block above right is decoded first unless it is in the next 8x8 block
+		topRight = luma4x4BlkIdx(x+1, y-1) < luma4x4BlkIdx(x, y)
+	}
+
+	// p[-1, 3..0], p[-1, -1] and p[0..7, -1]
+	var e [13]int32
+	for i := range e {
+		e[i] = unavailableSample
+	}
+	if left {
+		for i := 0; i < 4; i++ {
+			e[3-i] = int32(plane[origin+i*stride-1])
+		}
+	}
+	if topLeft {
+		e[4] = int32(plane[origin-stride-1])
+	}
+	if top {
+		for i := 0; i < 4; i++ {
+			e[5+i] = int32(plane[origin-stride+i])
+		}
+		for i := 4; i < 8; i++ {
+			if topRight {
+				e[5+i] = int32(plane[origin-stride+i])
+			} else {
+				e[5+i] = e[8]
+			}
+		}
+	}
+	predIntraNxN(plane[origin:], stride, 4, mode, e[:], left, top)
+}
+
+// predIntraNxN writes the Intra_4x4 or Intra_8x8 prediction of an n x n luma
+// block to dst, given its neighbouring samples p from p[-1, n-1] to p[-1, 0],
+// then p[-1, -1] and p[0..2n-1, -1].
+func predIntraNxN(dst []byte, stride, n int, mode int8, p []int32, left, top bool) {
+	pt := func(x int) int32 { return p[n+1+x] }
+	pl := func(y int) int32 { return p[n-1-y] }
+	var dc int32 = 128
+	if mode == intra4x4DC {
+		var sumTop, sumLeft int32
+		for i := 0; i < n; i++ {
+			sumTop += pt(i)
+			sumLeft += pl(i)
+		}
+		shift := uint(2)
+		if n == 8 {
+			shift = 3
+		}
+		switch {
+		case left && top:
+			dc = (sumTop + sumLeft + int32(n)) >> (shift + 1)
+		case left:
+			dc = (sumLeft + int32(n/2)) >> shift
+		case top:
+			dc = (sumTop + int32(n/2)) >> shift
+		}
+	}
+
+	for j := 0; j < n; j++ {
+		for i := 0; i < n; i++ {
+			var v int32
+			switch mode {
+			case intra4x4Vertical:
+				v = pt(i)
+			case intra4x4Horizontal:
+				v = pl(j)
+			case intra4x4DC:
+				v = dc
+			case intra4x4DiagonalDownLeft:
+				if i == n-1 && j == n-1 {
+					v = (pt(2*n-2) + 3*pt(2*n-1) + 2) >> 2
+				} else {
+					v = (pt(i+j) + 2*pt(i+j+1) + pt(i+j+2) + 2) >> 2
+				}
+			case intra4x4DiagonalDownRight:
+				k := i - j
+				v = (p[n-1+k] + 2*p[n+k] + p[n+1+k] + 2) >> 2
+			case intra4x4VerticalRight:
+				switch zVR := 2*i - j; {
+				case zVR >= 0 && zVR%2 == 0:
+					v = (pt(i-(j>>1)-1) + pt(i-(j>>1)) + 1) >> 1
+				case zVR >= 0:
+					v = (pt(i-(j>>1)-2) + 2*pt(i-(j>>1)-1) + pt(i-(j>>1)) + 2) >> 2
+				case zVR == -1:
+					v = (pl(0) + 2*pl(-1) + pt(0) + 2) >> 2
+				default:
+					v = (pl(j-2*i-1) + 2*pl(j-2*i-2) + pl(j-2*i-3) + 2) >> 2
+				}
+			case intra4x4HorizontalDown:
+				switch zHD := 2*j - i; {
+				case zHD >= 0 && zHD%2 == 0:
+					v = (pl(j-(i>>1)-1) + pl(j-(i>>1)) + 1) >> 1
+				case zHD >= 0:
+					v = (pl(j-(i>>1)-2) + 2*pl(j-(i>>1)-1) + pl(j-(i>>1)) + 2) >> 2
+				case zHD == -1:
+					v = (pl(0) + 2*pl(-1) + pt(0) + 2) >> 2
+				default:
+					v = (pt(i-2*j-1) + 2*pt(i-2*j-2) + pt(i-2*j-3) + 2) >> 2
+				}
+			case intra4x4VerticalLeft:
+				if j%2 == 0 {
+					v = (pt(i+(j>>1)) + pt(i+(j>>1)+1) + 1) >> 1
+				} else {
+					v = (pt(i+(j>>1)) + 2*pt(i+(j>>1)+1) + pt(i+(j>>1)+2) + 2) >> 2
+				}
+			case intra4x4HorizontalUp:
+				switch zHU := i + 2*j; {
+				case zHU > 2*n-3:
+					v = pl(n - 1)
+				case zHU == 2*n-3:
+					v = (pl(n-2) + 3*pl(n-1) + 2) >> 2
+				case zHU%2 == 0:
+					v = (pl(j+(i>>1)) + pl(j+(i>>1)+1) + 1) >> 1
+				default:
+					v = (pl(j+(i>>1)) + 2*pl(j+(i>>1)+1) + pl(j+(i>>1)+2) + 2) >> 2
+				}
+			}
+			dst[j*stride+i] = byte(v)
+		}
+	}
+}
+
+// predIntra8x8 writes the Intra_8x8 prediction of the luma 8x8 block b8 of the
+// current macroblock, in raster order.
+// See 8.3.2.2 Intra_8x8 sample prediction
+func (s *h264SliceDecoder) predIntra8x8(b8 int, mode int8) {
+	img := s.pic.img
+	stride := img.YStride
+	x, y := b8%2, b8/2
+	origin := img.YOffset(s.mbX*16+x*8, s.mbY*16+y*8)
+	plane := img.Y
+
+	left := x > 0 || s.neighbourMB(-1, 0, true) != nil
+	top := y > 0 || s.neighbourMB(0, -1, true) != nil
+	var topLeft, topRight bool
+	switch {
+	case x > 0 && y > 0:
+		topLeft = true
+	case y > 0:
+		topLeft = s.neighbourMB(-1, 0, true) != nil
+	case x > 0:
+		topLeft = s.neighbourMB(0, -1, true) != nil
+	default:
+		topLeft = s.neighbourMB(-1, -1, true) != nil
+	}
+	switch {
+	case y == 0 && x == 0:
+		topRight = s.neighbourMB(0, -1, true) != nil
+	case y == 0:
+		topRight = s.neighbourMB(1, -1, true) != nil
+	case x == 0:
+		// the top right 8x8 block is decoded first
+		topRight = true
+	}
+
+	// p[-1, 7..0], p[-1, -1] and p[0..15, -1]
+	var e [25]int32
+	for i := range e {
+		e[i] = unavailableSample
+	}
+	if left {
+		for i := 0; i < 8; i++ {
+			e[7-i] = int32(plane[origin+i*stride-1])
+		}
+	}
+	if topLeft {
+		e[8] = int32(plane[origin-stride-1])
+	}
+	if top {
+		for i := 0; i < 16; i++ {
+			if i < 8 || topRight {
+				e[9+i] = int32(plane[origin-stride+i])
+			} else {
+				e[9+i] = e[16]
+			}
+		}
+	}
+
+	// 8.3.2.2.1 Reference sample filtering process for Intra_8x8 sample
+	// prediction
+	f := e
+	if top {
+		if topLeft {
+			f[9] = (e[8] + 2*e[9] + e[10] + 2) >> 2
+		} else {
+			f[9] = (3*e[9] + e[10] + 2) >> 2
+		}
+		for i := 10; i < 24; i++ {
+			f[i] = (e[i-1] + 2*e[i] + e[i+1] + 2) >> 2
+		}
+		f[24] = (e[23] + 3*e[24] + 2) >> 2
+	}
+	if topLeft {
+		switch {
+		case top && left:
+			f[8] = (e[7] + 2*e[8] + e[9] + 2) >> 2
+		case top:
+			f[8] = (3*e[8] + e[9] + 2) >> 2
+		case left:
+			f[8] = (3*e[8] + e[7] + 2) >> 2
+		}
+	}
+	if left {
+		if topLeft {
+			f[7] = (e[8] + 2*e[7] + e[6] + 2) >> 2
+		} else {
+			f[7] = (3*e[7] + e[6] + 2) >> 2
+		}
+		for i := 1; i < 7; i++ {
+			f[i] = (e[i-1] + 2*e[i] + e[i+1] + 2) >> 2
+		}
+		f[0] = (e[1] + 3*e[0] + 2) >> 2
+	}
+	predIntraNxN(plane[origin:], stride, 8, mode, f[:], left, top)
+}
+
+// luma4x4BlkIdx returns the index of the luma block at (x, y).
+// See 6.4.13.1 Derivation process for 4x4 luma block indices
+func luma4x4BlkIdx(x, y int) int {
+	return 8*(y/2) + 4*(x/2) + 2*(y%2) + (x % 2)
+}
+
+// predIntra16x16 writes the Intra_16x16 prediction of the current macroblock.
+// See 8.3.3 Intra_16x16 prediction process for luma samples
+func (s *h264SliceDecoder) predIntra16x16(mode int) {
+	img := s.pic.img
+	s.predIntraBlock(img.Y, img.YOffset(s.mbX*16, s.mbY*16), img.YStride, 16, mode)
+}
+
+// predIntraChroma writes the prediction of the chroma blocks of the current
+// macroblock.
+// See 8.3.4 Intra prediction process for chroma samples
+func (s *h264SliceDecoder) predIntraChroma(chromaMode int) {
+	img := s.pic.img
+	origin := img.COffset(s.mbX*16, s.mbY*16)
+	for _, plane := range [][]byte{img.Cb, img.Cr} {
+		if mode := intraChromaModes[chromaMode]; mode != intra16x16DC {
+			s.predIntraBlock(plane, origin, img.CStride, 8, mode)
+		} else {
+			s.predChromaDC(plane, origin, img.CStride)
+		}
+	}
+}
+
+// neighbourSamples returns p[-1..size-1, -1] and p[-1, 0..size-1] of the
+// current macroblock, and whether the left and top samples are available.
+func (s *h264SliceDecoder) neighbourSamples(plane []byte, origin, stride, size int) (top, left []int32, leftAvailable, topAvailable bool) {
+	top = make([]int32, size+1)
+	left = make([]int32, size)
+	for i := range top {
+		top[i] = unavailableSample
+	}
+	for i := range left {
+		left[i] = unavailableSample
+	}
+	if s.neighbourMB(-1, -1, true) != nil {
+		top[0] = int32(plane[origin-stride-1])
+	}
+	if s.neighbourMB(0, -1, true) != nil {
+		topAvailable = true
+		for i := 0; i < size; i++ {
+			top[i+1] = int32(plane[origin-stride+i])
+		}
+	}
+	if s.neighbourMB(-1, 0, true) != nil {
+		leftAvailable = true
+		for i := 0; i < size; i++ {
+			left[i] = int32(plane[origin+i*stride-1])
+		}
+	}
+	return top, left, leftAvailable, topAvailable
+}
+
+// predIntraBlock writes the Intra_16x16 prediction of a luma macroblock or the
+// vertical, horizontal or plane prediction of a chroma macroblock.
+func (s *h264SliceDecoder) predIntraBlock(plane []byte, origin, stride, size, mode int) {
+	top, left, leftAvailable, topAvailable := s.neighbourSamples(plane, origin, stride, size)
+
+	var dc, a, b, c int32
+	switch mode {
+	case intra16x16DC:
+		var sumTop, sumLeft int32
+		for i := 0; i < size; i++ {
+			sumTop += top[i+1]
+			sumLeft += left[i]
+		}
+		switch {
+		case leftAvailable && topAvailable:
+			dc = (sumTop + sumLeft + 16) >> 5
+		case leftAvailable:
+			dc = (sumLeft + 8) >> 4
+		case topAvailable:
+			dc = (sumTop + 8) >> 4
+		default:
+			dc = 128
+		}
+	case intra16x16Plane:
+		// top[x+1] is p[x, -1], p[-1, -1] being both top[0] and left[-1]
+		pl := func(y int) int32 {
+			if y < 0 {
+				return top[0]
+			}
+			return left[y]
+		}
+		n := size / 2
+		var h, v int32
+		for i := 0; i < n; i++ {
+			h += int32(i+1) * (top[n+i+1] - top[n-1-i])
+			v += int32(i+1) * (pl(n+i) - pl(n-2-i))
+		}
+		a = 16 * (left[size-1] + top[size])
+		if size == 16 {
+			b, c = (5*h+32)>>6, (5*v+32)>>6
+		} else {
+			b, c = (34*h+32)>>6, (34*v+32)>>6
+		}
+	}
+
+	for y := 0; y < size; y++ {
+		row := plane[origin+y*stride : origin+y*stride+size]
+		for x := range row {
+			switch mode {
+			case intra16x16Vertical:
+				row[x] = byte(top[x+1])
+			case intra16x16Horizontal:
+				row[x] = byte(left[y])
+			case intra16x16DC:
+				row[x] = byte(dc)
+			case intra16x16Plane:
+				row[x] = clip1((a + b*int32(x-size/2+1) + c*int32(y-size/2+1) + 16) >> 5)
+			}
+		}
+	}
+}
+
+// predChromaDC writes the DC prediction of the 4x4 blocks of a chroma
+// macroblock.
+// See 8.3.4.1 Specification of Intra_Chroma_DC prediction mode
+func (s *h264SliceDecoder) predChromaDC(plane []byte, origin, stride int) {
+	top, left, leftAvailable, topAvailable := s.neighbourSamples(plane, origin, stride, 8)
+	for blk := 0; blk < 4; blk++ {
+		xO, yO := blk%2*4, blk/2*4
+		var sumTop, sumLeft int32
+		for i := 0; i < 4; i++ {
+			sumTop += top[xO+i+1]
+			sumLeft += left[yO+i]
+		}
+		useLeft, useTop := leftAvailable, topAvailable
+		switch {
+		case xO == 4 && yO == 0 && topAvailable:
+			useLeft = false
+		case xO == 0 && yO == 4 && leftAvailable:
+			useTop = false
+		}
+		dc := int32(128)
+		switch {
+		case useLeft && useTop:
+			dc = (sumTop + sumLeft + 4) >> 3
+		case useLeft:
+			dc = (sumLeft + 2) >> 2
+		case useTop:
+			dc = (sumTop + 2) >> 2
+		}
+		for y := 0; y < 4; y++ {
+			row := plane[origin+(yO+y)*stride+xO:]
+			for x := 0; x < 4; x++ {
+				row[x] = byte(dc)
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package datamosh
+
+import "sort"
+
+// Reference marking of the decoded pictures.
+const (
+	unusedForReference = iota
+	shortTermReference
+	longTermReference
+)
+
+// maxFrameNum returns MaxFrameNum.
+func (s *H264SPS) maxFrameNum() int {
+	return 1 << (s.Log2MaxFrameNumMinus4 + 4)
+}
+
+// picNum returns PicNum of a short-term reference picture, FrameNumWrap for
+// frames, when decoding a picture with the given frame_num.
+// See 8.2.4.1 Decoding process for picture numbers
+func (p *h264Picture) picNum(frameNum uint32, maxFrameNum int) int {
+	if p.frameNum > frameNum {
+		return int(p.frameNum) - maxFrameNum
+	}
+	return int(p.frameNum)
+}
+
+// refPicList0 returns RefPicList0 of a P slice. Entries missing from a
+// damaged or moshed stream are nil.
+// See 8.2.4 Decoding process for reference picture lists construction
+func (d *H264Decoder) refPicList0(h *H264SliceHeader) []*h264Picture {
+	maxFrameNum := h.sps.maxFrameNum()
+	var short, long []*h264Picture
+	for _, p := range d.dpb {
+		switch p.ref {
+		case shortTermReference:
+			short = append(short, p)
+		case longTermReference:
+			long = append(long, p)
+		}
+	}
+	// 8.2.4.2.1 Initialisation process for the reference picture list for P
+	// and SP slices in frames
+	sort.SliceStable(short, func(i, j int) bool {
+		return short[i].picNum(h.FrameNum, maxFrameNum) > short[j].picNum(h.FrameNum, maxFrameNum)
+	})
+	sort.SliceStable(long, func(i, j int) bool {
+		return long[i].longTermFrameIdx < long[j].longTermFrameIdx
+	})
+
+	n := int(h.NumRefIdxL0ActiveMinus1) + 1
+	list := make([]*h264Picture, n)
+	copy(list, append(short, long...))
+
+	// 8.2.4.3 Modification process for reference picture lists
+	picNumPred := int(h.FrameNum)
+	for refIdx, mod := range h.RefPicListModificationL0 {
+		if refIdx >= n {
+			break
+		}
+		var pic *h264Picture
+		switch mod.ModificationOfPicNumsIDC {
+		case 0, 1:
+			diff := int(mod.AbsDiffPicNumMinus1) + 1
+			if mod.ModificationOfPicNumsIDC == 0 {
+				diff = -diff
+			}
+			picNumNoWrap := (picNumPred + diff + maxFrameNum) % maxFrameNum
+			picNumPred = picNumNoWrap
+			picNum := picNumNoWrap
+			if picNum > int(h.FrameNum) {
+				picNum -= maxFrameNum
+			}
+			for _, p := range short {
+				if p.picNum(h.FrameNum, maxFrameNum) == picNum {
+					pic = p
+				}
+			}
+		case 2:
+			for _, p := range long {
+				if p.longTermFrameIdx == mod.LongTermPicNum {
+					pic = p
+				}
+			}
+		default:
+			continue
+		}
+
+		// insert the picture at refIdx and remove its other occurrence
+		list = append(list[:refIdx], append([]*h264Picture{pic}, list[refIdx:]...)...)
+		next := refIdx + 1
+		for _, p := range list[refIdx+1:] {
+			if p == nil || p != pic {
+				list[next] = p
+				next++
+			}
+		}
+		list = list[:n]
+	}
+	return list
+}
+
+// markReference marks a decoded picture as a reference picture when it is
+// one, and drops the pictures no longer used for reference.
+// See 8.2.5 Decoded reference picture marking process
+func (d *H264Decoder) markReference(pic *h264Picture) {
+	h := pic.slices[0]
+	if h.NalRefIdc == 0 {
+		return
+	}
+	if h.IsIDR() {
+		for _, p := range d.dpb {
+			p.ref = unusedForReference
+		}
+		pic.ref = shortTermReference
+		d.maxLongTermFrameIdx = -1
+		if h.LongTermReference {
+			pic.ref = longTermReference
+			pic.longTermFrameIdx = 0
+			d.maxLongTermFrameIdx = 0
+		}
+	} else {
+		if h.AdaptiveRefPicMarking {
+			d.applyMMCOs(pic, h)
+		}
+		if pic.ref != longTermReference {
+			pic.ref = shortTermReference
+		}
+	}
+
+	// 8.2.5.3 Sliding window decoded reference picture marking process, also
+	// applied after memory management operations so broken streams can't
+	// grow the list of reference pictures
+	maxRefs := int(pic.sps.MaxNumRefFrames)
+	if maxRefs < 1 {
+		maxRefs = 1
+	}
+	refs := d.dpb[:0]
+	for _, p := range d.dpb {
+		if p.ref != unusedForReference {
+			refs = append(refs, p)
+		}
+	}
+	maxFrameNum := pic.sps.maxFrameNum()
+	for len(refs) >= maxRefs {
+		oldest := -1
+		for i, p := range refs {
+			if p.ref == shortTermReference && (oldest < 0 || p.picNum(pic.frameNum, maxFrameNum) < refs[oldest].picNum(pic.frameNum, maxFrameNum)) {
+				oldest = i
+			}
+		}
+		if oldest < 0 {
+			// only long-term pictures left
+			oldest = 0
+		}
+		refs[oldest].ref = unusedForReference
+		refs = append(refs[:oldest], refs[oldest+1:]...)
+	}
+	d.dpb = append(refs, pic)
+}
+
+// applyMMCOs applies the memory management control operations of the slice
+// header of a picture.
+// See 8.2.5.4 Adaptive memory control decoded reference picture marking process
+func (d *H264Decoder) applyMMCOs(pic *h264Picture, h *H264SliceHeader) {
+	maxFrameNum := pic.sps.maxFrameNum()
+	shortTerm := func(op H264MMCO) *h264Picture {
+		picNumX := int(h.FrameNum) - int(op.DifferenceOfPicNumsMinus1+1)
+		for _, p := range d.dpb {
+			if p.ref == shortTermReference && p.picNum(h.FrameNum, maxFrameNum) == picNumX {
+				return p
+			}
+		}
+		return nil
+	}
+	unmarkLongTerm := func(keep func(idx uint32) bool) {
+		for _, p := range d.dpb {
+			if p.ref == longTermReference && !keep(p.longTermFrameIdx) {
+				p.ref = unusedForReference
+			}
+		}
+	}
+
+	for _, op := range h.MMCOs {
+		switch op.Operation {
+		case 1:
+			if p := shortTerm(op); p != nil {
+				p.ref = unusedForReference
+			}
+		case 2:
+			unmarkLongTerm(func(idx uint32) bool { return idx != op.LongTermPicNum })
+		case 3:
+			p := shortTerm(op)
+			if p == nil {
+				continue
+			}
+			unmarkLongTerm(func(idx uint32) bool { return idx != op.LongTermFrameIdx })
+			p.ref = longTermReference
+			p.longTermFrameIdx = op.LongTermFrameIdx
+		case 4:
+			d.maxLongTermFrameIdx = int(op.MaxLongTermFrameIdxPlus1) - 1
+			unmarkLongTerm(func(idx uint32) bool { return int(idx) <= d.maxLongTermFrameIdx })
+		case 5:
+			for _, p := range d.dpb {
+				p.ref = unusedForReference
+			}
+			d.maxLongTermFrameIdx = -1
+			// the picture is inferred to have had frame_num 0
+			pic.frameNum = 0
+		case 6:
+			unmarkLongTerm(func(idx uint32) bool { return idx != op.LongTermFrameIdx })
+			pic.ref = longTermReference
+			pic.longTermFrameIdx = op.LongTermFrameIdx
+		}
+	}
+}
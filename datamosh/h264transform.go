@@ -0,0 +1,393 @@
+package datamosh
+
+// zigzag4x4 maps the coefficients of a 4x4 block in zig-zag scanning order to
+// their raster position.
+// See 8.5.6 Inverse scanning process for 4x4 transform coefficients and scaling lists
+var zigzag4x4 = [16]int{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+
+// normAdjust4x4 holds v, the scaling factors of the 4x4 transform for
+// qP % 6 and the position classes of the coefficients.
+// See 8.5.9 Derivation process for scaling functions
+var normAdjust4x4 = [6][3]int32{
+	{10, 16, 13},
+	{11, 18, 14},
+	{13, 20, 16},
+	{14, 23, 18},
+	{16, 25, 20},
+	{18, 29, 23},
+}
+
+// levelScale4x4 is LevelScale4x4 with flat scaling matrices, indexed by
+// qP % 6 and the raster position of the coefficient.
+var levelScale4x4 [6][16]int32
+
+func init() {
+	for m := range levelScale4x4 {
+		for i := 0; i < 16; i++ {
+			row, col := i/4, i%4
+			switch {
+			case row%2 == 0 && col%2 == 0:
+				levelScale4x4[m][i] = 16 * normAdjust4x4[m][0]
+			case row%2 == 1 && col%2 == 1:
+				levelScale4x4[m][i] = 16 * normAdjust4x4[m][1]
+			default:
+				levelScale4x4[m][i] = 16 * normAdjust4x4[m][2]
+			}
+		}
+	}
+}
+
+// zigzag8x8 maps the coefficients of an 8x8 block in zig-zag scanning order to
+// their raster position.
+// See 8.5.7 Inverse scanning process for 8x8 transform coefficients and scaling lists
+var zigzag8x8 = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10, 17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34, 27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36, 29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46, 53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// normAdjust8x8 holds v, the scaling factors of the 8x8 transform for qP % 6
+// and the position classes of the coefficients.
+// See 8.5.9 Derivation process for scaling functions
+var normAdjust8x8 = [6][6]int32{
+	{20, 18, 32, 19, 25, 24},
+	{22, 19, 35, 21, 28, 26},
+	{26, 23, 42, 24, 33, 31},
+	{28, 25, 45, 26, 35, 33},
+	{32, 28, 51, 30, 40, 38},
+	{36, 32, 58, 34, 46, 43},
+}
+
+// levelScale8x8 is LevelScale8x8 with flat scaling matrices, indexed by
+// qP % 6 and the raster position of the coefficient.
+var levelScale8x8 [6][64]int32
+
+func init() {
+	for m := range levelScale8x8 {
+		for i := 0; i < 64; i++ {
+			row, col := i/8, i%8
+			var class int
+			switch {
+			case row%4 == 0 && col%4 == 0:
+				class = 0
+			case row%2 == 1 && col%2 == 1:
+				class = 1
+			case row%4 == 2 && col%4 == 2:
+				class = 2
+			case (row%4 == 0 && col%2 == 1) || (row%2 == 1 && col%4 == 0):
+				class = 3
+			case (row%4 == 0 && col%4 == 2) || (row%4 == 2 && col%4 == 0):
+				class = 4
+			default:
+				class = 5
+			}
+			levelScale8x8[m][i] = 16 * normAdjust8x8[m][class]
+		}
+	}
+}
+
+// QPc as a function of qPI, for qPI >= 30.
+// See Table 8-15
+var chromaQPTable = [22]int{29, 30, 31, 32, 32, 33, 34, 34, 35, 35, 36, 36, 37, 37, 37, 38, 38, 38, 39, 39, 39, 39}
+
+// chromaQP returns the chroma quantization parameter for a luma QP.
+// See 8.5.8 Derivation process for chroma quantisation parameters
+func chromaQP(qp int, offset int32) int {
+	qpi := qp + int(offset)
+	if qpi < 0 {
+		qpi = 0
+	} else if qpi > 51 {
+		qpi = 51
+	}
+	if qpi < 30 {
+		return qpi
+	}
+	return chromaQPTable[qpi-30]
+}
+
+// lumaDCDequant transforms and scales the DC coefficients of an Intra_16x16
+// macroblock, given in zig-zag scanning order. It returns dcY in raster
+// order, the DC of the luma block at (x, y) is dcY[y*4+x].
+// See 8.5.10 Scaling and transformation process for DC transform coefficients for Intra_16x16 macroblock type
+func lumaDCDequant(levels *[16]int32, qp int) [16]int32 {
+	var c, f [16]int32
+	for i, level := range levels {
+		c[zigzag4x4[i]] = level
+	}
+	// f = A * c * A with the 4x4 Hadamard matrix A
+	var t [16]int32
+	for i := 0; i < 4; i++ {
+		hadamard4(c[i*4:], t[i*4:], 1)
+	}
+	for j := 0; j < 4; j++ {
+		hadamard4(t[j:], f[j:], 4)
+	}
+
+	scale := levelScale4x4[qp%6][0]
+	var dcY [16]int32
+	for i, v := range f {
+		if qp >= 36 {
+			dcY[i] = (v * scale) << uint(qp/6-6)
+		} else {
+			dcY[i] = (v*scale + 1<<uint(5-qp/6)) >> uint(6-qp/6)
+		}
+	}
+	return dcY
+}
+
+// hadamard4 applies the 4 point Hadamard transform to the values of in at
+// 0, step, 2*step and 3*step.
+func hadamard4(in, out []int32, step int) {
+	a, b, c, d := in[0], in[step], in[2*step], in[3*step]
+	out[0] = a + b + c + d
+	out[step] = a + b - c - d
+	out[2*step] = a - b - c + d
+	out[3*step] = a - b + c - d
+}
+
+// chromaDCDequant transforms and scales the DC coefficients of a 4:2:0 chroma
+// component. It returns dcC in raster order.
+// See 8.5.11.2 Transformation process for chroma DC transform coefficients
+func chromaDCDequant(levels *[4]int32, qpc int) [4]int32 {
+	c := levels
+	f := [4]int32{
+		c[0] + c[1] + c[2] + c[3],
+		c[0] - c[1] + c[2] - c[3],
+		c[0] + c[1] - c[2] - c[3],
+		c[0] - c[1] - c[2] + c[3],
+	}
+	scale := levelScale4x4[qpc%6][0]
+	var dcC [4]int32
+	for i, v := range f {
+		dcC[i] = ((v * scale) << uint(qpc/6)) >> 5
+	}
+	return dcC
+}
+
+// addResidual4x4 scales the coefficients of a 4x4 block, given in zig-zag
+// scanning order, and adds their inverse transform to the samples at
+// dst[0:], dst[stride:]... With dcScaled set the first coefficient is an
+// already scaled DC value, as for Intra_16x16 and chroma blocks.
+// See 8.5.12 Scaling and transformation process for residual 4x4 blocks
+func addResidual4x4(dst []byte, stride int, levels *[16]int32, qp int, dcScaled bool) {
+	var d [16]int32
+	scale := &levelScale4x4[qp%6]
+	for i, level := range levels {
+		if level == 0 {
+			continue
+		}
+		pos := zigzag4x4[i]
+		if i == 0 && dcScaled {
+			d[pos] = level
+			continue
+		}
+		// with flat scaling matrices the rounding of qP < 24 never applies
+		d[pos] = (level * scale[pos]) << uint(qp/6) >> 4
+	}
+
+	// 8.5.12.2 Transformation process for residual 4x4 blocks, rows then columns
+	var f [16]int32
+	for i := 0; i < 4; i++ {
+		row := d[i*4 : i*4+4]
+		e0, e1 := row[0]+row[2], row[0]-row[2]
+		e2, e3 := (row[1]>>1)-row[3], row[1]+(row[3]>>1)
+		f[i*4], f[i*4+1], f[i*4+2], f[i*4+3] = e0+e3, e1+e2, e1-e2, e0-e3
+	}
+	for j := 0; j < 4; j++ {
+		g0, g1 := f[j]+f[8+j], f[j]-f[8+j]
+		g2, g3 := (f[4+j]>>1)-f[12+j], f[4+j]+(f[12+j]>>1)
+		h := [4]int32{g0 + g3, g1 + g2, g1 - g2, g0 - g3}
+		for i := 0; i < 4; i++ {
+			p := dst[i*stride+j:]
+			p[0] = clip1(int32(p[0]) + (h[i]+32)>>6)
+		}
+	}
+}
+
+// addResidual8x8 scales the coefficients of an 8x8 luma block, given in
+// zig-zag scanning order, and adds their inverse transform to the samples at
+// dst[0:], dst[stride:]...
+// See 8.5.13 Scaling and transformation process for residual 8x8 blocks
+func addResidual8x8(dst []byte, stride int, levels *[64]int32, qp int) {
+	var d [64]int32
+	scale := &levelScale8x8[qp%6]
+	for i, level := range levels {
+		if level == 0 {
+			continue
+		}
+		pos := zigzag8x8[i]
+		if qp >= 36 {
+			d[pos] = (level * scale[pos]) << uint(qp/6-6)
+		} else {
+			d[pos] = (level*scale[pos] + 1<<uint(5-qp/6)) >> uint(6-qp/6)
+		}
+	}
+
+	// 8.5.13.2 Transformation process for residual 8x8 blocks, rows then
+	// columns
+	var f [64]int32
+	for i := 0; i < 8; i++ {
+		idct8(d[i*8:], f[i*8:], 1)
+	}
+	var h [64]int32
+	for j := 0; j < 8; j++ {
+		idct8(f[j:], h[j:], 8)
+	}
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			p := dst[i*stride+j:]
+			p[0] = clip1(int32(p[0]) + (h[i*8+j]+32)>>6)
+		}
+	}
+}
+
+// idct8 applies the 8 point inverse transform to the values of in at 0,
+// step... 7*step.
+func idct8(in, out []int32, step int) {
+	var d [8]int32
+	for i := range d {
+		d[i] = in[i*step]
+	}
+	a0, a4 := d[0]+d[4], d[0]-d[4]
+	a2, a6 := (d[2]>>1)-d[6], d[2]+(d[6]>>1)
+	b0, b2, b4, b6 := a0+a6, a4+a2, a4-a2, a0-a6
+	a1 := -d[3] + d[5] - d[7] - (d[7] >> 1)
+	a3 := d[1] + d[7] - d[3] - (d[3] >> 1)
+	a5 := -d[1] + d[7] + d[5] + (d[5] >> 1)
+	a7 := d[3] + d[5] + d[1] + (d[1] >> 1)
+	b1, b7 := a1+(a7>>2), a7-(a1>>2)
+	b3, b5 := a3+(a5>>2), (a3>>2)-a5
+	for i, v := range [8]int32{b0 + b7, b2 + b5, b4 + b3, b6 + b1, b6 - b1, b4 - b3, b2 - b5, b0 - b7} {
+		out[i*step] = v
+	}
+}
+
+// quantMF holds the multiplication factors of the quantization of the 4x4
+// transform coefficients for qP % 6 and the position classes of
+// normAdjust4x4, 2^15 / (v * scaling of the forward transform).
+var quantMF = [6][3]int32{
+	{13107, 5243, 8066},
+	{11916, 4660, 7490},
+	{10082, 4194, 6554},
+	{9362, 3647, 5825},
+	{8192, 3355, 5243},
+	{7282, 2893, 4559},
+}
+
+// quantMF4x4 is quantMF indexed by qP % 6 and the raster position of the
+// coefficient.
+var quantMF4x4 [6][16]int32
+
+func init() {
+	for m := range quantMF4x4 {
+		for i := 0; i < 16; i++ {
+			row, col := i/4, i%4
+			switch {
+			case row%2 == 0 && col%2 == 0:
+				quantMF4x4[m][i] = quantMF[m][0]
+			case row%2 == 1 && col%2 == 1:
+				quantMF4x4[m][i] = quantMF[m][1]
+			default:
+				quantMF4x4[m][i] = quantMF[m][2]
+			}
+		}
+	}
+}
+
+// forward4x4 returns the forward core transform of the differences between
+// the samples of a 4x4 block of src and of its prediction pred, both at
+// offset with the given stride. The coefficients are in raster order.
+func forward4x4(src, pred []byte, offset, stride int) [16]int32 {
+	var d, t [16]int32
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			p := offset + i*stride + j
+			d[i*4+j] = int32(src[p]) - int32(pred[p])
+		}
+	}
+	// rows then columns, with the matrix of the inverse transform transposed
+	for i := 0; i < 4; i++ {
+		r := d[i*4 : i*4+4]
+		s03, d03 := r[0]+r[3], r[0]-r[3]
+		s12, d12 := r[1]+r[2], r[1]-r[2]
+		t[i*4], t[i*4+1], t[i*4+2], t[i*4+3] = s03+s12, 2*d03+d12, s03-s12, d03-2*d12
+	}
+	var c [16]int32
+	for j := 0; j < 4; j++ {
+		s03, d03 := t[j]+t[12+j], t[j]-t[12+j]
+		s12, d12 := t[4+j]+t[8+j], t[4+j]-t[8+j]
+		c[j], c[4+j], c[8+j], c[12+j] = s03+s12, 2*d03+d12, s03-s12, d03-2*d12
+	}
+	return c
+}
+
+// quantize returns the level of a transform coefficient for the
+// multiplication factor mf, dividing by 2^qbits with the rounding offset of
+// intra macroblocks.
+func quantize(coeff, mf int32, qbits uint) int32 {
+	level := int32((int64(abs32(coeff))*int64(mf) + (1<<qbits)/3) >> qbits)
+	if level > maxCAVLCLevel {
+		level = maxCAVLCLevel
+	}
+	if coeff < 0 {
+		return -level
+	}
+	return level
+}
+
+// quantize4x4 quantizes the coefficients of a 4x4 block, in raster order, to
+// levels in zig-zag scanning order. The first levels up to start are left to
+// zero, start being 1 for the blocks whose DC is coded apart. It returns the
+// number of non-zero levels.
+func quantize4x4(levels *[16]int32, coeffs *[16]int32, qp, start int) int {
+	mf := &quantMF4x4[qp%6]
+	n := 0
+	for i := range levels {
+		levels[i] = 0
+		if i < start {
+			continue
+		}
+		pos := zigzag4x4[i]
+		levels[i] = quantize(coeffs[pos], mf[pos], uint(15+qp/6))
+		if levels[i] != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// lumaDCQuant transforms and quantizes the DC coefficients of the blocks of
+// an Intra_16x16 macroblock, given in raster order, reverting lumaDCDequant.
+// The levels are in zig-zag scanning order.
+func lumaDCQuant(dc *[16]int32, qp int) [16]int32 {
+	var t, f [16]int32
+	for i := 0; i < 4; i++ {
+		hadamard4(dc[i*4:], t[i*4:], 1)
+	}
+	for j := 0; j < 4; j++ {
+		hadamard4(t[j:], f[j:], 4)
+	}
+	var levels [16]int32
+	for i := range levels {
+		levels[i] = quantize(f[zigzag4x4[i]]/2, quantMF[qp%6][0], uint(16+qp/6))
+	}
+	return levels
+}
+
+// chromaDCQuant transforms and quantizes the DC coefficients of the blocks of
+// a 4:2:0 chroma component, reverting chromaDCDequant.
+func chromaDCQuant(dc *[4]int32, qpc int) [4]int32 {
+	c := dc
+	f := [4]int32{
+		c[0] + c[1] + c[2] + c[3],
+		c[0] - c[1] + c[2] - c[3],
+		c[0] + c[1] - c[2] - c[3],
+		c[0] - c[1] - c[2] + c[3],
+	}
+	var levels [4]int32
+	for i, v := range f {
+		levels[i] = quantize(v, quantMF[qpc%6][0], uint(16+qpc/6))
+	}
+	return levels
+}
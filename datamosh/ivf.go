@@ -0,0 +1,222 @@
+package datamosh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abema/go-mp4"
+)
+
+const (
+	ivfHeaderSize      = 32
+	ivfFrameHeaderSize = 12
+)
+
+// IVFHeader represents the file header of an IVF file.
+type IVFHeader struct {
+	FourCC      [4]byte
+	Width       uint16
+	Height      uint16
+	TimebaseDen uint32 // frame rate
+	TimebaseNum uint32 // time scale
+	FrameCount  uint32
+}
+
+// ParseIVF reads an IVF file and returns its header and its frames as a track.
+// Every frame is stored as its own chunk, timestamps use TimebaseDen as the
+// track timescale.
+func ParseIVF(r io.ReadSeeker) (*IVFHeader, *Track, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	buf := make([]byte, ivfHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, fmt.Errorf("failed to read the IVF header: %v", err)
+	}
+	if string(buf[0:4]) != "DKIF" {
+		return nil, nil, errors.New("not an IVF file")
+	}
+	headerSize := binary.LittleEndian.Uint16(buf[6:8])
+	if headerSize < ivfHeaderSize {
+		return nil, nil, fmt.Errorf("invalid IVF header size: %d", headerSize)
+	}
+
+	header := &IVFHeader{
+		Width:       binary.LittleEndian.Uint16(buf[12:14]),
+		Height:      binary.LittleEndian.Uint16(buf[14:16]),
+		TimebaseDen: binary.LittleEndian.Uint32(buf[16:20]),
+		TimebaseNum: binary.LittleEndian.Uint32(buf[20:24]),
+		FrameCount:  binary.LittleEndian.Uint32(buf[24:28]),
+	}
+	copy(header.FourCC[:], buf[8:12])
+	if header.TimebaseNum == 0 {
+		header.TimebaseNum = 1
+	}
+
+	track := &Track{
+		TrackID:   1,
+		Timescale: header.TimebaseDen,
+		Handler:   handlerVideo,
+		Chunks:    mp4.Chunks{},
+		Samples:   mp4.Samples{},
+	}
+
+	offset := int64(headerSize)
+	var pts []uint64
+	frameHeader := make([]byte, ivfFrameHeaderSize)
+	for {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		if _, err := io.ReadFull(r, frameHeader); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, fmt.Errorf("failed to read IVF frame header: %v", err)
+		}
+		size := binary.LittleEndian.Uint32(frameHeader[0:4])
+		pts = append(pts, binary.LittleEndian.Uint64(frameHeader[4:12])*uint64(header.TimebaseNum))
+		track.Chunks = append(track.Chunks, &mp4.Chunk{
+			DataOffset:      uint64(offset) + ivfFrameHeaderSize,
+			SamplesPerChunk: 1,
+		})
+		track.Samples = append(track.Samples, &mp4.Sample{Size: size})
+		offset += ivfFrameHeaderSize + int64(size)
+	}
+
+	track.setSampleTimes(pts)
+	if len(track.Samples) == 1 {
+		track.Samples[0].TimeDelta = header.TimebaseNum
+		track.Duration = uint64(header.TimebaseNum)
+	}
+
+	var err error
+	switch header.FourCC {
+	case fourCCAV1:
+		err = processAV1Stream(r, track)
+	case fourCCVP8, fourCCVP9:
+		track.VPX = &VPXConfig{
+			FourCC:   header.FourCC,
+			Width:    header.Width,
+			Height:   header.Height,
+			BitDepth: 8,
+		}
+		track.VPXFrames, err = processVPXTrack(r, track)
+	}
+	if err != nil {
+		return header, track, err
+	}
+
+	return header, track, nil
+}
+
+// processAV1Stream configures a track read from a raw stream using the first
+// sequence header found in its samples, then splits the samples into OBUs.
+func processAV1Stream(r io.ReadSeeker, track *Track) error {
+	offsets := track.sampleOffsets()
+	for si, sample := range track.Samples {
+		if _, err := r.Seek(int64(offsets[si]), io.SeekStart); err != nil {
+			return err
+		}
+		data := make([]byte, sample.Size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		for pos := 0; pos < len(data); {
+			obu, err := parseOBUHeader(data[pos:])
+			if err != nil {
+				return fmt.Errorf("sample %d: %v", si, err)
+			}
+			end := pos + int(obu.HeaderSize+obu.Length)
+			if obu.Type == OBU_SEQUENCE_HEADER {
+				sh, err := ParseAV1SequenceHeader(data[pos+int(obu.HeaderSize) : end])
+				if err != nil {
+					return fmt.Errorf("failed to parse sequence header: %v", err)
+				}
+				track.AV1 = newAV1ConfigFromSequenceHeader(sh, data[pos:end])
+				break
+			}
+			pos = end
+		}
+		if track.AV1 != nil {
+			break
+		}
+	}
+	if track.AV1 == nil {
+		return errors.New("no AV1 sequence header found")
+	}
+
+	var err error
+	track.OBUs, err = processAV1Track(r, track)
+	return err
+}
+
+// WriteIVF writes an IVF file with the given samples of the track read from r,
+// in the given order. Samples can be repeated or omitted, timestamps are
+// rebuilt from the sample durations.
+func WriteIVF(w io.Writer, r io.ReadSeeker, header *IVFHeader, track *Track, samples []uint32) error {
+	timebaseNum := header.TimebaseNum
+	if timebaseNum == 0 {
+		timebaseNum = 1
+	}
+
+	buf := make([]byte, ivfHeaderSize)
+	copy(buf[0:4], "DKIF")
+	binary.LittleEndian.PutUint16(buf[4:6], 0)
+	binary.LittleEndian.PutUint16(buf[6:8], ivfHeaderSize)
+	copy(buf[8:12], header.FourCC[:])
+	binary.LittleEndian.PutUint16(buf[12:14], header.Width)
+	binary.LittleEndian.PutUint16(buf[14:16], header.Height)
+	binary.LittleEndian.PutUint32(buf[16:20], header.TimebaseDen)
+	binary.LittleEndian.PutUint32(buf[20:24], timebaseNum)
+	binary.LittleEndian.PutUint32(buf[24:28], uint32(len(samples)))
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("failed to write the IVF header: %v", err)
+	}
+
+	offsets := track.sampleOffsets()
+	frameHeader := make([]byte, ivfFrameHeaderSize)
+	var currentTime uint64
+	for _, id := range samples {
+		if int(id) >= len(track.Samples) {
+			return fmt.Errorf("sample %d out of range", id)
+		}
+		sample := track.Samples[id]
+		binary.LittleEndian.PutUint32(frameHeader[0:4], sample.Size)
+		binary.LittleEndian.PutUint64(frameHeader[4:12], currentTime/uint64(timebaseNum))
+		if _, err := w.Write(frameHeader); err != nil {
+			return fmt.Errorf("failed to write IVF frame header: %v", err)
+		}
+		if _, err := r.Seek(int64(offsets[id]), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, int64(sample.Size)); err != nil {
+			return fmt.Errorf("failed to copy sample %d: %v", id, err)
+		}
+		currentTime += uint64(sample.TimeDelta)
+	}
+
+	return nil
+}
+
+// NewIVFHeader returns the IVF header matching an AV1, VP8 or VP9 track.
+func NewIVFHeader(track *Track) (*IVFHeader, error) {
+	header := &IVFHeader{
+		TimebaseDen: track.Timescale,
+		TimebaseNum: 1,
+		FrameCount:  uint32(len(track.Samples)),
+	}
+	switch {
+	case track.AV1 != nil:
+		header.FourCC = fourCCAV1
+		header.Width, header.Height = track.AV1.Width, track.AV1.Height
+	case track.VPX != nil:
+		header.FourCC = track.VPX.FourCC
+		header.Width, header.Height = track.VPX.Width, track.VPX.Height
+	default:
+		return nil, errors.New("IVF only supports AV1, VP8 and VP9 tracks")
+	}
+	return header, nil
+}
@@ -0,0 +1,370 @@
+package datamosh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/abema/go-mp4"
+)
+
+// Matroska element ids only used by the muxer.
+const (
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42F7
+	ebmlIDMaxIDLength        = 0x42F2
+	ebmlIDMaxSizeLength      = 0x42F3
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+	mkvIDMuxingApp           = 0x4D80
+	mkvIDWritingApp          = 0x5741
+	mkvIDFlagLacing          = 0x9C
+	mkvIDCuePoint            = 0xBB
+	mkvIDCueTime             = 0xB3
+	mkvIDCueTrackPositions   = 0xB7
+	mkvIDCueTrack            = 0xF7
+	mkvIDCueClusterPosition  = 0xF1
+	mkvAppName               = "moshing-vfx"
+	mkvClusterDuration       = 1000 // in ms, clusters start on video key frames
+)
+
+// MKVMuxer writes Matroska files, or WebM files when WebM is set.
+type MKVMuxer struct {
+	WebM bool
+}
+
+// Supports returns true for H.264, AV1, VP8, VP9 and AAC tracks as well as for
+// tracks read from WebM/Matroska files. WebM files only hold AV1, VP8, VP9,
+// Opus and Vorbis tracks.
+func (m *MKVMuxer) Supports(track *Track) bool {
+	codecID, _, err := mkvCodec(track)
+	if err != nil {
+		return false
+	}
+	if m.WebM {
+		switch codecID {
+		case mkvCodecVP8, mkvCodecVP9, mkvCodecAV1, "A_OPUS", "A_VORBIS":
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+// mkvCodec returns the codec id and the codec private data of a track.
+func mkvCodec(track *Track) (string, []byte, error) {
+	switch {
+	case track.AVC != nil:
+		avcC := track.AVC.AVCDecoderConfiguration
+		avcC.Type = mp4.BoxTypeAvcC()
+		buf := &bytes.Buffer{}
+		if _, err := mp4.Marshal(buf, &avcC, mp4.Context{}); err != nil {
+			return "", nil, fmt.Errorf("failed to marshal avcC: %v", err)
+		}
+		return mkvCodecAVC, buf.Bytes(), nil
+	case track.AV1 != nil:
+		buf := &bytes.Buffer{}
+		if _, err := mp4.Marshal(buf, &track.AV1.Av1C, mp4.Context{}); err != nil {
+			return "", nil, fmt.Errorf("failed to marshal av1C: %v", err)
+		}
+		return mkvCodecAV1, buf.Bytes(), nil
+	case track.VPX != nil && track.VPX.IsVP9():
+		return mkvCodecVP9, nil, nil
+	case track.VPX != nil:
+		return mkvCodecVP8, nil, nil
+	case track.MP4A != nil && track.MP4A.OTI == objectTypeAAC:
+		return mkvCodecAAC, track.MP4A.DecoderSpecificInfo, nil
+	case track.WebM != nil && track.WebM.CodecID != "":
+		return track.WebM.CodecID, track.WebM.CodecPrivate, nil
+	}
+	return "", nil, fmt.Errorf("no Matroska codec id for track %d", track.TrackID)
+}
+
+// mkvBlock is a SimpleBlock to write.
+type mkvBlock struct {
+	track  int
+	sample muxSample
+	pts    int64 // in ms
+	dts    int64 // in ms
+}
+
+// mkvCluster is a run of blocks sharing a timecode.
+type mkvCluster struct {
+	timecode int64
+	blocks   []*mkvBlock
+	cue      *mkvBlock // video key frame to reference in the cues
+	offset   uint64    // from the start of the segment data
+	size     uint64    // of the cluster data
+}
+
+func (m *MKVMuxer) Mux(w io.Writer, r io.ReadSeeker, tracks []MuxTrack) error {
+	if len(tracks) == 0 {
+		return errors.New("no track to write")
+	}
+
+	trackEntries := [][]byte{}
+	blocks := []*mkvBlock{}
+	var duration int64
+	for i, t := range tracks {
+		if !m.Supports(t.Track) {
+			return fmt.Errorf("track %d can't be written to %s", t.Track.TrackID, m.format())
+		}
+		entry, err := m.trackEntry(uint64(i+1), t.Track)
+		if err != nil {
+			return err
+		}
+		trackEntries = append(trackEntries, entry)
+
+		samples, err := t.muxSamples()
+		if err != nil {
+			return err
+		}
+		timescale := int64(t.Track.Timescale)
+		if timescale == 0 {
+			timescale = 1
+		}
+		toMs := func(v int64) int64 { return (v*1000 + timescale/2) / timescale }
+		// presentation starts at 0 like with an edit list skipping the composition delay
+		var minPTS int64
+		for j, s := range samples {
+			if j == 0 || s.pts() < minPTS {
+				minPTS = s.pts()
+			}
+		}
+		for _, s := range samples {
+			block := &mkvBlock{
+				track:  i,
+				sample: s,
+				pts:    toMs(s.pts() - minPTS),
+				dts:    toMs(int64(s.dts)),
+			}
+			if block.pts < 0 {
+				block.pts = 0
+			}
+			if end := toMs(s.pts() - minPTS + int64(s.duration)); end > duration {
+				duration = end
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	// interleave the blocks of the tracks in decode order
+	sort.SliceStable(blocks, func(a, b int) bool { return blocks[a].dts < blocks[b].dts })
+
+	clusters := []*mkvCluster{}
+	var cluster *mkvCluster
+	var minPTS, maxPTS int64
+	for _, block := range blocks {
+		isVideoKey := block.sample.key && tracks[block.track].Track.IsVideo()
+		newCluster := cluster == nil ||
+			(isVideoKey && block.pts-cluster.blocks[0].pts >= mkvClusterDuration) ||
+			// block timecodes are 16 bit signed values relative to the cluster
+			block.pts-minPTS > math.MaxInt16 || maxPTS-block.pts > math.MaxInt16
+		if newCluster {
+			cluster = &mkvCluster{}
+			clusters = append(clusters, cluster)
+			minPTS, maxPTS = block.pts, block.pts
+		}
+		cluster.blocks = append(cluster.blocks, block)
+		if block.pts < minPTS {
+			minPTS = block.pts
+		}
+		if block.pts > maxPTS {
+			maxPTS = block.pts
+		}
+		cluster.timecode = minPTS
+		if isVideoKey && cluster.cue == nil {
+			cluster.cue = block
+		}
+	}
+
+	info := ebmlMaster(mkvIDInfo,
+		ebmlUint(mkvIDTimecodeScale, mkvDefaultTimecodeNs),
+		ebmlString(mkvIDMuxingApp, mkvAppName),
+		ebmlString(mkvIDWritingApp, mkvAppName),
+		ebmlFloat(mkvIDDuration, float64(duration)),
+	)
+	tracksData := ebmlMaster(mkvIDTracks, trackEntries...)
+
+	offset := uint64(len(info) + len(tracksData))
+	cuePoints := [][]byte{}
+	for _, cluster := range clusters {
+		cluster.offset = offset
+		cluster.size = uint64(len(ebmlUint(mkvIDTimecode, uint64(cluster.timecode))))
+		for _, block := range cluster.blocks {
+			cluster.size += uint64(len(mkvBlockHeader(block, cluster))) + uint64(block.sample.size)
+		}
+		offset += uint64(len(ebmlID(mkvIDCluster))+len(ebmlSize(cluster.size))) + cluster.size
+		if cluster.cue != nil {
+			cuePoints = append(cuePoints, ebmlMaster(mkvIDCuePoint,
+				ebmlUint(mkvIDCueTime, uint64(cluster.cue.pts)),
+				ebmlMaster(mkvIDCueTrackPositions,
+					ebmlUint(mkvIDCueTrack, uint64(cluster.cue.track+1)),
+					ebmlUint(mkvIDCueClusterPosition, cluster.offset),
+				),
+			))
+		}
+	}
+	var cues []byte
+	if len(cuePoints) > 0 {
+		cues = ebmlMaster(mkvIDCues, cuePoints...)
+	}
+	segmentSize := offset + uint64(len(cues))
+
+	docType := "matroska"
+	if m.WebM {
+		docType = "webm"
+	}
+	header := ebmlMaster(ebmlIDHeader,
+		ebmlUint(ebmlIDVersion, 1),
+		ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4),
+		ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlString(ebmlIDDocType, docType),
+		ebmlUint(ebmlIDDocTypeVersion, 4),
+		ebmlUint(ebmlIDDocTypeReadVersion, 2),
+	)
+	for _, data := range [][]byte{header, ebmlID(mkvIDSegment), ebmlSize(segmentSize), info, tracksData} {
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("failed to write the %s header: %v", m.format(), err)
+		}
+	}
+
+	for _, cluster := range clusters {
+		head := append(ebmlID(mkvIDCluster), ebmlSize(cluster.size)...)
+		head = append(head, ebmlUint(mkvIDTimecode, uint64(cluster.timecode))...)
+		if _, err := w.Write(head); err != nil {
+			return fmt.Errorf("failed to write cluster: %v", err)
+		}
+		for _, block := range cluster.blocks {
+			if _, err := w.Write(mkvBlockHeader(block, cluster)); err != nil {
+				return fmt.Errorf("failed to write block: %v", err)
+			}
+			if err := copySample(w, tracks[block.track].reader(r), block.sample); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := w.Write(cues); err != nil {
+		return fmt.Errorf("failed to write cues: %v", err)
+	}
+	return nil
+}
+
+func (m *MKVMuxer) format() string {
+	if m.WebM {
+		return "WebM"
+	}
+	return "Matroska"
+}
+
+func (m *MKVMuxer) trackEntry(number uint64, track *Track) ([]byte, error) {
+	codecID, codecPrivate, err := mkvCodec(track)
+	if err != nil {
+		return nil, err
+	}
+	children := [][]byte{
+		ebmlUint(mkvIDTrackNumber, number),
+		ebmlUint(mkvIDTrackUID, number),
+	}
+	switch {
+	case track.IsVideo():
+		children = append(children, ebmlUint(mkvIDTrackType, mkvTrackTypeVideo))
+	case track.IsAudio():
+		children = append(children, ebmlUint(mkvIDTrackType, mkvTrackTypeAudio))
+	case track.WebM != nil:
+		children = append(children, ebmlUint(mkvIDTrackType, track.WebM.TrackType))
+	}
+	children = append(children,
+		ebmlUint(mkvIDFlagLacing, 0),
+		ebmlString(mkvIDCodecID, codecID),
+	)
+	if len(codecPrivate) > 0 {
+		children = append(children, ebmlMaster(mkvIDCodecPrivate, codecPrivate))
+	}
+	if track.IsVideo() {
+		width, height := track.dimensions()
+		children = append(children, ebmlMaster(mkvIDVideo,
+			ebmlUint(mkvIDPixelWidth, uint64(width)),
+			ebmlUint(mkvIDPixelHeight, uint64(height)),
+		))
+	} else if track.WebM != nil && track.WebM.SamplingFreq > 0 {
+		children = append(children, ebmlMaster(mkvIDAudio,
+			ebmlFloat(mkvIDSamplingFreq, track.WebM.SamplingFreq),
+			ebmlUint(mkvIDChannels, track.WebM.Channels),
+		))
+	} else if track.MP4A != nil {
+		children = append(children, ebmlMaster(mkvIDAudio,
+			ebmlFloat(mkvIDSamplingFreq, float64(track.MP4A.SampleRate)),
+			ebmlUint(mkvIDChannels, uint64(track.MP4A.ChannelCount)),
+		))
+	}
+	return ebmlMaster(mkvIDTrackEntry, children...), nil
+}
+
+// mkvBlockHeader returns the SimpleBlock element header followed by the
+// block header, the frame data comes next.
+func mkvBlockHeader(block *mkvBlock, cluster *mkvCluster) []byte {
+	head := []byte{0x80 | byte(block.track+1), 0, 0, 0}
+	binary.BigEndian.PutUint16(head[1:3], uint16(int16(block.pts-cluster.timecode)))
+	if block.sample.key {
+		head[3] = mkvSimpleBlockKeyFlag
+	}
+	data := append(ebmlID(mkvIDSimpleBlock), ebmlSize(uint64(len(head))+uint64(block.sample.size))...)
+	return append(data, head...)
+}
+
+// ebmlID returns the bytes of an element id, length marker included.
+func ebmlID(id uint32) []byte {
+	data := []byte{}
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(data) > 0 {
+			data = append(data, b)
+		}
+	}
+	return data
+}
+
+// ebmlSize returns the shortest variable size integer holding size.
+func ebmlSize(size uint64) []byte {
+	length := 1
+	// all ones values are reserved for unknown sizes
+	for length < 8 && size >= 1<<(7*uint(length))-1 {
+		length++
+	}
+	data := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		data[i] = byte(size)
+		size >>= 8
+	}
+	data[0] |= 0x80 >> uint(length-1)
+	return data
+}
+
+func ebmlMaster(id uint32, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	element := append(ebmlID(id), ebmlSize(uint64(len(data)))...)
+	return append(element, data...)
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	data := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		data = append([]byte{byte(v)}, data...)
+	}
+	return ebmlMaster(id, data)
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, math.Float64bits(v))
+	return ebmlMaster(id, data)
+}
+
+func ebmlString(id uint32, s string) []byte {
+	return ebmlMaster(id, []byte(s))
+}
@@ -0,0 +1,395 @@
+package datamosh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/abema/go-mp4"
+)
+
+// MotionVector is a luma motion vector in quarter samples.
+type MotionVector struct {
+	X, Y int32
+}
+
+// MotionTransform changes a motion vector, or a motion vector difference.
+type MotionTransform func(mv MotionVector) MotionVector
+
+// ScaleMotion multiplies the vectors by factor, amplifying the motion above 1
+// and slowing it down below.
+func ScaleMotion(factor float64) MotionTransform {
+	return func(mv MotionVector) MotionVector {
+		return MotionVector{
+			X: int32(math.Round(float64(mv.X) * factor)),
+			Y: int32(math.Round(float64(mv.Y) * factor)),
+		}
+	}
+}
+
+// RotateMotion rotates the vectors by the given angle, clockwise on screen as
+// the vertical axis points down.
+func RotateMotion(degrees float64) MotionTransform {
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	return func(mv MotionVector) MotionVector {
+		x, y := float64(mv.X), float64(mv.Y)
+		return MotionVector{
+			X: int32(math.Round(x*cos - y*sin)),
+			Y: int32(math.Round(x*sin + y*cos)),
+		}
+	}
+}
+
+// InvertMotion reverses the vectors.
+func InvertMotion() MotionTransform {
+	return func(mv MotionVector) MotionVector {
+		return MotionVector{X: -mv.X, Y: -mv.Y}
+	}
+}
+
+// FreezeMotion zeroes the vectors.
+func FreezeMotion() MotionTransform {
+	return func(mv MotionVector) MotionVector {
+		return MotionVector{}
+	}
+}
+
+// MotionNoise adds random offsets of up to amount quarter samples to the
+// vectors, seed makes the noise reproducible.
+func MotionNoise(amount int32, seed int64) MotionTransform {
+	rng := rand.New(rand.NewSource(seed))
+	return func(mv MotionVector) MotionVector {
+		if amount <= 0 {
+			return mv
+		}
+		return MotionVector{
+			X: mv.X + rng.Int31n(2*amount+1) - amount,
+			Y: mv.Y + rng.Int31n(2*amount+1) - amount,
+		}
+	}
+}
+
+// ChainMotion applies the transforms in order.
+func ChainMotion(transforms ...MotionTransform) MotionTransform {
+	return func(mv MotionVector) MotionVector {
+		for _, t := range transforms {
+			mv = t(mv)
+		}
+		return mv
+	}
+}
+
+// ParseMotionTransform parses a comma separated list of transforms, applied
+// in order: scale=<factor>, rotate=<degrees>, invert, freeze and
+// noise=<quarter samples>. For instance "scale=2,rotate=90".
+func ParseMotionTransform(spec string) (MotionTransform, error) {
+	var transforms []MotionTransform
+	for i, item := range strings.Split(spec, ",") {
+		name, arg, hasArg := strings.Cut(strings.TrimSpace(item), "=")
+		if (name == "invert" || name == "freeze") == hasArg {
+			return nil, fmt.Errorf("invalid motion transform %q", item)
+		}
+		var value float64
+		if hasArg {
+			var err error
+			if value, err = strconv.ParseFloat(arg, 64); err != nil {
+				return nil, fmt.Errorf("invalid motion transform %q: %v", item, err)
+			}
+		}
+		switch name {
+		case "scale":
+			transforms = append(transforms, ScaleMotion(value))
+		case "rotate":
+			transforms = append(transforms, RotateMotion(value))
+		case "invert":
+			transforms = append(transforms, InvertMotion())
+		case "freeze":
+			transforms = append(transforms, FreezeMotion())
+		case "noise":
+			transforms = append(transforms, MotionNoise(int32(value), int64(i)))
+		default:
+			return nil, fmt.Errorf("unknown motion transform %q", name)
+		}
+	}
+	return ChainMotion(transforms...), nil
+}
+
+// Range of mvd_l0, see 7.4.5.1 Macroblock prediction semantics
+const (
+	minMVD = -1 << 15
+	maxMVD = 1<<15 - 1
+)
+
+// h264MVD is a motion vector difference of a slice, its position in the RBSP
+// and the value to write in its place. With CABAC, the value is coded again
+// with the ctxIdxInc of its components given the rewritten neighbours.
+type h264MVD struct {
+	start, end int // in bits
+	mvd        [2]int32
+	ctxIdxInc  [2]int
+}
+
+// MotionMosher rewrites the motion vector differences of the P slices of an
+// H.264 stream, coded with CAVLC or CABAC, the rest of the slices is copied as
+// is. The
+// transform applies to the motion vector differences, so the changes spread
+// to the next partitions through the motion vector prediction, or to the
+// motion vectors themselves with Absolute.
+type MotionMosher struct {
+	Transform MotionTransform
+	// Absolute applies the transform to the motion vectors rather than to
+	// their differences, FreezeMotion then makes the P macroblocks static.
+	Absolute bool
+
+	d *H264Decoder // for its parameter sets and gray reference picture
+}
+
+// NewMotionMosher returns a mosher primed with the parameter sets of the avcC
+// box of a track, avc can be nil if the parameter sets are in the stream.
+func NewMotionMosher(avc *AVCDecoderConfig, transform MotionTransform) (*MotionMosher, error) {
+	d, err := NewH264Decoder(avc)
+	if err != nil {
+		return nil, err
+	}
+	return &MotionMosher{Transform: transform, d: d}, nil
+}
+
+// clampMVD returns the motion vector difference within the range of mvd_l0.
+func clampMVD(mvd MotionVector) [2]int32 {
+	return [2]int32{
+		int32(clampInt(int(mvd.X), minMVD, maxMVD)),
+		int32(clampInt(int(mvd.Y), minMVD, maxMVD)),
+	}
+}
+
+// sliceParser returns a decoder for the slice data of the slice whose header
+// was read by r. The slice is decoded on its own: the parsing of its
+// macroblocks only depends on the previous ones of the slice and the samples
+// don't matter.
+func (d *H264Decoder) sliceParser(r *rbspReader, h *H264SliceHeader) *h264SliceDecoder {
+	pic := newH264Picture(h.sps)
+	s := &h264SliceDecoder{
+		r:     r,
+		h:     h,
+		pic:   pic,
+		slice: 1,
+		qp:    h.QP(),
+		refs:  make([]*h264Picture, h.NumRefIdxL0ActiveMinus1+1),
+	}
+	for i := range s.refs {
+		s.refs[i] = d.missingReference(pic)
+	}
+	return s
+}
+
+// parseSlice parses the P slice whose header was read by r, calling
+// rewriteMVD for the motion vector differences, and returns the parser with
+// their positions. The slice data coded with CABAC is coded again to out if
+// not nil.
+func (m *MotionMosher) parseSlice(r *rbspReader, h *H264SliceHeader, rewriteMVD func(pred, mvd [2]int32) [2]int32, out *rbspWriter) (*h264SliceDecoder, error) {
+	s := m.d.sliceParser(r, h)
+	s.rewriteMVD = rewriteMVD
+	if out != nil {
+		s.cabacOut = newCABACEncoder(out, h)
+	}
+	if err := s.decode(); err != nil {
+		return nil, fmt.Errorf("failed to parse slice: %v", err)
+	}
+	return s, nil
+}
+
+// RewriteNAL returns the NAL unit with the motion vector differences of P
+// slices transformed, the other NAL units are returned as is. Parameter sets
+// are recorded for the next slices. An error wrapping ErrH264Unsupported is
+// returned for slices the mosher can't parse.
+func (m *MotionMosher) RewriteNAL(nal []byte) ([]byte, error) {
+	if len(nal) == 0 {
+		return nil, errors.New("NAL unit data is empty")
+	}
+	switch nal[0] & 0x1f {
+	case NAL_SPS, NAL_PPS:
+		return nal, m.d.DecodeNAL(nal)
+	case NAL_SLICE:
+	default:
+		return nal, nil
+	}
+
+	rbsp := unescapeRBSP(nal[1:])
+	r := newRBSPReader(rbsp)
+	h, err := parseH264SliceHeader(r, nal[0], m.d.sps, m.d.pps)
+	if err != nil {
+		return nil, err
+	}
+	if h.Type() != SLICE_P {
+		return nal, nil
+	}
+	if err := checkH264Support(h); err != nil {
+		return nil, err
+	}
+
+	if m.Transform == nil {
+		return nal, nil
+	}
+	rewriteMVD := func(pred, mvd [2]int32) [2]int32 {
+		return clampMVD(m.Transform(MotionVector{X: mvd[0], Y: mvd[1]}))
+	}
+	if m.Absolute {
+		// the motion vectors of the slice as coded, the predictions change
+		// with the rewritten ones
+		var vectors []MotionVector
+		record := func(pred, mvd [2]int32) [2]int32 {
+			vectors = append(vectors, MotionVector{X: pred[0] + mvd[0], Y: pred[1] + mvd[1]})
+			return mvd
+		}
+		first := newRBSPReader(rbsp)
+		if _, err := parseH264SliceHeader(first, nal[0], m.d.sps, m.d.pps); err != nil {
+			return nil, err
+		}
+		if _, err := m.parseSlice(first, h, record, nil); err != nil {
+			return nil, err
+		}
+		i := 0
+		rewriteMVD = func(pred, mvd [2]int32) [2]int32 {
+			mv := m.Transform(vectors[i])
+			i++
+			return clampMVD(MotionVector{X: mv.X - pred[0], Y: mv.Y - pred[1]})
+		}
+	}
+	if h.pps.EntropyCodingMode {
+		// the slice data is coded again after the header
+		w := newRBSPWriter()
+		copyBits(w, rbsp, 0, r.pos)
+		s, err := m.parseSlice(r, h, rewriteMVD, w)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.mvds) == 0 {
+			return nal, nil
+		}
+		out, err := w.alignedBytes()
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{nal[0]}, escapeRBSP(out)...), nil
+	}
+	s, err := m.parseSlice(r, h, rewriteMVD, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.mvds) == 0 {
+		return nal, nil
+	}
+
+	w := newRBSPWriter()
+	pos := 0
+	for _, mvd := range s.mvds {
+		copySliceData(w, rbsp, pos, mvd.start, s.pcm)
+		w.se(mvd.mvd[0])
+		w.se(mvd.mvd[1])
+		pos = mvd.end
+	}
+	copySliceData(w, rbsp, pos, r.end, s.pcm)
+	out, err := w.trailingBits()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{nal[0]}, escapeRBSP(out)...), nil
+}
+
+// copyBits writes the bits from to end of data.
+func copyBits(w *rbspWriter, data []byte, from, end int) {
+	for pos := from; pos < end; {
+		n := min(8-pos%8, end-pos)
+		v := uint32(data[pos/8]>>(8-pos%8-n)) & (1<<n - 1)
+		w.u(n, v)
+		pos += n
+	}
+}
+
+// copySliceData writes the bits from to end of the CAVLC slice data, padding
+// the I_PCM macroblocks in the range, whose bit ranges of
+// pcm_alignment_zero_bits are in pcm, to a byte boundary of w.
+func copySliceData(w *rbspWriter, data []byte, from, end int, pcm [][2]int) {
+	for _, align := range pcm {
+		if align[0] < from || align[1] > end {
+			continue
+		}
+		copyBits(w, data, from, align[0])
+		for !w.byteAligned() {
+			w.u(1, 0) // pcm_alignment_zero_bit
+		}
+		from = align[1]
+	}
+	copyBits(w, data, from, end)
+}
+
+// RewriteNALs returns a copy of the H.264 track whose NAL units are replaced
+// by the ones returned by fn, and its sample data the track points to. The
+// NAL units fn returns nil for are dropped.
+func (t *Track) RewriteNALs(r io.ReadSeeker, fn func(nal []byte) ([]byte, error)) (*Track, []byte, error) {
+	return t.rewriteNALs(r, func(_ *NALUnit, payload []byte) ([]byte, error) {
+		return fn(payload)
+	})
+}
+
+// rewriteNALs is RewriteNALs with fn also given the NAL units, for their
+// timestamps.
+func (t *Track) rewriteNALs(r io.ReadSeeker, fn func(nal *NALUnit, payload []byte) ([]byte, error)) (*Track, []byte, error) {
+	if t.AVC == nil {
+		return nil, nil, errors.New("AVC configuration not found")
+	}
+	lengthSize := int(t.AVC.LengthSize)
+	if lengthSize < 1 || lengthSize > 4 {
+		return nil, nil, fmt.Errorf("invalid NAL unit length size %d", lengthSize)
+	}
+
+	out := *t
+	out.Samples = make(mp4.Samples, len(t.Samples))
+	out.NALs = make([]*NALUnit, 0, len(t.NALs))
+	var data []byte
+	i := 0
+	for id, sample := range t.Samples {
+		copied := *sample
+		copied.Size = 0
+		out.Samples[id] = &copied
+		for ; i < len(t.NALs) && t.NALs[i].SampleID == uint32(id); i++ {
+			nal := t.NALs[i]
+			payload, err := nal.Payload(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			if payload, err = fn(nal, payload); err != nil {
+				return nil, nil, fmt.Errorf("sample %d: %w", id, err)
+			}
+			if len(payload) == 0 {
+				continue
+			}
+			if lengthSize < 4 && len(payload) >= 1<<(8*lengthSize) {
+				return nil, nil, fmt.Errorf("sample %d: NAL unit too large for %d byte lengths", id, lengthSize)
+			}
+			var length [4]byte
+			binary.BigEndian.PutUint32(length[:], uint32(len(payload)))
+			data = append(data, length[4-lengthSize:]...)
+			rewritten := *nal
+			rewritten.Offset = int64(len(data))
+			rewritten.Length = uint32(len(payload))
+			rewritten.Chunk = 0
+			rewritten.SliceType = sliceTypeUnknown
+			if rewritten.Type == NAL_SLICE || rewritten.Type == NAL_IDR_SLICE {
+				rewritten.SliceType = parseSliceType(payload[1:])
+			}
+			out.NALs = append(out.NALs, &rewritten)
+			data = append(data, payload...)
+			copied.Size += uint32(lengthSize + len(payload))
+		}
+	}
+	out.Chunks = mp4.Chunks{{DataOffset: 0, SamplesPerChunk: uint32(len(t.Samples))}}
+	out.SampleFlags = t.keptSampleFlags(&out)
+	out.stss = nil
+	return &out, data, nil
+}
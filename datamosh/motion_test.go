@@ -0,0 +1,262 @@
+package datamosh
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testH264MotionSlice returns a P slice of two P_L0_16x16 macroblocks with
+// the given motion vector differences, the first one has a luma residual.
+func testH264MotionSlice(mvds [2]MotionVector) []byte {
+	return testH264PSlice(1, func(w *rbspWriter) {
+		w.ue(0) // mb_skip_run
+		w.ue(0) // mb_type P_L0_16x16
+		w.se(mvds[0].X)
+		w.se(mvds[0].Y)
+		w.ue(2)  // coded_block_pattern 1, the first 8x8 luma block
+		w.se(-3) // mb_qp_delta
+		w.residualBlock([]int32{5, -1, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 16, 0)
+		zeros := make([]int32, 16)
+		w.residualBlock(zeros, 16, 5)
+		w.residualBlock(zeros, 16, 5)
+		w.residualBlock(zeros, 16, 0)
+
+		w.ue(0) // mb_skip_run
+		w.ue(0) // mb_type P_L0_16x16
+		w.se(mvds[1].X)
+		w.se(mvds[1].Y)
+		w.ue(0) // coded_block_pattern 0
+	})
+}
+
+func testMotionConfig(cabac bool) *AVCDecoderConfig {
+	sps, pps := testH264SPS(2, 1, 0), testH264PPS(cabac)
+	avc := &AVCDecoderConfig{LengthSize: 4}
+	avc.SequenceParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(sps)), NALUnit: sps}}
+	avc.PictureParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(pps)), NALUnit: pps}}
+	return avc
+}
+
+func TestMotionMosher(t *testing.T) {
+	// the first macroblock has no neighbour, its motion vector is its
+	// difference, the second one predicts from it
+	in := [2]MotionVector{{4, -8}, {2, 2}}
+	tests := []struct {
+		name      string
+		transform MotionTransform
+		absolute  bool
+		want      [2]MotionVector
+	}{
+		{name: "identity", want: in},
+		{name: "scale", transform: ScaleMotion(2), want: [2]MotionVector{{8, -16}, {4, 4}}},
+		{name: "invert", transform: InvertMotion(), want: [2]MotionVector{{-4, 8}, {-2, -2}}},
+		{name: "rotate", transform: RotateMotion(90), want: [2]MotionVector{{8, 4}, {-2, 2}}},
+		{name: "chain", transform: ChainMotion(ScaleMotion(0.5), InvertMotion()), want: [2]MotionVector{{-2, 4}, {-1, -1}}},
+		{name: "clamp", transform: ScaleMotion(10000), want: [2]MotionVector{{maxMVD, minMVD}, {20000, 20000}}},
+		{name: "freeze vectors", transform: FreezeMotion(), absolute: true, want: [2]MotionVector{{0, 0}, {0, 0}}},
+		{name: "scale vectors", transform: ScaleMotion(2), absolute: true, want: [2]MotionVector{{8, -16}, {4, 4}}},
+		{name: "invert vectors", transform: InvertMotion(), absolute: true, want: [2]MotionVector{{-4, 8}, {-2, -2}}},
+		{name: "offset vectors", transform: func(mv MotionVector) MotionVector { return MotionVector{mv.X + 4, mv.Y} }, absolute: true, want: [2]MotionVector{{8, -8}, {2, 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMotionMosher(testMotionConfig(false), tt.transform)
+			require.NoError(t, err)
+			m.Absolute = tt.absolute
+			got, err := m.RewriteNAL(testH264MotionSlice(in))
+			require.NoError(t, err)
+			assert.Equal(t, testH264MotionSlice(tt.want), got)
+
+			// other NAL units are kept
+			idr := testH264PCMSlice(2)
+			got, err = m.RewriteNAL(idr)
+			require.NoError(t, err)
+			assert.Equal(t, idr, got)
+			skip := testH264PSlice(2, func(w *rbspWriter) { w.ue(2) })
+			got, err = m.RewriteNAL(skip)
+			require.NoError(t, err)
+			assert.Equal(t, skip, got)
+
+			// the slices coded with CABAC are coded again
+			m, err = NewMotionMosher(testMotionConfig(true), tt.transform)
+			require.NoError(t, err)
+			m.Absolute = tt.absolute
+			got, err = m.RewriteNAL(testH264CABACMotionSlice(in))
+			require.NoError(t, err)
+			assert.Equal(t, testH264CABACMotionSlice(tt.want), got)
+		})
+	}
+}
+
+func TestMotionMosherErrors(t *testing.T) {
+	m, err := NewMotionMosher(testMotionConfig(false), InvertMotion())
+	require.NoError(t, err)
+	m.d.pps[0].ScalingMatrixPresent = true
+	w := newRBSPWriter()
+	w.ue(0)       // first_mb_in_slice
+	w.ue(5)       // slice_type P
+	w.ue(0)       // pic_parameter_set_id
+	w.u(4, 1)     // frame_num
+	w.u(4, 2)     // pic_order_cnt_lsb
+	w.flag(false) // num_ref_idx_active_override_flag
+	w.flag(false) // ref_pic_list_modification_flag_l0
+	w.flag(false) // adaptive_ref_pic_marking_mode_flag
+	w.se(0)       // slice_qp_delta
+	w.ue(2)       // mb_skip_run
+	_, err = m.RewriteNAL(testH264NAL(0x41, w))
+	assert.True(t, errors.Is(err, ErrH264Unsupported), "unexpected error %v", err)
+
+	// interlaced streams
+	data := mp4Fixture{gop: "IP", interlaced: true}.build(t)
+	tracks, err := ParseTracks(bytes.NewReader(data))
+	require.NoError(t, err)
+	m, err = NewMotionMosher(tracks[0].AVC, InvertMotion())
+	require.NoError(t, err)
+	_, _, err = tracks[0].RewriteNALs(bytes.NewReader(data), m.RewriteNAL)
+	assert.True(t, errors.Is(err, ErrH264Unsupported), "unexpected error %v", err)
+
+	m, err = NewMotionMosher(nil, InvertMotion())
+	require.NoError(t, err)
+	_, err = m.RewriteNAL(testH264MotionSlice([2]MotionVector{}))
+	assert.EqualError(t, err, "unknown PPS id 0")
+	_, err = m.RewriteNAL(nil)
+	assert.Error(t, err)
+	// the parameter sets can be in the stream
+	avc := testMotionConfig(false)
+	for _, nal := range [][]byte{avc.SequenceParameterSets[0].NALUnit, avc.PictureParameterSets[0].NALUnit} {
+		got, err := m.RewriteNAL(nal)
+		require.NoError(t, err)
+		assert.Equal(t, nal, got)
+	}
+	got, err := m.RewriteNAL(testH264MotionSlice([2]MotionVector{{1, 1}, {0, 0}}))
+	require.NoError(t, err)
+	assert.Equal(t, testH264MotionSlice([2]MotionVector{{-1, -1}, {0, 0}}), got)
+}
+
+func TestParseMotionTransform(t *testing.T) {
+	tests := []struct {
+		spec string
+		in   MotionVector
+		want MotionVector
+		err  string
+	}{
+		{spec: "scale=2", in: MotionVector{3, -1}, want: MotionVector{6, -2}},
+		{spec: "scale=2, invert", in: MotionVector{3, -1}, want: MotionVector{-6, 2}},
+		{spec: "rotate=180", in: MotionVector{3, -1}, want: MotionVector{-3, 1}},
+		{spec: "freeze", in: MotionVector{3, -1}},
+		{spec: "noise=0", in: MotionVector{3, -1}, want: MotionVector{3, -1}},
+		{spec: "scale", err: `invalid motion transform "scale"`},
+		{spec: "invert=1", err: `invalid motion transform "invert=1"`},
+		{spec: "scale=x", err: `invalid motion transform "scale=x": strconv.ParseFloat: parsing "x": invalid syntax`},
+		{spec: "spin=1", err: `unknown motion transform "spin"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			transform, err := ParseMotionTransform(tt.spec)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, transform(tt.in))
+		})
+	}
+
+	noise := MotionNoise(4, 1)
+	for i := 0; i < 100; i++ {
+		mv := noise(MotionVector{10, 10})
+		assert.InDelta(t, 10, mv.X, 4)
+		assert.InDelta(t, 10, mv.Y, 4)
+	}
+}
+
+func TestTrackRewriteNALs(t *testing.T) {
+	fixture := mp4Fixture{gop: "IBPBPIP", slices: 2, audio: true}.withDefaults()
+	data := fixture.build(t)
+	tracks, err := ParseTracks(bytes.NewReader(data))
+	require.NoError(t, err)
+	track := tracks[0]
+
+	// drop the B slices
+	rewritten, out, err := track.RewriteNALs(bytes.NewReader(data), func(nal []byte) ([]byte, error) {
+		if nal[0]>>5 == 0 {
+			return nil, nil
+		}
+		return nal, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, rewritten.Samples, len(track.Samples))
+	require.Len(t, rewritten.NALs, len(track.NALs)-2*fixture.slices)
+	assert.Len(t, track.NALs, len(fixture.gop)*fixture.slices, "the track is left untouched")
+
+	var muxed bytes.Buffer
+	require.NoError(t, (&MP4Muxer{}).Mux(&muxed, bytes.NewReader(out), []MuxTrack{{Track: rewritten}}))
+	tracks, err = ParseTracks(bytes.NewReader(muxed.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, tracks, 1)
+	r := bytes.NewReader(muxed.Bytes())
+	i := 0
+	for id, frame := range fixture.frames() {
+		if frame.kind == 'B' {
+			assert.Zero(t, tracks[0].Samples[id].Size)
+			continue
+		}
+		for _, want := range frame.nals {
+			nal := tracks[0].NALs[i]
+			i++
+			assert.Equal(t, uint32(id), nal.SampleID)
+			assert.Equal(t, frame.pts, nal.PTS())
+			payload, err := nal.Payload(r)
+			require.NoError(t, err)
+			assert.Equal(t, want, payload)
+		}
+	}
+	assert.Len(t, tracks[0].NALs, i)
+
+	_, _, err = tracks[0].RewriteNALs(r, func(nal []byte) ([]byte, error) { return nil, errors.New("boom") })
+	assert.EqualError(t, err, "sample 0: boom")
+}
+
+func TestMotionMoshDecode(t *testing.T) {
+	// a key frame followed by a P frame moving the picture 2 samples
+	// horizontally, decoded after inverting the motion
+	avc := testMotionConfig(false)
+	avc.Width, avc.Height = 32, 16
+	m, err := NewMotionMosher(avc, InvertMotion())
+	require.NoError(t, err)
+	p := testH264PSlice(1, func(w *rbspWriter) {
+		w.ue(0) // mb_skip_run
+		w.ue(0) // mb_type P_L0_16x16
+		w.se(8)
+		w.se(0)
+		w.ue(0) // coded_block_pattern
+		w.ue(1) // mb_skip_run, predicting from the first macroblock
+	})
+	moshed, err := m.RewriteNAL(p)
+	require.NoError(t, err)
+
+	decode := func(slice []byte) *image.YCbCr {
+		d, err := NewH264Decoder(avc)
+		require.NoError(t, err)
+		_, err = d.DecodeAccessUnit([][]byte{testH264PCMSlice(2)})
+		require.NoError(t, err)
+		img, err := d.DecodeAccessUnit([][]byte{slice})
+		require.NoError(t, err)
+		return img
+	}
+	img := decode(moshed)
+	// the samples come from 2 samples to the left, clamped at the edge, the
+	// skipped macroblock has no neighbour above and doesn't move
+	for _, x := range []int{0, 5, 15} {
+		assert.Equal(t, testH264Sample(max(x-2, 0), 7), img.Y[img.YOffset(x, 7)], "x %d", x)
+	}
+	assert.Equal(t, testH264Sample(20, 7), img.Y[img.YOffset(20, 7)])
+	img = decode(p)
+	assert.Equal(t, testH264Sample(7, 7), img.Y[img.YOffset(5, 7)])
+}
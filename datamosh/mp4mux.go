@@ -0,0 +1,661 @@
+package datamosh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/abema/go-mp4"
+)
+
+const (
+	mp4MovieTimescale = 1000
+	mp4ChunkDuration  = 1 // in seconds, samples are interleaved by chunks
+)
+
+// MP4Muxer writes MP4 files with the moov box after the media data, or before
+// it for faststart files. The sync samples, sample dependencies and 'roll' and
+// 'rap ' sample groups of the source tracks are kept.
+type MP4Muxer struct {
+	// Faststart places the moov box before the media data, so players can
+	// start playing the file while it is downloaded.
+	Faststart bool
+}
+
+// Supports returns true for tracks read from MP4 files, whose sample
+// description is copied, and for H.264, AV1, VP8, VP9 and MPEG-4 audio
+// tracks.
+func (m *MP4Muxer) Supports(track *Track) bool {
+	return track.stsd != nil || track.AVC != nil || track.AV1 != nil || track.VPX != nil || track.MP4A != nil
+}
+
+// mp4Chunk is a run of consecutive samples of a track in the output file.
+type mp4Chunk struct {
+	track  int
+	first  int // index of the first sample in the output samples of the track
+	count  int
+	start  float64 // in seconds
+	offset uint64  // in the output file
+}
+
+func (m *MP4Muxer) Mux(w io.Writer, r io.ReadSeeker, tracks []MuxTrack) error {
+	if len(tracks) == 0 {
+		return errors.New("no track to write")
+	}
+	samples := make([][]muxSample, len(tracks))
+	chunks := []*mp4Chunk{}
+	for i, t := range tracks {
+		if !m.Supports(t.Track) {
+			return fmt.Errorf("track %d can't be written to MP4", t.Track.TrackID)
+		}
+		var err error
+		if samples[i], err = t.muxSamples(); err != nil {
+			return err
+		}
+		chunks = append(chunks, splitMP4Chunks(i, t.Track.Timescale, samples[i])...)
+	}
+	// interleave the chunks of the tracks by time
+	sort.SliceStable(chunks, func(a, b int) bool { return chunks[a].start < chunks[b].start })
+
+	ftyp, err := newMP4Ftyp(tracks, [4]byte{'i', 's', 'o', 'm'}, [4]byte{'i', 's', 'o', '2'})
+	if err != nil {
+		return err
+	}
+	var dataSize uint64
+	for _, trackSamples := range samples {
+		for _, s := range trackSamples {
+			dataSize += uint64(s.size)
+		}
+	}
+	mdatHeader := newMP4MdatHeader(dataSize)
+
+	// the chunk offsets depend on the size of a moov box written first, which
+	// grows when they need 64 bits
+	var moov []byte
+	moovSize := 0
+	for {
+		offset := uint64(len(ftyp) + moovSize + len(mdatHeader))
+		for _, chunk := range chunks {
+			chunk.offset = offset
+			for _, s := range samples[chunk.track][chunk.first : chunk.first+chunk.count] {
+				offset += uint64(s.size)
+			}
+		}
+		if moov, err = newMP4Moov(tracks, samples, chunks, false); err != nil {
+			return err
+		}
+		if !m.Faststart || len(moov) == moovSize {
+			break
+		}
+		moovSize = len(moov)
+	}
+
+	if _, err := w.Write(ftyp); err != nil {
+		return fmt.Errorf("failed to write ftyp box: %v", err)
+	}
+	if m.Faststart {
+		if _, err := w.Write(moov); err != nil {
+			return fmt.Errorf("failed to write moov box: %v", err)
+		}
+	}
+	if _, err := w.Write(mdatHeader); err != nil {
+		return fmt.Errorf("failed to write mdat box: %v", err)
+	}
+	for _, chunk := range chunks {
+		r := tracks[chunk.track].reader(r)
+		for _, s := range samples[chunk.track][chunk.first : chunk.first+chunk.count] {
+			if err := copySample(w, r, s); err != nil {
+				return err
+			}
+		}
+	}
+	if !m.Faststart {
+		if _, err := w.Write(moov); err != nil {
+			return fmt.Errorf("failed to write moov box: %v", err)
+		}
+	}
+	return nil
+}
+
+// splitMP4Chunks groups the samples of a track into chunks of about
+// mp4ChunkDuration.
+func splitMP4Chunks(track int, timescale uint32, samples []muxSample) []*mp4Chunk {
+	chunks := []*mp4Chunk{}
+	var chunk *mp4Chunk
+	for i, s := range samples {
+		if chunk == nil || s.dts-samples[chunk.first].dts >= uint64(timescale)*mp4ChunkDuration {
+			chunk = &mp4Chunk{
+				track: track,
+				first: i,
+				start: float64(s.dts) / float64(timescale),
+			}
+			chunks = append(chunks, chunk)
+		}
+		chunk.count++
+	}
+	return chunks
+}
+
+// marshalMP4Box returns the box with its header and children.
+func marshalMP4Box(box mp4.IImmutableBox, children ...[]byte) ([]byte, error) {
+	payload := &bytes.Buffer{}
+	if _, err := mp4.Marshal(payload, box, mp4.Context{}); err != nil {
+		return nil, fmt.Errorf("failed to marshal %s box: %v", box.GetType(), err)
+	}
+	for _, child := range children {
+		payload.Write(child)
+	}
+	data := make([]byte, 8, 8+payload.Len())
+	binary.BigEndian.PutUint32(data[0:4], uint32(8+payload.Len()))
+	boxType := box.GetType()
+	copy(data[4:8], boxType[:])
+	return append(data, payload.Bytes()...), nil
+}
+
+// marshalMP4Boxes marshals a list of boxes, each one holding the next one.
+func marshalMP4Boxes(boxes ...mp4.IImmutableBox) ([]byte, error) {
+	var data []byte
+	for i := len(boxes) - 1; i >= 0; i-- {
+		var err error
+		if data == nil {
+			data, err = marshalMP4Box(boxes[i])
+		} else {
+			data, err = marshalMP4Box(boxes[i], data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// newMP4MdatHeader returns the header of an mdat box holding dataSize bytes.
+func newMP4MdatHeader(dataSize uint64) []byte {
+	header := make([]byte, 8)
+	if dataSize+8 > math.MaxUint32 {
+		// use the 64 bit largesize field
+		header = make([]byte, 16)
+		binary.BigEndian.PutUint32(header[0:4], 1)
+		binary.BigEndian.PutUint64(header[8:16], dataSize+16)
+	} else {
+		binary.BigEndian.PutUint32(header[0:4], uint32(dataSize+8))
+	}
+	copy(header[4:8], "mdat")
+	return header
+}
+
+// newMP4Ftyp returns the ftyp box of the tracks, the first brand being the
+// major brand.
+func newMP4Ftyp(tracks []MuxTrack, brands ...[4]byte) ([]byte, error) {
+	ftyp := &mp4.Ftyp{
+		MajorBrand:   brands[0],
+		MinorVersion: 0x200,
+	}
+	for _, brand := range brands {
+		ftyp.AddCompatibleBrand(brand)
+	}
+	for _, t := range tracks {
+		switch {
+		case t.Track.AVC != nil:
+			ftyp.AddCompatibleBrand([4]byte{'a', 'v', 'c', '1'})
+		case t.Track.AV1 != nil:
+			ftyp.AddCompatibleBrand([4]byte{'a', 'v', '0', '1'})
+		}
+	}
+	ftyp.AddCompatibleBrand([4]byte{'m', 'p', '4', '1'})
+	return marshalMP4Box(ftyp)
+}
+
+// newMP4Moov returns the moov box of the tracks. The sample tables of
+// fragmented files are left empty, the mvex box announcing the movie fragments
+// holding the samples.
+func newMP4Moov(tracks []MuxTrack, samples [][]muxSample, chunks []*mp4Chunk, fragmented bool) ([]byte, error) {
+	var movieDuration, fragmentDuration uint64
+	traks := [][]byte{}
+	for i, t := range tracks {
+		trackChunks := []*mp4Chunk{}
+		for _, chunk := range chunks {
+			if chunk.track == i {
+				trackChunks = append(trackChunks, chunk)
+			}
+		}
+		tableSamples := samples[i]
+		if fragmented {
+			tableSamples = nil
+			var mediaDuration uint64
+			for _, s := range samples[i] {
+				mediaDuration += uint64(s.duration)
+			}
+			if timescale := uint64(t.Track.Timescale); timescale > 0 {
+				fragmentDuration = max(fragmentDuration, mediaDuration*mp4MovieTimescale/timescale)
+			}
+		}
+		trak, duration, err := newMP4Trak(uint32(i+1), t.Track, t.muxEditList(samples[i]), tableSamples, trackChunks)
+		if err != nil {
+			return nil, err
+		}
+		if duration > movieDuration {
+			movieDuration = duration
+		}
+		traks = append(traks, trak)
+	}
+	if fragmented {
+		mvex, err := newMP4Mvex(len(tracks), fragmentDuration)
+		if err != nil {
+			return nil, err
+		}
+		traks = append(traks, mvex)
+	}
+
+	mvhd := &mp4.Mvhd{
+		Timescale:   mp4MovieTimescale,
+		Rate:        0x00010000,
+		Volume:      0x0100,
+		Matrix:      [9]int32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000},
+		NextTrackID: uint32(len(tracks) + 1),
+	}
+	if movieDuration > math.MaxUint32 {
+		mvhd.SetVersion(1)
+		mvhd.DurationV1 = movieDuration
+	} else {
+		mvhd.DurationV0 = uint32(movieDuration)
+	}
+	mvhdData, err := marshalMP4Box(mvhd)
+	if err != nil {
+		return nil, err
+	}
+	return marshalMP4Box(&mp4.Moov{}, append([][]byte{mvhdData}, traks...)...)
+}
+
+// newMP4Mvex returns the mvex box of a fragmented file, with the duration of
+// its fragments in the movie timescale. See ISO/IEC 14496-12 8.8.1.
+func newMP4Mvex(trackCount int, fragmentDuration uint64) ([]byte, error) {
+	mehd := &mp4.Mehd{}
+	if fragmentDuration > math.MaxUint32 {
+		mehd.SetVersion(1)
+		mehd.FragmentDurationV1 = fragmentDuration
+	} else {
+		mehd.FragmentDurationV0 = uint32(fragmentDuration)
+	}
+	mehdData, err := marshalMP4Box(mehd)
+	if err != nil {
+		return nil, err
+	}
+	children := [][]byte{mehdData}
+	for i := 0; i < trackCount; i++ {
+		trex, err := marshalMP4Box(&mp4.Trex{TrackID: uint32(i + 1), DefaultSampleDescriptionIndex: 1})
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, trex)
+	}
+	return marshalMP4Box(&mp4.Mvex{}, children...)
+}
+
+// newMP4Trak returns the trak box of a track and its duration in the movie
+// timescale, the duration of its edit list if any.
+func newMP4Trak(trackID uint32, track *Track, edits []Edit, samples []muxSample, chunks []*mp4Chunk) ([]byte, uint64, error) {
+	timescale := track.Timescale
+	if timescale == 0 {
+		timescale = 1
+	}
+	var mediaDuration uint64
+	for _, s := range samples {
+		mediaDuration += uint64(s.duration)
+	}
+	duration := mediaDuration * mp4MovieTimescale / uint64(timescale)
+	if edits != nil {
+		duration = 0
+		for _, edit := range edits {
+			duration += edit.SegmentDuration * mp4MovieTimescale / uint64(timescale)
+		}
+	}
+
+	width, height := track.dimensions()
+	tkhd := &mp4.Tkhd{
+		TrackID: trackID,
+		Matrix:  [9]int32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000},
+		Width:   uint32(width) << 16,
+		Height:  uint32(height) << 16,
+	}
+	tkhd.SetFlags(0x000003) // enabled, in movie
+	if duration > math.MaxUint32 {
+		tkhd.SetVersion(1)
+		tkhd.DurationV1 = duration
+	} else {
+		tkhd.DurationV0 = uint32(duration)
+	}
+	if track.IsAudio() {
+		tkhd.Volume = 0x0100
+	}
+	tkhdData, err := marshalMP4Box(tkhd)
+	if err != nil {
+		return nil, 0, err
+	}
+	children := [][]byte{tkhdData}
+
+	if edits != nil {
+		elst := &mp4.Elst{EntryCount: uint32(len(edits))}
+		elst.SetVersion(1)
+		for _, edit := range edits {
+			elst.Entries = append(elst.Entries, mp4.ElstEntry{
+				SegmentDurationV1: edit.SegmentDuration * mp4MovieTimescale / uint64(timescale),
+				MediaTimeV1:       edit.MediaTime,
+				MediaRateInteger:  edit.Rate,
+			})
+		}
+		edts, err := marshalMP4Boxes(&mp4.Edts{}, elst)
+		if err != nil {
+			return nil, 0, err
+		}
+		children = append(children, edts)
+	}
+
+	mdhd := &mp4.Mdhd{
+		Timescale: timescale,
+		Language:  [3]byte{'u' - 0x60, 'n' - 0x60, 'd' - 0x60},
+	}
+	if mediaDuration > math.MaxUint32 {
+		mdhd.SetVersion(1)
+		mdhd.DurationV1 = mediaDuration
+	} else {
+		mdhd.DurationV0 = uint32(mediaDuration)
+	}
+	mdhdData, err := marshalMP4Box(mdhd)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hdlr := &mp4.Hdlr{HandlerType: track.Handler}
+	var mediaHeader []byte
+	switch {
+	case track.IsVideo():
+		hdlr.HandlerType = handlerVideo
+		hdlr.Name = "VideoHandler"
+		vmhd := &mp4.Vmhd{}
+		vmhd.SetFlags(0x000001)
+		mediaHeader, err = marshalMP4Box(vmhd)
+	case track.IsAudio():
+		hdlr.HandlerType = handlerAudio
+		hdlr.Name = "SoundHandler"
+		mediaHeader, err = marshalMP4Box(&mp4.Smhd{})
+	default:
+		// empty nmhd full box, not defined by go-mp4
+		mediaHeader = []byte{0, 0, 0, 12, 'n', 'm', 'h', 'd', 0, 0, 0, 0}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	hdlrData, err := marshalMP4Box(hdlr)
+	if err != nil {
+		return nil, 0, err
+	}
+	url := &mp4.Url{}
+	url.SetFlags(mp4.UrlSelfContained)
+	dinf, err := marshalMP4Boxes(&mp4.Dinf{}, &mp4.Dref{EntryCount: 1}, url)
+	if err != nil {
+		return nil, 0, err
+	}
+	stbl, err := newMP4Stbl(track, samples, chunks)
+	if err != nil {
+		return nil, 0, err
+	}
+	minf, err := marshalMP4Box(&mp4.Minf{}, mediaHeader, dinf, stbl)
+	if err != nil {
+		return nil, 0, err
+	}
+	mdia, err := marshalMP4Box(&mp4.Mdia{}, mdhdData, hdlrData, minf)
+	if err != nil {
+		return nil, 0, err
+	}
+	children = append(children, mdia)
+
+	trak, err := marshalMP4Box(&mp4.Trak{}, children...)
+	return trak, duration, err
+}
+
+func newMP4Stbl(track *Track, samples []muxSample, chunks []*mp4Chunk) ([]byte, error) {
+	boxes := [][]byte{}
+	add := func(box mp4.IImmutableBox) error {
+		data, err := marshalMP4Box(box)
+		if err == nil {
+			boxes = append(boxes, data)
+		}
+		return err
+	}
+
+	stsd := track.stsd
+	if stsd == nil {
+		var err error
+		if stsd, err = newMP4Stsd(track); err != nil {
+			return nil, err
+		}
+	}
+	boxes = append(boxes, stsd)
+
+	stts := &mp4.Stts{}
+	ctts := &mp4.Ctts{}
+	hasCTO, negativeCTO := false, false
+	stss := &mp4.Stss{}
+	stsz := &mp4.Stsz{SampleCount: uint32(len(samples))}
+	for i, s := range samples {
+		if n := len(stts.Entries); n > 0 && stts.Entries[n-1].SampleDelta == s.duration {
+			stts.Entries[n-1].SampleCount++
+		} else {
+			stts.Entries = append(stts.Entries, mp4.SttsEntry{SampleCount: 1, SampleDelta: s.duration})
+		}
+		if n := len(ctts.Entries); n > 0 && ctts.Entries[n-1].SampleOffsetV1 == int32(s.cto) {
+			ctts.Entries[n-1].SampleCount++
+		} else {
+			ctts.Entries = append(ctts.Entries, mp4.CttsEntry{
+				SampleCount:    1,
+				SampleOffsetV0: uint32(s.cto),
+				SampleOffsetV1: int32(s.cto),
+			})
+		}
+		hasCTO = hasCTO || s.cto != 0
+		negativeCTO = negativeCTO || s.cto < 0
+		if s.key {
+			stss.SampleNumber = append(stss.SampleNumber, uint32(i+1))
+		}
+		stsz.EntrySize = append(stsz.EntrySize, s.size)
+	}
+	stts.EntryCount = uint32(len(stts.Entries))
+	if err := add(stts); err != nil {
+		return nil, err
+	}
+	if hasCTO {
+		if negativeCTO {
+			ctts.SetVersion(1)
+		}
+		ctts.EntryCount = uint32(len(ctts.Entries))
+		if err := add(ctts); err != nil {
+			return nil, err
+		}
+	}
+	if track.IsVideo() && len(stss.SampleNumber) < len(samples) {
+		stss.EntryCount = uint32(len(stss.SampleNumber))
+		if err := add(stss); err != nil {
+			return nil, err
+		}
+	}
+	for _, box := range newMP4SampleDependencies(samples) {
+		if err := add(box); err != nil {
+			return nil, err
+		}
+	}
+
+	stsc := &mp4.Stsc{}
+	for i, chunk := range chunks {
+		if n := len(stsc.Entries); n > 0 && stsc.Entries[n-1].SamplesPerChunk == uint32(chunk.count) {
+			continue
+		}
+		stsc.Entries = append(stsc.Entries, mp4.StscEntry{
+			FirstChunk:             uint32(i + 1),
+			SamplesPerChunk:        uint32(chunk.count),
+			SampleDescriptionIndex: 1,
+		})
+	}
+	stsc.EntryCount = uint32(len(stsc.Entries))
+	if err := add(stsc); err != nil {
+		return nil, err
+	}
+	if err := add(stsz); err != nil {
+		return nil, err
+	}
+
+	var lastOffset uint64
+	if len(chunks) > 0 {
+		lastOffset = chunks[len(chunks)-1].offset
+	}
+	if lastOffset > math.MaxUint32 {
+		co64 := &mp4.Co64{EntryCount: uint32(len(chunks))}
+		for _, chunk := range chunks {
+			co64.ChunkOffset = append(co64.ChunkOffset, chunk.offset)
+		}
+		if err := add(co64); err != nil {
+			return nil, err
+		}
+	} else {
+		stco := &mp4.Stco{EntryCount: uint32(len(chunks))}
+		for _, chunk := range chunks {
+			stco.ChunkOffset = append(stco.ChunkOffset, uint32(chunk.offset))
+		}
+		if err := add(stco); err != nil {
+			return nil, err
+		}
+	}
+
+	return marshalMP4Box(&mp4.Stbl{}, boxes...)
+}
+
+// newMP4SampleDependencies returns the sdtp box and the 'roll' and 'rap '
+// sample groups of the samples, those the source track had. The 'prol' groups
+// are written as 'roll' ones. See ISO/IEC 14496-12 8.6.4 and 10.
+func newMP4SampleDependencies(samples []muxSample) []mp4.IImmutableBox {
+	var boxes []mp4.IImmutableBox
+	sdtp := &mp4.Sdtp{}
+	hasSdtp := false
+	for _, s := range samples {
+		f := s.flags
+		sdtp.Samples = append(sdtp.Samples, mp4.SdtpSampleElem{
+			IsLeading:           f.IsLeading,
+			SampleDependsOn:     f.DependsOn,
+			SampleIsDependedOn:  f.IsDependedOn,
+			SampleHasRedundancy: f.HasRedundancy,
+		})
+		hasSdtp = hasSdtp || f.IsLeading != 0 || f.DependsOn != 0 || f.IsDependedOn != 0 || f.HasRedundancy != 0
+	}
+	if hasSdtp {
+		boxes = append(boxes, sdtp)
+	}
+
+	// the group description index of each sample, 0 for none
+	roll := &mp4.Sgpd{FullBox: mp4.FullBox{Version: 1}, GroupingType: groupingTypeRoll, DefaultLength: 2}
+	rap := &mp4.Sgpd{FullBox: mp4.FullBox{Version: 1}, GroupingType: groupingTypeRap, DefaultLength: 1}
+	rollIndexes := make([]uint32, len(samples))
+	rapIndexes := make([]uint32, len(samples))
+	distances := map[int16]uint32{}
+	for i, s := range samples {
+		if s.flags.Roll {
+			if distances[s.flags.RollDistance] == 0 {
+				roll.RollDistances = append(roll.RollDistances, s.flags.RollDistance)
+				distances[s.flags.RollDistance] = uint32(len(roll.RollDistances))
+			}
+			rollIndexes[i] = distances[s.flags.RollDistance]
+		}
+		if s.flags.RandomAccess {
+			// leading samples unknown
+			rap.VisualRandomAccessEntries = []mp4.VisualRandomAccessEntry{{}}
+			rapIndexes[i] = 1
+		}
+	}
+	roll.EntryCount = uint32(len(roll.RollDistances))
+	rap.EntryCount = uint32(len(rap.VisualRandomAccessEntries))
+	for _, group := range []struct {
+		sgpd    *mp4.Sgpd
+		indexes []uint32
+	}{{roll, rollIndexes}, {rap, rapIndexes}} {
+		if group.sgpd.EntryCount == 0 {
+			continue
+		}
+		sbgp := &mp4.Sbgp{GroupingType: binary.BigEndian.Uint32(group.sgpd.GroupingType[:])}
+		for _, index := range group.indexes {
+			if n := len(sbgp.Entries); n > 0 && sbgp.Entries[n-1].GroupDescriptionIndex == index {
+				sbgp.Entries[n-1].SampleCount++
+			} else {
+				sbgp.Entries = append(sbgp.Entries, mp4.SbgpEntry{SampleCount: 1, GroupDescriptionIndex: index})
+			}
+		}
+		sbgp.EntryCount = uint32(len(sbgp.Entries))
+		boxes = append(boxes, group.sgpd, sbgp)
+	}
+	return boxes
+}
+
+// newMP4Stsd builds the sample description of a track read from another
+// container.
+func newMP4Stsd(track *Track) ([]byte, error) {
+	if track.MP4A != nil {
+		return newMP4AStsd(track)
+	}
+	width, height := track.dimensions()
+	entry := &mp4.VisualSampleEntry{
+		SampleEntry:     mp4.SampleEntry{DataReferenceIndex: 1},
+		Width:           width,
+		Height:          height,
+		Horizresolution: 0x00480000, // 72 dpi
+		Vertresolution:  0x00480000,
+		FrameCount:      1,
+		Depth:           0x0018,
+		PreDefined3:     -1,
+	}
+
+	var config mp4.IImmutableBox
+	switch {
+	case track.AVC != nil:
+		entry.Type = mp4.BoxTypeAvc1()
+		avcC := track.AVC.AVCDecoderConfiguration
+		avcC.Type = mp4.BoxTypeAvcC()
+		config = &avcC
+	case track.AV1 != nil:
+		entry.Type = mp4.BoxTypeAv01()
+		av1C := track.AV1.Av1C
+		config = &av1C
+	case track.VPX != nil:
+		entry.Type = mp4.BoxTypeVp08()
+		if track.VPX.IsVP9() {
+			entry.Type = mp4.BoxTypeVp09()
+		}
+		vpcC := track.VPX.VpcC
+		if vpcC == nil {
+			vpcC = &mp4.VpcC{
+				Profile:                 track.VPX.Profile,
+				Level:                   10,
+				BitDepth:                track.VPX.BitDepth,
+				ChromaSubsampling:       1, // 4:2:0 colocated with luma
+				ColourPrimaries:         2, // unspecified
+				TransferCharacteristics: 2,
+				MatrixCoefficients:      2,
+			}
+			vpcC.SetVersion(1)
+		}
+		config = vpcC
+	default:
+		return nil, fmt.Errorf("no MP4 sample description for track %d", track.TrackID)
+	}
+
+	configData, err := marshalMP4Box(config)
+	if err != nil {
+		return nil, err
+	}
+	entryData, err := marshalMP4Box(entry, configData)
+	if err != nil {
+		return nil, err
+	}
+	return marshalMP4Box(&mp4.Stsd{EntryCount: 1}, entryData)
+}
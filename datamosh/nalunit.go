@@ -33,15 +33,29 @@ const (
 
 const EVC_MAX_PPS_COUNT = 64
 
+// Slice types, slice_type % 5
+const (
+	SLICE_P  = 0
+	SLICE_B  = 1
+	SLICE_I  = 2
+	SLICE_SP = 3
+	SLICE_SI = 4
+
+	sliceTypeUnknown = -1
+)
+
 // NALUnit represents a Network Abstraction Layer unit in a video file.
 type NALUnit struct {
-	Type      byte
-	Offset    int64  // inside the mdat box, first byte of the NAL unit data (header byte)
-	Length    uint32 // of the NAL unit data
-	TrackID   uint32
-	Chunk     uint32
-	SampleID  uint32
-	Timestamp uint64 // in the timescale of the track
+	Type       byte
+	RefIdc     byte
+	SliceType  int    // slice_type % 5 for slice units, -1 when unknown
+	Offset     int64  // inside the mdat box, first byte of the NAL unit data (header byte)
+	Length     uint32 // of the NAL unit data
+	TrackID    uint32
+	Chunk      uint32
+	SampleID   uint32
+	Timestamp  uint64 // presentation time in the timescale of the track
+	DecodeTime uint64 // in the timescale of the track
 }
 
 type NALHeader struct {
@@ -112,6 +126,8 @@ func (n *NALUnit) Nullify(w io.WriteSeeker) error {
 	if err != nil {
 		return fmt.Errorf("failed to write the NAL unit data: %v", err)
 	}
+	// the zeroed slice header has no slice type, as when read back
+	n.SliceType = sliceTypeUnknown
 
 	return nil
 }
@@ -209,23 +225,68 @@ func (n *NALUnit) ExtractRBSP(r io.ReadSeeker) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read NAL unit data: %v", err)
 	}
 
-	rbspBuf := make([]byte, len(nalBuf))
-	j := 0
+	return unescapeRBSP(nalBuf), nil
+}
 
-	for i := 0; i < nalSize; i++ {
-		if i+2 < nalSize && nalBuf[i] == 0x00 && nalBuf[i+1] == 0x00 && nalBuf[i+2] == 0x03 {
-			rbspBuf[j] = nalBuf[i]
-			j++
-			rbspBuf[j] = nalBuf[i+1]
-			j++
-			i += 2 // Skip the 0x03 byte
-		} else {
-			rbspBuf[j] = nalBuf[i]
-			j++
+// parseSliceType reads slice_type from the first bytes of a slice NAL unit,
+// right after the header byte. It returns slice_type % 5, or -1 if the data is
+// too short.
+func parseSliceType(data []byte) int {
+	br := bitio.NewReader(bytes.NewReader(unescapeRBSP(data)))
+	if _, err := br.ReadUE(); err != nil { // first_mb_in_slice
+		return sliceTypeUnknown
+	}
+	sliceType, err := br.ReadUE()
+	if err != nil {
+		return sliceTypeUnknown
+	}
+	return int(sliceType % 5)
+}
+
+// parseRecoveryPoint returns the recovery_frame_cnt of the recovery point
+// message of an SEI NAL unit, right after the header byte, and whether it
+// holds one.
+// See 7.3.2.3.1 Supplemental enhancement information message syntax and D.1.8
+func parseRecoveryPoint(data []byte) (uint32, bool) {
+	rbsp := unescapeRBSP(data)
+	// the messages until rbsp_trailing_bits
+	for i := 0; i < len(rbsp) && rbsp[i] != 0x80; {
+		var payloadType, payloadSize int
+		for _, value := range []*int{&payloadType, &payloadSize} {
+			for ; i < len(rbsp) && rbsp[i] == 0xff; i++ {
+				*value += 255
+			}
+			if i >= len(rbsp) {
+				return 0, false
+			}
+			*value += int(rbsp[i])
+			i++
+		}
+		if i+payloadSize > len(rbsp) {
+			return 0, false
+		}
+		if payloadType == 6 {
+			br := bitio.NewReader(bytes.NewReader(rbsp[i : i+payloadSize]))
+			frameCnt, err := br.ReadUE()
+			return frameCnt, err == nil
 		}
+		i += payloadSize
 	}
+	return 0, false
+}
 
-	return rbspBuf[:j], nil
+// unescapeRBSP removes the emulation prevention bytes from NAL unit data.
+func unescapeRBSP(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if i+2 < len(data) && data[i] == 0x00 && data[i+1] == 0x00 && data[i+2] == 0x03 {
+			rbsp = append(rbsp, 0x00, 0x00)
+			i += 2
+			continue
+		}
+		rbsp = append(rbsp, data[i])
+	}
+	return rbsp
 }
 
 // SPS represents the parsed sequence parameter set data.
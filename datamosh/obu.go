@@ -0,0 +1,112 @@
+package datamosh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abema/go-mp4"
+)
+
+// ParseOBUStream reads a low overhead bitstream format AV1 file (.obu), made of
+// OBUs with size fields, and returns it as a track with one sample per
+// temporal unit.
+func ParseOBUStream(r io.ReadSeeker) (*Track, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	track := &Track{
+		TrackID: 1,
+		Handler: handlerVideo,
+		Chunks:  mp4.Chunks{},
+		Samples: mp4.Samples{},
+	}
+
+	var sh *AV1SequenceHeader
+	unitStart := -1
+	closeUnit := func(end int) {
+		if unitStart < 0 || end <= unitStart {
+			return
+		}
+		track.Chunks = append(track.Chunks, &mp4.Chunk{
+			DataOffset:      uint64(unitStart),
+			SamplesPerChunk: 1,
+		})
+		track.Samples = append(track.Samples, &mp4.Sample{Size: uint32(end - unitStart)})
+	}
+
+	for pos := 0; pos < len(data); {
+		if data[pos]&0x02 == 0 {
+			return nil, fmt.Errorf("OBU at offset %d has no size field", pos)
+		}
+		obu, err := parseOBUHeader(data[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: %v", pos, err)
+		}
+		end := pos + int(obu.HeaderSize+obu.Length)
+		switch obu.Type {
+		case OBU_TEMPORAL_DELIMITER:
+			closeUnit(pos)
+			unitStart = pos
+		case OBU_SEQUENCE_HEADER:
+			if sh == nil {
+				sh, err = ParseAV1SequenceHeader(data[pos+int(obu.HeaderSize) : end])
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse sequence header: %v", err)
+				}
+				track.AV1 = newAV1ConfigFromSequenceHeader(sh, data[pos:end])
+			}
+		}
+		if unitStart < 0 {
+			unitStart = pos
+		}
+		pos = end
+	}
+	closeUnit(len(data))
+
+	if sh == nil {
+		return nil, errors.New("no AV1 sequence header found")
+	}
+
+	// Use the sequence timing info when present, 30 fps otherwise.
+	track.Timescale = 30
+	delta := uint32(1)
+	if sh.TimingInfoPresent && sh.TimeScale > 0 && sh.NumUnitsInDisplayTick > 0 {
+		track.Timescale = sh.TimeScale
+		delta = sh.NumUnitsInDisplayTick * (sh.NumTicksPerPictureMinus1 + 1)
+	}
+	for _, sample := range track.Samples {
+		sample.TimeDelta = delta
+		track.Duration += uint64(delta)
+	}
+
+	track.OBUs, err = processAV1Track(r, track)
+	if err != nil {
+		return nil, err
+	}
+
+	return track, nil
+}
+
+// WriteOBUStream writes the given samples of an AV1 track read from r as a
+// low overhead bitstream format file, in the given order.
+func WriteOBUStream(w io.Writer, r io.ReadSeeker, track *Track, samples []uint32) error {
+	offsets := track.sampleOffsets()
+	for _, id := range samples {
+		if int(id) >= len(track.Samples) {
+			return fmt.Errorf("sample %d out of range", id)
+		}
+		if _, err := r.Seek(int64(offsets[id]), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, int64(track.Samples[id].Size)); err != nil {
+			return fmt.Errorf("failed to copy sample %d: %v", id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package datamosh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sunfish-shogi/bufseekio"
+)
+
+// gop is a group of pictures of a track: the frames from a key sample to the
+// next one, processed in order by a single worker.
+type gop struct {
+	track     *Track
+	frames    []Frame
+	keys      int // key samples before the GOP, across the tracks
+	nullified map[uint32]bool
+	ctx       context.Context
+}
+
+// ProcessFramesParallel runs fn on the frames of the tracks of an MP4 file like
+// ProcessFrames, with up to concurrency workers, one per CPU when concurrency
+// is 0 or less. The frames of the tracks are parsed concurrently, then the GOPs
+// of all the tracks, each starting at a key frame, are processed concurrently.
+// Like ProcessFrames, and unlike StreamFrames, it keeps all the frames of the
+// file in memory.
+//
+// The frames of a GOP are given to fn in order with a context of their own,
+// derived from ctx with the track and the IFrameCountKey count of the key
+// samples before the GOP, so NullifyIFrames behaves as with ProcessFrames. The
+// returned context holds the counts of all the GOPs, whatever the order in
+// which they were processed. The workers share the file, so fn must only write
+// the data of the frame it's given, with WriteAt. Interactive contexts are
+// processed sequentially by ProcessFrames, the answers applying to the next
+// frames. As with StreamFrames, ErrNoSyncSampleBox is returned once all the
+// tracks are processed if the file must be remuxed.
+func ProcessFramesParallel(ctx context.Context, inputFile *os.File, fn FrameProcessor, concurrency int) (context.Context, error) {
+	if interactive, _ := ctx.Value(InteractiveKey).(bool); interactive {
+		return ProcessFrames(ctx, inputFile, fn)
+	}
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	tracks, err := ReadTracks(inputFile)
+	if err != nil {
+		fmt.Println("Error parsing tracks:", err)
+		return ctx, err
+	}
+	err = runParallel(len(tracks), concurrency, func(i int) error {
+		// each worker reads the file at its own offset
+		r := bufseekio.NewReadSeeker(io.NewSectionReader(inputFile, 0, math.MaxInt64), 128*1024, 4)
+		return processTracks(r, tracks[i:i+1])
+	})
+	if err != nil {
+		return ctx, err
+	}
+
+	startCount, _ := ctx.Value(IFrameCountKey).(int)
+	removedCount, _ := ctx.Value(IFrameRemovedCountKey).(int)
+	gops := splitGOPs(tracks)
+	err = runParallel(len(gops), concurrency, func(i int) error {
+		g := gops[i]
+		gopContext := context.WithValue(ctx, TrackKey, g.track)
+		gopContext = context.WithValue(gopContext, nullifiedSamplesKey, g.nullified)
+		gopContext = context.WithValue(gopContext, IFrameCountKey, startCount+g.keys)
+		gopContext = context.WithValue(gopContext, IFrameRemovedCountKey, 0)
+		var err error
+		for _, frame := range g.frames {
+			gopContext, err = fn(gopContext, inputFile, frame)
+			if err != nil {
+				log.Printf("Error processing frame: %v - %v", frame, err)
+				return err
+			}
+		}
+		g.ctx = gopContext
+		return nil
+	})
+	if err != nil {
+		return ctx, err
+	}
+
+	// merge the GOPs in order, then the sync samples of each track
+	iFrameCount := startCount
+	nullified := map[*Track]map[uint32]bool{}
+	for _, g := range gops {
+		if count, ok := g.ctx.Value(IFrameCountKey).(int); ok {
+			iFrameCount += count - startCount - g.keys
+		}
+		if count, ok := g.ctx.Value(IFrameRemovedCountKey).(int); ok {
+			removedCount += count
+		}
+		if nullified[g.track] == nil {
+			nullified[g.track] = map[uint32]bool{}
+		}
+		for id := range g.nullified {
+			nullified[g.track][id] = true
+		}
+	}
+	var syncErr error
+	for _, track := range tracks {
+		if ids := nullified[track]; len(ids) > 0 {
+			// players must not seek to the nullified key frames
+			if err := track.removeSyncSamples(inputFile, ids); errors.Is(err, ErrNoSyncSampleBox) {
+				syncErr = err
+			} else if err != nil {
+				return ctx, err
+			}
+		}
+	}
+	if len(gops) > 0 {
+		ctx = context.WithValue(ctx, IFrameCountKey, iFrameCount)
+		ctx = context.WithValue(ctx, IFrameRemovedCountKey, removedCount)
+	}
+	return ctx, syncErr
+}
+
+// splitGOPs splits the frames of the tracks in GOPs starting at their key
+// samples, the frames before the first key sample of a track forming a GOP of
+// their own.
+func splitGOPs(tracks []*Track) []*gop {
+	var gops []*gop
+	keyCount := 0
+	for _, track := range tracks {
+		frames := track.Frames()
+		keys := keySamples(track)
+		var current *gop
+		for i, frame := range frames {
+			sample := frame.Sample()
+			first := i == 0 || frames[i-1].Sample() != sample
+			if current == nil || (first && keys[sample]) {
+				current = &gop{track: track, keys: keyCount, nullified: map[uint32]bool{}}
+				gops = append(gops, current)
+			}
+			if first && keys[sample] {
+				keyCount++
+			}
+			current.frames = append(current.frames, frame)
+		}
+	}
+	return gops
+}
+
+// runParallel calls fn for the indexes from 0 to n-1, in order, with up to
+// concurrency goroutines. Once a call fails the next indexes are skipped, and
+// the error of the lowest failing index is returned so the result doesn't
+// depend on the scheduling.
+func runParallel(n, concurrency int, fn func(i int) error) error {
+	errs := make([]error, n)
+	var failed atomic.Bool
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(concurrency, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if errs[i] = fn(i); errs[i] != nil {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	for i := 0; i < n && !failed.Load(); i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package datamosh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessFramesParallelNullifyIFrames(t *testing.T) {
+	// MP4 files with several GOPs of each codec
+	toMP4 := func(t *testing.T, ivf []byte) []byte {
+		out := &bytes.Buffer{}
+		require.NoError(t, Remux(out, bytes.NewReader(ivf), ContainerMP4, nil))
+		return out.Bytes()
+	}
+	vp9 := [][]byte{}
+	for i := 0; i < 3; i++ {
+		vp9 = append(vp9, testVP9Frame(true, true, 0), testVP9Frame(false, true, 0x01))
+	}
+	tests := []struct {
+		name    string
+		data    func(t *testing.T) []byte
+		count   int // key frames
+		removed int
+	}{
+		{name: "h264", data: func(t *testing.T) []byte {
+			return mp4Fixture{gop: "IPPIPPIPPIPIPP", heightMbs: 3, slices: 2, audio: true}.withDefaults().build(t)
+		}, count: 5, removed: 4},
+		{name: "av1", data: func(t *testing.T) []byte {
+			return toMP4(t, testIVF(append(testAV1Frames(), testAV1Frames()...)))
+		}, count: 4, removed: 3},
+		{name: "vp9", data: func(t *testing.T) []byte {
+			return toMP4(t, testVPXIVF("VP90", vp9))
+		}, count: 3, removed: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.data(t)
+			process := func(name string, concurrency int) (context.Context, []byte) {
+				path := filepath.Join(t.TempDir(), name+".mp4")
+				require.NoError(t, os.WriteFile(path, data, 0o644))
+				f, err := os.OpenFile(path, os.O_RDWR, 0)
+				require.NoError(t, err)
+				var ctx context.Context
+				if concurrency == 0 {
+					ctx, err = ProcessFrames(context.Background(), f, NullifyIFrames)
+				} else {
+					ctx, err = ProcessFramesParallel(context.Background(), f, NullifyIFrames, concurrency)
+				}
+				require.NoError(t, err)
+				require.NoError(t, f.Close())
+				out, err := os.ReadFile(path)
+				require.NoError(t, err)
+				return ctx, out
+			}
+
+			_, want := process("sequential", 0)
+			assert.NotEqual(t, data, want)
+			for _, concurrency := range []int{1, 2, 8} {
+				// the output doesn't depend on the number of workers
+				ctx, got := process(fmt.Sprint("parallel", concurrency), concurrency)
+				assert.Equal(t, tt.count, ctx.Value(IFrameCountKey), concurrency)
+				assert.Equal(t, tt.removed, ctx.Value(IFrameRemovedCountKey), concurrency)
+				assert.Equal(t, want, got, concurrency)
+			}
+		})
+	}
+}
+
+func TestSplitGOPs(t *testing.T) {
+	fixture := mp4Fixture{gop: "PIPPIPIP", heightMbs: 2, slices: 2, audio: true}.withDefaults()
+	f, err := os.CreateTemp(t.TempDir(), "gops")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write(fixture.build(t))
+	require.NoError(t, err)
+	tracks, err := ParseTracks(f)
+	require.NoError(t, err)
+
+	var starts []uint32
+	var keys []int
+	frames := 0
+	for _, g := range splitGOPs(tracks) {
+		assert.Equal(t, tracks[0], g.track)
+		starts = append(starts, g.frames[0].Sample())
+		keys = append(keys, g.keys)
+		frames += len(g.frames)
+	}
+	// the P frame before the first key frame forms a GOP of its own
+	assert.Equal(t, []uint32{0, 1, 4, 6}, starts)
+	assert.Equal(t, []int{0, 0, 1, 2}, keys)
+	assert.Equal(t, len(tracks[0].Frames()), frames)
+}
+
+func TestRunParallel(t *testing.T) {
+	var running, peak atomic.Int32
+	var calls atomic.Int32
+	err := runParallel(20, 3, func(i int) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		calls.Add(1)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, 20, calls.Load())
+	assert.LessOrEqual(t, peak.Load(), int32(3))
+
+	// the error of the lowest failing index is returned
+	for i := 0; i < 20; i++ {
+		err := runParallel(20, 4, func(i int) error {
+			if i%5 == 3 {
+				return fmt.Errorf("index %d", i)
+			}
+			return nil
+		})
+		assert.EqualError(t, err, "index 3")
+	}
+	assert.NoError(t, runParallel(0, 4, func(i int) error { return errors.New("unexpected") }))
+}
@@ -1,6 +1,7 @@
 package datamosh
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -23,36 +24,62 @@ func ProcessFrames(ctx context.Context, inputFile *os.File, fn FrameProcessor) (
 	}
 
 	currentContext := ctx
+	var syncErr error
 	for _, track := range tracks {
-		if track.AVC != nil {
-			currentContext = context.WithValue(currentContext, TrackKey, track)
-			for _, nalUnit := range track.NALs {
-				if nalUnit.Type == NAL_IDR_SLICE {
-					fmt.Println("IDR Frame", nalUnit.Offset, nalUnit.Length)
-					r.Seek(nalUnit.Offset, io.SeekStart)
-					header, err := nalUnit.ParseHeader(r)
-					if err != nil {
-						panic(err)
-					}
-					fmt.Printf("  header: %#v\n", header)
-					hexDump(r, 8)
-				}
-				currentContext, err = fn(currentContext, inputFile, nalUnit)
+		frames := track.Frames()
+		if len(frames) == 0 {
+			continue
+		}
+		currentContext = context.WithValue(currentContext, TrackKey, track)
+		nullified := map[uint32]bool{}
+		currentContext = context.WithValue(currentContext, nullifiedSamplesKey, nullified)
+		for _, frame := range frames {
+			if nalUnit, ok := frame.(*NALUnit); ok && nalUnit.Type == NAL_IDR_SLICE && Debug {
+				fmt.Println("IDR Frame", nalUnit.Offset, nalUnit.Length)
+				r.Seek(nalUnit.Offset, io.SeekStart)
+				header, err := nalUnit.ParseHeader(r)
 				if err != nil {
-					log.Printf("Error processing frame: %v - %v", nalUnit, err)
-					return currentContext, err
+					return currentContext, fmt.Errorf("failed to parse the header of the IDR frame at offset %d: %v", nalUnit.Offset, err)
 				}
+				fmt.Printf("  header: %#v\n", header)
+				hexDump(r, 8)
 			}
+			currentContext, err = fn(currentContext, inputFile, frame)
+			if err != nil {
+				log.Printf("Error processing frame: %v - %v", frame, err)
+				return currentContext, err
+			}
+		}
+		// players must not seek to the nullified key frames
+		if err := track.removeSyncSamples(inputFile, nullified); errors.Is(err, ErrNoSyncSampleBox) {
+			syncErr = err
+		} else if err != nil {
+			return currentContext, err
 		}
 	}
 
-	return currentContext, nil
+	return currentContext, syncErr
 }
 
-// Parse Tracks parses the track information from the reader and returns a slice of tracks.
+// ParseTracks parses the tracks of an MP4 file and the frames of the tracks
+// using a supported codec.
 func ParseTracks(r io.ReadSeeker) ([]*Track, error) {
+	r = bufferedReader(r)
+	tracks, err := ReadTracks(r)
+	if err != nil {
+		return tracks, err
+	}
+	return tracks, processTracks(r, tracks)
+}
+
+// ReadTracks parses the tracks of an MP4 file and their sample tables, without
+// their frames, for StreamFrames and NALIterator.
+func ReadTracks(r io.ReadSeeker) ([]*Track, error) {
 	var err error
+	r = bufferedReader(r)
 	tracks := []*Track{}
+	var movieTimescale uint32
+	trex := map[uint32]*mp4.Trex{}
 
 	_, err = mp4.ReadBoxStructure(r, func(h *mp4.ReadHandle) (interface{}, error) {
 
@@ -68,19 +95,27 @@ func ParseTracks(r io.ReadSeeker) ([]*Track, error) {
 		var err error
 
 		switch h.BoxInfo.Type {
-		case mp4.BoxTypeTrak():
-			track, err := processTrak(r, bi)
+		case mp4.BoxTypeMvhd():
+			box, _, err := h.ReadPayload()
 			if err != nil {
 				return nil, err
 			}
-			if track.AVC != nil {
-				track.NALs, err = processTrack(r, track)
-				if err != nil {
-					fmt.Println("Error processing track:", err)
-					return nil, err
-				}
+			movieTimescale = box.(*mp4.Mvhd).Timescale
+		case mp4.BoxTypeTrak():
+			track, err := processTrak(r, bi, movieTimescale)
+			if err != nil {
+				return nil, err
 			}
 			tracks = append(tracks, track)
+		case mp4.BoxTypeTrex():
+			box, _, err := h.ReadPayload()
+			if err != nil {
+				return nil, err
+			}
+			trex[box.(*mp4.Trex).TrackID] = box.(*mp4.Trex)
+		case mp4.BoxTypeMoof():
+			// the samples of fragmented files follow the moov box
+			return nil, readMoof(r, bi, tracks, trex)
 		default:
 		}
 
@@ -90,6 +125,9 @@ func ParseTracks(r io.ReadSeeker) ([]*Track, error) {
 
 		return nil, nil
 	})
+	if err == nil {
+		setFragmentedDurations(tracks)
+	}
 
 	if err != nil {
 		fmt.Println("Error reading box structure:", err)
@@ -99,6 +137,58 @@ func ParseTracks(r io.ReadSeeker) ([]*Track, error) {
 	return tracks, nil
 }
 
+// bufferedReader returns r buffered for the many small reads of the box
+// parser, unless it already is or reads from memory.
+func bufferedReader(r io.ReadSeeker) io.ReadSeeker {
+	switch r.(type) {
+	case *bufseekio.ReadSeeker, *bytes.Reader:
+		return r
+	}
+	return bufseekio.NewReadSeeker(r, 128*1024, 4)
+}
+
+// setFragmentedDurations sets the duration of the tracks of fragmented files,
+// only known once their fragments are read.
+func setFragmentedDurations(tracks []*Track) {
+	for _, track := range tracks {
+		if track.Duration == 0 {
+			for _, sample := range track.Samples {
+				track.Duration += uint64(sample.TimeDelta)
+			}
+		}
+	}
+}
+
+// processTracks reads the frames of the tracks once all their samples are
+// known, fragments included.
+func processTracks(r io.ReadSeeker, tracks []*Track) error {
+	var err error
+	for _, track := range tracks {
+		if track.AVC != nil {
+			track.NALs, err = processTrack(r, track)
+			if err != nil {
+				fmt.Println("Error processing track:", err)
+				return err
+			}
+		}
+		if track.AV1 != nil {
+			track.OBUs, err = processAV1Track(r, track)
+			if err != nil {
+				fmt.Println("Error processing track:", err)
+				return err
+			}
+		}
+		if track.VPX != nil {
+			track.VPXFrames, err = processVPXTrack(r, track)
+			if err != nil {
+				fmt.Println("Error processing track:", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func ProcessFile(inputFile *os.File, outputFile *os.File) error {
 	r := bufseekio.NewReadSeeker(inputFile, 128*1024, 4)
 	tracks, err := ParseTracks(r)
@@ -145,7 +235,7 @@ func ProcessFile(inputFile *os.File, outputFile *os.File) error {
 
 			sawFirstIFrame := false
 			for _, nalUnit := range track.NALs {
-				timestampInSecs := float32(nalUnit.Timestamp / uint64(track.Timescale))
+				pts, _ := track.PresentationTime(int64(nalUnit.Timestamp))
 
 				switch nalUnit.Type {
 				case byte(NAL_SLICE):
@@ -163,7 +253,7 @@ func ProcessFile(inputFile *os.File, outputFile *os.File) error {
 						fmt.Println("Error parsing slice:", err)
 						return err
 					}
-					fmt.Printf("%.2f IDR Frame: %s\n", timestampInSecs, sliceType)
+					fmt.Printf("%s IDR Frame: %s\n", pts, sliceType)
 					if !sawFirstIFrame {
 						sawFirstIFrame = true
 						// skip the first iframe since we want the video to start properly
@@ -193,16 +283,26 @@ func ProcessFile(inputFile *os.File, outputFile *os.File) error {
 	return err
 }
 
-func processTrak(r io.ReadSeeker, bi *mp4.BoxInfo) (*Track, error) {
+// processTrak reads the track of a trak box, the segment durations of its edit
+// list being in the movie timescale.
+func processTrak(r io.ReadSeeker, bi *mp4.BoxInfo, movieTimescale uint32) (*Track, error) {
 
 	bips, err := mp4.ExtractBoxesWithPayload(r, bi, []mp4.BoxPath{
 		{mp4.BoxTypeTkhd()},
 		{mp4.BoxTypeEdts(), mp4.BoxTypeElst()},
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMdhd()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeHdlr()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd()},
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeAvc1()},
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeAvc1(), mp4.BoxTypeAvcC()},
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeEncv()},
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeEncv(), mp4.BoxTypeAvcC()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeAv01()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeAv01(), mp4.BoxTypeAv1C()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeVp08()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeVp08(), mp4.BoxTypeVpcC()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeVp09()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeVp09(), mp4.BoxTypeVpcC()},
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeMp4a()},
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeMp4a(), mp4.BoxTypeEsds()},
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsd(), mp4.BoxTypeMp4a(), mp4.BoxTypeWave(), mp4.BoxTypeEsds()},
@@ -214,6 +314,10 @@ func processTrak(r io.ReadSeeker, bi *mp4.BoxInfo) (*Track, error) {
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeCtts()},
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsc()},
 		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStsz()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeStss()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeSdtp()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeSgpd()},
+		{mp4.BoxTypeMdia(), mp4.BoxTypeMinf(), mp4.BoxTypeStbl(), mp4.BoxTypeSbgp()},
 	})
 	if err != nil {
 		return nil, err
@@ -221,16 +325,26 @@ func processTrak(r io.ReadSeeker, bi *mp4.BoxInfo) (*Track, error) {
 	var tkhd *mp4.Tkhd
 	var elst *mp4.Elst
 	var mdhd *mp4.Mdhd
+	var stsdInfo *mp4.BoxInfo
 	var avc1 *mp4.VisualSampleEntry
 	var avcC *mp4.AVCDecoderConfiguration
-	// var audioSampleEntry *mp4.AudioSampleEntry
-	// var esds *mp4.Esds
+	var av01 *mp4.VisualSampleEntry
+	var av1C *mp4.Av1C
+	var vpxEntry *mp4.VisualSampleEntry
+	var vpxFourCC [4]byte
+	var vpcC *mp4.VpcC
+	var audioSampleEntry *mp4.AudioSampleEntry
+	var esds *mp4.Esds
 	var stco *mp4.Stco
 	var stts *mp4.Stts
 	var stsc *mp4.Stsc
 	var ctts *mp4.Ctts
 	var stsz *mp4.Stsz
 	var co64 *mp4.Co64
+	var stss *mp4.Stss
+	var sdtp *mp4.Sdtp
+	var sgpds []*mp4.Sgpd
+	var sbgps []*mp4.Sbgp
 	var track Track
 
 	for _, bip := range bips {
@@ -241,23 +355,39 @@ func processTrak(r io.ReadSeeker, bi *mp4.BoxInfo) (*Track, error) {
 			elst = bip.Payload.(*mp4.Elst)
 		case mp4.BoxTypeMdhd():
 			mdhd = bip.Payload.(*mp4.Mdhd)
+		case mp4.BoxTypeHdlr():
+			track.Handler = bip.Payload.(*mp4.Hdlr).HandlerType
+		case mp4.BoxTypeStsd():
+			stsdInfo = &bip.Info
 		case mp4.BoxTypeAvc1():
 			track.Codec = mp4.CodecAVC1
 			avc1 = bip.Payload.(*mp4.VisualSampleEntry)
 		case mp4.BoxTypeAvcC():
 			avcC = bip.Payload.(*mp4.AVCDecoderConfiguration)
+		case mp4.BoxTypeAv01():
+			av01 = bip.Payload.(*mp4.VisualSampleEntry)
+		case mp4.BoxTypeAv1C():
+			av1C = bip.Payload.(*mp4.Av1C)
+		case mp4.BoxTypeVp08():
+			vpxEntry = bip.Payload.(*mp4.VisualSampleEntry)
+			vpxFourCC = fourCCVP8
+		case mp4.BoxTypeVp09():
+			vpxEntry = bip.Payload.(*mp4.VisualSampleEntry)
+			vpxFourCC = fourCCVP9
+		case mp4.BoxTypeVpcC():
+			vpcC = bip.Payload.(*mp4.VpcC)
 		case mp4.BoxTypeEncv():
 			track.Codec = mp4.CodecAVC1
 			track.Encrypted = true
 		case mp4.BoxTypeMp4a():
 			track.Codec = mp4.CodecMP4A
-			// audioSampleEntry = bip.Payload.(*mp4.AudioSampleEntry)
+			audioSampleEntry = bip.Payload.(*mp4.AudioSampleEntry)
 		case mp4.BoxTypeEnca():
 			track.Codec = mp4.CodecMP4A
 			track.Encrypted = true
-			// audioSampleEntry = bip.Payload.(*mp4.AudioSampleEntry)
+			audioSampleEntry = bip.Payload.(*mp4.AudioSampleEntry)
 		case mp4.BoxTypeEsds():
-			// esds = bip.Payload.(*mp4.Esds)
+			esds = bip.Payload.(*mp4.Esds)
 		case mp4.BoxTypeStco():
 			stco = bip.Payload.(*mp4.Stco)
 		case mp4.BoxTypeStts():
@@ -270,6 +400,15 @@ func processTrak(r io.ReadSeeker, bi *mp4.BoxInfo) (*Track, error) {
 			stsz = bip.Payload.(*mp4.Stsz)
 		case mp4.BoxTypeCo64():
 			co64 = bip.Payload.(*mp4.Co64)
+		case mp4.BoxTypeStss():
+			stss = bip.Payload.(*mp4.Stss)
+			track.stss = &bip.Info
+		case mp4.BoxTypeSdtp():
+			sdtp = bip.Payload.(*mp4.Sdtp)
+		case mp4.BoxTypeSgpd():
+			sgpds = append(sgpds, bip.Payload.(*mp4.Sgpd))
+		case mp4.BoxTypeSbgp():
+			sbgps = append(sbgps, bip.Payload.(*mp4.Sbgp))
 		}
 	}
 
@@ -281,12 +420,22 @@ func processTrak(r io.ReadSeeker, bi *mp4.BoxInfo) (*Track, error) {
 	track.Timescale = mdhd.Timescale
 	track.TrakOffset = bi.Offset
 
+	if mdhd == nil {
+		return nil, errors.New("mdhd box not found")
+	}
+	track.Timescale = mdhd.Timescale
+	track.Duration = mdhd.GetDuration()
+
 	if elst != nil {
-		editList := make([]*mp4.EditListEntry, 0, len(elst.Entries))
-		for i := range elst.Entries {
-			editList = append(editList, &mp4.EditListEntry{
+		if movieTimescale == 0 {
+			return nil, errors.New("mvhd box not found")
+		}
+		editList := make([]Edit, 0, len(elst.Entries))
+		for i, entry := range elst.Entries {
+			editList = append(editList, Edit{
+				SegmentDuration: elst.GetSegmentDuration(i) * uint64(track.Timescale) / uint64(movieTimescale),
 				MediaTime:       elst.GetMediaTime(i),
-				SegmentDuration: elst.GetSegmentDuration(i),
+				Rate:            entry.MediaRateInteger,
 			})
 			if Debug {
 				fmt.Printf("Segment: time: %d duration: %d\n", elst.GetMediaTime(i), elst.GetSegmentDuration(i))
@@ -295,11 +444,16 @@ func processTrak(r io.ReadSeeker, bi *mp4.BoxInfo) (*Track, error) {
 		track.EditList = editList
 	}
 
-	if mdhd == nil {
-		return nil, errors.New("mdhd box not found")
+	// keep the sample description as is so it can be copied to a new file
+	if stsdInfo != nil {
+		if _, err := stsdInfo.SeekToStart(r); err != nil {
+			return nil, err
+		}
+		track.stsd = make([]byte, stsdInfo.Size)
+		if _, err := io.ReadFull(r, track.stsd); err != nil {
+			return nil, fmt.Errorf("failed to read stsd box: %v", err)
+		}
 	}
-	track.Timescale = mdhd.Timescale
-	track.Duration = mdhd.GetDuration()
 
 	if avc1 != nil && avcC != nil {
 		track.AVC = &AVCDecoderConfig{
@@ -310,17 +464,22 @@ func processTrak(r io.ReadSeeker, bi *mp4.BoxInfo) (*Track, error) {
 		}
 	}
 
-	// if audioSampleEntry != nil && esds != nil {
-	// 	oti, audOTI, err := mp4.detectAACProfile(esds)
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	track.MP4A = &mp4.MP4AInfo{
-	// 		OTI:          oti,
-	// 		AudOTI:       audOTI,
-	// 		ChannelCount: audioSampleEntry.ChannelCount,
-	// 	}
-	// }
+	if av01 != nil && av1C != nil {
+		track.AV1, err = newAV1Config(av01, av1C)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if vpxEntry != nil {
+		track.VPX = newVPXConfig(vpxFourCC, vpxEntry, vpcC)
+	}
+
+	if audioSampleEntry != nil && esds != nil {
+		if track.MP4A, err = newMP4AConfig(audioSampleEntry, esds); err != nil {
+			return nil, err
+		}
+	}
 
 	track.Chunks = make([]*mp4.Chunk, 0)
 	if stco != nil {
@@ -383,117 +542,72 @@ func processTrak(r io.ReadSeeker, bi *mp4.BoxInfo) (*Track, error) {
 		}
 	}
 
+	track.SampleFlags = newSampleFlags(len(track.Samples), stss, sdtp, sgpds, sbgps)
+
 	return &track, nil
 }
 
+// processTrack reads the NAL units of an H.264 track.
 func processTrack(r io.ReadSeeker, track *Track) ([]*NALUnit, error) {
-	if track.AVC == nil {
-		return nil, errors.New("AVC configuration not found")
+	it, err := NewNALIterator(r, track)
+	if err != nil {
+		return nil, err
 	}
-	lengthSize := uint32(track.AVC.LengthSize)
-
 	nalUnits := []*NALUnit{}
-
-	var si int
-	currentTime := uint64(0)
-	for nChunk, chunk := range track.Chunks {
-		end := si + int(chunk.SamplesPerChunk)
-		dataOffset := chunk.DataOffset
-		if Debug {
-			fmt.Printf("Chunk %d: offset: %d, samples %d-%d\n", nChunk, dataOffset, si, end)
-		}
-		for ; si < end && si < len(track.Samples); si++ {
-			sample := track.Samples[si]
-			if sample.Size == 0 {
-				continue
-			}
-
-			// Calculate presentation time for the sample
-			presentationTime := currentTime + uint64(sample.CompositionTimeOffset)
-
-			for nalOffset := uint32(0); nalOffset+lengthSize+1 <= sample.Size; {
-				if _, err := r.Seek(int64(dataOffset+uint64(nalOffset)), io.SeekStart); err != nil {
-					return nalUnits, err
-				}
-				data := make([]byte, lengthSize+1)
-				if _, err := io.ReadFull(r, data); err != nil {
-					return nalUnits, err
-				}
-				var length uint32
-				for i := 0; i < int(lengthSize); i++ {
-					length = (length << 8) + uint32(data[i])
-				}
-				nalHeader := data[lengthSize]
-				nalType := nalHeader & 0x1f
-
-				if Debug {
-					switch nalType {
-					case 1:
-						fmt.Println("  P-frame or B-frame")
-						// fmt.Println("\tCoded slice of a non-IDR picture")
-						// fmt.Println("\tThis type represents a regular slice of a P-frame or B-frame. Non-IDR pictures are used for inter-prediction and are dependent on other frames for decoding.")
-					case 2:
-						fmt.Println("  Data Partition A")
-					case 3:
-						fmt.Println("  Data Partition B")
-					case 4:
-						fmt.Println("  Data Partition C")
-					case 5:
-						fmt.Println("  I-frame")
-						// fmt.Println("\tCoded slice of an IDR (Instantaneous Decoding Refresh) picture")
-						// fmt.Println("\tAn IDR picture is a special type of I-frame that serves as a recovery point for the decoder. When an IDR picture is encountered, the decoder discards all previously decoded pictures and starts decoding afresh from the IDR picture.")
-					case 6:
-						fmt.Println("  SEI Metadata")
-						// fmt.Println("\tSupplemental Enhancement Information (SEI)")
-						// fmt.Println("\tSEI messages contain metadata about the video stream that can be used for various purposes, such as buffering, picture timing, and user data.")
-					case 7:
-						fmt.Println("  Sequence parameter set")
-					case 8:
-						fmt.Println("  Picture parameter set")
-					case 9:
-						fmt.Println("  Access unit delimiter")
-					case 10:
-						fmt.Println("  End of sequence")
-					case 11:
-						fmt.Println("  End of stream")
-					case 12:
-						fmt.Println("  Filler data")
-					case 13:
-						fmt.Println("  Sequence parameter set extension")
-					case 14:
-						fmt.Println("  Prefix NAL unit")
-					case 15:
-						fmt.Println("  Subset sequence parameter set")
-					case 19:
-						fmt.Println("  Auxiliary coded picture without partitioning")
-					case 20:
-						fmt.Println("  Slice extension")
-					case 21:
-						fmt.Println("  Slice extension for depth view components")
-					default:
-						fmt.Println("  NAL type:", nalType)
-					}
-					fmt.Println(int64(dataOffset+uint64(nalOffset)), length)
-					fmt.Println()
-				}
-
-				nalUnits = append(nalUnits, &NALUnit{
-					Type:      nalType,
-					Offset:    int64(dataOffset+uint64(nalOffset)) + int64(lengthSize),
-					Length:    length,
-					TrackID:   track.TrackID,
-					Chunk:     uint32(nChunk),
-					SampleID:  uint32(si),
-					Timestamp: presentationTime,
-				})
-
-				nalOffset += lengthSize + length
-			}
-			dataOffset += uint64(sample.Size)
-			// Increment the current time by the sample's time delta
-			currentTime += uint64(sample.TimeDelta)
-		}
+	for it.Next() {
+		nalUnits = append(nalUnits, it.NAL())
 	}
+	return nalUnits, it.Err()
+}
 
-	return nalUnits, nil
+// debugNAL prints the type, offset and length of a NAL unit.
+func debugNAL(nalType byte, offset int64, length uint32) {
+	switch nalType {
+	case 1:
+		fmt.Println("  P-frame or B-frame")
+		// fmt.Println("\tCoded slice of a non-IDR picture")
+		// fmt.Println("\tThis type represents a regular slice of a P-frame or B-frame. Non-IDR pictures are used for inter-prediction and are dependent on other frames for decoding.")
+	case 2:
+		fmt.Println("  Data Partition A")
+	case 3:
+		fmt.Println("  Data Partition B")
+	case 4:
+		fmt.Println("  Data Partition C")
+	case 5:
+		fmt.Println("  I-frame")
+		// fmt.Println("\tCoded slice of an IDR (Instantaneous Decoding Refresh) picture")
+		// fmt.Println("\tAn IDR picture is a special type of I-frame that serves as a recovery point for the decoder. When an IDR picture is encountered, the decoder discards all previously decoded pictures and starts decoding afresh from the IDR picture.")
+	case 6:
+		fmt.Println("  SEI Metadata")
+		// fmt.Println("\tSupplemental Enhancement Information (SEI)")
+		// fmt.Println("\tSEI messages contain metadata about the video stream that can be used for various purposes, such as buffering, picture timing, and user data.")
+	case 7:
+		fmt.Println("  Sequence parameter set")
+	case 8:
+		fmt.Println("  Picture parameter set")
+	case 9:
+		fmt.Println("  Access unit delimiter")
+	case 10:
+		fmt.Println("  End of sequence")
+	case 11:
+		fmt.Println("  End of stream")
+	case 12:
+		fmt.Println("  Filler data")
+	case 13:
+		fmt.Println("  Sequence parameter set extension")
+	case 14:
+		fmt.Println("  Prefix NAL unit")
+	case 15:
+		fmt.Println("  Subset sequence parameter set")
+	case 19:
+		fmt.Println("  Auxiliary coded picture without partitioning")
+	case 20:
+		fmt.Println("  Slice extension")
+	case 21:
+		fmt.Println("  Slice extension for depth view components")
+	default:
+		fmt.Println("  NAL type:", nalType)
+	}
+	fmt.Println(offset, length)
+	fmt.Println()
 }
@@ -0,0 +1,253 @@
+package datamosh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"os"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTracks(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixture  mp4Fixture
+		kinds    []FrameKind // of the samples in decoding order
+		keys     []uint32
+		editList []Edit
+	}{
+		{
+			name:    "gops",
+			fixture: mp4Fixture{gop: "IPPPIPPP"},
+			kinds:   []FrameKind{FrameKindI, FrameKindP, FrameKindP, FrameKindP, FrameKindI, FrameKindP, FrameKindP, FrameKindP},
+			keys:    []uint32{0, 4},
+		},
+		{
+			name:    "slices",
+			fixture: mp4Fixture{gop: "IPPIP", heightMbs: 3, slices: 3, chunk: 2},
+			kinds:   []FrameKind{FrameKindI, FrameKindP, FrameKindP, FrameKindI, FrameKindP},
+			keys:    []uint32{0, 3},
+		},
+		{
+			name:    "non idr",
+			fixture: mp4Fixture{gop: "IPiP"},
+			kinds:   []FrameKind{FrameKindI, FrameKindP, FrameKindI, FrameKindP},
+			keys:    []uint32{0},
+		},
+		{
+			name:    "b frames",
+			fixture: mp4Fixture{gop: "IBBPBBPIBP", slices: 2},
+			kinds:   []FrameKind{FrameKindI, FrameKindP, FrameKindB, FrameKindB, FrameKindP, FrameKindB, FrameKindB, FrameKindI, FrameKindP, FrameKindB},
+			keys:    []uint32{0, 7},
+		},
+		{
+			name: "edit list",
+			fixture: mp4Fixture{gop: "IBPBP", editList: []mp4.ElstEntry{
+				{SegmentDurationV1: 200, MediaTimeV1: -1, MediaRateInteger: 1},
+				{SegmentDurationV1: 200, MediaTimeV1: fixtureFrameDuration, MediaRateInteger: 1},
+			}},
+			kinds: []FrameKind{FrameKindI, FrameKindP, FrameKindB, FrameKindP, FrameKindB},
+			keys:  []uint32{0},
+			editList: []Edit{
+				{SegmentDuration: 200 * fixtureTimescale / mp4MovieTimescale, MediaTime: -1, Rate: 1},
+				{SegmentDuration: 200 * fixtureTimescale / mp4MovieTimescale, MediaTime: fixtureFrameDuration, Rate: 1},
+			},
+		},
+		{
+			name:    "co64",
+			fixture: mp4Fixture{gop: "IPPPPPIPP", co64: true, chunk: 3},
+			kinds:   []FrameKind{FrameKindI, FrameKindP, FrameKindP, FrameKindP, FrameKindP, FrameKindP, FrameKindI, FrameKindP, FrameKindP},
+			keys:    []uint32{0, 6},
+		},
+		{
+			name:    "audio",
+			fixture: mp4Fixture{gop: "IPPPPPPPPPIPPPPP", audio: true, chunk: 5},
+			kinds:   []FrameKind{FrameKindI, FrameKindP, FrameKindP, FrameKindP, FrameKindP, FrameKindP, FrameKindP, FrameKindP, FrameKindP, FrameKindP, FrameKindI, FrameKindP, FrameKindP, FrameKindP, FrameKindP, FrameKindP},
+			keys:    []uint32{0, 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := tt.fixture.withDefaults()
+			data := fixture.build(t)
+			r := bytes.NewReader(data)
+			tracks, err := ParseTracks(r)
+			require.NoError(t, err)
+			if fixture.audio {
+				require.Len(t, tracks, 2)
+			} else {
+				require.Len(t, tracks, 1)
+			}
+
+			track := tracks[0]
+			assert.True(t, track.IsVideo())
+			assert.Equal(t, mp4.CodecAVC1, track.Codec)
+			assert.Equal(t, uint32(fixtureTimescale), track.Timescale)
+			assert.Equal(t, uint16(fixture.widthMbs*16), track.AVC.Width)
+			assert.Equal(t, tt.editList, track.EditList)
+			require.Len(t, track.Samples, len(fixture.gop))
+
+			frames := fixture.frames()
+			var kinds []FrameKind
+			var keys []uint32
+			i := 0
+			for id, frame := range frames {
+				sample := track.Samples[id]
+				assert.Equal(t, int64(frame.pts-frame.dts), sample.CompositionTimeOffset, "sample %d", id)
+				for _, want := range frame.nals {
+					require.Less(t, i, len(track.NALs))
+					nal := track.NALs[i]
+					i++
+					assert.Equal(t, uint32(id), nal.SampleID)
+					assert.Equal(t, frame.pts, nal.PTS(), "sample %d", id)
+					assert.Equal(t, frame.dts, nal.DTS(), "sample %d", id)
+					assert.Equal(t, uint32(id/fixture.chunk), nal.Chunk)
+					assert.Equal(t, frame.kind != 'B', nal.IsReference())
+					payload, err := nal.Payload(r)
+					require.NoError(t, err)
+					assert.Equal(t, want, payload)
+				}
+				kinds = append(kinds, track.NALs[i-1].Kind())
+				if track.NALs[i-1].IsKeyframe() {
+					keys = append(keys, uint32(id))
+				}
+			}
+			assert.Len(t, track.NALs, i)
+			assert.Equal(t, tt.kinds, kinds)
+			assert.Equal(t, tt.keys, keys)
+			assert.Equal(t, tt.keys, keySamplesList(track))
+
+			if !fixture.audio {
+				return
+			}
+			audio := tracks[1]
+			assert.True(t, audio.IsAudio())
+			assert.False(t, audio.IsVideo())
+			assert.Equal(t, mp4.CodecMP4A, audio.Codec)
+			assert.Equal(t, uint32(fixtureSampleRate), audio.Timescale)
+			assert.Empty(t, audio.Frames())
+			audioFrames := fixture.audioFrames()
+			require.Len(t, audio.Samples, len(audioFrames))
+			for id, offset := range audio.sampleOffsets() {
+				got := make([]byte, audio.Samples[id].Size)
+				_, err := r.ReadAt(got, int64(offset))
+				require.NoError(t, err)
+				assert.Equal(t, audioFrames[id], got, "audio sample %d", id)
+			}
+		})
+	}
+}
+
+// keySamplesList returns the sorted ids of the key samples of a track.
+func keySamplesList(track *Track) []uint32 {
+	var ids []uint32
+	keys := keySamples(track)
+	for id := range track.Samples {
+		if keys[uint32(id)] {
+			ids = append(ids, uint32(id))
+		}
+	}
+	return ids
+}
+
+func TestProcessFramesNullifyIFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture mp4Fixture
+		count   int   // key frames
+		shown   []int // index of the I frame shown by each decoded frame
+	}{
+		{name: "one slice", fixture: mp4Fixture{gop: "IPPIPPIP"}, count: 3, shown: []int{0, 0, 0, 0, 0, 0}},
+		{name: "slices", fixture: mp4Fixture{gop: "IPPIPPIP", heightMbs: 4, slices: 3}, count: 3, shown: []int{0, 0, 0, 0, 0, 0}},
+		// non IDR I frames aren't key frames
+		{name: "non idr", fixture: mp4Fixture{gop: "IPiPIP"}, count: 2, shown: []int{0, 0, 2, 2, 2}},
+		{name: "audio", fixture: mp4Fixture{gop: "IPPPIPPP", audio: true}, count: 2, shown: []int{0, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := tt.fixture.withDefaults()
+			f, err := os.OpenFile(fixture.file(t), os.O_RDWR, 0)
+			require.NoError(t, err)
+			defer f.Close()
+
+			ctx, err := ProcessFrames(context.Background(), f, NullifyIFrames)
+			require.NoError(t, err)
+			assert.Equal(t, tt.count, ctx.Value(IFrameCountKey))
+			assert.Equal(t, tt.count-1, ctx.Value(IFrameRemovedCountKey))
+
+			tracks, err := ParseTracks(f)
+			require.NoError(t, err)
+			track := tracks[0]
+			// only the first key frame is left to seek to
+			for id, flags := range track.SampleFlags {
+				assert.Equal(t, id == 0, flags.Sync, "sample %d", id)
+			}
+			// the headers are kept, the slice data is gone
+			for _, nal := range track.NALs {
+				if nal.IsKeyframe() && nal.SampleID > 0 {
+					assert.Equal(t, sliceTypeUnknown, nal.SliceType)
+				}
+			}
+
+			// the nullified key frames are dropped and the next frames keep
+			// showing the previous picture
+			var shown []int
+			err = track.DecodeFrames(f, func(sampleID uint32, img *image.YCbCr) error {
+				for index := range fixture.gop {
+					if img.Y[img.YOffset(5, 3)] == fixtureSample(index, 5, 3) {
+						shown = append(shown, index)
+						break
+					}
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.shown, shown)
+
+			if fixture.audio {
+				// the audio samples are untouched
+				audio := tracks[1]
+				audioFrames := fixture.audioFrames()
+				for id, offset := range audio.sampleOffsets() {
+					got := make([]byte, audio.Samples[id].Size)
+					_, err := f.ReadAt(got, int64(offset))
+					require.NoError(t, err)
+					assert.Equal(t, audioFrames[id], got)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeFixture(t *testing.T) {
+	fixture := mp4Fixture{gop: "IPiP", widthMbs: 3, heightMbs: 2, slices: 2}.withDefaults()
+	data := fixture.build(t)
+	tracks, _, err := Demux(bytes.NewReader(data))
+	require.NoError(t, err)
+	var decoded []*image.YCbCr
+	err = tracks[0].DecodeFrames(bytes.NewReader(data), func(sampleID uint32, img *image.YCbCr) error {
+		decoded = append(decoded, img)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, decoded, 4)
+	for i, index := range []int{0, 0, 2, 2} {
+		img := decoded[i]
+		assert.Equal(t, image.Rect(0, 0, 48, 32), img.Rect)
+		for _, p := range []image.Point{{0, 0}, {47, 31}, {20, 17}} {
+			assert.Equal(t, fixtureSample(index, p.X, p.Y), img.Y[img.YOffset(p.X, p.Y)], "frame %d at %v", i, p)
+		}
+	}
+
+	fixture.gop = "IBP"
+	data = fixture.build(t)
+	tracks, _, err = Demux(bytes.NewReader(data))
+	require.NoError(t, err)
+	err = tracks[0].DecodeFrames(bytes.NewReader(data), func(uint32, *image.YCbCr) error { return nil })
+	assert.True(t, errors.Is(err, ErrH264Unsupported), "unexpected error %v", err)
+}
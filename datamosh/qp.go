@@ -0,0 +1,176 @@
+package datamosh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abema/go-mp4"
+)
+
+// QPMosher shifts the quantization parameter of the slices of an H.264 stream
+// over a time range, so their residuals are scaled by another quantizer than
+// the one they were coded with: contrast and colours blow out above the coded
+// QP and flatten below. The slices are parsed, the slice data coded with CABAC
+// being coded again as its contexts depend on the QP. Large increases overflow
+// the 16 bit arithmetic of decoders, which then show different pictures.
+type QPMosher struct {
+	// Delta is added to the QP of the I and P slices presented within Range,
+	// the result being clamped to 0..51.
+	Delta int
+	Range TimeRange
+	// PicInitDelta is added to the pic_init_qp_minus26 of the PPS, shifting
+	// the QP of all the slices referring to them.
+	PicInitDelta int
+
+	d *H264Decoder // for the parameter sets as coded
+}
+
+// NewQPMosher returns a mosher adding delta to the QP of all the slices,
+// primed with the parameter sets of the avcC box of a track. avc can be nil
+// if the parameter sets are in the stream.
+func NewQPMosher(avc *AVCDecoderConfig, delta int) (*QPMosher, error) {
+	d, err := NewH264Decoder(avc)
+	if err != nil {
+		return nil, err
+	}
+	return &QPMosher{Delta: delta, d: d}, nil
+}
+
+// RewriteNAL returns the NAL unit with its QP shifted, pts being its
+// presentation time in seconds. The NAL units other than slices and PPS are
+// returned as is, and so are the slices of other types than I and P unless
+// their QP is clamped or, coded with CABAC, shifted by PicInitDelta. An error
+// wrapping ErrH264Unsupported is returned for the slices to rewrite the
+// mosher can't parse.
+func (m *QPMosher) RewriteNAL(nal []byte, pts float64) ([]byte, error) {
+	if len(nal) == 0 {
+		return nil, errors.New("NAL unit data is empty")
+	}
+	switch nal[0] & 0x1f {
+	case NAL_SPS:
+		return nal, m.d.DecodeNAL(nal)
+	case NAL_PPS:
+		// the slices are parsed with the PPS as coded
+		if err := m.d.DecodeNAL(nal); err != nil {
+			return nil, err
+		}
+		return m.rewritePPS(nal)
+	case NAL_SLICE, NAL_IDR_SLICE:
+	default:
+		return nal, nil
+	}
+
+	rbsp := unescapeRBSP(nal[1:])
+	r := newRBSPReader(rbsp)
+	h, err := parseH264SliceHeader(r, nal[0], m.d.sps, m.d.pps)
+	if err != nil {
+		return nil, err
+	}
+	pps := *h.pps
+	pps.PicInitQPMinus26 = m.picInitQP(h.pps)
+	qp := h.QP() + int(pps.PicInitQPMinus26-h.pps.PicInitQPMinus26)
+	if (h.Type() == SLICE_I || h.Type() == SLICE_P) && m.Range.Contains(pts) {
+		qp += m.Delta
+	}
+	delta := int32(clampInt(qp, 0, 51)-26) - pps.PicInitQPMinus26
+	// the CABAC contexts depend on the QP, shifted by the PPS alone when the
+	// slice_qp_delta stays the same
+	if delta == h.SliceQPDelta && (!h.pps.EntropyCodingMode || pps.PicInitQPMinus26 == h.pps.PicInitQPMinus26) {
+		return nal, nil
+	}
+
+	if err := checkH264Support(h); err != nil {
+		return nil, err
+	}
+
+	w := newRBSPWriter()
+	copyBits(w, rbsp, 0, h.pos.sliceQPDelta[0])
+	w.se(delta)
+	dataStart := r.pos
+	copyBits(w, rbsp, h.pos.sliceQPDelta[1], dataStart)
+	s := m.d.sliceParser(r, h)
+	if h.pps.EntropyCodingMode {
+		rewritten := *h
+		rewritten.SliceQPDelta, rewritten.pps = delta, &pps
+		s.cabacOut = newCABACEncoder(w, &rewritten)
+	}
+	// parsed for the CABAC contexts, which depend on the QP, and for the
+	// I_PCM macroblocks of CAVLC slices to stay byte aligned
+	if err := s.decode(); err != nil {
+		return nil, fmt.Errorf("failed to parse slice: %v", err)
+	}
+	var out []byte
+	if h.pps.EntropyCodingMode {
+		out, err = w.alignedBytes()
+	} else {
+		copySliceData(w, rbsp, dataStart, r.end, s.pcm)
+		out, err = w.trailingBits()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{nal[0]}, escapeRBSP(out)...), nil
+}
+
+// picInitQP returns the pic_init_qp_minus26 of the PPS shifted by
+// PicInitDelta.
+func (m *QPMosher) picInitQP(pps *H264PPS) int32 {
+	return int32(clampInt(int(pps.PicInitQPMinus26)+m.PicInitDelta, -26, 25))
+}
+
+// rewritePPS returns the PPS NAL unit with its pic_init_qp_minus26 shifted by
+// PicInitDelta.
+func (m *QPMosher) rewritePPS(nal []byte) ([]byte, error) {
+	pps, err := ParseH264PPS(nal)
+	if err != nil {
+		return nil, err
+	}
+	picInitQP := m.picInitQP(pps)
+	if picInitQP == pps.PicInitQPMinus26 {
+		return nal, nil
+	}
+	rbsp := unescapeRBSP(nal[1:])
+	w := newRBSPWriter()
+	copyBits(w, rbsp, 0, pps.picInitQPPos[0])
+	w.se(picInitQP)
+	copyBits(w, rbsp, pps.picInitQPPos[1], newRBSPReader(rbsp).end)
+	out, err := w.trailingBits()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{nal[0]}, escapeRBSP(out)...), nil
+}
+
+// RewriteTrack returns a copy of the H.264 track with its slices and PPS
+// rewritten, the ones of its avcC box included, and the sample data the track
+// points to. The mosher must be primed with the avcC box of the track.
+func (m *QPMosher) RewriteTrack(r io.ReadSeeker, t *Track) (*Track, []byte, error) {
+	if t.Timescale == 0 {
+		return nil, nil, errors.New("track timescale is not set")
+	}
+	out, data, err := t.rewriteNALs(r, func(nal *NALUnit, payload []byte) ([]byte, error) {
+		pts, _ := t.PresentationTime(int64(nal.Timestamp))
+		return m.RewriteNAL(payload, pts.Seconds())
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	avc := *t.AVC
+	avc.PictureParameterSets = make([]mp4.AVCParameterSet, len(t.AVC.PictureParameterSets))
+	changed := false
+	for i, ps := range t.AVC.PictureParameterSets {
+		nal, err := m.rewritePPS(ps.NALUnit)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to rewrite PPS: %v", err)
+		}
+		changed = changed || !bytes.Equal(nal, ps.NALUnit)
+		avc.PictureParameterSets[i] = mp4.AVCParameterSet{Length: uint16(len(nal)), NALUnit: nal}
+	}
+	if changed {
+		// the stsd box is written again from the rewritten avcC box
+		out.AVC, out.stsd = &avc, nil
+	}
+	return out, data, nil
+}
@@ -0,0 +1,132 @@
+package datamosh
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSliceQP returns the QP of a slice given its parameter sets.
+func testSliceQP(t *testing.T, d *H264Decoder, nal []byte) int {
+	h, err := parseH264SliceHeader(newRBSPReader(unescapeRBSP(nal[1:])), nal[0], d.sps, d.pps)
+	require.NoError(t, err)
+	return h.QP()
+}
+
+func TestQPMosher(t *testing.T) {
+	dc := make([]int32, 16)
+	dc[0] = 3
+	levels := [4][]int32{{5, -1, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, dc, make([]int32, 16), dc}
+
+	// the pictures of the key frame and of the P slice with the PPS and
+	// slices moshed
+	decode := func(cabac bool, delta, picInitDelta int) []*image.YCbCr {
+		avc := testMotionConfig(cabac)
+		m, err := NewQPMosher(nil, delta)
+		require.NoError(t, err)
+		m.PicInitDelta = picInitDelta
+		d, err := NewH264Decoder(nil)
+		require.NoError(t, err)
+		idr, p := testH264PCMSlice(2), testH264ResidualSlice(cabac, levels)
+		if cabac {
+			idr = testH264CABACPCMSlice(2)
+		}
+		var imgs []*image.YCbCr
+		for _, nal := range [][]byte{avc.SequenceParameterSets[0].NALUnit, avc.PictureParameterSets[0].NALUnit, idr, p} {
+			nal, err = m.RewriteNAL(nal, 0)
+			require.NoError(t, err)
+			switch nal[0] & 0x1f {
+			case NAL_SPS, NAL_PPS:
+				require.NoError(t, d.DecodeNAL(nal))
+				continue
+			case NAL_SLICE:
+				assert.Equal(t, 26+delta+picInitDelta, testSliceQP(t, d, nal))
+			}
+			img, err := d.DecodeAccessUnit([][]byte{nal})
+			require.NoError(t, err)
+			imgs = append(imgs, img)
+		}
+		return imgs
+	}
+
+	for _, cabac := range []bool{false, true} {
+		want := decode(cabac, 0, 0)
+		require.Len(t, want, 2)
+
+		got := decode(cabac, 12, 0)
+		assert.Equal(t, want[0], got[0], "cabac %v", cabac)
+		assert.NotEqual(t, want[1].Y, got[1].Y, "cabac %v", cabac)
+		// the slice data coded with CABAC is the same as with CAVLC
+		if cabac {
+			assert.Equal(t, decode(false, 12, 0), got)
+		}
+
+		// the shifted PPS compensated by the slices
+		assert.Equal(t, want, decode(cabac, -4, 4), "cabac %v", cabac)
+		// the QP shifted by the PPS alone, the slice data coded with CABAC
+		// being coded again for the new QP
+		assert.Equal(t, decode(cabac, 4, 0), decode(cabac, 0, 4), "cabac %v", cabac)
+	}
+
+	m, err := NewQPMosher(testMotionConfig(false), 60)
+	require.NoError(t, err)
+	m.Range = TimeRange{Start: 1, End: 2}
+	p := testH264MotionSlice([2]MotionVector{{1, 2}, {3, 4}})
+	got, err := m.RewriteNAL(p, 0.5)
+	require.NoError(t, err)
+	assert.Equal(t, p, got, "out of the range")
+	got, err = m.RewriteNAL(p, 1.5)
+	require.NoError(t, err)
+	assert.Equal(t, 51, testSliceQP(t, m.d, got), "QP clamped")
+
+	m, err = NewQPMosher(testMotionConfig(true), 2)
+	require.NoError(t, err)
+	m.d.pps[0].ScalingMatrixPresent = true
+	_, err = m.RewriteNAL(testH264CABACMotionSlice([2]MotionVector{}), 0)
+	assert.True(t, errors.Is(err, ErrH264Unsupported), "unexpected error %v", err)
+}
+
+func TestQPMosherTrack(t *testing.T) {
+	fixture := mp4Fixture{gop: "IPBPIBP", slices: 2}.withDefaults()
+	data := fixture.build(t)
+	tracks, err := ParseTracks(bytes.NewReader(data))
+	require.NoError(t, err)
+	track := tracks[0]
+
+	m, err := NewQPMosher(track.AVC, 10)
+	require.NoError(t, err)
+	m.PicInitDelta = 2
+	// the third to the fifth frames
+	duration := float64(fixtureFrameDuration) / fixtureTimescale
+	m.Range = TimeRange{Start: 2 * duration, End: 5 * duration}
+	moshed, out, err := m.RewriteTrack(bytes.NewReader(data), track)
+	require.NoError(t, err)
+
+	var muxed bytes.Buffer
+	require.NoError(t, (&MP4Muxer{}).Mux(&muxed, bytes.NewReader(out), []MuxTrack{{Track: moshed}}))
+	tracks, err = ParseTracks(bytes.NewReader(muxed.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, tracks, 1)
+	pps, err := ParseH264PPS(tracks[0].AVC.PictureParameterSets[0].NALUnit)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), pps.PicInitQPMinus26)
+
+	d, err := NewH264Decoder(tracks[0].AVC)
+	require.NoError(t, err)
+	r := bytes.NewReader(muxed.Bytes())
+	require.Len(t, tracks[0].NALs, len(fixture.gop)*fixture.slices)
+	for _, nal := range tracks[0].NALs {
+		payload, err := nal.Payload(r)
+		require.NoError(t, err)
+		want := 28
+		// the QP of the B slices is only shifted by the PPS
+		if nal.SliceType != SLICE_B && m.Range.Contains(float64(nal.Timestamp)/fixtureTimescale) {
+			want += 10
+		}
+		assert.Equal(t, want, testSliceQP(t, d, payload), "sample %d", nal.SampleID)
+	}
+}
@@ -0,0 +1,238 @@
+package datamosh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/mattetti/moshing-vfx/internal/bitio"
+)
+
+// rbspReader reads the syntax elements of an H.264 RBSP. It keeps track of the
+// bit position to implement more_rbsp_data() and the first error is sticky:
+// reads after an error return zero values, callers check err once they are
+// done with a syntax structure.
+type rbspReader struct {
+	r   bitio.Reader
+	pos int // in bits
+	end int // position of the rbsp_stop_one_bit
+	err error
+}
+
+func newRBSPReader(rbsp []byte) *rbspReader {
+	end := len(rbsp) * 8
+	// the stop bit is the last bit set
+	for i := len(rbsp) - 1; i >= 0; i-- {
+		if rbsp[i] != 0 {
+			for bit := 0; bit < 8; bit++ {
+				if rbsp[i]&(1<<uint(bit)) != 0 {
+					end = i*8 + 7 - bit
+					break
+				}
+			}
+			break
+		}
+	}
+	return &rbspReader{r: bitio.NewReader(bytes.NewReader(rbsp)), end: end}
+}
+
+func (r *rbspReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// u reads n bits.
+func (r *rbspReader) u(n int) uint32 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := r.r.ReadUInt(n)
+	if err != nil {
+		r.fail(err)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *rbspReader) flag() bool {
+	return r.u(1) == 1
+}
+
+func (r *rbspReader) ue() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := r.r.ReadUE()
+	if err != nil {
+		r.fail(err)
+		return 0
+	}
+	r.pos += expGolombSize(v)
+	return v
+}
+
+func (r *rbspReader) se() int32 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := r.r.ReadSE()
+	if err != nil {
+		r.fail(err)
+		return 0
+	}
+	if v > 0 {
+		r.pos += expGolombSize(uint32(v)*2 - 1)
+	} else {
+		r.pos += expGolombSize(uint32(-v) * 2)
+	}
+	return v
+}
+
+// te reads a truncated Exp-Golomb value in the 0..max range.
+func (r *rbspReader) te(max uint32) uint32 {
+	if max > 1 {
+		return r.ue()
+	}
+	return 1 - r.u(1)
+}
+
+// ueMax reads an unsigned Exp-Golomb value and checks its range.
+func (r *rbspReader) ueMax(name string, max uint32) uint32 {
+	v := r.ue()
+	if v > max {
+		r.fail(fmt.Errorf("invalid %s: %d", name, v))
+		return 0
+	}
+	return v
+}
+
+func (r *rbspReader) byteAligned() bool {
+	return r.pos%8 == 0
+}
+
+// moreRBSPData returns true if there is data before the rbsp_stop_one_bit.
+func (r *rbspReader) moreRBSPData() bool {
+	return r.err == nil && r.pos < r.end
+}
+
+// bitsLeft returns the number of bits before the rbsp_stop_one_bit.
+func (r *rbspReader) bitsLeft() int {
+	return r.end - r.pos
+}
+
+// expGolombSize returns the number of bits of ue(v).
+func expGolombSize(v uint32) int {
+	length := 0
+	for tmp := uint64(v) + 1; tmp > 1; tmp >>= 1 {
+		length++
+	}
+	return 2*length + 1
+}
+
+var errRBSPOverrun = errors.New("read past the end of the RBSP")
+
+// rbspWriter writes the syntax elements of an H.264 RBSP, the first error is
+// sticky.
+type rbspWriter struct {
+	buf bytes.Buffer
+	w   bitio.Writer
+	pos int // in bits
+	err error
+}
+
+func newRBSPWriter() *rbspWriter {
+	w := &rbspWriter{}
+	w.w = bitio.NewWriter(&w.buf)
+	return w
+}
+
+func (w *rbspWriter) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *rbspWriter) u(n int, v uint32) {
+	if w.err != nil {
+		return
+	}
+	w.fail(w.w.WriteUInt(v, n))
+	w.pos += n
+}
+
+func (w *rbspWriter) flag(b bool) {
+	if b {
+		w.u(1, 1)
+	} else {
+		w.u(1, 0)
+	}
+}
+
+func (w *rbspWriter) ue(v uint32) {
+	if w.err != nil {
+		return
+	}
+	w.fail(w.w.WriteUE(v))
+	w.pos += expGolombSize(v)
+}
+
+func (w *rbspWriter) se(v int32) {
+	if v > 0 {
+		w.ue(uint32(v)*2 - 1)
+	} else {
+		w.ue(uint32(-v) * 2)
+	}
+}
+
+// te writes a truncated Exp-Golomb value in the 0..max range.
+func (w *rbspWriter) te(max uint32, v uint32) {
+	if max > 1 {
+		w.ue(v)
+	} else {
+		w.u(1, 1-v)
+	}
+}
+
+func (w *rbspWriter) byteAligned() bool {
+	return w.pos%8 == 0
+}
+
+// trailingBits writes the rbsp_trailing_bits and returns the RBSP.
+func (w *rbspWriter) trailingBits() ([]byte, error) {
+	w.u(1, 1)
+	for !w.byteAligned() {
+		w.u(1, 0)
+	}
+	return w.buf.Bytes(), w.err
+}
+
+// alignedBytes pads the RBSP with zero bits to a byte boundary and returns
+// it, for the slice data coded with CABAC which ends with the
+// rbsp_stop_one_bit.
+func (w *rbspWriter) alignedBytes() ([]byte, error) {
+	for !w.byteAligned() {
+		w.u(1, 0)
+	}
+	return w.buf.Bytes(), w.err
+}
+
+// escapeRBSP inserts the emulation prevention bytes, reverting unescapeRBSP.
+func escapeRBSP(rbsp []byte) []byte {
+	data := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 0x03 {
+			data = append(data, 0x03)
+			zeros = 0
+		}
+		data = append(data, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return data
+}
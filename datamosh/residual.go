@@ -0,0 +1,417 @@
+package datamosh
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// ResidualKind is the kind of a block of transform coefficient levels.
+type ResidualKind int
+
+const (
+	// ResidualLumaDC is the DC block of Intra 16x16 macroblocks.
+	ResidualLumaDC ResidualKind = iota
+	// ResidualLumaAC is a luma block of Intra 16x16 macroblocks, without
+	// its DC coefficient.
+	ResidualLumaAC
+	// ResidualLuma4x4 is a luma block of the other macroblocks.
+	ResidualLuma4x4
+	// ResidualChromaDC is the DC block of a chroma component.
+	ResidualChromaDC
+	// ResidualChromaAC is a chroma block without its DC coefficient.
+	ResidualChromaAC
+	// ResidualLuma8x8 is a luma block of the macroblocks using the 8x8
+	// transform, its 64 levels in the 8x8 scanning order. CABAC codes at
+	// least one non-zero level in those blocks: when a transform zeroes them
+	// all, the first non-zero level of the block is kept as +1 or -1.
+	ResidualLuma8x8
+)
+
+// ResidualBlock is a block of transform coefficient levels of a slice.
+type ResidualBlock struct {
+	Kind   ResidualKind
+	MbAddr int // address of the macroblock in the picture
+	// X and Y are the position of the 4x4 block in the macroblock in block
+	// units, in the 8x8 block of its component for chroma. They are the
+	// position of the top left 4x4 block of 8x8 blocks.
+	X, Y   int
+	Chroma int // 0 for Cb, 1 for Cr
+	Intra  bool
+	// Levels are in scanning order, from the low to the high frequencies,
+	// the AC blocks starting at the second coefficient.
+	Levels []int32
+}
+
+// firstCoeff returns the scanning position of the first level of the block.
+func (b *ResidualBlock) firstCoeff() int {
+	if b.Kind == ResidualLumaAC || b.Kind == ResidualChromaAC {
+		return 1
+	}
+	return 0
+}
+
+// ResidualTransform changes the levels of the residual blocks of a slice, in
+// parsing order. Only the blocks coded in the slice can be changed, the
+// others stay empty.
+type ResidualTransform func(blocks []ResidualBlock)
+
+// ZeroHighFrequencies zeroes the levels of the blocks from the scanning
+// position keep, washing the details out to flat blocks.
+func ZeroHighFrequencies(keep int) ResidualTransform {
+	return func(blocks []ResidualBlock) {
+		for _, b := range blocks {
+			for i := max(keep-b.firstCoeff(), 0); i < len(b.Levels); i++ {
+				b.Levels[i] = 0
+			}
+		}
+	}
+}
+
+// QuantizeResidual rounds the levels to multiples of step, a coarser
+// quantization than the encoder's.
+func QuantizeResidual(step int32) ResidualTransform {
+	return func(blocks []ResidualBlock) {
+		if step <= 1 {
+			return
+		}
+		for _, b := range blocks {
+			for i, level := range b.Levels {
+				q := (abs32(level) + step/2) / step * step
+				if level < 0 {
+					q = -q
+				}
+				b.Levels[i] = q
+			}
+		}
+	}
+}
+
+// ResidualNoise adds random offsets of up to amount to the levels, seed
+// makes the noise reproducible.
+func ResidualNoise(amount int32, seed int64) ResidualTransform {
+	rng := rand.New(rand.NewSource(seed))
+	return func(blocks []ResidualBlock) {
+		if amount <= 0 {
+			return
+		}
+		for _, b := range blocks {
+			for i := range b.Levels {
+				b.Levels[i] += rng.Int31n(2*amount+1) - amount
+			}
+		}
+	}
+}
+
+// SwapResidualBlocks swaps the levels of the pairs of consecutive blocks of
+// the same kind, moving the details around.
+func SwapResidualBlocks() ResidualTransform {
+	return func(blocks []ResidualBlock) {
+		pending := map[ResidualKind]int{}
+		for i := range blocks {
+			kind := blocks[i].Kind
+			j, ok := pending[kind]
+			if !ok {
+				pending[kind] = i
+				continue
+			}
+			blocks[i].Levels, blocks[j].Levels = blocks[j].Levels, blocks[i].Levels
+			delete(pending, kind)
+		}
+	}
+}
+
+// ChainResidual applies the transforms in order.
+func ChainResidual(transforms ...ResidualTransform) ResidualTransform {
+	return func(blocks []ResidualBlock) {
+		for _, t := range transforms {
+			t(blocks)
+		}
+	}
+}
+
+// ParseResidualTransform parses a comma separated list of transforms,
+// applied in order: zero=<levels kept>, quantize=<step>, noise=<amount> and
+// swap. For instance "zero=3,noise=2".
+func ParseResidualTransform(spec string) (ResidualTransform, error) {
+	var transforms []ResidualTransform
+	for i, item := range strings.Split(spec, ",") {
+		name, arg, hasArg := strings.Cut(strings.TrimSpace(item), "=")
+		if (name == "swap") == hasArg {
+			return nil, fmt.Errorf("invalid residual transform %q", item)
+		}
+		var value int
+		if hasArg {
+			var err error
+			if value, err = strconv.Atoi(arg); err != nil {
+				return nil, fmt.Errorf("invalid residual transform %q: %v", item, err)
+			}
+		}
+		switch name {
+		case "zero":
+			transforms = append(transforms, ZeroHighFrequencies(value))
+		case "quantize":
+			transforms = append(transforms, QuantizeResidual(int32(value)))
+		case "noise":
+			transforms = append(transforms, ResidualNoise(int32(value), int64(i)))
+		case "swap":
+			transforms = append(transforms, SwapResidualBlocks())
+		default:
+			return nil, fmt.Errorf("unknown residual transform %q", name)
+		}
+	}
+	return ChainResidual(transforms...), nil
+}
+
+// h264Residual is a residual block of a slice, its position in the RBSP and,
+// when rewritten, the nC or the ctxIdxInc of its coded_block_flag given the
+// rewritten neighbours.
+type h264Residual struct {
+	start, end   int // in bits
+	cat, c, x, y int // see h264SliceDecoder.residualBlock
+	mbAddr       int
+	intra        bool
+	levels       []int32
+	nC           int
+	ctxIdxInc    int
+	// CAVLC codes the 8x8 blocks as 4 interleaved 4x4 blocks, recorded as
+	// such and marked by transform8x8
+	transform8x8 bool
+}
+
+// recordResidual records the residual block just read by residualBlock,
+// starting at the bit start.
+func (s *h264SliceDecoder) recordResidual(coeffLevel []int32, cat, c, x, y, start int) {
+	res := h264Residual{
+		start:  start,
+		end:    s.r.pos,
+		cat:    cat,
+		c:      c,
+		x:      x,
+		y:      y,
+		mbAddr: s.mbY*s.pic.widthMbs + s.mbX,
+		intra:  s.mb.isIntra(),
+		levels: append([]int32(nil), coeffLevel...),
+		// the 4x4 blocks of an 8x8 block read with CAVLC
+		transform8x8: s.mb.transform8x8 && cat == blockLuma4x4,
+	}
+	if s.rewrittenLevels != nil {
+		if s.cabac != nil {
+			res.ctxIdxInc = s.codedBlockFlagCtxIdxInc(cat, c, x, y, true)
+		} else {
+			res.nC = s.nC(cat, c, x, y, true)
+		}
+		n := 0
+		for _, level := range s.rewrittenLevels[len(s.residuals)] {
+			if level != 0 {
+				n++
+			}
+		}
+		counts := &s.mb.rewrittenCoeffs
+		switch cat {
+		case blockLumaDC:
+			if n > 0 {
+				counts.codedDC |= 1
+			}
+		case blockChromaDC:
+			if n > 0 {
+				counts.codedDC |= 2 << uint(c)
+			}
+		case blockChromaAC:
+			counts.totalCoeffC[c][y*2+x] = uint8(n)
+		case blockLuma8x8:
+			for i := 0; i < 4; i++ {
+				counts.totalCoeff[(y+i/2)*4+x+i%2] = uint8(n)
+			}
+		default:
+			counts.totalCoeff[y*4+x] = uint8(n)
+		}
+	}
+	s.residuals = append(s.residuals, res)
+}
+
+// ResidualMosher rewrites the transform coefficient levels of the residual
+// blocks of the I and P slices of an H.264 stream, coded with CAVLC or
+// CABAC, for blocky compression artefacts without decoding the pictures.
+// With CAVLC the rest of the slices is copied as is, with CABAC the slice data
+// is coded again. Large levels overflow the 16 bit arithmetic of decoders,
+// which then show different pictures.
+//
+// The B, SP and SI slices are left untouched, as are the slices the decoder
+// can't parse (scaling matrices, interlaced or high bit depth streams), for
+// which RewriteNAL returns an error wrapping ErrH264Unsupported.
+type ResidualMosher struct {
+	Transform ResidualTransform
+
+	d *H264Decoder // for its parameter sets
+}
+
+// NewResidualMosher returns a mosher primed with the parameter sets of the
+// avcC box of a track, avc can be nil if the parameter sets are in the
+// stream.
+func NewResidualMosher(avc *AVCDecoderConfig, transform ResidualTransform) (*ResidualMosher, error) {
+	d, err := NewH264Decoder(avc)
+	if err != nil {
+		return nil, err
+	}
+	return &ResidualMosher{Transform: transform, d: d}, nil
+}
+
+// RewriteNAL returns the NAL unit with the residual blocks of I and P slices
+// transformed, the other NAL units are returned as is. Parameter sets are
+// recorded for the next slices. An error wrapping ErrH264Unsupported is
+// returned for slices the mosher can't parse.
+func (m *ResidualMosher) RewriteNAL(nal []byte) ([]byte, error) {
+	if len(nal) == 0 {
+		return nil, errors.New("NAL unit data is empty")
+	}
+	switch nal[0] & 0x1f {
+	case NAL_SPS, NAL_PPS:
+		return nal, m.d.DecodeNAL(nal)
+	case NAL_SLICE, NAL_IDR_SLICE:
+	default:
+		return nal, nil
+	}
+
+	rbsp := unescapeRBSP(nal[1:])
+	r := newRBSPReader(rbsp)
+	h, err := parseH264SliceHeader(r, nal[0], m.d.sps, m.d.pps)
+	if err != nil {
+		return nil, err
+	}
+	if h.Type() != SLICE_I && h.Type() != SLICE_P {
+		return nal, nil
+	}
+	if err := checkH264Support(h); err != nil {
+		return nil, err
+	}
+	if m.Transform == nil {
+		return nal, nil
+	}
+
+	s := m.d.sliceParser(r, h)
+	s.recordResiduals = true
+	if err := s.decode(); err != nil {
+		return nil, fmt.Errorf("failed to parse slice: %v", err)
+	}
+	blocks := residualBlocks(s.residuals)
+	m.Transform(blocks)
+	levels := residualLevels(s.residuals, blocks)
+	changed := false
+	for i, res := range s.residuals {
+		for j, level := range res.levels {
+			changed = changed || levels[i][j] != level
+		}
+	}
+	if !changed {
+		return nal, nil
+	}
+
+	// parsed again to code the blocks given the rewritten ones
+	r = newRBSPReader(rbsp)
+	if _, err := parseH264SliceHeader(r, nal[0], m.d.sps, m.d.pps); err != nil {
+		return nil, err
+	}
+	w := newRBSPWriter()
+	s = m.d.sliceParser(r, h)
+	s.recordResiduals, s.rewrittenLevels = true, levels
+	if h.pps.EntropyCodingMode {
+		copyBits(w, rbsp, 0, r.pos)
+		s.cabacOut = newCABACEncoder(w, h)
+	}
+	if err := s.decode(); err != nil {
+		return nil, fmt.Errorf("failed to parse slice: %v", err)
+	}
+	var out []byte
+	if h.pps.EntropyCodingMode {
+		out, err = w.alignedBytes()
+	} else {
+		pos := 0
+		for i, res := range s.residuals {
+			copySliceData(w, rbsp, pos, res.start, s.pcm)
+			w.residualBlock(levels[i], len(levels[i]), res.nC)
+			pos = res.end
+		}
+		copySliceData(w, rbsp, pos, r.end, s.pcm)
+		out, err = w.trailingBits()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{nal[0]}, escapeRBSP(out)...), nil
+}
+
+// residualBlocks returns the blocks of levels given to the transforms, the
+// 4x4 blocks of the 8x8 blocks read with CAVLC merged back into one.
+func residualBlocks(residuals []h264Residual) []ResidualBlock {
+	var blocks []ResidualBlock
+	for i := 0; i < len(residuals); i++ {
+		res := residuals[i]
+		b := ResidualBlock{
+			Kind:   ResidualKind(res.cat),
+			MbAddr: res.mbAddr,
+			X:      res.x,
+			Y:      res.y,
+			Chroma: res.c,
+			Intra:  res.intra,
+			Levels: append([]int32(nil), res.levels...),
+		}
+		if res.transform8x8 {
+			b.Kind, b.Levels = ResidualLuma8x8, make([]int32, 64)
+			for k := 0; k < 4; k++ {
+				for j, level := range residuals[i+k].levels {
+					b.Levels[4*j+k] = level
+				}
+			}
+			i += 3
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// residualLevels returns the levels of the residuals after the transforms
+// changed the blocks returned by residualBlocks, clamped to the range CAVLC
+// can code. The 8x8 blocks coded with CABAC keep a non-zero level.
+func residualLevels(residuals []h264Residual, blocks []ResidualBlock) [][]int32 {
+	levels := make([][]int32, len(residuals))
+	i := 0
+	for _, b := range blocks {
+		level := func(j int) int32 {
+			if j >= len(b.Levels) {
+				return 0
+			}
+			return int32(clampInt(int(b.Levels[j]), -maxCAVLCLevel, maxCAVLCLevel))
+		}
+		res := residuals[i]
+		if res.transform8x8 {
+			for k := 0; k < 4; k++ {
+				levels[i+k] = make([]int32, 16)
+				for j := range levels[i+k] {
+					levels[i+k][j] = level(4*j + k)
+				}
+			}
+			i += 4
+			continue
+		}
+		levels[i] = make([]int32, len(res.levels))
+		zero := true
+		for j := range levels[i] {
+			levels[i][j] = level(j)
+			zero = zero && levels[i][j] == 0
+		}
+		if zero && res.cat == blockLuma8x8 {
+			// CABAC has no coded_block_flag for the 8x8 blocks
+			for j, original := range res.levels {
+				if original != 0 {
+					levels[i][j] = original / abs32(original)
+					break
+				}
+			}
+		}
+		i++
+	}
+	return levels
+}
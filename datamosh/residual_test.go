@@ -0,0 +1,340 @@
+package datamosh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abema/go-mp4"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testH264ResidualSlice returns a P slice of a P_L0_16x16 macroblock whose
+// first 8x8 luma block has the levels of its 4x4 blocks, followed by a
+// skipped macroblock.
+func testH264ResidualSlice(cabac bool, levels [4][]int32) []byte {
+	var counts [4]int
+	for i, blk := range levels {
+		for _, level := range blk {
+			if level != 0 {
+				counts[i]++
+			}
+		}
+	}
+	if cabac {
+		return testH264CABACSlice(false, 1, func(e *cabacEncoder) {
+			e.decision(ctxMbSkipP, 0)
+			e.mbTypeP(0) // P_L0_16x16
+			e.mvd(ctxMVDX, 0, 0)
+			e.mvd(ctxMVDY, 0, 0)
+			e.cbp(cbpUnavailable, cbpUnavailable, 1)
+			e.mbQPDelta(0, 0)
+			// coded_block_flag of the blocks on the left plus twice the one
+			// of the blocks on top
+			coded := func(blk int) int { return boolInt(counts[blk] > 0) }
+			e.residualBlock(levels[0], blockLuma4x4, 0)
+			e.residualBlock(levels[1], blockLuma4x4, coded(0))
+			e.residualBlock(levels[2], blockLuma4x4, 2*coded(0))
+			e.residualBlock(levels[3], blockLuma4x4, coded(2)+2*coded(1))
+			e.terminate(0)
+			e.decision(ctxMbSkipP+1, 1)
+			e.terminate(1)
+		})
+	}
+	return testH264PSlice(1, func(w *rbspWriter) {
+		w.ue(0) // mb_skip_run
+		w.ue(0) // mb_type P_L0_16x16
+		w.se(0)
+		w.se(0)
+		w.ue(2) // coded_block_pattern 1
+		w.se(0) // mb_qp_delta
+		// nC from the blocks on the left and on top
+		w.residualBlock(levels[0], 16, 0)
+		w.residualBlock(levels[1], 16, counts[0])
+		w.residualBlock(levels[2], 16, counts[0])
+		w.residualBlock(levels[3], 16, (counts[1]+counts[2]+1)>>1)
+		w.ue(1) // mb_skip_run
+	})
+}
+
+func TestResidualMosher(t *testing.T) {
+	zeros := make([]int32, 16)
+	in := [4][]int32{
+		{5, -1, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+		{0, 3, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		zeros,
+		{-7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	}
+	tests := []struct {
+		name      string
+		transform ResidualTransform
+		want      [4][]int32
+	}{
+		{name: "identity", want: in},
+		{name: "noop", transform: QuantizeResidual(1), want: in},
+		{
+			name:      "zero",
+			transform: ZeroHighFrequencies(1),
+			want:      [4][]int32{{5, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, zeros, zeros, in[3]},
+		},
+		{
+			name:      "quantize",
+			transform: QuantizeResidual(4),
+			want: [4][]int32{
+				{4, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				{0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				zeros,
+				{-8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			},
+		},
+		{name: "swap", transform: SwapResidualBlocks(), want: [4][]int32{in[1], in[0], in[3], in[2]}},
+		{
+			name: "clamp",
+			transform: func(blocks []ResidualBlock) {
+				blocks[2].Levels[0] = 1 << 20
+				blocks[2].Levels = blocks[2].Levels[:1]
+			},
+			want: [4][]int32{in[0], in[1], {maxCAVLCLevel, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, in[3]},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, cabac := range []bool{false, true} {
+				m, err := NewResidualMosher(testMotionConfig(cabac), tt.transform)
+				require.NoError(t, err)
+				got, err := m.RewriteNAL(testH264ResidualSlice(cabac, in))
+				require.NoError(t, err)
+				assert.Equal(t, testH264ResidualSlice(cabac, tt.want), got, "cabac %v", cabac)
+			}
+		})
+	}
+}
+
+func TestResidualMosherBlocks(t *testing.T) {
+	var blocks []ResidualBlock
+	m, err := NewResidualMosher(nil, func(b []ResidualBlock) { blocks = b })
+	require.NoError(t, err)
+	avc := testMotionConfig(false)
+	for _, nal := range [][]byte{avc.SequenceParameterSets[0].NALUnit, avc.PictureParameterSets[0].NALUnit} {
+		_, err := m.RewriteNAL(nal)
+		require.NoError(t, err)
+	}
+
+	// the I_PCM macroblocks have no residual blocks
+	idr := testH264PCMSlice(2)
+	got, err := m.RewriteNAL(idr)
+	require.NoError(t, err)
+	assert.Equal(t, idr, got)
+	assert.Empty(t, blocks)
+
+	zeros, dc := make([]int32, 16), make([]int32, 16)
+	dc[0] = 1
+	slice := testH264ResidualSlice(false, [4][]int32{zeros, zeros, dc, zeros})
+	got, err = m.RewriteNAL(slice)
+	require.NoError(t, err)
+	assert.Equal(t, slice, got)
+	require.Len(t, blocks, 4)
+	for i, b := range blocks {
+		assert.Equal(t, ResidualLuma4x4, b.Kind)
+		assert.Equal(t, 0, b.MbAddr)
+		assert.Equal(t, i%2, b.X)
+		assert.Equal(t, i/2, b.Y)
+		assert.False(t, b.Intra)
+		assert.Len(t, b.Levels, 16)
+	}
+	assert.Equal(t, int32(1), blocks[2].Levels[0])
+
+	_, err = m.RewriteNAL(nil)
+	assert.Error(t, err)
+}
+
+// testResidual8x8Config returns the parameter sets of testMotionConfig with
+// the 8x8 transform enabled.
+func testResidual8x8Config() *AVCDecoderConfig {
+	w := newRBSPWriter()
+	w.ue(0)       // pic_parameter_set_id
+	w.ue(0)       // seq_parameter_set_id
+	w.flag(false) // entropy_coding_mode_flag
+	w.flag(false) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)       // num_slice_groups_minus1
+	w.ue(0)       // num_ref_idx_l0_default_active_minus1
+	w.ue(0)       // num_ref_idx_l1_default_active_minus1
+	w.flag(false) // weighted_pred_flag
+	w.u(2, 0)     // weighted_bipred_idc
+	w.se(0)       // pic_init_qp_minus26
+	w.se(0)       // pic_init_qs_minus26
+	w.se(0)       // chroma_qp_index_offset
+	w.flag(false) // deblocking_filter_control_present_flag
+	w.flag(false) // constrained_intra_pred_flag
+	w.flag(false) // redundant_pic_cnt_present_flag
+	w.flag(true)  // transform_8x8_mode_flag
+	w.flag(false) // pic_scaling_matrix_present_flag
+	w.se(0)       // second_chroma_qp_index_offset
+	pps := testH264NAL(0x68, w)
+	avc := testMotionConfig(false)
+	avc.PictureParameterSets = []mp4.AVCParameterSet{{Length: uint16(len(pps)), NALUnit: pps}}
+	return avc
+}
+
+// testH264Residual8x8Slice returns the slice of testH264ResidualSlice coded
+// with CAVLC, its first 8x8 luma block using the 8x8 transform.
+func testH264Residual8x8Slice(levels [4][]int32) []byte {
+	var counts [4]int
+	for i, blk := range levels {
+		for _, level := range blk {
+			if level != 0 {
+				counts[i]++
+			}
+		}
+	}
+	return testH264PSlice(1, func(w *rbspWriter) {
+		w.ue(0) // mb_skip_run
+		w.ue(0) // mb_type P_L0_16x16
+		w.se(0)
+		w.se(0)
+		w.ue(2)      // coded_block_pattern 1
+		w.flag(true) // transform_size_8x8_flag
+		w.se(0)      // mb_qp_delta
+		// the interleaved 4x4 blocks, nC as for the 4x4 transform
+		w.residualBlock(levels[0], 16, 0)
+		w.residualBlock(levels[1], 16, counts[0])
+		w.residualBlock(levels[2], 16, counts[0])
+		w.residualBlock(levels[3], 16, (counts[1]+counts[2]+1)>>1)
+		w.ue(1) // mb_skip_run
+	})
+}
+
+func TestResidualMosher8x8(t *testing.T) {
+	zeros := make([]int32, 16)
+	in := [4][]int32{
+		{5, -1, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+		{2, 3, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		zeros,
+		{-7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	}
+	var blocks []ResidualBlock
+	m, err := NewResidualMosher(testResidual8x8Config(), func(b []ResidualBlock) {
+		for _, block := range b {
+			block.Levels = append([]int32(nil), block.Levels...)
+			blocks = append(blocks, block)
+		}
+		ZeroHighFrequencies(2)(b)
+	})
+	require.NoError(t, err)
+	got, err := m.RewriteNAL(testH264Residual8x8Slice(in))
+	require.NoError(t, err)
+
+	// the 4x4 blocks are merged into one 8x8 block
+	require.Len(t, blocks, 1)
+	assert.Equal(t, ResidualLuma8x8, blocks[0].Kind)
+	assert.Equal(t, 0, blocks[0].X)
+	assert.Equal(t, 0, blocks[0].Y)
+	require.Len(t, blocks[0].Levels, 64)
+	for k, blk := range in {
+		for i, level := range blk {
+			assert.Equal(t, level, blocks[0].Levels[4*i+k], "level %d of block %d", i, k)
+		}
+	}
+	want := [4][]int32{{5, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, {2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, zeros, zeros}
+	assert.Equal(t, testH264Residual8x8Slice(want), got)
+}
+
+func TestResidualMosherCABAC8x8(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "x264.mp4"))
+	require.NoError(t, err)
+	defer f.Close()
+	tracks, err := ParseTracks(f)
+	require.NoError(t, err)
+	track := tracks[0]
+
+	// the 8x8 blocks have no coded_block_flag, zeroing them keeps a level
+	var blocks []ResidualBlock
+	m, err := NewResidualMosher(track.AVC, func(b []ResidualBlock) {
+		ZeroHighFrequencies(0)(b)
+	})
+	require.NoError(t, err)
+	check, err := NewResidualMosher(track.AVC, func(b []ResidualBlock) {
+		blocks = append(blocks, b...)
+	})
+	require.NoError(t, err)
+	d, err := NewH264Decoder(track.AVC)
+	require.NoError(t, err)
+	for _, nal := range track.NALs {
+		if nal.SampleID > 2 {
+			// B frames from here, left untouched
+			break
+		}
+		payload, err := nal.Payload(f)
+		require.NoError(t, err)
+		moshed, err := m.RewriteNAL(payload)
+		require.NoError(t, err)
+		_, err = check.RewriteNAL(moshed)
+		require.NoError(t, err)
+		require.NoError(t, d.DecodeNAL(moshed))
+	}
+
+	n8x8 := 0
+	for _, b := range blocks {
+		nonZero := 0
+		for _, level := range b.Levels {
+			if level != 0 {
+				nonZero++
+				assert.Equal(t, int32(1), abs32(level))
+			}
+		}
+		if b.Kind == ResidualLuma8x8 {
+			n8x8++
+			assert.Len(t, b.Levels, 64)
+			assert.Equal(t, 1, nonZero)
+		} else {
+			assert.Zero(t, nonZero)
+		}
+	}
+	assert.NotZero(t, n8x8)
+}
+
+func TestParseResidualTransform(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []int32
+		err  string
+	}{
+		{spec: "zero=2", want: []int32{9, -3, 0, 0}},
+		{spec: "quantize=4, zero=3", want: []int32{8, -4, 0, 0}},
+		{spec: "noise=0", want: []int32{9, -3, 1, 0}},
+		{spec: "swap", want: []int32{9, -3, 1, 0}},
+		{spec: "zero", err: `invalid residual transform "zero"`},
+		{spec: "swap=1", err: `invalid residual transform "swap=1"`},
+		{spec: "zero=x", err: `invalid residual transform "zero=x": strconv.Atoi: parsing "x": invalid syntax`},
+		{spec: "blur=1", err: `unknown residual transform "blur"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			transform, err := ParseResidualTransform(tt.spec)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			blocks := []ResidualBlock{{Kind: ResidualLuma4x4, Levels: []int32{9, -3, 1, 0}}}
+			transform(blocks)
+			assert.Equal(t, tt.want, blocks[0].Levels)
+		})
+	}
+
+	// the AC blocks start at the second coefficient
+	blocks := []ResidualBlock{{Kind: ResidualChromaAC, Levels: []int32{1, 1, 1}}, {Kind: ResidualChromaDC, Levels: []int32{1, 1, 1, 1}}}
+	ZeroHighFrequencies(2)(blocks)
+	assert.Equal(t, []int32{1, 0, 0}, blocks[0].Levels)
+	assert.Equal(t, []int32{1, 1, 0, 0}, blocks[1].Levels)
+
+	noise := ResidualNoise(3, 1)
+	for i := 0; i < 100; i++ {
+		blocks := []ResidualBlock{{Levels: []int32{10, 0}}}
+		noise(blocks)
+		assert.InDelta(t, 10, blocks[0].Levels[0], 3)
+		assert.InDelta(t, 0, blocks[0].Levels[1], 3)
+	}
+}
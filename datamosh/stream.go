@@ -0,0 +1,291 @@
+package datamosh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/abema/go-mp4"
+	"github.com/sunfish-shogi/bufseekio"
+)
+
+// NALIterator walks the NAL units of an H.264 track sample by sample, chunk by
+// chunk, reading their headers lazily so memory doesn't grow with the length
+// of the file. Each sample is read at once in a reused buffer, and the reader
+// is only seeked between chunks that don't follow each other.
+//
+//	it, err := NewNALIterator(r, track)
+//	for it.Next() {
+//		nal := it.NAL()
+//	}
+//	err = it.Err()
+type NALIterator struct {
+	r          io.ReadSeeker
+	track      *Track
+	lengthSize uint32
+	chunk      int    // index of the current chunk
+	chunkEnd   int    // index of the first sample after the current chunk
+	sample     int    // index of the current sample
+	dataOffset uint64 // of the current sample
+	nalOffset  uint32 // of the next NAL unit in the current sample
+	time       uint64 // decode time of the current sample
+	nal        *NALUnit
+	err        error
+
+	buf    []byte // data of the current sample, reused across samples
+	loaded bool   // buf holds the current sample
+	pos    int64  // of the reader, -1 when unknown
+}
+
+// NewNALIterator returns an iterator over the NAL units of an H.264 track
+// read from r.
+func NewNALIterator(r io.ReadSeeker, track *Track) (*NALIterator, error) {
+	if track.AVC == nil {
+		return nil, errors.New("AVC configuration not found")
+	}
+	return &NALIterator{r: r, track: track, lengthSize: uint32(track.AVC.LengthSize), chunk: -1, pos: -1}, nil
+}
+
+// Next advances to the next NAL unit. It returns false at the end of the
+// track or on error, see Err.
+func (it *NALIterator) Next() bool {
+	it.nal = nil
+	if it.err != nil {
+		return false
+	}
+	track := it.track
+	for it.sample < len(track.Samples) {
+		if it.sample >= it.chunkEnd {
+			if it.chunk+1 >= len(track.Chunks) {
+				return false
+			}
+			it.chunk++
+			chunk := track.Chunks[it.chunk]
+			it.chunkEnd = it.sample + int(chunk.SamplesPerChunk)
+			it.dataOffset, it.nalOffset = chunk.DataOffset, 0
+			if Debug {
+				fmt.Printf("Chunk %d: offset: %d, samples %d-%d\n", it.chunk, it.dataOffset, it.sample, it.chunkEnd)
+			}
+			continue
+		}
+
+		sample := track.Samples[it.sample]
+		if it.nalOffset+it.lengthSize+1 <= sample.Size {
+			if it.nal, it.err = it.readNAL(sample); it.err != nil {
+				return false
+			}
+			it.nalOffset += it.lengthSize + it.nal.Length
+			return true
+		}
+		it.dataOffset += uint64(sample.Size)
+		it.time += uint64(sample.TimeDelta)
+		it.nalOffset, it.loaded = 0, false
+		it.sample++
+	}
+	return false
+}
+
+// readSample reads the data of the current sample in the buffer.
+func (it *NALIterator) readSample(size uint32) error {
+	if int64(it.dataOffset) != it.pos {
+		if _, err := it.r.Seek(int64(it.dataOffset), io.SeekStart); err != nil {
+			it.pos = -1
+			return err
+		}
+	}
+	if cap(it.buf) < int(size) {
+		it.buf = make([]byte, size)
+	}
+	it.buf = it.buf[:size]
+	if _, err := io.ReadFull(it.r, it.buf); err != nil {
+		it.pos = -1
+		return err
+	}
+	it.pos = int64(it.dataOffset) + int64(size)
+	it.loaded = true
+	return nil
+}
+
+// readNAL reads the NAL unit at the current offset of the sample.
+func (it *NALIterator) readNAL(sample *mp4.Sample) (*NALUnit, error) {
+	if !it.loaded {
+		if err := it.readSample(sample.Size); err != nil {
+			return nil, err
+		}
+	}
+	offset := int64(it.dataOffset + uint64(it.nalOffset))
+	data := it.buf[it.nalOffset:]
+	var length uint32
+	for i := 0; i < int(it.lengthSize); i++ {
+		length = (length << 8) + uint32(data[i])
+	}
+	nalHeader := data[it.lengthSize]
+	nalType := nalHeader & 0x1f
+
+	sliceType := sliceTypeUnknown
+	switch nalType {
+	case NAL_SLICE, NAL_DPA, NAL_IDR_SLICE, NAL_AUX_SLICE:
+		// first_mb_in_slice and slice_type fit in the next few bytes
+		head := data[it.lengthSize+1:]
+		if n := min(8, int64(length)-1); int64(len(head)) > n {
+			head = head[:max(n, 0)]
+		}
+		sliceType = parseSliceType(head)
+	case NAL_SEI:
+		end := int(it.lengthSize) + int(length)
+		if end <= len(data) && it.sample < len(it.track.SampleFlags) {
+			if frameCnt, ok := parseRecoveryPoint(data[it.lengthSize+1 : end]); ok {
+				flags := &it.track.SampleFlags[it.sample]
+				flags.RecoveryPoint, flags.RecoveryFrameCnt = true, frameCnt
+			}
+		}
+	}
+
+	if Debug {
+		debugNAL(nalType, offset, length)
+	}
+
+	return &NALUnit{
+		Type:       nalType,
+		RefIdc:     (nalHeader >> 5) & 0x03,
+		SliceType:  sliceType,
+		Offset:     offset + int64(it.lengthSize),
+		Length:     length,
+		TrackID:    it.track.TrackID,
+		Chunk:      uint32(it.chunk),
+		SampleID:   uint32(it.sample),
+		Timestamp:  it.time + uint64(sample.CompositionTimeOffset),
+		DecodeTime: it.time,
+	}, nil
+}
+
+// NAL returns the current NAL unit.
+func (it *NALIterator) NAL() *NALUnit {
+	return it.nal
+}
+
+// Frame returns the current NAL unit as a frame.
+func (it *NALIterator) Frame() Frame {
+	return it.nal
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *NALIterator) Err() error {
+	return it.err
+}
+
+// frameIterator yields the frames of a track one at a time.
+type frameIterator interface {
+	Next() bool
+	Frame() Frame
+	Err() error
+}
+
+// sliceFrames iterates over frames already parsed.
+type sliceFrames struct {
+	frames []Frame
+	i      int
+}
+
+func (s *sliceFrames) Next() bool {
+	if s.i >= len(s.frames) {
+		return false
+	}
+	s.i++
+	return true
+}
+
+func (s *sliceFrames) Frame() Frame {
+	return s.frames[s.i-1]
+}
+
+func (s *sliceFrames) Err() error {
+	return nil
+}
+
+// frameIterator returns an iterator over the frames of a track read without
+// its frames, see ReadTracks. The NAL units of H.264 tracks are read lazily,
+// the frames of the other codecs are parsed at once. It returns nil for tracks
+// without supported frames.
+func (t *Track) frameIterator(r io.ReadSeeker) (frameIterator, error) {
+	var frames []Frame
+	switch {
+	case t.AVC != nil:
+		return NewNALIterator(r, t)
+	case t.AV1 != nil:
+		obus, err := processAV1Track(r, t)
+		if err != nil {
+			return nil, err
+		}
+		for _, obu := range obus {
+			frames = append(frames, obu)
+		}
+	case t.VPX != nil:
+		vpxFrames, err := processVPXTrack(r, t)
+		if err != nil {
+			return nil, err
+		}
+		for _, frame := range vpxFrames {
+			frames = append(frames, frame)
+		}
+	default:
+		return nil, nil
+	}
+	return &sliceFrames{frames: frames}, nil
+}
+
+// StreamFrames runs fn on the frames of the tracks of an MP4 file in a single
+// pass, like ProcessFrames, without keeping the frames in memory: the tracks
+// are read without their frames, the NAL units of H.264 tracks are then read
+// chunk by chunk as fn processes them, and the frames of the other codecs one
+// track at a time. The Track given to fn in the context has no frames, and fn
+// must only write the data of the frame it's given.
+//
+// Once all the tracks are processed, ErrNoSyncSampleBox is returned if key
+// frames were nullified in a track without stss box, for the file to be
+// remuxed.
+func StreamFrames(ctx context.Context, inputFile *os.File, fn FrameProcessor) (context.Context, error) {
+	r := bufseekio.NewReadSeeker(inputFile, 128*1024, 4)
+	tracks, err := ReadTracks(r)
+	if err != nil {
+		fmt.Println("Error parsing tracks:", err)
+		return ctx, err
+	}
+
+	currentContext := ctx
+	var syncErr error
+	for _, track := range tracks {
+		frames, err := track.frameIterator(r)
+		if err != nil {
+			return currentContext, err
+		}
+		if frames == nil {
+			continue
+		}
+		currentContext = context.WithValue(currentContext, TrackKey, track)
+		nullified := map[uint32]bool{}
+		currentContext = context.WithValue(currentContext, nullifiedSamplesKey, nullified)
+		for frames.Next() {
+			frame := frames.Frame()
+			currentContext, err = fn(currentContext, inputFile, frame)
+			if err != nil {
+				log.Printf("Error processing frame: %v - %v", frame, err)
+				return currentContext, err
+			}
+		}
+		if err := frames.Err(); err != nil {
+			return currentContext, err
+		}
+		// players must not seek to the nullified key frames
+		if err := track.removeSyncSamples(inputFile, nullified); errors.Is(err, ErrNoSyncSampleBox) {
+			syncErr = err
+		} else if err != nil {
+			return currentContext, err
+		}
+	}
+
+	return currentContext, syncErr
+}
@@ -0,0 +1,130 @@
+package datamosh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNALIterator(t *testing.T) {
+	for _, fixture := range []mp4Fixture{
+		{gop: "IPPPIPPP", chunk: 3},
+		{gop: "IBBPBBPIBP", heightMbs: 3, slices: 3, audio: true},
+	} {
+		t.Run(fixture.gop, func(t *testing.T) {
+			r := bytes.NewReader(fixture.withDefaults().build(t))
+			want, err := ParseTracks(r)
+			require.NoError(t, err)
+			tracks, err := ReadTracks(r)
+			require.NoError(t, err)
+			require.Len(t, tracks, len(want))
+			assert.Empty(t, tracks[0].NALs)
+
+			it, err := NewNALIterator(r, tracks[0])
+			require.NoError(t, err)
+			var nals []*NALUnit
+			for it.Next() {
+				nals = append(nals, it.NAL())
+			}
+			require.NoError(t, it.Err())
+			assert.Equal(t, want[0].NALs, nals)
+
+			if fixture.audio {
+				_, err := NewNALIterator(r, tracks[1])
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestStreamFramesNullifyIFrames(t *testing.T) {
+	fixture := mp4Fixture{gop: "IPPIPPIPP", heightMbs: 3, slices: 2, audio: true}.withDefaults()
+	data := fixture.build(t)
+
+	// the file processed in a single pass matches the one processed with all
+	// its frames parsed first
+	files := map[string][]byte{}
+	for name, process := range map[string]func(context.Context, *os.File, FrameProcessor) (context.Context, error){
+		"process": ProcessFrames,
+		"stream":  StreamFrames,
+	} {
+		path := filepath.Join(t.TempDir(), name+".mp4")
+		require.NoError(t, os.WriteFile(path, data, 0o644))
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		require.NoError(t, err)
+		ctx, err := process(context.Background(), f, NullifyIFrames)
+		require.NoError(t, err)
+		assert.Equal(t, 3, ctx.Value(IFrameCountKey), name)
+		assert.Equal(t, 2, ctx.Value(IFrameRemovedCountKey), name)
+		require.NoError(t, f.Close())
+		files[name], err = os.ReadFile(path)
+		require.NoError(t, err)
+	}
+	assert.NotEqual(t, data, files["stream"])
+	assert.Equal(t, files["process"], files["stream"])
+}
+
+// benchmarkFile writes 10 seconds of synthetic video with slices and audio to
+// a file, so reads go through the file system.
+func benchmarkFile(b *testing.B) (*os.File, int64) {
+	gop := strings.Repeat("I"+strings.Repeat("P", 24), 10)
+	data := mp4Fixture{gop: gop, widthMbs: 8, heightMbs: 6, slices: 3, audio: true}.withDefaults().build(b)
+	path := filepath.Join(b.TempDir(), "bench.mp4")
+	require.NoError(b, os.WriteFile(path, data, 0o644))
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(b, err)
+	b.Cleanup(func() { f.Close() })
+	return f, int64(len(data))
+}
+
+func BenchmarkParseTracks(b *testing.B) {
+	f, size := benchmarkFile(b)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseTracks(f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNALIterator(b *testing.B) {
+	f, size := benchmarkFile(b)
+	tracks, err := ReadTracks(f)
+	require.NoError(b, err)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it, err := NewNALIterator(f, tracks[0])
+		if err != nil {
+			b.Fatal(err)
+		}
+		for it.Next() {
+		}
+		if err := it.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStreamFrames(b *testing.B) {
+	f, size := benchmarkFile(b)
+	keyframes := func(ctx context.Context, w io.WriteSeeker, frame Frame) (context.Context, error) {
+		frame.IsKeyframe()
+		return ctx, nil
+	}
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := StreamFrames(context.Background(), f, keyframes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package datamosh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abema/go-mp4"
+)
+
+// SampleFlags are the random access and dependency properties the sample
+// table of an MP4 track gives a sample, which may differ from what the
+// bitstream says: an open GOP I frame or a recovery point SEI can be listed as
+// a sync sample while not being an IDR picture.
+type SampleFlags struct {
+	// Sync is set for the samples listed by the stss box, and for all the
+	// samples of tracks without one. See ISO/IEC 14496-12 8.6.2.
+	Sync bool
+
+	// IsLeading, DependsOn, IsDependedOn and HasRedundancy are the fields of
+	// the sdtp box, 0 (unknown) without one. See ISO/IEC 14496-12 8.6.4.
+	IsLeading     uint8
+	DependsOn     uint8 // 1: inter frame, 2: intra frame
+	IsDependedOn  uint8 // 1: reference, 2: disposable
+	HasRedundancy uint8
+
+	// Roll is set for the members of a 'roll' or 'prol' sample group, the
+	// samples decoding properly RollDistance samples after (or before when
+	// negative) a random access at this one. See ISO/IEC 14496-12 10.1.
+	Roll         bool
+	RollDistance int16
+
+	// RandomAccess is set for the members of a 'rap ' sample group, open GOP
+	// random access points. See ISO/IEC 14496-12 10.4.
+	RandomAccess bool
+
+	// RecoveryPoint is set for the H.264 samples holding a recovery point SEI
+	// message, as their NAL units are read: the pictures are correct
+	// RecoveryFrameCnt frames after a random access at this one. See H.264
+	// D.2.8.
+	RecoveryPoint    bool
+	RecoveryFrameCnt uint32
+}
+
+var (
+	groupingTypeRoll = [4]byte{'r', 'o', 'l', 'l'}
+	groupingTypeProl = [4]byte{'p', 'r', 'o', 'l'}
+	groupingTypeRap  = [4]byte{'r', 'a', 'p', ' '}
+)
+
+// IsSyncSample returns true when a random access can start at the sample
+// according to the container.
+func (t *Track) IsSyncSample(id uint32) bool {
+	if int(id) >= len(t.SampleFlags) {
+		return true
+	}
+	return t.SampleFlags[id].Sync
+}
+
+// newSampleFlags returns the flags of count samples from the sync sample,
+// sample dependency and sample group boxes of a track, all optional.
+func newSampleFlags(count int, stss *mp4.Stss, sdtp *mp4.Sdtp, sgpds []*mp4.Sgpd, sbgps []*mp4.Sbgp) []SampleFlags {
+	flags := make([]SampleFlags, count)
+	for i := range flags {
+		flags[i].Sync = stss == nil
+	}
+	if stss != nil {
+		for _, number := range stss.SampleNumber {
+			if number >= 1 && int(number) <= count {
+				flags[number-1].Sync = true
+			}
+		}
+	}
+	if sdtp != nil {
+		for i, sample := range sdtp.Samples {
+			if i >= count {
+				break
+			}
+			flags[i].IsLeading = sample.IsLeading
+			flags[i].DependsOn = sample.SampleDependsOn
+			flags[i].IsDependedOn = sample.SampleIsDependedOn
+			flags[i].HasRedundancy = sample.SampleHasRedundancy
+		}
+	}
+
+	for _, sbgp := range sbgps {
+		var groupingType [4]byte
+		binary.BigEndian.PutUint32(groupingType[:], sbgp.GroupingType)
+		var sgpd *mp4.Sgpd
+		for _, description := range sgpds {
+			if description.GroupingType == groupingType {
+				sgpd = description
+			}
+		}
+		if sgpd == nil {
+			continue
+		}
+		var si int
+		for _, entry := range sbgp.Entries {
+			for n := uint32(0); n < entry.SampleCount && si < count; n++ {
+				// 0 means no group, the indices start at 1
+				if index := int(entry.GroupDescriptionIndex) - 1; index >= 0 {
+					setSampleGroup(&flags[si], sgpd, index)
+				}
+				si++
+			}
+		}
+	}
+	return flags
+}
+
+// setSampleGroup sets the flags of a sample member of the group at index of
+// the sample group description.
+func setSampleGroup(flags *SampleFlags, sgpd *mp4.Sgpd, index int) {
+	switch sgpd.GroupingType {
+	case groupingTypeRoll, groupingTypeProl:
+		switch {
+		case index < len(sgpd.RollDistances):
+			flags.Roll, flags.RollDistance = true, sgpd.RollDistances[index]
+		case index < len(sgpd.RollDistancesL):
+			flags.Roll, flags.RollDistance = true, sgpd.RollDistancesL[index].RollDistance
+		}
+	case groupingTypeRap:
+		flags.RandomAccess = index < len(sgpd.VisualRandomAccessEntries) ||
+			index < len(sgpd.VisualRandomAccessEntriesL)
+	}
+}
+
+// keptSampleFlags returns a copy of the flags of the samples of t for out, a
+// rewrite of t with the same samples: the samples whose key frames were
+// removed are no longer sync samples.
+func (t *Track) keptSampleFlags(out *Track) []SampleFlags {
+	if t.SampleFlags == nil {
+		return nil
+	}
+	flags := make([]SampleFlags, len(t.SampleFlags))
+	copy(flags, t.SampleFlags)
+	kept := keySamples(out)
+	for id := range keySamples(t) {
+		if !kept[id] && int(id) < len(flags) {
+			flags[id].Sync = false
+		}
+	}
+	return flags
+}
+
+// ErrNoSyncSampleBox is returned when key frames are nullified in place in a
+// track without stss box, which players see as made of sync samples only: the
+// file must be remuxed, such as with MP4Muxer, to list the sync samples left.
+var ErrNoSyncSampleBox = errors.New("no stss box to remove the sync samples from")
+
+// removeSyncSamples rewrites in place the stss box of a track read from an MP4
+// file so it no longer lists the given samples, such as nullified key frames
+// players would otherwise seek to. The box shrinks, followed by a free box
+// taking the freed space. A single freed entry being too small for a box, the
+// last sync sample is listed twice instead. The sample flags of fragmented
+// tracks are rewritten in their trun boxes.
+//
+// Without stss box all the samples are sync samples, and there is no room to
+// insert one in place: the sample flags are updated and ErrNoSyncSampleBox is
+// returned, the file having to be remuxed.
+func (t *Track) removeSyncSamples(w io.WriteSeeker, ids map[uint32]bool) error {
+	if len(t.fragmentFlags) > 0 {
+		if err := t.removeFragmentSyncSamples(w, ids); err != nil {
+			return err
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if t.stss == nil {
+		if len(t.fragmentFlags) > 0 || t.SampleFlags == nil {
+			return nil
+		}
+		for id := range ids {
+			if int(id) < len(t.SampleFlags) {
+				t.SampleFlags[id].Sync = false
+			}
+		}
+		return fmt.Errorf("track %d: %w", t.TrackID, ErrNoSyncSampleBox)
+	}
+	var numbers []uint32
+	for i := range t.SampleFlags {
+		if ids[uint32(i)] {
+			t.SampleFlags[i].Sync = false
+		}
+		if t.SampleFlags[i].Sync {
+			numbers = append(numbers, uint32(i+1))
+		}
+	}
+	box := make([]byte, t.stss.Size)
+	stssSize := 16 + 4*len(numbers)
+	free := len(box) - stssSize
+	if free == 4 && len(numbers) > 0 {
+		numbers = append(numbers, numbers[len(numbers)-1])
+		stssSize, free = stssSize+4, 0
+	}
+	if free < 0 || (free > 0 && free < 8) {
+		return fmt.Errorf("can't rewrite the stss box of track %d in place", t.TrackID)
+	}
+	binary.BigEndian.PutUint32(box, uint32(stssSize))
+	copy(box[4:], "stss")
+	// version and flags are 0
+	binary.BigEndian.PutUint32(box[12:], uint32(len(numbers)))
+	for i, number := range numbers {
+		binary.BigEndian.PutUint32(box[16+4*i:], number)
+	}
+	if free > 0 {
+		binary.BigEndian.PutUint32(box[stssSize:], uint32(free))
+		copy(box[stssSize+4:], "free")
+	}
+	if _, err := w.Seek(int64(t.stss.Offset), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.Write(box); err != nil {
+		return fmt.Errorf("failed to write stss box: %v", err)
+	}
+	t.stss.Size, t.stss.HeaderSize = uint64(stssSize), 8
+	return nil
+}
@@ -0,0 +1,118 @@
+package datamosh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleFlags(t *testing.T) {
+	fixture := mp4Fixture{gop: "IBPiBP", audio: true}.withDefaults()
+	data := fixture.build(t)
+	tracks, err := ParseTracks(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+	video, audio := tracks[0], tracks[1]
+	frames := fixture.frames()
+	require.Len(t, video.SampleFlags, len(frames))
+	for id, frame := range frames {
+		flags := video.SampleFlags[id]
+		assert.Equal(t, frame.kind == 'I', flags.Sync, "sample %d", id)
+		assert.Equal(t, frame.kind == 'i', flags.RandomAccess, "sample %d", id)
+		intra := frame.kind == 'I' || frame.kind == 'i'
+		assert.Equal(t, intra, flags.DependsOn == 2, "sample %d", id)
+		assert.Equal(t, frame.kind == 'B', flags.IsDependedOn == 2, "sample %d", id)
+	}
+	// without stss box, all the samples are sync samples
+	require.Len(t, audio.SampleFlags, len(fixture.audioFrames()))
+	for id := range audio.Samples {
+		assert.True(t, audio.IsSyncSample(uint32(id)))
+	}
+
+	roll := &mp4.Sgpd{GroupingType: groupingTypeRoll, EntryCount: 2, RollDistances: []int16{-1, 2}}
+	sbgp := &mp4.Sbgp{
+		GroupingType: binary.BigEndian.Uint32(groupingTypeRoll[:]),
+		Entries:      []mp4.SbgpEntry{{SampleCount: 1}, {SampleCount: 2, GroupDescriptionIndex: 2}},
+	}
+	flags := newSampleFlags(4, &mp4.Stss{SampleNumber: []uint32{1, 9}}, nil, []*mp4.Sgpd{roll}, []*mp4.Sbgp{sbgp})
+	assert.Equal(t, []SampleFlags{
+		{Sync: true},
+		{Roll: true, RollDistance: 2},
+		{Roll: true, RollDistance: 2},
+		{},
+	}, flags)
+}
+
+func TestKeptSampleFlags(t *testing.T) {
+	fixture := mp4Fixture{gop: "IPPIPP"}.withDefaults()
+	data := fixture.build(t)
+	tracks, err := ParseTracks(bytes.NewReader(data))
+	require.NoError(t, err)
+	video := tracks[0]
+	require.True(t, video.IsSyncSample(3))
+
+	// the second IDR picture removed
+	moshed, moshedData, err := video.rewriteNALs(bytes.NewReader(data), func(nal *NALUnit, payload []byte) ([]byte, error) {
+		if nal.Type == NAL_IDR_SLICE && nal.SampleID == 3 {
+			return nil, nil
+		}
+		return payload, nil
+	})
+	require.NoError(t, err)
+	assert.True(t, moshed.IsSyncSample(0))
+	assert.False(t, moshed.IsSyncSample(3))
+	assert.True(t, video.IsSyncSample(3), "the original track is left as is")
+
+	// the muxed file only lists the key frames left
+	out := &bytes.Buffer{}
+	muxed := MuxTrack{Track: moshed, Data: bytes.NewReader(moshedData)}
+	require.NoError(t, (&MP4Muxer{}).Mux(out, bytes.NewReader(data), []MuxTrack{muxed}))
+	tracks, err = ParseTracks(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	for id, flags := range tracks[0].SampleFlags {
+		assert.Equal(t, id == 0, flags.Sync, "sample %d", id)
+	}
+}
+
+func TestRemoveSyncSamplesWithoutStss(t *testing.T) {
+	fixture := mp4Fixture{gop: "IPPIPPIPP", noStss: true}.withDefaults()
+	for name, process := range map[string]func(context.Context, *os.File, FrameProcessor) (context.Context, error){
+		"process": ProcessFrames,
+		"stream":  StreamFrames,
+		"parallel": func(ctx context.Context, f *os.File, fn FrameProcessor) (context.Context, error) {
+			return ProcessFramesParallel(ctx, f, fn, 2)
+		},
+	} {
+		path := filepath.Join(t.TempDir(), name+".mp4")
+		require.NoError(t, os.WriteFile(path, fixture.build(t), 0o644))
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		require.NoError(t, err)
+		defer f.Close()
+
+		// the key frames are nullified, but the file lists all the samples as
+		// sync samples until remuxed
+		ctx, err := process(context.Background(), f, NullifyIFrames)
+		require.True(t, errors.Is(err, ErrNoSyncSampleBox), "%s: unexpected error %v", name, err)
+		assert.Equal(t, 2, ctx.Value(IFrameRemovedCountKey), name)
+		tracks, _, err := Demux(f)
+		require.NoError(t, err)
+		assert.True(t, tracks[0].IsSyncSample(3), name)
+
+		out := &bytes.Buffer{}
+		require.NoError(t, (&MP4Muxer{}).Mux(out, f, []MuxTrack{{Track: tracks[0]}}))
+		tracks, err = ParseTracks(bytes.NewReader(out.Bytes()))
+		require.NoError(t, err)
+		// the other samples are left as the container listed them
+		for id, flags := range tracks[0].SampleFlags {
+			assert.Equal(t, id != 3 && id != 6, flags.Sync, "%s: sample %d", name, id)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package datamosh
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Timestamp is an exact time, a number of ticks of a timescale, such as the
+// decode and presentation times of the samples of a track.
+type Timestamp struct {
+	Ticks     int64
+	Timescale uint32 // ticks per second
+}
+
+// timescale returns the timescale as a big.Int, 1 when not set.
+func (ts Timestamp) timescale() *big.Int {
+	if ts.Timescale == 0 {
+		return big.NewInt(1)
+	}
+	return new(big.Int).SetUint64(uint64(ts.Timescale))
+}
+
+// Rat returns the timestamp as an exact number of seconds.
+func (ts Timestamp) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(ts.Ticks), ts.timescale())
+}
+
+// Seconds returns the timestamp in seconds, rounded to the nearest float64.
+func (ts Timestamp) Seconds() float64 {
+	seconds, _ := ts.Rat().Float64()
+	return seconds
+}
+
+// Duration returns the timestamp as a time.Duration, rounded down to the
+// nanosecond.
+func (ts Timestamp) Duration() time.Duration {
+	ns := new(big.Int).Mul(big.NewInt(ts.Ticks), big.NewInt(int64(time.Second)))
+	return time.Duration(ns.Div(ns, ts.timescale()).Int64())
+}
+
+// Frame returns the number of the frame shown at the timestamp for a frame
+// rate of num/den frames per second, see Track.FrameRate. It returns 0 for an
+// invalid rate.
+func (ts Timestamp) Frame(num, den uint32) int64 {
+	if num == 0 || den == 0 {
+		return 0
+	}
+	n := new(big.Int).Mul(big.NewInt(ts.Ticks), new(big.Int).SetUint64(uint64(num)))
+	d := new(big.Int).Mul(ts.timescale(), new(big.Int).SetUint64(uint64(den)))
+	// Div rounds down, negative timestamps included
+	return n.Div(n, d).Int64()
+}
+
+// Timecode returns the HH:MM:SS:FF timecode of the frame shown at the
+// timestamp for a frame rate of num/den frames per second. Timecodes are non
+// drop frame, counting frames at the nominal rate: 30 per second for 29.97 fps.
+func (ts Timestamp) Timecode(num, den uint32) string {
+	frame := ts.Frame(num, den)
+	var fps int64 = 1
+	if num != 0 && den != 0 {
+		fps = int64((num + den - 1) / den)
+	}
+	sign := ""
+	if frame < 0 {
+		sign, frame = "-", -frame
+	}
+	seconds := frame / fps
+	return fmt.Sprintf("%s%02d:%02d:%02d:%02d", sign, seconds/3600, seconds/60%60, seconds%60, frame%fps)
+}
+
+// String returns the timestamp as HH:MM:SS.mmm.
+func (ts Timestamp) String() string {
+	d := ts.Duration()
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%s%02d:%02d:%02d.%03d", sign, ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// DTS returns the decode time of a frame of the track.
+func (t *Track) DTS(f Frame) Timestamp {
+	return Timestamp{Ticks: int64(f.DTS()), Timescale: t.Timescale}
+}
+
+// PTS returns the presentation time of a frame of the track in its media,
+// before the edit list is applied, see Track.PresentationTime.
+func (t *Track) PTS(f Frame) Timestamp {
+	return Timestamp{Ticks: int64(f.PTS()), Timescale: t.Timescale}
+}
+
+// frameTime describes when players show a frame of the track, for reports.
+func (t *Track) frameTime(f Frame) string {
+	pts, _ := t.PresentationTime(int64(f.PTS()))
+	num, den := t.FrameRate()
+	return fmt.Sprintf("%s, frame %d", pts, pts.Frame(num, den))
+}
@@ -0,0 +1,54 @@
+package datamosh
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestamp(t *testing.T) {
+	// 1001/30000 s frames: NTSC
+	ts := Timestamp{Ticks: 3 * 60 * 30000, Timescale: 30000}
+	assert.Equal(t, 180.0, ts.Seconds())
+	assert.Equal(t, 3*time.Minute, ts.Duration())
+	assert.Equal(t, "00:03:00.000", ts.String())
+	assert.Equal(t, int64(5394), ts.Frame(30000, 1001))
+	assert.Equal(t, "00:02:59:24", ts.Timecode(30000, 1001))
+	assert.Equal(t, "00:03:00:00", ts.Timecode(30, 1))
+
+	// no rounding to floats or integer seconds
+	ts = Timestamp{Ticks: 1, Timescale: 3}
+	assert.Equal(t, big.NewRat(1, 3), ts.Rat())
+	assert.Equal(t, 333333333*time.Nanosecond, ts.Duration())
+	assert.Equal(t, "00:00:00.333", ts.String())
+	ts = Timestamp{Ticks: 3*3600*12800 + 7*12800 + 6400, Timescale: 12800}
+	assert.Equal(t, "03:00:07.500", ts.String())
+	assert.Equal(t, "03:00:07:12", ts.Timecode(25, 1))
+	assert.Equal(t, int64(270187), ts.Frame(25, 1))
+
+	ts = Timestamp{Ticks: -512, Timescale: 12800}
+	assert.Equal(t, "-00:00:00.040", ts.String())
+	assert.Equal(t, int64(-1), ts.Frame(25, 1))
+	assert.Equal(t, "-00:00:00:01", ts.Timecode(25, 1))
+	assert.Equal(t, int64(0), ts.Frame(0, 1))
+}
+
+func TestFrameTimestamps(t *testing.T) {
+	fixture := mp4Fixture{gop: "IBPBP"}.withDefaults()
+	tracks, err := ParseTracks(bytes.NewReader(fixture.build(t)))
+	require.NoError(t, err)
+	video := tracks[0]
+	frames := video.Frames()
+	for i, want := range fixture.frames() {
+		frame := frames[i]
+		assert.Equal(t, Timestamp{Ticks: int64(want.dts), Timescale: fixtureTimescale}, video.DTS(frame))
+		assert.Equal(t, Timestamp{Ticks: int64(want.pts), Timescale: fixtureTimescale}, video.PTS(frame))
+		assert.Equal(t, int64(want.pts/fixtureFrameDuration), video.PTS(frame).Frame(video.FrameRate()))
+	}
+	// the P frame shown third, after the composition delay of a frame
+	assert.Equal(t, "00:00:00.120, frame 3", video.frameTime(frames[1]))
+}
@@ -0,0 +1,124 @@
+package datamosh
+
+import "math"
+
+// Edit is an entry of the edit list of a track, mapping a segment of the
+// presentation timeline to the media. See ISO/IEC 14496-12 8.6.6.
+type Edit struct {
+	SegmentDuration uint64 // in the timescale of the track
+	MediaTime       int64  // in the timescale of the track, -1 for an empty edit
+	Rate            int16  // 1 for normal playback, 0 to show MediaTime for the whole segment
+}
+
+// IsEmpty returns true for the edits presenting no media, delaying the
+// following ones.
+func (e Edit) IsEmpty() bool {
+	return e.MediaTime == -1
+}
+
+// PresentationTime returns the time at which players present the media time
+// of the track, in its timescale, once its edit list is applied. ok is false
+// when no edit presents it, like the frames trimmed at the start of the track,
+// the time being then extrapolated from the first edit presenting media.
+func (t *Track) PresentationTime(mediaTime int64) (ts Timestamp, ok bool) {
+	var start int64 // of the edit, in the timescale of the track
+	first, firstStart := -1, int64(0)
+	for i, edit := range t.EditList {
+		if !edit.IsEmpty() {
+			if first < 0 {
+				first, firstStart = i, start
+			}
+			offset := mediaTime - edit.MediaTime
+			switch {
+			case edit.Rate <= 0:
+				if offset == 0 {
+					return Timestamp{Ticks: start, Timescale: t.Timescale}, true
+				}
+			// a 0 duration lasts until the end of the media
+			case offset >= 0 && (edit.SegmentDuration == 0 || offset < int64(edit.SegmentDuration)*int64(edit.Rate)):
+				return t.editTime(start, offset, edit.Rate), true
+			}
+		}
+		start += int64(edit.SegmentDuration)
+	}
+	if first < 0 {
+		return Timestamp{Ticks: mediaTime, Timescale: t.Timescale}, len(t.EditList) == 0
+	}
+	edit := t.EditList[first]
+	rate := edit.Rate
+	if rate <= 0 {
+		rate = 1
+	}
+	return t.editTime(firstStart, mediaTime-edit.MediaTime, rate), false
+}
+
+// editTime returns the presentation time of the media offset of an edit
+// starting at start and played at rate.
+func (t *Track) editTime(start, offset int64, rate int16) Timestamp {
+	if rate == 1 {
+		return Timestamp{Ticks: start + offset, Timescale: t.Timescale}
+	}
+	// exact in a timescale rate times finer
+	return Timestamp{Ticks: start*int64(rate) + offset, Timescale: t.Timescale * uint32(rate)}
+}
+
+// mediaStart returns the media time presented first, the composition delay or
+// the encoder delay trimmed by the edit list.
+func (t *Track) mediaStart() int64 {
+	for _, edit := range t.EditList {
+		if !edit.IsEmpty() {
+			return edit.MediaTime
+		}
+	}
+	return 0
+}
+
+// rebuildEditList returns the edit list of a track whose media changed: the
+// leading empty edits are kept and the media is presented from mediaTime to
+// mediaEnd at normal rate. It returns nil when there is nothing to edit.
+func (t *Track) rebuildEditList(mediaTime int64, mediaEnd uint64) []Edit {
+	var edits []Edit
+	for _, edit := range t.EditList {
+		if !edit.IsEmpty() {
+			break
+		}
+		edits = append(edits, edit)
+	}
+	if mediaTime <= 0 && len(edits) == 0 {
+		return nil
+	}
+	if mediaTime < 0 {
+		mediaTime = 0
+	}
+	var duration uint64
+	if uint64(mediaTime) < mediaEnd {
+		duration = mediaEnd - uint64(mediaTime)
+	}
+	return append(edits, Edit{SegmentDuration: duration, MediaTime: mediaTime, Rate: 1})
+}
+
+// muxEditList returns the edit list to write with the samples of the track:
+// the one of the track when its samples are written as is, else a rebuilt one
+// skipping the composition delay of the samples, or the start trimmed by the
+// edit list of the track when the first sample is still the first one.
+func (t MuxTrack) muxEditList(samples []muxSample) []Edit {
+	if t.Samples == nil && len(t.Track.EditList) > 0 {
+		return t.Track.EditList
+	}
+	start, end := int64(math.MaxInt64), int64(0)
+	for _, s := range samples {
+		if pts := s.pts(); pts < start {
+			start = pts
+		}
+		if pts := s.pts() + int64(s.duration); pts > end {
+			end = pts
+		}
+	}
+	if len(samples) == 0 {
+		start = 0
+	}
+	if len(t.Samples) > 0 && t.Samples[0] == 0 && len(t.Track.EditList) > 0 {
+		start = t.Track.mediaStart()
+	}
+	return t.Track.rebuildEditList(start, uint64(end))
+}
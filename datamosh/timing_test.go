@@ -0,0 +1,76 @@
+package datamosh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresentationTime(t *testing.T) {
+	track := &Track{Timescale: 1000}
+	ts, ok := track.PresentationTime(1500)
+	assert.True(t, ok)
+	assert.Equal(t, Timestamp{Ticks: 1500, Timescale: 1000}, ts)
+
+	// a delay, a trimmed start, a dwell and a fast forward
+	track.EditList = []Edit{
+		{SegmentDuration: 500, MediaTime: -1, Rate: 1},
+		{SegmentDuration: 1000, MediaTime: 200, Rate: 1},
+		{SegmentDuration: 500, MediaTime: 2000, Rate: 0},
+		{SegmentDuration: 1000, MediaTime: 3000, Rate: 2},
+	}
+	for _, tt := range []struct {
+		mediaTime int64
+		seconds   float64
+		ok        bool
+	}{
+		{200, 0.5, true},
+		{700, 1, true},
+		{2000, 1.5, true},
+		{4000, 2.5, true},
+		{100, 0.4, false},
+		{1500, 1.8, false},
+	} {
+		ts, ok := track.PresentationTime(tt.mediaTime)
+		assert.InDelta(t, tt.seconds, ts.Seconds(), 1e-9, "media time %d", tt.mediaTime)
+		assert.Equal(t, tt.ok, ok, "media time %d", tt.mediaTime)
+	}
+}
+
+func TestMuxEditList(t *testing.T) {
+	fixture := mp4Fixture{gop: "IBPBPIP", editList: []mp4.ElstEntry{
+		{SegmentDurationV1: 100, MediaTimeV1: -1, MediaRateInteger: 1},
+		{SegmentDurationV1: 200, MediaTimeV1: fixtureFrameDuration, MediaRateInteger: 1},
+	}}.withDefaults()
+	data := fixture.build(t)
+	tracks, err := ParseTracks(bytes.NewReader(data))
+	require.NoError(t, err)
+	video := tracks[0]
+	delay := Edit{SegmentDuration: 100 * fixtureTimescale / mp4MovieTimescale, MediaTime: -1, Rate: 1}
+	require.Equal(t, []Edit{delay, {SegmentDuration: 200 * fixtureTimescale / mp4MovieTimescale, MediaTime: fixtureFrameDuration, Rate: 1}}, video.EditList)
+	ts, ok := video.PresentationTime(fixtureFrameDuration)
+	assert.True(t, ok)
+	assert.Equal(t, 0.1, ts.Seconds())
+
+	remux := func(muxed MuxTrack) *Track {
+		out := &bytes.Buffer{}
+		require.NoError(t, (&MP4Muxer{}).Mux(out, bytes.NewReader(data), []MuxTrack{muxed}))
+		tracks, err := ParseTracks(bytes.NewReader(out.Bytes()))
+		require.NoError(t, err)
+		return tracks[0]
+	}
+	// written as is, the edit list is kept
+	assert.Equal(t, video.EditList, remux(MuxTrack{Track: video}).EditList)
+
+	// with samples dropped, the delay and the trimmed start are kept and the
+	// edit lasts until the end of the media
+	dropped := DropKeyFrames(video)
+	require.Len(t, dropped, 6)
+	assert.Equal(t, []Edit{delay, {SegmentDuration: 6 * fixtureFrameDuration, MediaTime: fixtureFrameDuration, Rate: 1}}, remux(MuxTrack{Track: video, Samples: dropped}).EditList)
+	// without the first sample, the composition delay of the first sample
+	// written is skipped
+	assert.Equal(t, []Edit{delay, {SegmentDuration: fixtureFrameDuration, MediaTime: fixtureFrameDuration, Rate: 1}}, remux(MuxTrack{Track: video, Samples: []uint32{6}}).EditList)
+}
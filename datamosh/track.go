@@ -1,6 +1,10 @@
 package datamosh
 
-import "github.com/abema/go-mp4"
+import (
+	"sort"
+
+	"github.com/abema/go-mp4"
+)
 
 type Track struct {
 	TrakOffset uint64 // original offset of the trak box
@@ -8,13 +12,26 @@ type Track struct {
 	Timescale  uint32
 	Duration   uint64
 	Codec      mp4.Codec
+	Handler    [4]byte // media handler type: vide, soun...
 	Encrypted  bool
-	EditList   mp4.EditList
+	EditList   []Edit
 	Samples    mp4.Samples
 	Chunks     mp4.Chunks
 	AVC        *AVCDecoderConfig
-	MP4A       *mp4.MP4AInfo
+	AV1        *AV1Config
+	VPX        *VPXConfig
+	MP4A       *MP4AConfig
 	NALs       []*NALUnit
+	OBUs       []*OBU
+	VPXFrames  []*VPXFrame
+	WebM       *WebMTrackInfo // only set for tracks read from WebM/Matroska files
+
+	SampleFlags []SampleFlags // per sample, only set for tracks read from MP4 files
+
+	stsd []byte       // raw stsd box of tracks read from MP4 files
+	stss *mp4.BoxInfo // stss box of tracks read from MP4 files, if any
+
+	fragmentFlags map[uint32]fragmentFlags // trun flags of the sync samples of fragmented tracks
 }
 
 type AVCDecoderConfig struct {
@@ -24,3 +41,81 @@ type AVCDecoderConfig struct {
 	Width      uint16
 	Height     uint16
 }
+
+var (
+	handlerVideo = [4]byte{'v', 'i', 'd', 'e'}
+	handlerAudio = [4]byte{'s', 'o', 'u', 'n'}
+)
+
+// IsVideo returns true for video tracks.
+func (t *Track) IsVideo() bool {
+	return t.AVC != nil || t.AV1 != nil || t.VPX != nil || t.Handler == handlerVideo
+}
+
+// IsAudio returns true for audio tracks.
+func (t *Track) IsAudio() bool {
+	return t.Codec == mp4.CodecMP4A || t.Handler == handlerAudio
+}
+
+// dimensions returns the size of the pictures of a video track.
+func (t *Track) dimensions() (uint16, uint16) {
+	switch {
+	case t.AVC != nil:
+		return t.AVC.Width, t.AVC.Height
+	case t.AV1 != nil:
+		return t.AV1.Width, t.AV1.Height
+	case t.VPX != nil:
+		return t.VPX.Width, t.VPX.Height
+	case t.WebM != nil:
+		return uint16(t.WebM.PixelWidth), uint16(t.WebM.PixelHeight)
+	}
+	return 0, 0
+}
+
+// sampleOffsets returns the file offset of every sample of the track.
+func (t *Track) sampleOffsets() []uint64 {
+	offsets := make([]uint64, len(t.Samples))
+	var si int
+	for _, chunk := range t.Chunks {
+		dataOffset := chunk.DataOffset
+		for end := si + int(chunk.SamplesPerChunk); si < end && si < len(t.Samples); si++ {
+			offsets[si] = dataOffset
+			dataOffset += uint64(t.Samples[si].Size)
+		}
+	}
+	return offsets
+}
+
+// decodeTimes returns the decode time of every sample of the track, followed
+// by the end time of the last one.
+func (t *Track) decodeTimes() []uint64 {
+	times := make([]uint64, len(t.Samples)+1)
+	for i, sample := range t.Samples {
+		times[i+1] = times[i] + uint64(sample.TimeDelta)
+	}
+	return times
+}
+
+// setSampleTimes fills the sample durations and composition offsets from
+// presentation timestamps listed in decode order, as found in containers that
+// only store one timestamp per frame. Decode times are the sorted presentation
+// times.
+func (t *Track) setSampleTimes(pts []uint64) {
+	dts := make([]uint64, len(pts))
+	copy(dts, pts)
+	sort.Slice(dts, func(i, j int) bool { return dts[i] < dts[j] })
+
+	t.Duration = 0
+	for i, sample := range t.Samples {
+		switch {
+		case i+1 < len(dts) && dts[i+1] > dts[i]:
+			sample.TimeDelta = uint32(dts[i+1] - dts[i])
+		case i > 0:
+			sample.TimeDelta = t.Samples[i-1].TimeDelta
+		default:
+			sample.TimeDelta = 1
+		}
+		sample.CompositionTimeOffset = int64(pts[i]) - int64(dts[i])
+		t.Duration += uint64(sample.TimeDelta)
+	}
+}
@@ -0,0 +1,350 @@
+package datamosh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abema/go-mp4"
+)
+
+// Transplant returns an H.264 track made of the first sample of the track a,
+// an IDR picture, followed by the P frames of the track b, and the sample data
+// the track points to. The P frames predict from the picture of a rather than
+// from the ones of b, moving it with the motion of b: the classic datamosh.
+//
+// The pictures of both tracks must have the same size and be coded with the
+// same tools, as checked on their SPS. The PPS of b are added to the avcC box
+// of a with new ids, and the slices of b are rewritten to refer to them and to
+// follow the frame numbers and picture order counts of a. Samples are timed
+// by their durations, converted to the timescale of a.
+func Transplant(a *Track, ra io.ReadSeeker, b *Track, rb io.ReadSeeker) (*Track, []byte, error) {
+	for _, t := range []*Track{a, b} {
+		if t.AVC == nil {
+			return nil, nil, fmt.Errorf("track %d: AVC configuration not found", t.TrackID)
+		}
+		if t.Timescale == 0 {
+			return nil, nil, fmt.Errorf("track %d: timescale is not set", t.TrackID)
+		}
+	}
+	if len(a.Samples) == 0 {
+		return nil, nil, fmt.Errorf("track %d has no samples", a.TrackID)
+	}
+	lengthSize := int(a.AVC.LengthSize)
+	if lengthSize < 1 || lengthSize > 4 {
+		return nil, nil, fmt.Errorf("invalid NAL unit length size %d", lengthSize)
+	}
+	da, err := NewH264Decoder(a.AVC)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := NewH264Decoder(b.AVC)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := *a
+	out.Samples = nil
+	out.SampleFlags = nil
+	out.stss = nil
+	out.NALs = nil
+	out.EditList = nil
+	out.Duration = 0
+	var data []byte
+	// addSample appends a sample of NAL units lasting duration
+	addSample := func(nals [][]byte, duration uint32) error {
+		id := uint32(len(out.Samples))
+		sample := &mp4.Sample{TimeDelta: duration}
+		for _, nal := range nals {
+			if lengthSize < 4 && len(nal) >= 1<<(8*lengthSize) {
+				return fmt.Errorf("sample %d: NAL unit too large for %d byte lengths", id, lengthSize)
+			}
+			var length [4]byte
+			binary.BigEndian.PutUint32(length[:], uint32(len(nal)))
+			data = append(data, length[4-lengthSize:]...)
+			unit := &NALUnit{
+				Type:       nal[0] & 0x1f,
+				RefIdc:     nal[0] >> 5 & 0x03,
+				SliceType:  sliceTypeUnknown,
+				Offset:     int64(len(data)),
+				Length:     uint32(len(nal)),
+				TrackID:    a.TrackID,
+				SampleID:   id,
+				Timestamp:  out.Duration,
+				DecodeTime: out.Duration,
+			}
+			if unit.Type == NAL_SLICE || unit.Type == NAL_IDR_SLICE {
+				unit.SliceType = parseSliceType(nal[1:])
+			}
+			out.NALs = append(out.NALs, unit)
+			data = append(data, nal...)
+			sample.Size += uint32(lengthSize + len(nal))
+		}
+		out.Samples = append(out.Samples, sample)
+		out.Duration += uint64(duration)
+		return nil
+	}
+
+	// the key frame of a
+	nals, err := a.sampleNALs(ra, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var key *H264SliceHeader
+	for _, nal := range nals {
+		switch nal[0] & 0x1f {
+		case NAL_SPS, NAL_PPS:
+			if err := da.DecodeNAL(nal); err != nil {
+				return nil, nil, err
+			}
+		case NAL_SLICE, NAL_IDR_SLICE:
+			if key == nil {
+				if key, err = parseH264SliceHeader(newRBSPReader(unescapeRBSP(nal[1:])), nal[0], da.sps, da.pps); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	if key == nil || !key.IsIDR() {
+		return nil, nil, fmt.Errorf("track %d doesn't start with an IDR picture", a.TrackID)
+	}
+	if err := addSample(nals, a.Samples[0].TimeDelta); err != nil {
+		return nil, nil, err
+	}
+
+	t := &transplant{
+		sps:             key.sps,
+		b:               db,
+		bPPS:            map[uint32][]byte{},
+		ppsIDs:          map[string]uint32{},
+		prevRefFrameNum: key.FrameNum,
+		poc:             key.PicOrderCntLsb,
+	}
+	for id := range da.pps {
+		t.nextPPSID = max(t.nextPPSID, id+1)
+	}
+	for _, ps := range b.AVC.PictureParameterSets {
+		if pps, err := ParseH264PPS(ps.NALUnit); err == nil {
+			t.bPPS[pps.ID] = ps.NALUnit
+		}
+	}
+	i := 0
+	for id, sample := range b.Samples {
+		var nals [][]byte
+		for ; i < len(b.NALs) && b.NALs[i].SampleID == uint32(id); i++ {
+			payload, err := b.NALs[i].Payload(rb)
+			if err != nil {
+				return nil, nil, err
+			}
+			nals = append(nals, payload)
+		}
+		slices, err := t.sample(nals)
+		if err != nil {
+			return nil, nil, fmt.Errorf("sample %d: %w", id, err)
+		}
+		if len(slices) == 0 {
+			continue
+		}
+		duration := uint64(sample.TimeDelta) * uint64(a.Timescale) / uint64(b.Timescale)
+		if err := addSample(slices, uint32(max(duration, 1))); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	avc := *a.AVC
+	avc.PictureParameterSets = append(append([]mp4.AVCParameterSet(nil), a.AVC.PictureParameterSets...), t.pps...)
+	avc.NumOfPictureParameterSets = uint8(len(avc.PictureParameterSets))
+	// the stsd box is written again from the avcC box with the PPS of b
+	out.AVC, out.stsd = &avc, nil
+	out.Chunks = mp4.Chunks{{DataOffset: 0, SamplesPerChunk: uint32(len(out.Samples))}}
+	return &out, data, nil
+}
+
+// transplant holds the state of the rewriting of the P frames of a track
+// following the key frame of another one, see Transplant.
+type transplant struct {
+	sps       *H264SPS          // of the key frame
+	b         *H264Decoder      // for the parameter sets of the P frames
+	bPPS      map[uint32][]byte // PPS NAL units of the P frames by id
+	ppsIDs    map[string]uint32 // new ids of the PPS NAL units of the P frames
+	pps       []mp4.AVCParameterSet
+	nextPPSID uint32
+
+	prevRefFrameNum uint32
+	poc             uint32 // pic_order_cnt_lsb of the previous picture
+}
+
+// sample returns the slices of a sample of the P frames rewritten, or nil if
+// the sample isn't a P frame. Its parameter sets are recorded.
+func (t *transplant) sample(nals [][]byte) ([][]byte, error) {
+	isP := false
+	for _, nal := range nals {
+		switch nal[0] & 0x1f {
+		case NAL_SPS:
+			if err := t.b.DecodeNAL(nal); err != nil {
+				return nil, err
+			}
+		case NAL_PPS:
+			pps, err := ParseH264PPS(nal)
+			if err != nil {
+				return nil, err
+			}
+			t.b.pps[pps.ID] = pps
+			t.bPPS[pps.ID] = nal
+		case NAL_IDR_SLICE:
+			return nil, nil
+		case NAL_SLICE:
+			if parseSliceType(nal[1:]) != SLICE_P {
+				return nil, nil
+			}
+			isP = true
+		}
+	}
+	if !isP {
+		return nil, nil
+	}
+
+	// the frame_num of a picture follows the one of the previous reference
+	// picture, the picture order counts are the ones of frames
+	frameNum := (t.prevRefFrameNum + 1) % (1 << (t.sps.Log2MaxFrameNumMinus4 + 4))
+	poc := (t.poc + 2) % (1 << (t.sps.Log2MaxPicOrderCntLsbMinus4 + 4))
+	var slices [][]byte
+	ref := false
+	for _, nal := range nals {
+		if nal[0]&0x1f != NAL_SLICE {
+			continue
+		}
+		slice, err := t.slice(nal, frameNum, poc)
+		if err != nil {
+			return nil, err
+		}
+		slices = append(slices, slice)
+		ref = ref || nal[0]>>5 != 0
+	}
+	if ref {
+		t.prevRefFrameNum = frameNum
+	}
+	t.poc = poc
+	return slices, nil
+}
+
+// slice returns a P slice of b referring to its PPS in the avcC box of a,
+// with the frame_num and the pic_order_cnt_lsb given, coded with the lengths
+// of the SPS of a.
+func (t *transplant) slice(nal []byte, frameNum, poc uint32) ([]byte, error) {
+	rbsp := unescapeRBSP(nal[1:])
+	r := newRBSPReader(rbsp)
+	h, err := parseH264SliceHeader(r, nal[0], t.b.sps, t.b.pps)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTransplantSPS(t.sps, h.sps); err != nil {
+		return nil, err
+	}
+	ppsID, err := t.ppsID(h.PPSID)
+	if err != nil {
+		return nil, err
+	}
+
+	w := newRBSPWriter()
+	copyBits(w, rbsp, 0, h.pos.ppsID[0])
+	w.ue(ppsID)
+	copyBits(w, rbsp, h.pos.ppsID[1], h.pos.frameNum[0])
+	w.u(int(t.sps.Log2MaxFrameNumMinus4+4), frameNum)
+	if t.sps.PicOrderCntType == 0 {
+		copyBits(w, rbsp, h.pos.frameNum[1], h.pos.picOrderCntLsb[0])
+		w.u(int(t.sps.Log2MaxPicOrderCntLsbMinus4+4), poc)
+		copyBits(w, rbsp, h.pos.picOrderCntLsb[1], r.pos)
+	} else {
+		copyBits(w, rbsp, h.pos.frameNum[1], r.pos)
+	}
+
+	var out []byte
+	switch {
+	case h.pps.EntropyCodingMode:
+		// the slice data is byte aligned by the cabac_alignment_one_bits
+		for !w.byteAligned() {
+			w.u(1, 1)
+		}
+		copyBits(w, rbsp, (r.pos+7)/8*8, len(rbsp)*8)
+		out, err = w.alignedBytes()
+	case (w.pos-r.pos)%8 == 0:
+		copyBits(w, rbsp, r.pos, r.end)
+		out, err = w.trailingBits()
+	default:
+		// the I_PCM macroblocks are aligned again
+		if err := checkH264Support(h); err != nil {
+			return nil, err
+		}
+		dataStart := r.pos
+		s := t.b.sliceParser(r, h)
+		if err := s.decode(); err != nil {
+			return nil, fmt.Errorf("failed to parse slice: %v", err)
+		}
+		copySliceData(w, rbsp, dataStart, r.end, s.pcm)
+		out, err = w.trailingBits()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{nal[0]}, escapeRBSP(out)...), nil
+}
+
+// ppsID returns the id of the PPS of b of the given id once added to the
+// avcC box of a, referring to the SPS of a.
+func (t *transplant) ppsID(id uint32) (uint32, error) {
+	nal := t.bPPS[id]
+	if nal == nil {
+		return 0, fmt.Errorf("unknown PPS id %d", id)
+	}
+	if newID, ok := t.ppsIDs[string(nal)]; ok {
+		return newID, nil
+	}
+	if t.nextPPSID > 255 {
+		return 0, errors.New("too many PPS")
+	}
+	r := newRBSPReader(unescapeRBSP(nal[1:]))
+	r.ue() // pic_parameter_set_id
+	r.ue() // seq_parameter_set_id
+	if r.err != nil {
+		return 0, fmt.Errorf("failed to parse PPS: %v", r.err)
+	}
+	w := newRBSPWriter()
+	w.ue(t.nextPPSID)
+	w.ue(t.sps.ID)
+	copyBits(w, unescapeRBSP(nal[1:]), r.pos, r.end)
+	rbsp, err := w.trailingBits()
+	if err != nil {
+		return 0, err
+	}
+	pps := append([]byte{nal[0]}, escapeRBSP(rbsp)...)
+	t.pps = append(t.pps, mp4.AVCParameterSet{Length: uint16(len(pps)), NALUnit: pps})
+	t.ppsIDs[string(nal)] = t.nextPPSID
+	t.nextPPSID++
+	return t.ppsIDs[string(nal)], nil
+}
+
+// checkTransplantSPS returns an error if the slices coded with the SPS b
+// can't follow the pictures coded with the SPS a.
+func checkTransplantSPS(a, b *H264SPS) error {
+	var field string
+	switch {
+	case a.PicWidthInMbsMinus1 != b.PicWidthInMbsMinus1 || a.PicHeightInMapUnitsMinus1 != b.PicHeightInMapUnitsMinus1:
+		return fmt.Errorf("incompatible picture sizes: %dx%d and %dx%d macroblocks",
+			a.PicWidthInMbsMinus1+1, a.PicHeightInMapUnitsMinus1+1, b.PicWidthInMbsMinus1+1, b.PicHeightInMapUnitsMinus1+1)
+	case a.ChromaFormatIDC != b.ChromaFormatIDC || a.SeparateColourPlane != b.SeparateColourPlane:
+		field = "chroma_format_idc"
+	case a.BitDepthLumaMinus8 != b.BitDepthLumaMinus8 || a.BitDepthChromaMinus8 != b.BitDepthChromaMinus8:
+		field = "bit depth"
+	case a.FrameMbsOnly != b.FrameMbsOnly || a.MbAdaptiveFrameField != b.MbAdaptiveFrameField:
+		field = "frame_mbs_only_flag"
+	case a.PicOrderCntType != b.PicOrderCntType || a.DeltaPicOrderAlwaysZero != b.DeltaPicOrderAlwaysZero:
+		field = "pic_order_cnt_type"
+	case a.QpprimeYZeroTransformBypass != b.QpprimeYZeroTransformBypass:
+		field = "qpprime_y_zero_transform_bypass_flag"
+	default:
+		return nil
+	}
+	return fmt.Errorf("incompatible SPS: different %s", field)
+}
@@ -0,0 +1,121 @@
+package datamosh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTransplantTrack returns a 25 fps track of a NAL unit per sample, and its
+// sample data.
+func testTransplantTrack(avc *AVCDecoderConfig, samples ...[]byte) (*Track, []byte) {
+	track := &Track{TrackID: 1, Timescale: 1000, AVC: avc}
+	var data []byte
+	for i, nal := range samples {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nal)))
+		track.Samples = append(track.Samples, &mp4.Sample{Size: uint32(4 + len(nal)), TimeDelta: 40})
+		track.NALs = append(track.NALs, &NALUnit{Offset: int64(len(data)), Length: uint32(len(nal)), SampleID: uint32(i)})
+		data = append(data, nal...)
+	}
+	track.Chunks = mp4.Chunks{{SamplesPerChunk: uint32(len(samples))}}
+	return track, data
+}
+
+func TestTransplant(t *testing.T) {
+	a := mp4Fixture{gop: "IPP"}.withDefaults()
+	aData := a.build(t)
+	b := mp4Fixture{gop: "IPBPiPPIP", slices: 2}.withDefaults()
+	bData := b.build(t)
+	aTracks, err := ParseTracks(bytes.NewReader(aData))
+	require.NoError(t, err)
+	bTracks, err := ParseTracks(bytes.NewReader(bData))
+	require.NoError(t, err)
+
+	track, data, err := Transplant(aTracks[0], bytes.NewReader(aData), bTracks[0], bytes.NewReader(bData))
+	require.NoError(t, err)
+	var muxed bytes.Buffer
+	require.NoError(t, (&MP4Muxer{}).Mux(&muxed, bytes.NewReader(data), []MuxTrack{{Track: track}}))
+	tracks, err := ParseTracks(bytes.NewReader(muxed.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, tracks, 1)
+	moshed := tracks[0]
+	// the key frame of a and the 5 P frames of b
+	require.Len(t, moshed.Samples, 6)
+	require.Len(t, moshed.AVC.PictureParameterSets, 2)
+	pps, err := ParseH264PPS(moshed.AVC.PictureParameterSets[1].NALUnit)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), pps.ID)
+
+	d, err := NewH264Decoder(moshed.AVC)
+	require.NoError(t, err)
+	r := bytes.NewReader(muxed.Bytes())
+	for i, nal := range moshed.NALs {
+		payload, err := nal.Payload(r)
+		require.NoError(t, err)
+		h, err := parseH264SliceHeader(newRBSPReader(unescapeRBSP(payload[1:])), payload[0], d.sps, d.pps)
+		require.NoError(t, err)
+		id := nal.SampleID
+		assert.Equal(t, uint32(min(id, 1)), h.PPSID, "sample %d", id)
+		assert.Equal(t, id, h.FrameNum, "sample %d", id)
+		assert.Equal(t, id*2, h.PicOrderCntLsb, "sample %d", id)
+		assert.Equal(t, uint64(id)*fixtureFrameDuration, nal.Timestamp, "nal %d", i)
+	}
+
+	// the skipped macroblocks of the P frames of b show the key frame of a
+	var frames []*image.YCbCr
+	require.NoError(t, moshed.DecodeFrames(r, func(sampleID uint32, img *image.YCbCr) error {
+		frames = append(frames, img)
+		return nil
+	}))
+	require.Len(t, frames, 6)
+	for i, img := range frames {
+		for _, p := range []image.Point{{0, 0}, {17, 5}, {31, 31}} {
+			assert.Equal(t, fixtureSample(0, p.X, p.Y), img.Y[img.YOffset(p.X, p.Y)], "frame %d at %v", i, p)
+		}
+	}
+
+	small := mp4Fixture{gop: "IP", widthMbs: 3}.withDefaults()
+	smallData := small.build(t)
+	smallTracks, err := ParseTracks(bytes.NewReader(smallData))
+	require.NoError(t, err)
+	_, _, err = Transplant(aTracks[0], bytes.NewReader(aData), smallTracks[0], bytes.NewReader(smallData))
+	assert.EqualError(t, err, "sample 1: incompatible picture sizes: 2x2 and 3x2 macroblocks")
+
+	nonIDR := mp4Fixture{gop: "iP"}.withDefaults()
+	nonIDRData := nonIDR.build(t)
+	nonIDRTracks, err := ParseTracks(bytes.NewReader(nonIDRData))
+	require.NoError(t, err)
+	_, _, err = Transplant(nonIDRTracks[0], bytes.NewReader(nonIDRData), bTracks[0], bytes.NewReader(bData))
+	assert.EqualError(t, err, "track 1 doesn't start with an IDR picture")
+}
+
+func TestTransplantCABAC(t *testing.T) {
+	// the P frames of b moving the picture of a, the same as when decoded
+	// after the key frame of b
+	mvds := [2]MotionVector{{6, -3}, {-17, 40}}
+	aTrack, aData := testTransplantTrack(testMotionConfig(true), testH264CABACPCMSlice(2))
+	bTrack, bData := testTransplantTrack(testMotionConfig(true), testH264PCMSlice(2), testH264CABACMotionSlice(mvds))
+	track, data, err := Transplant(aTrack, bytes.NewReader(aData), bTrack, bytes.NewReader(bData))
+	require.NoError(t, err)
+	require.Len(t, track.Samples, 2)
+
+	var got []*image.YCbCr
+	require.NoError(t, track.DecodeFrames(bytes.NewReader(data), func(sampleID uint32, img *image.YCbCr) error {
+		got = append(got, img)
+		return nil
+	}))
+	d, err := NewH264Decoder(testMotionConfig(true))
+	require.NoError(t, err)
+	var want []*image.YCbCr
+	for _, nal := range [][]byte{testH264CABACPCMSlice(2), testH264CABACMotionSlice(mvds)} {
+		img, err := d.DecodeAccessUnit([][]byte{nal})
+		require.NoError(t, err)
+		want = append(want, img)
+	}
+	assert.Equal(t, want, got)
+}
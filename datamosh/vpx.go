@@ -0,0 +1,591 @@
+package datamosh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abema/go-mp4"
+	"github.com/mattetti/moshing-vfx/internal/bitio"
+)
+
+// VP8 reference buffers refreshed by a frame, VP9 frames use one bit per
+// reference slot instead.
+const (
+	VP8_REFRESH_LAST   = 1 << 0
+	VP8_REFRESH_GOLDEN = 1 << 1
+	VP8_REFRESH_ALTREF = 1 << 2
+)
+
+var (
+	fourCCVP8 = [4]byte{'V', 'P', '8', '0'}
+	fourCCVP9 = [4]byte{'V', 'P', '9', '0'}
+	fourCCAV1 = [4]byte{'A', 'V', '0', '1'}
+)
+
+// VPXConfig holds the configuration of a VP8 or VP9 track.
+type VPXConfig struct {
+	FourCC   [4]byte // VP80 or VP90
+	Width    uint16
+	Height   uint16
+	Profile  uint8
+	BitDepth uint8
+	VpcC     *mp4.VpcC // only set for MP4 tracks
+}
+
+// IsVP9 returns true for VP9 tracks.
+func (c *VPXConfig) IsVP9() bool {
+	return c.FourCC == fourCCVP9
+}
+
+// VPXFrame represents a VP8 or VP9 frame in a video file.
+// VP9 superframes hold several frames in the same sample.
+type VPXFrame struct {
+	FourCC     [4]byte // VP80 or VP90
+	Offset     int64   // first byte of the frame data
+	Length     uint32  // of the frame data
+	TrackID    uint32
+	Chunk      uint32
+	SampleID   uint32
+	Timestamp  uint64 // presentation time in the timescale of the track
+	DecodeTime uint64 // in the timescale of the track
+	Header     *VPXFrameHeader
+}
+
+// VPXFrameHeader represents the parsed frame header fields shared by VP8 and VP9.
+type VPXFrameHeader struct {
+	KeyFrame          bool
+	ShowFrame         bool
+	ShowExistingFrame bool // VP9 only
+	IntraOnly         bool // VP9 only
+	Profile           uint32
+	Width             uint32 // only for key frames
+	Height            uint32 // only for key frames
+	RefreshFrameFlags uint32
+}
+
+// boolDecoder is the VP8 boolean entropy decoder.
+// See RFC 6386, 7.3 Actual Implementation
+type boolDecoder struct {
+	data     []byte
+	pos      int
+	value    uint32
+	rng      uint32
+	bitCount int
+}
+
+func newBoolDecoder(data []byte) *boolDecoder {
+	d := &boolDecoder{data: data, rng: 255}
+	for i := 0; i < 2; i++ {
+		d.value = d.value<<8 | uint32(d.nextByte())
+	}
+	return d
+}
+
+func (d *boolDecoder) nextByte() byte {
+	if d.pos >= len(d.data) {
+		return 0
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *boolDecoder) readBool(prob uint32) bool {
+	split := 1 + (((d.rng - 1) * prob) >> 8)
+	bigSplit := split << 8
+	var bit bool
+	if d.value >= bigSplit {
+		bit = true
+		d.rng -= split
+		d.value -= bigSplit
+	} else {
+		d.rng = split
+	}
+	for d.rng < 128 {
+		d.value <<= 1
+		d.rng <<= 1
+		d.bitCount++
+		if d.bitCount == 8 {
+			d.bitCount = 0
+			d.value |= uint32(d.nextByte())
+		}
+	}
+	return bit
+}
+
+// readLiteral reads an n bits unsigned literal, L(n) in the spec.
+func (d *boolDecoder) readLiteral(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if d.readBool(128) {
+			v |= 1
+		}
+	}
+	return v
+}
+
+// skipOptional skips an optional field made of a flag followed by n bits.
+func (d *boolDecoder) skipOptional(n int) {
+	if d.readBool(128) {
+		d.readLiteral(n)
+	}
+}
+
+// ParseVP8FrameHeader parses a VP8 frame tag and the first partition header
+// up to the reference buffer refresh flags.
+// See RFC 6386, 9 Frame-Level Header and 19.2 Frame Header
+func ParseVP8FrameHeader(data []byte) (*VPXFrameHeader, error) {
+	if len(data) < 3 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	tag := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+	h := &VPXFrameHeader{
+		KeyFrame:  tag&0x01 == 0,
+		Profile:   (tag >> 1) & 0x07,
+		ShowFrame: (tag>>4)&0x01 != 0,
+	}
+	firstPartSize := int(tag >> 5)
+	pos := 3
+
+	if h.KeyFrame {
+		if len(data) < 10 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+			return nil, errors.New("invalid VP8 start code")
+		}
+		h.Width = uint32(data[6]) | uint32(data[7]&0x3f)<<8
+		h.Height = uint32(data[8]) | uint32(data[9]&0x3f)<<8
+		h.RefreshFrameFlags = VP8_REFRESH_LAST | VP8_REFRESH_GOLDEN | VP8_REFRESH_ALTREF
+		pos = 10
+	}
+	if pos+firstPartSize > len(data) {
+		return nil, fmt.Errorf("first partition size %d exceeds the frame size %d", firstPartSize, len(data))
+	}
+
+	d := newBoolDecoder(data[pos : pos+firstPartSize])
+	if h.KeyFrame {
+		// color_space and clamping_type
+		d.readLiteral(2)
+	}
+
+	// segmentation_enabled
+	if d.readBool(128) {
+		updateMap := d.readBool(128)
+		updateData := d.readBool(128)
+		if updateData {
+			// segment_feature_mode
+			d.readLiteral(1)
+			for i := 0; i < 4; i++ {
+				// quantizer_update_value and sign
+				d.skipOptional(8)
+			}
+			for i := 0; i < 4; i++ {
+				// loop_filter_update_value and sign
+				d.skipOptional(7)
+			}
+		}
+		if updateMap {
+			for i := 0; i < 3; i++ {
+				// segment_prob
+				d.skipOptional(8)
+			}
+		}
+	}
+
+	// filter_type, loop_filter_level and sharpness_level
+	d.readLiteral(1 + 6 + 3)
+
+	// loop_filter_adj_enable
+	if d.readBool(128) {
+		// mode_ref_lf_delta_update
+		if d.readBool(128) {
+			for i := 0; i < 8; i++ {
+				// delta_magnitude and delta_sign
+				d.skipOptional(7)
+			}
+		}
+	}
+
+	// log2_nbr_of_dct_partitions
+	d.readLiteral(2)
+
+	// y_ac_qi then the optional y_dc, y2_dc, y2_ac, uv_dc and uv_ac deltas
+	d.readLiteral(7)
+	for i := 0; i < 5; i++ {
+		d.skipOptional(5)
+	}
+
+	if !h.KeyFrame {
+		refreshGolden := d.readBool(128)
+		refreshAltRef := d.readBool(128)
+		if !refreshGolden {
+			// copy_buffer_to_golden
+			d.readLiteral(2)
+		}
+		if !refreshAltRef {
+			// copy_buffer_to_alternate
+			d.readLiteral(2)
+		}
+		// sign_bias_golden, sign_bias_alternate and refresh_entropy_probs
+		d.readLiteral(3)
+		refreshLast := d.readBool(128)
+
+		if refreshLast {
+			h.RefreshFrameFlags |= VP8_REFRESH_LAST
+		}
+		if refreshGolden {
+			h.RefreshFrameFlags |= VP8_REFRESH_GOLDEN
+		}
+		if refreshAltRef {
+			h.RefreshFrameFlags |= VP8_REFRESH_ALTREF
+		}
+	}
+
+	return h, nil
+}
+
+// ParseVP9FrameHeader parses the uncompressed header of a VP9 frame up to
+// the reference refresh flags.
+// See VP9 bitstream specification, 6.2 Uncompressed header syntax
+func ParseVP9FrameHeader(data []byte) (*VPXFrameHeader, error) {
+	r := bitio.NewReader(bytes.NewReader(data))
+	h := &VPXFrameHeader{}
+
+	frameMarker, err := r.ReadUInt(2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame_marker: %v", err)
+	}
+	if frameMarker != 2 {
+		return nil, errors.New("invalid VP9 frame marker")
+	}
+	profileLow, err := r.ReadUInt(1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile_low_bit: %v", err)
+	}
+	profileHigh, err := r.ReadUInt(1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile_high_bit: %v", err)
+	}
+	h.Profile = profileHigh<<1 | profileLow
+	if h.Profile == 3 {
+		if _, err = r.ReadUInt(1); err != nil {
+			return nil, fmt.Errorf("failed to read reserved_zero: %v", err)
+		}
+	}
+
+	if h.ShowExistingFrame, err = readFlag(r); err != nil {
+		return nil, fmt.Errorf("failed to read show_existing_frame: %v", err)
+	}
+	if h.ShowExistingFrame {
+		h.ShowFrame = true
+		return h, nil
+	}
+
+	frameType, err := r.ReadUInt(1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame_type: %v", err)
+	}
+	h.KeyFrame = frameType == 0
+	if h.ShowFrame, err = readFlag(r); err != nil {
+		return nil, fmt.Errorf("failed to read show_frame: %v", err)
+	}
+	errorResilientMode, err := readFlag(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read error_resilient_mode: %v", err)
+	}
+
+	if h.KeyFrame {
+		if err = readVP9SyncCode(r); err != nil {
+			return nil, err
+		}
+		if err = skipVP9ColorConfig(r, h.Profile); err != nil {
+			return nil, err
+		}
+		if err = h.readVP9FrameSize(r); err != nil {
+			return nil, err
+		}
+		h.RefreshFrameFlags = 0xff
+		return h, nil
+	}
+
+	if !h.ShowFrame {
+		if h.IntraOnly, err = readFlag(r); err != nil {
+			return nil, fmt.Errorf("failed to read intra_only: %v", err)
+		}
+	}
+	if !errorResilientMode {
+		// reset_frame_context
+		if _, err = r.ReadUInt(2); err != nil {
+			return nil, fmt.Errorf("failed to read reset_frame_context: %v", err)
+		}
+	}
+	if h.IntraOnly {
+		if err = readVP9SyncCode(r); err != nil {
+			return nil, err
+		}
+		if h.Profile > 0 {
+			if err = skipVP9ColorConfig(r, h.Profile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if h.RefreshFrameFlags, err = r.ReadUInt(8); err != nil {
+		return nil, fmt.Errorf("failed to read refresh_frame_flags: %v", err)
+	}
+	if h.IntraOnly {
+		if err = h.readVP9FrameSize(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+func readVP9SyncCode(r bitio.Reader) error {
+	syncCode, err := r.ReadUInt(24)
+	if err != nil {
+		return fmt.Errorf("failed to read frame_sync_code: %v", err)
+	}
+	if syncCode != 0x498342 {
+		return errors.New("invalid VP9 frame sync code")
+	}
+	return nil
+}
+
+// skipVP9ColorConfig skips the color_config() syntax.
+func skipVP9ColorConfig(r bitio.Reader, profile uint32) error {
+	if profile >= 2 {
+		// ten_or_twelve_bit
+		if _, err := r.ReadUInt(1); err != nil {
+			return fmt.Errorf("failed to read ten_or_twelve_bit: %v", err)
+		}
+	}
+	colorSpace, err := r.ReadUInt(3)
+	if err != nil {
+		return fmt.Errorf("failed to read color_space: %v", err)
+	}
+	n := 0
+	if colorSpace != 7 { // CS_RGB
+		// color_range
+		n++
+		if profile == 1 || profile == 3 {
+			// subsampling_x, subsampling_y and reserved_zero
+			n += 3
+		}
+	} else if profile == 1 || profile == 3 {
+		// reserved_zero
+		n++
+	}
+	if _, err = r.ReadUInt(n); err != nil {
+		return fmt.Errorf("failed to read color config: %v", err)
+	}
+	return nil
+}
+
+func (h *VPXFrameHeader) readVP9FrameSize(r bitio.Reader) error {
+	width, err := r.ReadUInt(16)
+	if err != nil {
+		return fmt.Errorf("failed to read frame_width_minus_1: %v", err)
+	}
+	height, err := r.ReadUInt(16)
+	if err != nil {
+		return fmt.Errorf("failed to read frame_height_minus_1: %v", err)
+	}
+	h.Width, h.Height = width+1, height+1
+	return nil
+}
+
+// splitVP9Superframe returns the offset and size of the frames packed in a
+// VP9 sample, a single frame when the sample has no superframe index.
+// See VP9 bitstream specification, Annex B Superframes
+func splitVP9Superframe(data []byte) [][2]int {
+	whole := [][2]int{{0, len(data)}}
+	if len(data) == 0 {
+		return whole
+	}
+	marker := data[len(data)-1]
+	if marker&0xe0 != 0xc0 {
+		return whole
+	}
+	frames := int(marker&0x07) + 1
+	mag := int((marker>>3)&0x03) + 1
+	indexSize := 2 + mag*frames
+	if len(data) < indexSize || data[len(data)-indexSize] != marker {
+		return whole
+	}
+
+	parts := make([][2]int, 0, frames)
+	pos := 0
+	index := data[len(data)-indexSize+1:]
+	for i := 0; i < frames; i++ {
+		size := 0
+		for b := 0; b < mag; b++ {
+			size |= int(index[i*mag+b]) << (8 * b)
+		}
+		if pos+size > len(data)-indexSize {
+			return whole
+		}
+		parts = append(parts, [2]int{pos, size})
+		pos += size
+	}
+	return parts
+}
+
+// parseVPXFrames parses the frames of a sample.
+func parseVPXFrames(data []byte, offset int64, vp9 bool) ([]*VPXFrame, error) {
+	parts := [][2]int{{0, len(data)}}
+	if vp9 {
+		parts = splitVP9Superframe(data)
+	}
+
+	frames := make([]*VPXFrame, 0, len(parts))
+	for _, part := range parts {
+		frameData := data[part[0] : part[0]+part[1]]
+		var header *VPXFrameHeader
+		var err error
+		if vp9 {
+			header, err = ParseVP9FrameHeader(frameData)
+		} else {
+			header, err = ParseVP8FrameHeader(frameData)
+		}
+		if err != nil {
+			return frames, err
+		}
+		fourCC := fourCCVP8
+		if vp9 {
+			fourCC = fourCCVP9
+		}
+		frames = append(frames, &VPXFrame{
+			FourCC: fourCC,
+			Offset: offset + int64(part[0]),
+			Length: uint32(part[1]),
+			Header: header,
+		})
+	}
+	return frames, nil
+}
+
+// processVPXTrack reads every sample of a VP8 or VP9 track and parses its
+// frame headers.
+func processVPXTrack(r io.ReadSeeker, track *Track) ([]*VPXFrame, error) {
+	if track.VPX == nil {
+		return nil, errors.New("VP8/VP9 configuration not found")
+	}
+	vp9 := track.VPX.IsVP9()
+	frames := []*VPXFrame{}
+
+	var si int
+	currentTime := uint64(0)
+	for nChunk, chunk := range track.Chunks {
+		end := si + int(chunk.SamplesPerChunk)
+		dataOffset := chunk.DataOffset
+		for ; si < end && si < len(track.Samples); si++ {
+			sample := track.Samples[si]
+			decodeTime := currentTime
+			presentationTime := currentTime + uint64(sample.CompositionTimeOffset)
+			currentTime += uint64(sample.TimeDelta)
+			if sample.Size == 0 {
+				continue
+			}
+
+			if _, err := r.Seek(int64(dataOffset), io.SeekStart); err != nil {
+				return frames, err
+			}
+			data := make([]byte, sample.Size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return frames, err
+			}
+
+			sampleFrames, err := parseVPXFrames(data, int64(dataOffset), vp9)
+			if err != nil {
+				return frames, fmt.Errorf("sample %d: %v", si, err)
+			}
+			for _, frame := range sampleFrames {
+				frame.TrackID = track.TrackID
+				frame.Chunk = uint32(nChunk)
+				frame.SampleID = uint32(si)
+				frame.Timestamp = presentationTime
+				frame.DecodeTime = decodeTime
+				if Debug {
+					fmt.Printf("  VPX frame: key: %t, show: %t, offset: %d, length: %d\n",
+						frame.Header.KeyFrame, frame.Header.ShowFrame, frame.Offset, frame.Length)
+				}
+			}
+			frames = append(frames, sampleFrames...)
+			dataOffset += uint64(sample.Size)
+		}
+	}
+
+	return frames, nil
+}
+
+// Nullify neutralizes the frame in place. VP9 frames become a
+// show_existing_frame of the last frame buffer, VP8 frames keep their
+// uncompressed header and get their partitions zeroed.
+func (f *VPXFrame) Nullify(w io.WriteSeeker) error {
+	writerAt, ok := w.(io.WriterAt)
+	if !ok {
+		return fmt.Errorf("writer does not implement io.WriterAt")
+	}
+
+	if f.FourCC == fourCCVP8 {
+		// Keep the frame tag, and the start code and dimensions of key frames.
+		headerSize := int64(3)
+		if f.Header.KeyFrame {
+			headerSize = 10
+		}
+		if int64(f.Length) <= headerSize {
+			return nil
+		}
+		if _, err := writerAt.WriteAt(make([]byte, int64(f.Length)-headerSize), f.Offset+headerSize); err != nil {
+			return fmt.Errorf("failed to write the frame data: %v", err)
+		}
+		return nil
+	}
+	if f.Header.ShowExistingFrame {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	bw := bitio.NewWriter(buf)
+	bits := []bool{true, false, f.Header.Profile&1 != 0, f.Header.Profile&2 != 0}
+	if f.Header.Profile == 3 {
+		bits = append(bits, false) // reserved_zero
+	}
+	// show_existing_frame and frame_to_show_map_idx 0
+	bits = append(bits, true, false, false, false)
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for _, bit := range bits {
+		if err := bw.WriteBit(bit); err != nil {
+			return err
+		}
+	}
+	data := make([]byte, f.Length)
+	copy(data, buf.Bytes())
+	if _, err := writerAt.WriteAt(data, f.Offset); err != nil {
+		return fmt.Errorf("failed to write the frame data: %v", err)
+	}
+	return nil
+}
+
+// newVPXConfig builds the track configuration of a vp08 or vp09 MP4 track.
+func newVPXConfig(fourCC [4]byte, entry *mp4.VisualSampleEntry, vpcC *mp4.VpcC) *VPXConfig {
+	config := &VPXConfig{
+		FourCC:   fourCC,
+		Width:    entry.Width,
+		Height:   entry.Height,
+		BitDepth: 8,
+		VpcC:     vpcC,
+	}
+	if vpcC != nil {
+		config.Profile = vpcC.Profile
+		config.BitDepth = vpcC.BitDepth
+	}
+	return config
+}
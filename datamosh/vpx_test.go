@@ -0,0 +1,305 @@
+package datamosh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBoolEncoder is the VP8 boolean entropy encoder from RFC 6386, 7.3.
+type testBoolEncoder struct {
+	out      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newTestBoolEncoder() *testBoolEncoder {
+	return &testBoolEncoder{rng: 255, bitCount: 24}
+}
+
+func (e *testBoolEncoder) writeBool(prob uint32, bit bool) {
+	split := 1 + (((e.rng - 1) * prob) >> 8)
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			for i := len(e.out) - 1; i >= 0; i-- {
+				e.out[i]++
+				if e.out[i] != 0 {
+					break
+				}
+			}
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.out = append(e.out, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+func (e *testBoolEncoder) writeLiteral(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		e.writeBool(128, (v>>i)&1 != 0)
+	}
+}
+
+func (e *testBoolEncoder) bytes() []byte {
+	for i := 0; i < 32; i++ {
+		e.writeBool(128, false)
+	}
+	return e.out
+}
+
+func testVP8Frame(key bool, refreshGolden bool) []byte {
+	e := newTestBoolEncoder()
+	if key {
+		e.writeLiteral(0, 2) // color_space, clamping_type
+	}
+	e.writeLiteral(0, 1)  // segmentation_enabled
+	e.writeLiteral(0, 1)  // filter_type
+	e.writeLiteral(20, 6) // loop_filter_level
+	e.writeLiteral(0, 3)  // sharpness_level
+	e.writeLiteral(1, 1)  // loop_filter_adj_enable
+	e.writeLiteral(1, 1)  // mode_ref_lf_delta_update
+	for i := 0; i < 8; i++ {
+		e.writeLiteral(1, 1) // flag
+		e.writeLiteral(2, 6) // magnitude
+		e.writeLiteral(1, 1) // sign
+	}
+	e.writeLiteral(0, 2)  // log2_nbr_of_dct_partitions
+	e.writeLiteral(40, 7) // y_ac_qi
+	for i := 0; i < 5; i++ {
+		e.writeLiteral(0, 1)
+	}
+	if key {
+		e.writeLiteral(1, 1) // refresh_entropy_probs
+	} else {
+		if refreshGolden {
+			e.writeLiteral(1, 1)
+		} else {
+			e.writeLiteral(0, 1)
+		}
+		e.writeLiteral(0, 1) // refresh_alternate_frame
+		if !refreshGolden {
+			e.writeLiteral(1, 2) // copy_buffer_to_golden
+		}
+		e.writeLiteral(2, 2) // copy_buffer_to_alternate
+		e.writeLiteral(0, 3) // sign biases, refresh_entropy_probs
+		e.writeLiteral(1, 1) // refresh_last
+	}
+	partition := e.bytes()
+
+	tag := uint32(len(partition))<<5 | 1<<4 // show_frame
+	if !key {
+		tag |= 1
+	}
+	frame := []byte{byte(tag), byte(tag >> 8), byte(tag >> 16)}
+	if key {
+		frame = append(frame, 0x9d, 0x01, 0x2a, 0x40, 0x01, 0xf0, 0x00) // 320x240
+	}
+	return append(frame, partition...)
+}
+
+func testVP9Frame(key bool, show bool, refresh uint32) []byte {
+	b := newTestBitWriter()
+	b.put(2, 2) // frame_marker
+	b.put(0, 2) // profile
+	b.put(0, 1) // show_existing_frame
+	if key {
+		b.put(0, 1) // frame_type
+	} else {
+		b.put(1, 1)
+	}
+	if show {
+		b.put(1, 1)
+	} else {
+		b.put(0, 1)
+	}
+	b.put(0, 1) // error_resilient_mode
+	if key {
+		b.put(0x498342, 24)
+		b.put(1, 3) // color_space
+		b.put(0, 1) // color_range
+		b.put(639, 16)
+		b.put(359, 16)
+	} else {
+		if !show {
+			b.put(0, 1) // intra_only
+		}
+		b.put(0, 2) // reset_frame_context
+		b.put(refresh, 8)
+	}
+	b.put(0, 7)
+	return b.trailingBytes()
+}
+
+func TestParseVP8FrameHeader(t *testing.T) {
+	h, err := ParseVP8FrameHeader(testVP8Frame(true, false))
+	require.NoError(t, err)
+	assert.True(t, h.KeyFrame)
+	assert.True(t, h.ShowFrame)
+	assert.Equal(t, uint32(320), h.Width)
+	assert.Equal(t, uint32(240), h.Height)
+
+	h, err = ParseVP8FrameHeader(testVP8Frame(false, true))
+	require.NoError(t, err)
+	assert.False(t, h.KeyFrame)
+	assert.Equal(t, uint32(VP8_REFRESH_LAST|VP8_REFRESH_GOLDEN), h.RefreshFrameFlags)
+
+	h, err = ParseVP8FrameHeader(testVP8Frame(false, false))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(VP8_REFRESH_LAST), h.RefreshFrameFlags)
+}
+
+func TestParseVP9FrameHeader(t *testing.T) {
+	h, err := ParseVP9FrameHeader(testVP9Frame(true, true, 0))
+	require.NoError(t, err)
+	assert.True(t, h.KeyFrame)
+	assert.Equal(t, uint32(640), h.Width)
+	assert.Equal(t, uint32(360), h.Height)
+	assert.Equal(t, uint32(0xff), h.RefreshFrameFlags)
+
+	h, err = ParseVP9FrameHeader(testVP9Frame(false, false, 0x04))
+	require.NoError(t, err)
+	assert.False(t, h.KeyFrame)
+	assert.False(t, h.ShowFrame)
+	assert.Equal(t, uint32(0x04), h.RefreshFrameFlags)
+}
+
+func testSuperframe(frames ...[]byte) []byte {
+	data := bytes.Join(frames, nil)
+	marker := byte(0xc0 | (2-1)<<3 | byte(len(frames)-1))
+	data = append(data, marker)
+	for _, frame := range frames {
+		data = append(data, byte(len(frame)), byte(len(frame)>>8))
+	}
+	return append(data, marker)
+}
+
+func testVPXIVF(fourCC string, frames [][]byte) []byte {
+	data := testIVF(frames)
+	copy(data[8:12], fourCC)
+	return data
+}
+
+func TestVP9IVFSuperframes(t *testing.T) {
+	frames := [][]byte{
+		testVP9Frame(true, true, 0),
+		testSuperframe(testVP9Frame(false, false, 0x04), testVP9Frame(false, true, 0x01)),
+		testVP9Frame(true, true, 0),
+		testVP9Frame(false, true, 0x01),
+	}
+	_, track, err := ParseIVF(bytes.NewReader(testVPXIVF("VP90", frames)))
+	require.NoError(t, err)
+	require.NotNil(t, track.VPX)
+	assert.True(t, track.VPX.IsVP9())
+	require.Len(t, track.VPXFrames, 5)
+	assert.Equal(t, uint32(1), track.VPXFrames[1].SampleID)
+	assert.Equal(t, uint32(1), track.VPXFrames[2].SampleID)
+	assert.False(t, track.VPXFrames[1].Header.ShowFrame)
+	assert.Equal(t, []uint32{0, 1, 3}, DropKeyFrames(track))
+}
+
+func TestVP8IVFMosh(t *testing.T) {
+	frames := [][]byte{
+		testVP8Frame(true, false),
+		testVP8Frame(false, false),
+		testVP8Frame(true, false),
+		testVP8Frame(false, true),
+	}
+	data := testVPXIVF("VP80", frames)
+	header, track, err := ParseIVF(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Len(t, track.VPXFrames, 4)
+
+	samples := RepeatInterFrames(track, DropKeyFrames(track), 1)
+	assert.Equal(t, []uint32{0, 1, 1, 3, 3}, samples)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, WriteIVF(out, bytes.NewReader(data), header, track, samples))
+	_, moshed, err := ParseIVF(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	assert.Len(t, moshed.VPXFrames, 5)
+}
+
+func testEBML(id uint32, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	var idBytes []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(idBytes) > 0 {
+			idBytes = append(idBytes, b)
+		}
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(data)))
+	size[0] = 0x01
+	return append(append(idBytes, size...), data...)
+}
+
+func testEBMLUint(id uint32, v uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, v)
+	return testEBML(id, data)
+}
+
+func testSimpleBlock(track byte, timecode int16, key bool, frame []byte) []byte {
+	flags := byte(0)
+	if key {
+		flags = mkvSimpleBlockKeyFlag
+	}
+	head := []byte{0x80 | track, byte(uint16(timecode) >> 8), byte(timecode), flags}
+	return testEBML(mkvIDSimpleBlock, head, frame)
+}
+
+func TestParseWebM(t *testing.T) {
+	frames := [][]byte{
+		testVP8Frame(true, false),
+		testVP8Frame(false, false),
+		testVP8Frame(true, false),
+	}
+	file := bytes.Join([][]byte{
+		testEBML(ebmlIDHeader, testEBML(ebmlIDDocType, []byte("webm"))),
+		testEBML(mkvIDSegment,
+			testEBML(mkvIDInfo, testEBMLUint(mkvIDTimecodeScale, 1000000)),
+			testEBML(mkvIDTracks, testEBML(mkvIDTrackEntry,
+				testEBMLUint(mkvIDTrackNumber, 1),
+				testEBMLUint(mkvIDTrackType, mkvTrackTypeVideo),
+				testEBML(mkvIDCodecID, []byte(mkvCodecVP8)),
+				testEBML(mkvIDVideo,
+					testEBMLUint(mkvIDPixelWidth, 320),
+					testEBMLUint(mkvIDPixelHeight, 240)),
+			)),
+			testEBML(mkvIDCluster,
+				testEBMLUint(mkvIDTimecode, 0),
+				testSimpleBlock(1, 0, true, frames[0]),
+				testSimpleBlock(1, 33, false, frames[1])),
+			testEBML(mkvIDCluster,
+				testEBMLUint(mkvIDTimecode, 66),
+				testSimpleBlock(1, 0, true, frames[2])),
+		),
+	}, nil)
+
+	tracks, err := ParseWebM(bytes.NewReader(file))
+	require.NoError(t, err)
+	require.Len(t, tracks, 1)
+	track := tracks[0]
+	require.NotNil(t, track.VPX)
+	assert.Equal(t, uint16(320), track.VPX.Width)
+	assert.Equal(t, uint32(1000), track.Timescale)
+	require.Len(t, track.VPXFrames, 3)
+	assert.Equal(t, uint64(33), track.VPXFrames[1].Timestamp)
+	assert.Equal(t, uint64(66), track.VPXFrames[2].Timestamp)
+	assert.Equal(t, []uint32{0, 1}, DropKeyFrames(track))
+}
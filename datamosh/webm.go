@@ -0,0 +1,510 @@
+package datamosh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/abema/go-mp4"
+)
+
+// Matroska/WebM element ids used by the demuxer.
+// See https://www.matroska.org/technical/elements.html
+const (
+	ebmlIDHeader          = 0x1A45DFA3
+	ebmlIDDocType         = 0x4282
+	mkvIDSegment          = 0x18538067
+	mkvIDSeekHead         = 0x114D9B74
+	mkvIDInfo             = 0x1549A966
+	mkvIDTimecodeScale    = 0x2AD7B1
+	mkvIDDuration         = 0x4489
+	mkvIDTracks           = 0x1654AE6B
+	mkvIDTrackEntry       = 0xAE
+	mkvIDTrackNumber      = 0xD7
+	mkvIDTrackUID         = 0x73C5
+	mkvIDTrackType        = 0x83
+	mkvIDCodecID          = 0x86
+	mkvIDCodecPrivate     = 0x63A2
+	mkvIDDefaultDuration  = 0x23E383
+	mkvIDVideo            = 0xE0
+	mkvIDPixelWidth       = 0xB0
+	mkvIDPixelHeight      = 0xBA
+	mkvIDAudio            = 0xE1
+	mkvIDSamplingFreq     = 0xB5
+	mkvIDChannels         = 0x9F
+	mkvIDCluster          = 0x1F43B675
+	mkvIDTimecode         = 0xE7
+	mkvIDSimpleBlock      = 0xA3
+	mkvIDBlockGroup       = 0xA0
+	mkvIDBlock            = 0xA1
+	mkvIDCues             = 0x1C53BB6B
+	mkvIDTags             = 0x1254C367
+	mkvIDChapters         = 0x1043A770
+	mkvIDAttachments      = 0x1941A469
+	mkvTrackTypeVideo     = 1
+	mkvTrackTypeAudio     = 2
+	ebmlUnknownSize       = math.MaxUint64
+	mkvDefaultTimecodeNs  = 1000000
+	mkvCodecVP8           = "V_VP8"
+	mkvCodecVP9           = "V_VP9"
+	mkvCodecAV1           = "V_AV1"
+	mkvCodecAVC           = "V_MPEG4/ISO/AVC"
+	mkvCodecAAC           = "A_AAC"
+	mkvSimpleBlockKeyFlag = 0x80
+)
+
+// WebMTrackInfo holds the Matroska specific track information.
+type WebMTrackInfo struct {
+	TrackNumber     uint64
+	TrackType       uint64
+	CodecID         string
+	CodecPrivate    []byte
+	DefaultDuration uint64 // in nanoseconds
+	PixelWidth      uint64
+	PixelHeight     uint64
+	SamplingFreq    float64
+	Channels        uint64
+}
+
+// ebmlElement is an element header read from the file.
+type ebmlElement struct {
+	ID         uint32
+	Offset     int64 // of the element header
+	DataOffset int64
+	Size       uint64 // of the data, ebmlUnknownSize for live streams
+}
+
+func (e *ebmlElement) end() int64 {
+	if e.Size == ebmlUnknownSize {
+		return math.MaxInt64
+	}
+	return e.DataOffset + int64(e.Size)
+}
+
+// readEBMLVint reads a variable size integer. Element ids keep their length
+// marker, sizes don't.
+func readEBMLVint(r io.Reader, keepMarker bool) (uint64, int, error) {
+	first := []byte{0}
+	if _, err := io.ReadFull(r, first); err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && first[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 0, errors.New("invalid EBML variable size integer")
+	}
+
+	value := uint64(first[0])
+	if !keepMarker {
+		value &= uint64(0xff >> length)
+	}
+	allOnes := value == uint64(0xff>>length)
+	rest := make([]byte, length-1)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return 0, 0, err
+	}
+	for _, b := range rest {
+		value = value<<8 | uint64(b)
+		allOnes = allOnes && b == 0xff
+	}
+	if !keepMarker && allOnes {
+		return ebmlUnknownSize, length, nil
+	}
+	return value, length, nil
+}
+
+func readEBMLElement(r io.ReadSeeker) (*ebmlElement, error) {
+	offset, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	id, idLen, err := readEBMLVint(r, true)
+	if err != nil {
+		return nil, err
+	}
+	size, sizeLen, err := readEBMLVint(r, false)
+	if err != nil {
+		return nil, err
+	}
+	return &ebmlElement{
+		ID:         uint32(id),
+		Offset:     offset,
+		DataOffset: offset + int64(idLen+sizeLen),
+		Size:       size,
+	}, nil
+}
+
+func readEBMLData(r io.ReadSeeker, e *ebmlElement) ([]byte, error) {
+	if e.Size == ebmlUnknownSize || e.Size > 1<<30 {
+		return nil, fmt.Errorf("element 0x%X is too large to be read", e.ID)
+	}
+	if _, err := r.Seek(e.DataOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, e.Size)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+func readEBMLUint(r io.ReadSeeker, e *ebmlElement) (uint64, error) {
+	data, err := readEBMLData(r, e)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func readEBMLFloat(r io.ReadSeeker, e *ebmlElement) (float64, error) {
+	data, err := readEBMLData(r, e)
+	if err != nil {
+		return 0, err
+	}
+	switch len(data) {
+	case 0:
+		return 0, nil
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	}
+	return 0, fmt.Errorf("invalid float size %d", len(data))
+}
+
+// walkEBML calls fn for every child element of parent, fn returns true to
+// skip over the element data. Children of unknown size elements end at the
+// first element fn doesn't know, reported through isChild.
+func walkEBML(r io.ReadSeeker, start, end int64, isChild func(id uint32) bool, fn func(e *ebmlElement) (bool, error)) (int64, error) {
+	pos := start
+	for pos < end {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return pos, err
+		}
+		e, err := readEBMLElement(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return pos, nil
+		}
+		if err != nil {
+			return pos, err
+		}
+		if isChild != nil && !isChild(e.ID) {
+			return pos, nil
+		}
+		skip, err := fn(e)
+		if err != nil {
+			return pos, err
+		}
+		if !skip {
+			pos = e.DataOffset
+			continue
+		}
+		if e.Size == ebmlUnknownSize {
+			return pos, fmt.Errorf("can't skip element 0x%X of unknown size", e.ID)
+		}
+		pos = e.end()
+	}
+	return pos, nil
+}
+
+// webmBlock is a frame found in a SimpleBlock or Block element.
+type webmBlock struct {
+	offset   int64
+	size     uint32
+	pts      int64 // in the segment timecode scale
+	keyFrame bool
+	laced    bool // the sample holds the lacing header and several frames
+}
+
+// ParseWebM reads the tracks of a WebM or Matroska file. Frames of every
+// track are stored as one sample per chunk, the timescale of the tracks
+// matches the segment TimecodeScale.
+func ParseWebM(r io.ReadSeeker) ([]*Track, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header, err := readEBMLElement(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read EBML header: %v", err)
+	}
+	if header.ID != ebmlIDHeader {
+		return nil, errors.New("not an EBML file")
+	}
+
+	timecodeScale := uint64(mkvDefaultTimecodeNs)
+	infos := map[uint64]*WebMTrackInfo{}
+	order := []uint64{}
+	blocks := map[uint64][]*webmBlock{}
+	var clusterTime int64
+
+	readBlock := func(e *ebmlElement, simple bool) error {
+		if _, err := r.Seek(e.DataOffset, io.SeekStart); err != nil {
+			return err
+		}
+		trackNumber, n, err := readEBMLVint(r, false)
+		if err != nil {
+			return err
+		}
+		head := make([]byte, 3)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return err
+		}
+		flags := head[2]
+		headerSize := int64(n + 3)
+		blocks[trackNumber] = append(blocks[trackNumber], &webmBlock{
+			offset:   e.DataOffset + headerSize,
+			size:     uint32(int64(e.Size) - headerSize),
+			pts:      clusterTime + int64(int16(binary.BigEndian.Uint16(head[0:2]))),
+			keyFrame: simple && flags&mkvSimpleBlockKeyFlag != 0,
+			laced:    flags&0x06 != 0,
+		})
+		return nil
+	}
+
+	isSegmentChild := func(id uint32) bool {
+		switch id {
+		case mkvIDSeekHead, mkvIDInfo, mkvIDTracks, mkvIDCluster, mkvIDCues,
+			mkvIDTags, mkvIDChapters, mkvIDAttachments,
+			0xEC, 0xBF: // Void and CRC-32
+			return true
+		}
+		return false
+	}
+	isClusterChild := func(id uint32) bool {
+		return !isSegmentChild(id) && id != mkvIDSegment && id != ebmlIDHeader
+	}
+
+	_, err = walkEBML(r, header.end(), math.MaxInt64, nil, func(segment *ebmlElement) (bool, error) {
+		if segment.ID != mkvIDSegment {
+			return true, nil
+		}
+		segmentEnd, err := walkEBML(r, segment.DataOffset, segment.end(), isSegmentChild, func(e *ebmlElement) (bool, error) {
+			switch e.ID {
+			case mkvIDInfo:
+				_, err := walkEBML(r, e.DataOffset, e.end(), nil, func(child *ebmlElement) (bool, error) {
+					if child.ID == mkvIDTimecodeScale {
+						scale, err := readEBMLUint(r, child)
+						if err != nil {
+							return true, err
+						}
+						if scale > 0 {
+							timecodeScale = scale
+						}
+					}
+					return true, nil
+				})
+				return true, err
+			case mkvIDTracks:
+				_, err := walkEBML(r, e.DataOffset, e.end(), nil, func(entry *ebmlElement) (bool, error) {
+					if entry.ID != mkvIDTrackEntry {
+						return true, nil
+					}
+					info, err := parseWebMTrackEntry(r, entry)
+					if err != nil {
+						return true, err
+					}
+					infos[info.TrackNumber] = info
+					order = append(order, info.TrackNumber)
+					return true, nil
+				})
+				return true, err
+			case mkvIDCluster:
+				clusterEnd, err := walkEBML(r, e.DataOffset, e.end(), isClusterChild, func(child *ebmlElement) (bool, error) {
+					switch child.ID {
+					case mkvIDTimecode:
+						timecode, err := readEBMLUint(r, child)
+						clusterTime = int64(timecode)
+						return true, err
+					case mkvIDSimpleBlock:
+						return true, readBlock(child, true)
+					case mkvIDBlockGroup:
+						_, err := walkEBML(r, child.DataOffset, child.end(), nil, func(b *ebmlElement) (bool, error) {
+							if b.ID == mkvIDBlock {
+								return true, readBlock(b, false)
+							}
+							return true, nil
+						})
+						return true, err
+					}
+					return true, nil
+				})
+				if err != nil {
+					return true, err
+				}
+				if e.Size == ebmlUnknownSize {
+					e.Size = uint64(clusterEnd - e.DataOffset)
+				}
+				return true, nil
+			}
+			return true, nil
+		})
+		if segment.Size == ebmlUnknownSize {
+			segment.Size = uint64(segmentEnd - segment.DataOffset)
+		}
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := []*Track{}
+	for _, number := range order {
+		track, err := newWebMTrack(r, infos[number], blocks[number], timecodeScale)
+		if err != nil {
+			return tracks, fmt.Errorf("track %d: %v", number, err)
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+func parseWebMTrackEntry(r io.ReadSeeker, entry *ebmlElement) (*WebMTrackInfo, error) {
+	info := &WebMTrackInfo{}
+	var parse func(e *ebmlElement) (bool, error)
+	parse = func(e *ebmlElement) (bool, error) {
+		var err error
+		switch e.ID {
+		case mkvIDTrackNumber:
+			info.TrackNumber, err = readEBMLUint(r, e)
+		case mkvIDTrackType:
+			info.TrackType, err = readEBMLUint(r, e)
+		case mkvIDCodecID:
+			var data []byte
+			data, err = readEBMLData(r, e)
+			info.CodecID = string(bytes.TrimRight(data, "\x00"))
+		case mkvIDCodecPrivate:
+			info.CodecPrivate, err = readEBMLData(r, e)
+		case mkvIDDefaultDuration:
+			info.DefaultDuration, err = readEBMLUint(r, e)
+		case mkvIDPixelWidth:
+			info.PixelWidth, err = readEBMLUint(r, e)
+		case mkvIDPixelHeight:
+			info.PixelHeight, err = readEBMLUint(r, e)
+		case mkvIDSamplingFreq:
+			info.SamplingFreq, err = readEBMLFloat(r, e)
+		case mkvIDChannels:
+			info.Channels, err = readEBMLUint(r, e)
+		case mkvIDVideo, mkvIDAudio:
+			_, err = walkEBML(r, e.DataOffset, e.end(), nil, parse)
+		}
+		return true, err
+	}
+	if _, err := walkEBML(r, entry.DataOffset, entry.end(), nil, parse); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// newWebMTrack builds a track from the blocks of a WebM track and parses its
+// frames when the codec is supported.
+func newWebMTrack(r io.ReadSeeker, info *WebMTrackInfo, blocks []*webmBlock, timecodeScale uint64) (*Track, error) {
+	track := &Track{
+		TrackID: uint32(info.TrackNumber),
+		Chunks:  make(mp4.Chunks, 0, len(blocks)),
+		Samples: make(mp4.Samples, 0, len(blocks)),
+		WebM:    info,
+	}
+	switch info.TrackType {
+	case mkvTrackTypeVideo:
+		track.Handler = handlerVideo
+	case mkvTrackTypeAudio:
+		track.Handler = handlerAudio
+	}
+	// Express timestamps in ticks of the timecode scale.
+	track.Timescale = uint32(1000000000 / timecodeScale)
+	if track.Timescale == 0 {
+		track.Timescale = 1
+	}
+
+	for _, block := range blocks {
+		if block.laced && info.TrackType == mkvTrackTypeVideo {
+			return nil, errors.New("laced video blocks are not supported")
+		}
+	}
+
+	pts := make([]uint64, len(blocks))
+	var first int64
+	if len(blocks) > 0 {
+		first = blocks[0].pts
+		for _, block := range blocks {
+			if block.pts < first {
+				first = block.pts
+			}
+		}
+	}
+	for i, block := range blocks {
+		track.Chunks = append(track.Chunks, &mp4.Chunk{
+			DataOffset:      uint64(block.offset),
+			SamplesPerChunk: 1,
+		})
+		track.Samples = append(track.Samples, &mp4.Sample{Size: block.size})
+		pts[i] = uint64(block.pts - first)
+	}
+	track.setSampleTimes(pts)
+	if len(track.Samples) > 0 && info.DefaultDuration > 0 {
+		track.Samples[len(track.Samples)-1].TimeDelta = uint32(info.DefaultDuration / timecodeScale)
+	}
+
+	var err error
+	switch info.CodecID {
+	case mkvCodecVP8, mkvCodecVP9:
+		fourCC := fourCCVP8
+		if info.CodecID == mkvCodecVP9 {
+			fourCC = fourCCVP9
+		}
+		track.VPX = &VPXConfig{
+			FourCC:   fourCC,
+			Width:    uint16(info.PixelWidth),
+			Height:   uint16(info.PixelHeight),
+			BitDepth: 8,
+		}
+		track.VPXFrames, err = processVPXTrack(r, track)
+	case mkvCodecAV1:
+		if len(info.CodecPrivate) >= 4 {
+			av1C := &mp4.Av1C{}
+			if _, err = mp4.Unmarshal(bytes.NewReader(info.CodecPrivate), uint64(len(info.CodecPrivate)), av1C, mp4.Context{}); err != nil {
+				return nil, fmt.Errorf("failed to parse av1C: %v", err)
+			}
+			entry := &mp4.VisualSampleEntry{
+				Width:  uint16(info.PixelWidth),
+				Height: uint16(info.PixelHeight),
+			}
+			if track.AV1, err = newAV1Config(entry, av1C); err != nil {
+				return nil, err
+			}
+			track.OBUs, err = processAV1Track(r, track)
+		} else {
+			err = processAV1Stream(r, track)
+		}
+	case mkvCodecAVC:
+		avcC := &mp4.AVCDecoderConfiguration{AnyTypeBox: mp4.AnyTypeBox{Type: mp4.BoxTypeAvcC()}}
+		if _, err = mp4.Unmarshal(bytes.NewReader(info.CodecPrivate), uint64(len(info.CodecPrivate)), avcC, mp4.Context{}); err != nil {
+			return nil, fmt.Errorf("failed to parse avcC: %v", err)
+		}
+		track.Codec = mp4.CodecAVC1
+		track.AVC = &AVCDecoderConfig{
+			AVCDecoderConfiguration: *avcC,
+			LengthSize:              uint16(avcC.LengthSizeMinusOne) + 1,
+			Width:                   uint16(info.PixelWidth),
+			Height:                  uint16(info.PixelHeight),
+		}
+		track.NALs, err = processTrack(r, track)
+	case mkvCodecAAC:
+		track.Codec = mp4.CodecMP4A
+		if len(info.CodecPrivate) > 0 {
+			track.MP4A, err = newAACConfig(info.CodecPrivate, uint32(info.SamplingFreq), uint16(info.Channels))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return track, nil
+}
@@ -2,9 +2,15 @@ module github.com/mattetti/moshing-vfx
 
 go 1.21.4
 
-require github.com/abema/go-mp4 v1.2.0
+require (
+	github.com/abema/go-mp4 v1.2.0
+	github.com/stretchr/testify v1.4.0
+	github.com/sunfish-shogi/bufseekio v0.1.0
+)
 
 require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/uuid v1.1.2 // indirect
-	github.com/sunfish-shogi/bufseekio v0.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -17,6 +17,9 @@ type Reader interface {
 
 	// ReadUE reads an unsigned Exp-Golomb coded integer
 	ReadUE() (uint32, error)
+
+	// ReadSE reads a signed Exp-Golomb coded integer
+	ReadSE() (int32, error)
 }
 
 type ReadSeeker interface {
@@ -122,6 +125,19 @@ func (r *reader) ReadUE() (uint32, error) {
 	return codeNum, nil
 }
 
+// ReadSE reads a signed Exp-Golomb coded integer
+func (r *reader) ReadSE() (int32, error) {
+	codeNum, err := r.ReadUE()
+	if err != nil {
+		return 0, err
+	}
+	// 0, 1, -1, 2, -2...
+	if codeNum%2 == 1 {
+		return int32((codeNum + 1) / 2), nil
+	}
+	return -int32(codeNum / 2), nil
+}
+
 type readSeeker struct {
 	reader
 	seeker io.Seeker
@@ -178,3 +178,16 @@ func TestSeekInvalidAlignment(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []byte{0x03}, data)
 }
+
+func TestReadExpGolomb(t *testing.T) {
+	// 1 010 011 00100 00101
+	r := NewReader(bytes.NewReader([]byte{0xa6, 0x42, 0x80}))
+	for _, expected := range []uint32{0, 1, 2, 3} {
+		v, err := r.ReadUE()
+		require.NoError(t, err)
+		assert.Equal(t, expected, v)
+	}
+	v, err := r.ReadSE()
+	require.NoError(t, err)
+	assert.Equal(t, int32(-2), v)
+}
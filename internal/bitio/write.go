@@ -13,6 +13,15 @@ type Writer interface {
 	WriteBits(data []byte, width uint) error
 
 	WriteBit(bit bool) error
+
+	// WriteUInt writes the n low bits of v
+	WriteUInt(v uint32, n int) error
+
+	// WriteUE writes an unsigned Exp-Golomb coded integer
+	WriteUE(v uint32) error
+
+	// WriteSE writes a signed Exp-Golomb coded integer
+	WriteSE(v int32) error
 }
 
 type writer struct {
@@ -59,3 +68,39 @@ func (w *writer) WriteBit(bit bool) error {
 	}
 	return nil
 }
+
+// WriteUInt writes the n low bits of v
+func (w *writer) WriteUInt(v uint32, n int) error {
+	for i := n - 1; i >= 0; i-- {
+		if err := w.WriteBit((v>>uint(i))&0x01 != 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteUE writes an unsigned Exp-Golomb coded integer
+func (w *writer) WriteUE(v uint32) error {
+	value := uint64(v) + 1
+	length := 0
+	for tmp := value; tmp > 1; tmp >>= 1 {
+		length++
+	}
+	if err := w.WriteUInt(0, length); err != nil {
+		return err
+	}
+	for i := length; i >= 0; i-- {
+		if err := w.WriteBit((value>>uint(i))&0x01 != 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSE writes a signed Exp-Golomb coded integer
+func (w *writer) WriteSE(v int32) error {
+	if v > 0 {
+		return w.WriteUE(uint32(v)*2 - 1)
+	}
+	return w.WriteUE(uint32(-v) * 2)
+}
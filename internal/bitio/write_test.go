@@ -49,3 +49,39 @@ func TestWriteInvalidAlignment(t *testing.T) {
 	_, err = w.Write([]byte{0xa4, 0x6f})
 	require.Equal(t, ErrInvalidAlignment, err)
 }
+
+func TestWriteExpGolomb(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := NewWriter(buf)
+	ue := []uint32{0, 1, 2, 3, 7, 255, 1 << 20}
+	se := []int32{0, 1, -1, 2, -2, 100, -100}
+	for _, v := range ue {
+		require.NoError(t, w.WriteUE(v))
+	}
+	for _, v := range se {
+		require.NoError(t, w.WriteSE(v))
+	}
+	require.NoError(t, w.WriteUInt(0x5, 3))
+	// pad to a byte boundary
+	for {
+		if _, err := w.Write(nil); err == nil {
+			break
+		}
+		require.NoError(t, w.WriteBit(false))
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	for _, v := range ue {
+		got, err := r.ReadUE()
+		require.NoError(t, err)
+		assert.Equal(t, v, got)
+	}
+	for _, v := range se {
+		got, err := r.ReadSE()
+		require.NoError(t, err)
+		assert.Equal(t, v, got)
+	}
+	got, err := r.ReadUInt(3)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0x5), got)
+}